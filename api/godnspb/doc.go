@@ -0,0 +1,5 @@
+// Package godnspb contains the gRPC admin API of godns, generated from
+// admin.proto.
+package godnspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
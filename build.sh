@@ -1,6 +1,15 @@
 #!/usr/bin/env bash
 set -eo pipefail; [[ $TRACE ]] && set -x
 
+# With SIGNING_KEY set to an ed25519 private key in PEM format, SHA256SUMS
+# is signed and the binaries carry the public key `godns update` verifies
+# the signature with.
+LDFLAGS=""
+if [ -n "$SIGNING_KEY" ]; then
+  PUBLIC_KEY=$(openssl pkey -in "$SIGNING_KEY" -pubout -outform DER | tail -c 32 | base64)
+  LDFLAGS="-X github.com/nodesocket/godns/pkg/godns.releasePublicKey=$PUBLIC_KEY"
+fi
+
 mkdir -p bin
 
 for GOARCH in amd64 arm64; do
@@ -8,7 +17,19 @@ for GOARCH in amd64 arm64; do
     # only support darwin arm64
     if [ "$GOOS" != "darwin" ] || [ "$GOARCH" != "amd64" ]; then
       printf "building... bin/godns_%s_%s\n" $GOOS $GOARCH
-      GOARCH=$GOARCH GOOS=$GOOS go build -o bin/godns_${GOOS}_${GOARCH}
+      GOARCH=$GOARCH GOOS=$GOOS go build -ldflags "$LDFLAGS" -o bin/godns_${GOOS}_${GOARCH} ./cmd/godns
     fi
   done
 done
+
+for GOARCH in amd64 arm64; do
+  printf "building... bin/godns_windows_%s.exe\n" $GOARCH
+  GOARCH=$GOARCH GOOS=windows go build -ldflags "$LDFLAGS" -o bin/godns_windows_${GOARCH}.exe ./cmd/godns
+done
+
+printf "writing... bin/SHA256SUMS\n"
+(cd bin && sha256sum godns_* > SHA256SUMS)
+if [ -n "$SIGNING_KEY" ]; then
+  printf "signing... bin/SHA256SUMS.sig\n"
+  openssl pkeyutl -sign -rawin -inkey "$SIGNING_KEY" -in bin/SHA256SUMS -out bin/SHA256SUMS.sig
+fi
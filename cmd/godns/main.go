@@ -0,0 +1,13 @@
+// Command godns is a DNS server that answers from local records and
+// forwards everything else to upstream resolvers.
+package main
+
+import (
+	"os"
+
+	"github.com/nodesocket/godns/pkg/godns"
+)
+
+func main() {
+	os.Exit(godns.Main(os.Args[1:]))
+}
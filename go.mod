@@ -1,12 +1,24 @@
-module godns
+module github.com/nodesocket/godns
 
 go 1.21.5
 
-require github.com/miekg/dns v1.1.57
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/miekg/dns v1.1.57
+	github.com/tetratelabs/wazero v1.8.2
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/net v0.17.0
+	golang.org/x/sync v0.4.0
+	golang.org/x/sys v0.13.0
+	google.golang.org/grpc v1.60.1
+	google.golang.org/protobuf v1.32.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/golang/protobuf v1.5.3 // indirect
 	golang.org/x/mod v0.12.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/tools v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20231002182017-d307bd883b97 // indirect
 )
@@ -0,0 +1,134 @@
+package godns
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const summaryTopN = 10
+
+// queryCounts accumulates per-domain, per-client and per-rcode counts
+// between two summary log lines.
+type queryCounts struct {
+	mu      sync.Mutex
+	total   uint64
+	domains map[string]uint64
+	clients map[string]uint64
+	rcodes  map[string]uint64
+	since   time.Time
+	// memory is the counters' share of the memory budget and bytes what
+	// the current domain and client keys take of it. When it is spent,
+	// new domains and clients are counted as otherKey.
+	memory *budgetAccount
+	bytes  int64
+}
+
+// otherKey counts the domains and clients the memory budget had no room
+// for.
+const otherKey = "(other)"
+
+func (s *Server) newQueryCounts() *queryCounts {
+	return &queryCounts{
+		domains: make(map[string]uint64),
+		clients: make(map[string]uint64),
+		rcodes:  make(map[string]uint64),
+		since:   time.Now(),
+		memory:  s.budget.account("summary", nil),
+	}
+}
+
+// countKey counts key in m, or otherKey if key is new and the memory
+// budget has no room for it, with c.mu held.
+func (c *queryCounts) countKey(m map[string]uint64, key string) {
+	if _, ok := m[key]; !ok {
+		// A map entry with its key and count.
+		size := int64(len(key) + 48)
+		if !c.memory.tryCharge(size) {
+			m[otherKey]++
+			return
+		}
+		c.bytes += size
+	}
+	m[key]++
+}
+
+// sampleQuery decides whether the request and response of one query are
+// written to the query log.
+func (s *Server) sampleQuery() bool {
+	rate := s.cfg.Logging.QuerySample
+	return rate >= 1 || rand.Float64() < rate
+}
+
+func (s *Server) aggregateQuery(client string, q dns.Question, rcode int) {
+	if s.queryAggregate == nil {
+		return
+	}
+	c := s.queryAggregate
+	c.mu.Lock()
+	c.total++
+	c.countKey(c.domains, strings.ToLower(strings.TrimSuffix(q.Name, ".")))
+	c.countKey(c.clients, client)
+	c.rcodes[dns.RcodeToString[rcode]]++
+	c.mu.Unlock()
+}
+
+// logQuerySummaries writes an aggregated summary every interval until s
+// shuts down.
+func (s *Server) logQuerySummaries(interval time.Duration) {
+	for s.sleep(interval) {
+		s.logQuerySummary()
+	}
+}
+
+// logQuerySummary writes the summary of the queries since the previous one
+// and resets the counters.
+func (s *Server) logQuerySummary() {
+	c := s.queryAggregate
+	c.mu.Lock()
+	total, domains, clients, rcodes, since := c.total, c.domains, c.clients, c.rcodes, c.since
+	c.total = 0
+	c.domains = make(map[string]uint64)
+	c.clients = make(map[string]uint64)
+	c.rcodes = make(map[string]uint64)
+	c.since = time.Now()
+	c.memory.release(c.bytes)
+	c.bytes = 0
+	c.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "SUMMARY (last %s): %d queries", time.Since(since).Round(time.Second), total)
+	if total > 0 {
+		fmt.Fprintf(&b, "\n  rcodes: %s", topCounts(rcodes, len(rcodes)))
+		fmt.Fprintf(&b, "\n  top domains: %s", topCounts(domains, summaryTopN))
+		fmt.Fprintf(&b, "\n  top clients: %s", topCounts(clients, summaryTopN))
+	}
+	s.logMessage(b.String())
+}
+
+func topCounts(counts map[string]uint64, n int) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", k, counts[k])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,61 @@
+package godns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+const (
+	anonymizeIPv4Prefix = 24
+	anonymizeIPv6Prefix = 48
+)
+
+var anonymizeKey = make([]byte, 32)
+
+func init() {
+	rand.Read(anonymizeKey)
+}
+
+func validateAnonymizeMode(mode string) error {
+	switch mode {
+	case "none", "mask", "hash":
+		return nil
+	}
+	return fmt.Errorf("unknown IP anonymization mode %q (want none, mask or hash)", mode)
+}
+
+// clientLabel returns how a client address appears in logs and statistics.
+// In mask mode IPv4 addresses are truncated to /24 and IPv6 to /48; in hash
+// mode the address is replaced by a keyed hash that is stable for the
+// lifetime of the process but cannot be reversed or correlated across
+// restarts.
+func (s *Server) clientLabel(ip net.IP) string {
+	switch s.cfg.Logging.AnonymizeIPs {
+	case "mask":
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(anonymizeIPv4Prefix, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(anonymizeIPv6Prefix, 128)).String()
+	case "hash":
+		mac := hmac.New(sha256.New, anonymizeKey)
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		mac.Write(ip)
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return ip.String()
+}
+
+// clientAddrLabel is clientLabel for log lines that also carry the port,
+// which is dropped whenever the address is anonymized.
+func (s *Server) clientAddrLabel(addr *net.UDPAddr) string {
+	if s.cfg.Logging.AnonymizeIPs != "none" {
+		return s.clientLabel(addr.IP)
+	}
+	return fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
+}
@@ -0,0 +1,239 @@
+package godns
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	errRecordNotFound = errors.New("record not found")
+	// errNoHostsFile is returned by record edits when godns runs without
+	// a hosts file.
+	errNoHostsFile = errors.New("no hosts file is configured")
+)
+
+func init() {
+	handleAdmin("/records", func(s *Server) http.HandlerFunc { return s.requireToken(s.recordsHandler) })
+	handleAdmin("/records/", func(s *Server) http.HandlerFunc { return s.requireToken(s.recordHandler) })
+}
+
+// requireToken rejects requests that do not carry the configured admin
+// token as a bearer token. Without a token the endpoint is disabled.
+func (s *Server) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.Admin.Token == "" {
+			http.Error(w, "disabled: no admin token configured", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Admin.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="godns"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireTokenIfSet is requireToken for the endpoints that are open while
+// no admin token is configured: the statistics and the query log.
+func (s *Server) requireTokenIfSet(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.Admin.Token == "" {
+			next(w, r)
+			return
+		}
+		s.requireToken(next)(w, r)
+	}
+}
+
+// recordsHandler lists the live records from every source, typed records
+// included, or with ?tag= those of the hosts with a tag.
+func (s *Server) recordsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.liveRecordList(r.URL.Query().Get("tag")))
+}
+
+// liveRecordList returns the live records sorted by host, typed records
+// included, or with a tag only those of the hosts with it.
+func (s *Server) liveRecordList(tag string) []Record {
+	live := s.currentRecords()
+	typed := newTypedHosts()
+	if set := s.liveRecords.Load(); set != nil && set.typed != nil {
+		typed = set.typed
+	}
+	list := make([]Record, 0, len(live))
+	for host, ip := range live {
+		if tag == "" || slices.Contains(typed.tags[host], tag) {
+			list = append(list, Record{Host: host, IP: ip, Tags: typed.tags[host]})
+		}
+	}
+	for host, rrs := range typed.rrs {
+		if tag != "" && !slices.Contains(typed.tags[host], tag) {
+			continue
+		}
+		for _, rr := range rrs {
+			list = append(list, Record{
+				Host: host,
+				IP:   strings.TrimPrefix(rr.String(), rr.Header().String()),
+				Type: dns.TypeToString[rr.Header().Rrtype],
+				TTL:  rr.Header().Ttl,
+				Tags: typed.tags[host],
+			})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+// recordHandler reads (GET), creates or updates (PUT) and deletes (DELETE)
+// a single record. Changes are written to the hosts file and applied with
+// a reload.
+func (s *Server) recordHandler(w http.ResponseWriter, r *http.Request) {
+	host, ok := normalizeRecordHost(strings.TrimPrefix(r.URL.Path, "/records/"))
+	if !ok {
+		http.Error(w, "invalid host name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ip, ok := s.currentRecords()[host]
+		if !ok {
+			http.Error(w, "record not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, Record{Host: host, IP: ip})
+	case http.MethodPut:
+		var body Record
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if net.ParseIP(body.IP) == nil {
+			http.Error(w, "invalid IP address", http.StatusBadRequest)
+			return
+		}
+		if err := s.updateHostsFile("api:"+r.RemoteAddr, host, body.IP); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errNoHostsFile) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if s.currentRecords()[host] != body.IP {
+			http.Error(w, "record saved but overridden by another record source", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, Record{Host: host, IP: body.IP})
+	case http.MethodDelete:
+		if err := s.updateHostsFile("api:"+r.RemoteAddr, host, ""); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errRecordNotFound) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, errNoHostsFile) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if _, ok := s.currentRecords()[host]; ok {
+			http.Error(w, "record deleted but still defined by another record source", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// normalizeRecordHost lower-cases name and strips the trailing dot,
+// reporting whether the result is a valid domain name.
+func normalizeRecordHost(name string) (string, bool) {
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, ok := dns.IsDomainName(host); !ok || host == "" {
+		return "", false
+	}
+	return host, true
+}
+
+// updateHostsFile sets host to ip in the JSON hosts file, or removes it
+// when ip is empty, then reloads the live records.
+func (s *Server) updateHostsFile(actor, host, ip string) error {
+	s.apiWriteMu.Lock()
+	defer s.apiWriteMu.Unlock()
+
+	if err := editHostsFile(s.cfg.HostsFile, host, ip); err != nil {
+		return err
+	}
+	return s.reloadHosts(actor)
+}
+
+// editHostsFile sets host to ip in the JSON hosts file at path, or removes
+// it when ip is empty. The file is replaced atomically so a crash never
+// leaves it half written.
+func editHostsFile(path, host, ip string) error {
+	if path == "" {
+		return errNoHostsFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, found, err := patchHostsFile(data, path, map[string]string{host: ip})
+	if err != nil {
+		return err
+	}
+	if !found && ip == "" {
+		return fmt.Errorf("%s: %w in %s", host, errRecordNotFound, path)
+	}
+	return writeFileAtomic(path, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if info, err := os.Stat(path); err == nil {
+		tmp.Chmod(info.Mode())
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,47 @@
+package godns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminToken(t *testing.T) {
+	s := newTestServer()
+
+	for _, tt := range []struct {
+		name   string
+		token  string
+		path   string
+		header string
+		status int
+	}{
+		{"records without token configured", "", "/records", "", http.StatusForbidden},
+		{"capture without token configured", "", "/capture", "", http.StatusForbidden},
+		{"stats without token configured", "", "/stats", "", http.StatusOK},
+		{"records without header", "secret", "/records", "", http.StatusUnauthorized},
+		{"records with bare token", "secret", "/records", "secret", http.StatusUnauthorized},
+		{"records with wrong token", "secret", "/records", "Bearer wrong", http.StatusUnauthorized},
+		{"records", "secret", "/records", "Bearer secret", http.StatusOK},
+		{"capture with bare token", "secret", "/capture", "secret", http.StatusUnauthorized},
+		{"capture", "secret", "/capture", "Bearer secret", http.StatusOK},
+		{"stats without header", "secret", "/stats", "", http.StatusUnauthorized},
+		{"stats with bare token", "secret", "/stats", "secret", http.StatusUnauthorized},
+		{"stats", "secret", "/stats", "Bearer secret", http.StatusOK},
+		{"queries with bare token", "secret", "/queries", "secret", http.StatusUnauthorized},
+		{"blocking hits with bare token", "secret", "/blocking/hits", "secret", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s.cfg.Admin.Token = tt.token
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			s.adminMux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package godns
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// auditEntry is one line of the append-only audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Key    string    `json:"key,omitempty"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new,omitempty"`
+}
+
+func (s *Server) openAuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.auditFile = file
+	return nil
+}
+
+// audit appends entry to the audit log and syncs it to disk. It is a no-op
+// when no audit log is configured.
+func (s *Server) audit(entry auditEntry) {
+	if s.auditFile == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if _, err := s.auditFile.Write(append(line, '\n')); err == nil {
+		err = s.auditFile.Sync()
+	}
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error writing audit log: %v", err))
+	}
+}
+
+// recordChange is the change of one record: its key, and its old and new
+// values, empty when it was created or deleted.
+type recordChange struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// auditRecordChanges writes one entry per record that differs between old
+// and new, in key order, and returns the changes.
+func (s *Server) auditRecordChanges(actor string, old, new map[string]string) []recordChange {
+	changes := recordChanges(old, new)
+	for _, c := range changes {
+		s.audit(auditEntry{Actor: actor, Action: c.Action, Key: c.Key, Old: c.Old, New: c.New})
+	}
+	return changes
+}
+
+// recordChanges returns the records that differ between old and new, in
+// key order.
+func recordChanges(old, new map[string]string) []recordChange {
+	keys := make([]string, 0, len(old)+len(new))
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []recordChange
+	for _, k := range keys {
+		oldValue, hadOld := old[k]
+		newValue, hasNew := new[k]
+		switch {
+		case !hadOld:
+			changes = append(changes, recordChange{Action: "record.create", Key: k, New: newValue})
+		case !hasNew:
+			changes = append(changes, recordChange{Action: "record.delete", Key: k, Old: oldValue})
+		case oldValue != newValue:
+			changes = append(changes, recordChange{Action: "record.update", Key: k, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
+
+// auditStartup records the explicitly set command line options and the
+// number of records loaded when the server starts.
+func (s *Server) auditStartup(records map[string]string) {
+	flag.Visit(func(f *flag.Flag) {
+		s.audit(auditEntry{Actor: "startup", Action: "config.set", Key: f.Name, New: f.Value.String()})
+	})
+	s.audit(auditEntry{Actor: "startup", Action: "records.load", Key: s.cfg.HostsFile, New: fmt.Sprintf("%d records", len(records))})
+}
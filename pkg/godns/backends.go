@@ -0,0 +1,89 @@
+package godns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// publishBackendRecords replaces the records of a backend and reloads the
+// live record set if they changed.
+func (s *Server) publishBackendRecords(backend string, records map[string]string) {
+	s.backendMu.Lock()
+	prev, known := s.backendRecords[backend]
+	s.backendRecords[backend] = records
+	s.backendMu.Unlock()
+
+	if known && sameRecords(prev, records) {
+		return
+	}
+	s.reloadHosts("backend:" + backend)
+}
+
+// allBackendRecords merges the records of every backend. Backends are
+// merged in name order so a name defined by two of them resolves the same
+// way every time.
+func (s *Server) allBackendRecords() map[string]string {
+	s.backendMu.Lock()
+	defer s.backendMu.Unlock()
+
+	names := make([]string, 0, len(s.backendRecords))
+	for name := range s.backendRecords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	merged := make(map[string]string)
+	for _, name := range names {
+		for host, ip := range s.backendRecords[name] {
+			merged[host] = ip
+		}
+	}
+	return merged
+}
+
+// backendStore is the RecordStore of the merged backend records.
+type backendStore struct {
+	srv *Server
+}
+
+func (b backendStore) Records() (map[string]string, error) {
+	return b.srv.allBackendRecords(), nil
+}
+
+// addRecord adds name to records unless it is not a valid host name, is
+// already taken or ip is not an IP address (e.g. a host name, or an address
+// that is still pending).
+func addRecord(records map[string]string, name, ip string) {
+	host, ok := normalizeRecordHost(strings.TrimSpace(name))
+	if !ok || net.ParseIP(ip) == nil {
+		return
+	}
+	if _, taken := records[host]; !taken {
+		records[host] = ip
+	}
+}
+
+func sameRecords(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// backoff returns the delay before retry number attempt (from 0) of a
+// failing backend connection: doubling from one second up to 30 seconds.
+func backoff(attempt int) time.Duration {
+	return min(time.Second<<min(attempt, 5), 30*time.Second)
+}
+
+// backendFailed logs a failed backend connection.
+func (s *Server) backendFailed(backend string, err error) {
+	s.logMessage(fmt.Sprintf("Error in %s record backend: %v", backend, err))
+}
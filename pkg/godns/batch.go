@@ -0,0 +1,45 @@
+package godns
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// batchAddr is the client address of a datagram read in a batch, with
+// the control message telling which local address it was sent to, so the
+// response can be sent from that address.
+type batchAddr struct {
+	*net.UDPAddr
+	oob []byte
+	// buf is the pooled buffer the query was read into, if any, handed
+	// back by releaseQuery.
+	buf []byte
+}
+
+// releaseQuery returns the buffer a batched query was read into to its
+// pool once h has answered the query.
+func releaseQuery(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		h.ServeDNS(w, req)
+		if a, ok := w.RemoteAddr().(*batchAddr); ok && a.buf != nil {
+			putBuffer(a.buf)
+		}
+	})
+}
+
+// batchReader is a UDP listener that reads several datagrams per system
+// call. Each read returns the next datagram of the current batch.
+type batchReader interface {
+	readBatched(timeout time.Duration) ([]byte, net.Addr, error)
+}
+
+// readPacketConn reads a datagram from conn, from its current batch if it
+// reads in batches.
+func readPacketConn(r dns.Reader, conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	if b, ok := conn.(batchReader); ok {
+		return b.readBatched(timeout)
+	}
+	return r.(dns.PacketConnReader).ReadPacketConn(conn, timeout)
+}
@@ -0,0 +1,196 @@
+package godns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpBatchSize is the most datagrams one recvmmsg or sendmmsg call
+// handles.
+const udpBatchSize = 64
+
+// batchConn is a UDP listener that reads datagrams with recvmmsg and sends
+// responses with sendmmsg. Only the dns.Server read loop reads from it, so
+// the read batch needs no lock. Responses are queued for a single sender,
+// which sends whatever has queued up while it sent the previous batch, so
+// the handlers do not contend for the socket.
+type batchConn struct {
+	*net.UDPConn
+	pc      *ipv4.PacketConn
+	size    int
+	msgs    []ipv4.Message
+	n, next int
+
+	out     chan ipv4.Message
+	closing chan struct{}
+	sent    chan struct{}
+	once    sync.Once
+	// sendErrors counts the responses the kernel refused.
+	sendErrors *atomic.Uint64
+}
+
+// batchUDP returns conn reading datagrams in batches of up to
+// udpBatchSize, each of at most size bytes, and counting the responses it
+// fails to send in sendErrors.
+func batchUDP(conn *net.UDPConn, size int, sendErrors *atomic.Uint64) net.PacketConn {
+	// Ask for the destination address of every datagram, as dns.Server
+	// does for the listeners it reads itself; one of the two may fail on
+	// a socket of the other family.
+	err6 := ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+	err4 := ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+	if err6 != nil && err4 != nil {
+		return conn
+	}
+	oobSize := len(ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagInterface))
+	if n := len(ipv4.NewControlMessage(ipv4.FlagDst | ipv4.FlagInterface)); n > oobSize {
+		oobSize = n
+	}
+	c := &batchConn{
+		UDPConn: conn,
+		pc:      ipv4.NewPacketConn(conn),
+		size:    size,
+		msgs:    make([]ipv4.Message, udpBatchSize),
+		out:     make(chan ipv4.Message, 4*udpBatchSize),
+		closing: make(chan struct{}),
+		sent:    make(chan struct{}),
+
+		sendErrors: sendErrors,
+	}
+	for i := range c.msgs {
+		c.msgs[i].Buffers = [][]byte{make([]byte, size)}
+		c.msgs[i].OOB = make([]byte, oobSize)
+	}
+	go c.send()
+	return c
+}
+
+func (c *batchConn) readBatched(timeout time.Duration) ([]byte, net.Addr, error) {
+	for c.next == c.n {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		n, err := c.pc.ReadBatch(c.msgs, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.n, c.next = n, 0
+	}
+	m := &c.msgs[c.next]
+	c.next++
+	raddr, _ := m.Addr.(*net.UDPAddr)
+	addr := &batchAddr{UDPAddr: raddr, oob: append([]byte(nil), m.OOB[:m.NN]...)}
+	// The batch buffers are reused by the next batch while the datagrams
+	// are still being answered, so each is copied to a pooled buffer.
+	// dns.Server keeps a buffer whose capacity is its UDPSize for itself;
+	// capping the capacity at the length keeps it from taking ours, except
+	// for a datagram of exactly that size, which is left to it.
+	buf := getBuffer(m.N)
+	copy(buf, m.Buffers[0][:m.N])
+	if m.N != c.size {
+		addr.buf = buf
+	}
+	return buf[:m.N:m.N], addr, nil
+}
+
+// WriteTo queues a response to be sent from the address the query was
+// sent to. Errors sending it are counted in the statistics, not returned.
+func (c *batchConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*batchAddr)
+	if !ok {
+		return c.UDPConn.WriteTo(b, addr)
+	}
+	buf := getBuffer(len(b))
+	copy(buf, b)
+	msg := ipv4.Message{
+		Buffers: [][]byte{buf},
+		OOB:     sourceOOB(a.oob),
+		Addr:    a.UDPAddr,
+	}
+	select {
+	case c.out <- msg:
+		return len(b), nil
+	case <-c.closing:
+		return 0, net.ErrClosed
+	}
+}
+
+// send sends the queued responses until the listener is closed, then
+// those still queued.
+func (c *batchConn) send() {
+	defer close(c.sent)
+	batch := make([]ipv4.Message, 0, udpBatchSize)
+	for {
+		select {
+		case msg := <-c.out:
+			batch = append(batch[:0], msg)
+		case <-c.closing:
+			for {
+				batch = batch[:0]
+				c.drain(&batch)
+				if len(batch) == 0 {
+					return
+				}
+				c.flush(batch)
+			}
+		}
+		c.drain(&batch)
+		c.flush(batch)
+	}
+}
+
+// drain adds queued responses to batch until it is full or none is left.
+func (c *batchConn) drain(batch *[]ipv4.Message) {
+	for len(*batch) < udpBatchSize {
+		select {
+		case msg := <-c.out:
+			*batch = append(*batch, msg)
+		default:
+			return
+		}
+	}
+}
+
+// flush sends batch, skipping a response the kernel refuses, and returns
+// the buffers to their pool.
+func (c *batchConn) flush(batch []ipv4.Message) {
+	for pending := batch; len(pending) > 0; {
+		n, err := c.pc.WriteBatch(pending, 0)
+		if err != nil || n == 0 {
+			c.sendErrors.Add(1)
+			n = 1
+		}
+		pending = pending[n:]
+	}
+	for i := range batch {
+		putBuffer(batch[i].Buffers[0])
+		batch[i] = ipv4.Message{}
+	}
+}
+
+// Close sends the responses still queued, then closes the socket.
+// dns.Server closes the listener once every query it read is answered.
+func (c *batchConn) Close() error {
+	c.once.Do(func() { close(c.closing) })
+	<-c.sent
+	return c.UDPConn.Close()
+}
+
+// sourceOOB turns the control message of a received datagram into one
+// that sends from its destination address.
+func sourceOOB(oob []byte) []byte {
+	cm6 := new(ipv6.ControlMessage)
+	if cm6.Parse(oob) == nil && cm6.Dst != nil {
+		if cm6.Dst.To4() == nil {
+			return (&ipv6.ControlMessage{Src: cm6.Dst}).Marshal()
+		}
+		return (&ipv4.ControlMessage{Src: cm6.Dst}).Marshal()
+	}
+	cm4 := new(ipv4.ControlMessage)
+	if cm4.Parse(oob) == nil && cm4.Dst != nil {
+		return (&ipv4.ControlMessage{Src: cm4.Dst}).Marshal()
+	}
+	return nil
+}
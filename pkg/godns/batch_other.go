@@ -0,0 +1,13 @@
+//go:build !linux
+
+package godns
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// batchUDP returns conn: batched reads need recvmmsg, which only Linux has.
+func batchUDP(conn *net.UDPConn, size int, sendErrors *atomic.Uint64) net.PacketConn {
+	return conn
+}
@@ -0,0 +1,206 @@
+package godns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	handleAdmin("/blocking/hits", func(s *Server) http.HandlerFunc { return s.requireTokenIfSet(s.blockHitsHandler) })
+}
+
+// blockSet is the loaded blocklists: every blocked domain with the list it
+// came from. Like recordSet it is never modified once published.
+type blockSet struct {
+	rules map[string]string
+	bytes int64
+}
+
+// loadBlocklists reads every blocklist and replaces the blocked domains.
+// A list that fails to load leaves the previous domains in place.
+func (s *Server) loadBlocklists() error {
+	if len(s.cfg.Blocking.Lists) == 0 {
+		return nil
+	}
+	next := &blockSet{rules: make(map[string]string)}
+	for _, source := range s.cfg.Blocking.Lists {
+		domains, err := readBlocklist(source)
+		if err != nil {
+			return fmt.Errorf("blocklist %s: %v", source, err)
+		}
+		for _, domain := range domains {
+			next.add(domain, source)
+		}
+	}
+	// Followers replicate the blocked domains.
+	if prev := s.setBlocks(next); prev == nil || !maps.Equal(prev.rules, next.rules) {
+		s.notifyFollowers()
+	}
+	s.logMessage(fmt.Sprintf("Loaded %d blocked domains from %d blocklists", len(next.rules), len(s.cfg.Blocking.Lists)))
+	return nil
+}
+
+// add blocks domain as a rule of the list source, unless an earlier list
+// blocks it already.
+func (set *blockSet) add(domain, source string) {
+	if _, ok := set.rules[domain]; !ok {
+		set.rules[domain] = source
+		// A map entry with its key and the shared source string.
+		set.bytes += int64(len(domain) + 48)
+	}
+}
+
+// setBlocks replaces the blocked domains with next, charging them to the
+// memory budget in place of the previous ones, which it returns, or nil.
+func (s *Server) setBlocks(next *blockSet) *blockSet {
+	s.blockMemoryOnce.Do(func() { s.blockMemory = s.budget.account("blocklists", nil) })
+	// The lists cannot be loaded in part, so they are charged even over
+	// the budget, at the expense of the cache.
+	s.blockMemory.charge(next.bytes)
+	prev := s.liveBlocks.Swap(next)
+	if prev != nil {
+		s.blockMemory.release(prev.bytes)
+	}
+	return prev
+}
+
+// reloadBlocklists reloads the blocklists in the background, if any are
+// configured.
+func (s *Server) reloadBlocklists() {
+	if len(s.cfg.Blocking.Lists) == 0 {
+		return
+	}
+	s.goBackground(func() {
+		if err := s.loadBlocklists(); err != nil {
+			s.logMessage(fmt.Sprintf("Error loading blocklists: %v", err))
+		}
+	})
+}
+
+// readBlocklist reads the domains of a blocklist, a file or an HTTP(S)
+// URL with a domain per line, either alone or after an address as in
+// /etc/hosts files. Blank lines, # comments and the host names hosts
+// files define for the machine itself are skipped.
+func readBlocklist(source string) ([]string, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchWarmupList(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, field := range fields {
+			domain := strings.ToLower(strings.TrimSuffix(field, "."))
+			switch domain {
+			case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+				continue
+			}
+			if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+				return nil, fmt.Errorf("invalid domain %q", field)
+			}
+			domains = append(domains, domain)
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// blockingRule returns the blocked domain host is or is a subdomain of,
+// and the list that blocks it.
+func (s *Server) blockingRule(host string) (rule, source string, ok bool) {
+	set := s.liveBlocks.Load()
+	if set == nil {
+		return "", "", false
+	}
+	for name := host; ; {
+		if source, ok := set.rules[name]; ok {
+			return name, source, true
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return "", "", false
+		}
+		name = parent
+	}
+}
+
+// answerBlocked answers a query for a blocked name with the sinkhole
+// address of its family, with no answer when there is only one of the
+// other family, or with NXDOMAIN when there is no sinkhole.
+func (s *Server) answerBlocked(q dns.Question, response *dns.Msg) {
+	s.stats.blocked.Add(1)
+	if len(s.cfg.Blocking.Sinkhole) == 0 {
+		response.Rcode = dns.RcodeNameError
+		return
+	}
+	for _, addr := range s.cfg.Blocking.Sinkhole {
+		ip := net.ParseIP(addr)
+		rr := addressRecord(q.Name, ip, s.cfg.LocalTTL)
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			response.Answer = append(response.Answer, rr)
+		}
+	}
+}
+
+// blockHit is a client hitting a blocklist rule.
+type blockHit struct {
+	Client string `json:"client"`
+	Rule   string `json:"rule"`
+	List   string `json:"list"`
+	Count  uint64 `json:"count"`
+}
+
+// recordBlockHit counts and, with log_hits, logs a blocked query.
+func (s *Server) recordBlockHit(client string, q dns.Question, rule, source string) {
+	if s.cfg.Blocking.LogHits {
+		s.logMessage(fmt.Sprintf("Blocked %s %s for %s by %s (%s)", dns.TypeToString[q.Qtype], q.Name, client, rule, source))
+	}
+	key := blockHit{Client: client, Rule: rule, List: source}
+	s.blockHits.Lock()
+	defer s.blockHits.Unlock()
+	if s.blockHits.memory == nil {
+		s.blockHits.memory = s.budget.account("block_hits", nil)
+	}
+	if _, ok := s.blockHits.counts[key]; !ok && !s.blockHits.memory.tryCharge(int64(len(client)+len(rule)+64)) {
+		key.Client = otherKey
+	}
+	s.blockHits.counts[key]++
+}
+
+// blockHitsHandler lists the blocklist hits by client and rule, most
+// frequent first.
+func (s *Server) blockHitsHandler(w http.ResponseWriter, r *http.Request) {
+	s.blockHits.Lock()
+	hits := make([]blockHit, 0, len(s.blockHits.counts))
+	for key, count := range s.blockHits.counts {
+		key.Count = count
+		hits = append(hits, key)
+	}
+	s.blockHits.Unlock()
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Count != hits[j].Count {
+			return hits[i].Count > hits[j].Count
+		}
+		return hits[i].Client+hits[i].Rule < hits[j].Client+hits[j].Rule
+	})
+	writeJSON(w, http.StatusOK, hits)
+}
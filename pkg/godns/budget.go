@@ -0,0 +1,132 @@
+package godns
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// memoryBudget is a byte budget shared by several accounts. Sizes are
+// estimates of the memory an entry takes, not measurements.
+type memoryBudget struct {
+	limit int64
+	used  atomic.Int64
+	// accounts are the accounts in the order they give memory back when
+	// another one needs it.
+	accounts []*budgetAccount
+	// refused counts entries left out for lack of budget, reclaimed the
+	// bytes evicted to make room.
+	refused   atomic.Uint64
+	reclaimed atomic.Uint64
+}
+
+// budgetAccount is the share of the budget one consumer uses. reclaim, if
+// set, frees at least need bytes of the consumer's entries if it can and
+// returns how much it freed, so that another account can grow.
+type budgetAccount struct {
+	name    string
+	budget  *memoryBudget
+	used    atomic.Int64
+	reclaim func(need int64) int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// account adds an account to b. Accounts added first are reclaimed from
+// first. On a nil budget it returns nil, whose methods grant everything.
+func (b *memoryBudget) account(name string, reclaim func(need int64) int64) *budgetAccount {
+	if b == nil {
+		return nil
+	}
+	a := &budgetAccount{name: name, budget: b, reclaim: reclaim}
+	b.accounts = append(b.accounts, a)
+	return a
+}
+
+// tryCharge takes n bytes for a, reclaiming them from the accounts that
+// can give memory back when the budget is spent. It reports false, and
+// takes nothing, when not enough could be freed.
+func (a *budgetAccount) tryCharge(n int64) bool {
+	if a == nil {
+		return true
+	}
+	b := a.budget
+	for {
+		used := b.used.Load()
+		if used+n <= b.limit {
+			if b.used.CompareAndSwap(used, used+n) {
+				a.used.Add(n)
+				return true
+			}
+			continue
+		}
+		if !b.reclaimFor(used + n - b.limit) {
+			b.refused.Add(1)
+			return false
+		}
+	}
+}
+
+// charge takes n bytes for a even over the budget, for memory that
+// cannot be done without, reclaiming what it can from the others.
+func (a *budgetAccount) charge(n int64) {
+	if a == nil {
+		return
+	}
+	a.used.Add(n)
+	if over := a.budget.used.Add(n) - a.budget.limit; over > 0 {
+		a.budget.reclaimFor(over)
+	}
+}
+
+// release gives n bytes of a back to the budget.
+func (a *budgetAccount) release(n int64) {
+	if a == nil {
+		return
+	}
+	a.used.Add(-n)
+	a.budget.used.Add(-n)
+}
+
+// reclaimFor asks the accounts to free need bytes, in order, and reports
+// whether any memory was freed.
+func (b *memoryBudget) reclaimFor(need int64) bool {
+	freed := int64(0)
+	for _, a := range b.accounts {
+		if a.reclaim == nil || a.used.Load() == 0 {
+			continue
+		}
+		freed += a.reclaim(need - freed)
+		if freed >= need {
+			break
+		}
+	}
+	if freed > 0 {
+		b.reclaimed.Add(uint64(freed))
+	}
+	return freed > 0
+}
+
+// snapshot returns the budget and the use of every account in the format
+// of statsSnapshot.
+func (b *memoryBudget) snapshot() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "memory.budget=%d\n", b.limit)
+	fmt.Fprintf(&s, "memory.used=%d\n", b.used.Load())
+	for _, a := range b.accounts {
+		fmt.Fprintf(&s, "memory.%s=%d\n", a.name, a.used.Load())
+	}
+	fmt.Fprintf(&s, "memory.refused=%d\n", b.refused.Load())
+	fmt.Fprintf(&s, "memory.reclaimed=%d\n", b.reclaimed.Load())
+	return s.String()
+}
+
+// counters returns the refused and reclaimed counts, zero on a nil budget.
+func (b *memoryBudget) counters() (refused, reclaimed uint64) {
+	if b == nil {
+		return 0, 0
+	}
+	return b.refused.Load(), b.reclaimed.Load()
+}
@@ -0,0 +1,56 @@
+package godns
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// bufferTiers are the sizes of the pooled message buffers: a classic UDP
+// message, the EDNS buffer size recommended since DNS Flag Day 2020, the
+// common EDNS default and the largest TCP message.
+var bufferTiers = [...]int{dns.MinMsgSize, 1232, dns.DefaultMsgSize, dns.MaxMsgSize}
+
+var bufferPools [len(bufferTiers)]sync.Pool
+
+func init() {
+	for i, size := range bufferTiers {
+		size := size
+		bufferPools[i].New = func() any { return make([]byte, size) }
+	}
+}
+
+// getBuffer returns a buffer of length size from the smallest tier that
+// holds it, or a new one if none does. Whoever ends up with it last hands
+// it back with putBuffer, once nothing refers to it any more.
+func getBuffer(size int) []byte {
+	for i, tier := range bufferTiers {
+		if size <= tier {
+			return bufferPools[i].Get().([]byte)[:size]
+		}
+	}
+	return make([]byte, size)
+}
+
+// putBuffer returns a buffer from getBuffer to its pool. Buffers of other
+// capacities, e.g. ones dns.Msg.PackBuffer had to replace, are left to the
+// garbage collector.
+func putBuffer(buf []byte) {
+	for i, tier := range bufferTiers {
+		if cap(buf) == tier {
+			bufferPools[i].Put(buf[:tier])
+			return
+		}
+	}
+}
+
+// packResponse packs response into a pooled buffer.
+func packResponse(response *dns.Msg) ([]byte, error) {
+	// PackBuffer needs a byte more than the uncompressed length, as it
+	// compresses names after packing them.
+	compress := response.Compress
+	response.Compress = false
+	size := response.Len() + 1
+	response.Compress = compress
+	return response.PackBuffer(getBuffer(size))
+}
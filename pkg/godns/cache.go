@@ -0,0 +1,210 @@
+package godns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxCacheTTL caps how long an upstream answer is cached, whatever its TTL.
+const maxCacheTTL = 24 * time.Hour
+
+// responseCache keeps upstream answers for as long as their TTLs allow,
+// evicting the least recently used one when it is full.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	// memory is the cache's share of the memory budget, which it gives
+	// back by evicting its least recently used answers.
+	memory *budgetAccount
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// do and cd are the DNSSEC OK and Checking Disabled bits of the
+	// query, which change the answer: with DO it carries signatures, with
+	// CD it may hold data that failed validation.
+	do, cd bool
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+	// bytes is the memory the entry is estimated to take.
+	bytes int64
+}
+
+func (s *Server) newResponseCache(size int) *responseCache {
+	c := &responseCache{size: size, entries: make(map[cacheKey]*list.Element), lru: list.New()}
+	c.memory = s.budget.account("cache", c.reclaim)
+	return c
+}
+
+// counters returns the cache hits and misses, zero on a nil cache.
+func (c *responseCache) counters() (hits, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.hits.Load(), c.misses.Load()
+}
+
+// cacheEntrySize estimates the memory a cached answer takes: the entry
+// and its bookkeeping, the unpacked records and their names and data.
+func cacheEntrySize(msg *dns.Msg) int64 {
+	records := len(msg.Answer) + len(msg.Ns) + len(msg.Extra)
+	return int64(256 + 96*records + 2*msg.Len())
+}
+
+func newCacheKey(query *dns.Msg) cacheKey {
+	q := query.Question[0]
+	key := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, cd: query.CheckingDisabled}
+	if opt := query.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key
+}
+
+// get returns a copy of the cached answer to the upstream query with its
+// TTLs counted down by the time it spent in the cache, or nil. The answer
+// carries the name as the query spells it, for clients that check the case
+// of their query.
+func (c *responseCache) get(query *dns.Msg) *dns.Msg {
+	key, now := newCacheKey(query), time.Now()
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok && now.After(el.Value.(*cacheEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	e := el.Value.(*cacheEntry)
+	c.mu.Unlock()
+	c.hits.Add(1)
+
+	msg := e.msg.Copy()
+	setQuestion(msg, query.Question[0])
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl -= min(hdr.Ttl, age)
+			}
+		}
+	}
+	return msg
+}
+
+// setQuestion makes q the question of msg, an answer to a question for
+// the same name in any case, and spells the name of its answers as q does.
+func setQuestion(msg *dns.Msg, q dns.Question) {
+	msg.Question = []dns.Question{q}
+	for _, rr := range msg.Answer {
+		if strings.EqualFold(rr.Header().Name, q.Name) {
+			rr.Header().Name = q.Name
+		}
+	}
+}
+
+// set caches a copy of response, the answer to the upstream query, if it
+// may be.
+func (c *responseCache) set(query *dns.Msg, response *dns.Msg) {
+	ttl, ok := cacheTTL(response)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{key: newCacheKey(query), msg: response.Copy(), stored: now, expires: now.Add(ttl)}
+	e.bytes = cacheEntrySize(e.msg)
+	// Charged before taking the lock, as making room may evict from this
+	// cache. Without room the answer is not cached.
+	if !c.memory.tryCharge(e.bytes) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.memory.release(el.Value.(*cacheEntry).bytes)
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove evicts the entry of el, with c.mu held.
+func (c *responseCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.memory.release(e.bytes)
+}
+
+// reclaim evicts the least recently used answers until need bytes of the
+// memory budget are freed or the cache is empty, and returns how much was
+// freed.
+func (c *responseCache) reclaim(need int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	freed := int64(0)
+	for freed < need && c.lru.Len() > 0 {
+		oldest := c.lru.Back()
+		freed += oldest.Value.(*cacheEntry).bytes
+		c.remove(oldest)
+	}
+	return freed
+}
+
+// len returns the number of cached answers, including expired ones not
+// yet evicted.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// cacheTTL returns how long response may be cached: the smallest TTL of
+// its records, and for negative answers at most the SOA minimum (RFC
+// 2308). Failures, truncated answers and answers without any TTL are not
+// cached.
+func cacheTTL(response *dns.Msg) (time.Duration, bool) {
+	if (response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) || response.Truncated {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, rr := range section {
+			t := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(response.Answer) == 0 {
+				t = min(t, soa.Minttl)
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	return min(time.Duration(ttl)*time.Second, maxCacheTTL), true
+}
@@ -0,0 +1,322 @@
+package godns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCaptureDuration = time.Minute
+	maxCaptureDuration     = 10 * time.Minute
+	pcapLinkTypeRaw        = 101
+	pcapSnapLen            = 65535
+)
+
+// captureSession writes matching DNS traffic to a pcap file until it is
+// stopped or its deadline passes.
+type captureSession struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	path    string
+	client  net.IP
+	qname   string
+	until   time.Time
+	packets int
+	timer   *time.Timer
+}
+
+type captureStatus struct {
+	Active  bool       `json:"active"`
+	Path    string     `json:"path,omitempty"`
+	Client  string     `json:"client,omitempty"`
+	Qname   string     `json:"qname,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+	Packets int        `json:"packets"`
+}
+
+func init() {
+	handleAdmin("/capture", func(s *Server) http.HandlerFunc { return s.requireToken(s.captureHandler) })
+}
+
+// captureHandler starts (POST), stops (DELETE) or reports (GET) a capture.
+// POST accepts the optional query parameters duration, client and qname.
+func (s *Server) captureHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		duration := defaultCaptureDuration
+		if v := r.URL.Query().Get("duration"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > maxCaptureDuration {
+				http.Error(w, fmt.Sprintf("duration must be between 0 and %s", maxCaptureDuration), http.StatusBadRequest)
+				return
+			}
+			duration = d
+		}
+		var client net.IP
+		if v := r.URL.Query().Get("client"); v != "" {
+			if client = net.ParseIP(v); client == nil {
+				http.Error(w, "invalid client IP", http.StatusBadRequest)
+				return
+			}
+		}
+		qname := strings.ToLower(strings.TrimSuffix(r.URL.Query().Get("qname"), "."))
+		if err := s.startCapture(client, qname, duration); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case http.MethodDelete:
+		s.stopCapture()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := captureStatus{}
+	if session := s.activeCapture.Load(); session != nil {
+		session.mu.Lock()
+		status = captureStatus{
+			Active:  true,
+			Path:    session.path,
+			Qname:   session.qname,
+			Until:   &session.until,
+			Packets: session.packets,
+		}
+		if session.client != nil {
+			status.Client = session.client.String()
+		}
+		session.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) startCapture(client net.IP, qname string, duration time.Duration) error {
+	now := time.Now()
+	// Nanoseconds keep the names of captures started in the same second
+	// apart.
+	path := filepath.Join(s.cfg.Admin.CaptureDir, fmt.Sprintf("godns-%s.pcap", now.UTC().Format("20060102T150405.000000000Z")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	session := &captureSession{
+		file:   file,
+		w:      bufio.NewWriter(file),
+		path:   path,
+		client: client,
+		qname:  qname,
+		until:  now.Add(duration),
+	}
+	if !s.activeCapture.CompareAndSwap(nil, session) {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("a capture is already running")
+	}
+
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	session.w.Write(hdr[:])
+
+	session.timer = time.AfterFunc(duration, s.stopCapture)
+	s.logMessage(fmt.Sprintf("Packet capture started: %s (for %s)", path, duration))
+	return nil
+}
+
+func (s *Server) stopCapture() {
+	session := s.activeCapture.Swap(nil)
+	if session == nil {
+		return
+	}
+	session.timer.Stop()
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if err := session.w.Flush(); err != nil {
+		s.logMessage(fmt.Sprintf("Error writing packet capture: %v", err))
+	}
+	session.file.Close()
+	s.logMessage(fmt.Sprintf("Packet capture stopped: %s (%d packets)", session.path, session.packets))
+}
+
+// captureReader is the dns.DecorateReader of the listeners: it records the
+// queries they read, over UDP and TCP.
+func (s *Server) captureReader(r dns.Reader) dns.Reader {
+	return capturingReader{r, s}
+}
+
+type capturingReader struct {
+	dns.Reader
+	srv *Server
+}
+
+func (r capturingReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	data, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		r.srv.capturePacket(data, remoteUDPAddr(conn.RemoteAddr()), conn.LocalAddr(), true)
+	}
+	return data, err
+}
+
+func (r capturingReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	data, session, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		if client, ok := session.RemoteAddr().(*net.UDPAddr); ok {
+			r.srv.capturePacket(data, client, conn.LocalAddr(), true)
+		}
+	}
+	return data, session, err
+}
+
+func (r capturingReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	data, addr, err := readPacketConn(r.Reader, conn, timeout)
+	if err == nil {
+		r.srv.capturePacket(data, remoteUDPAddr(addr), conn.LocalAddr(), true)
+	}
+	return data, addr, err
+}
+
+// capturePacket records a DNS message exchanged with client if a capture is
+// running and the message matches its filters. fromClient tells the
+// direction of the packet. Messages exchanged over TCP are recorded as UDP
+// datagrams between the same addresses, one per message.
+func (s *Server) capturePacket(data []byte, client *net.UDPAddr, local net.Addr, fromClient bool) {
+	session := s.activeCapture.Load()
+	if session == nil {
+		return
+	}
+	if session.client != nil && !session.client.Equal(client.IP) {
+		return
+	}
+	if session.qname != "" {
+		var msg dns.Msg
+		if err := msg.Unpack(data); err != nil || len(msg.Question) == 0 {
+			return
+		}
+		if strings.ToLower(strings.TrimSuffix(msg.Question[0].Name, ".")) != session.qname {
+			return
+		}
+	}
+
+	server := remoteUDPAddr(local)
+	src, dst := client, server
+	if !fromClient {
+		src, dst = server, client
+	}
+	packet := buildIPPacket(src, dst, data)
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if s.activeCapture.Load() != session {
+		return
+	}
+	now := time.Now()
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(packet)))
+	session.w.Write(hdr[:])
+	session.w.Write(packet)
+	session.packets++
+}
+
+// buildIPPacket wraps payload in synthetic IP and UDP headers so it can be
+// stored with the raw IP link type.
+func buildIPPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	var srcIP, dstIP net.IP
+	v4 := fitsIPv4(src.IP) && fitsIPv4(dst.IP)
+	if v4 {
+		srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		if srcIP == nil {
+			srcIP = net.IPv4zero.To4()
+		}
+		if dstIP == nil {
+			dstIP = net.IPv4zero.To4()
+		}
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		if srcIP == nil {
+			srcIP = net.IPv6zero
+		}
+		if dstIP == nil {
+			dstIP = net.IPv6zero
+		}
+	}
+
+	udpLen := 8 + len(payload)
+	udp := make([]byte, udpLen)
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[8:], payload)
+
+	pseudo := make([]byte, 0, 2*len(srcIP)+8)
+	pseudo = append(pseudo, srcIP...)
+	pseudo = append(pseudo, dstIP...)
+	pseudo = append(pseudo, 0, 17, byte(udpLen>>8), byte(udpLen))
+	sum := checksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+
+	if v4 {
+		ip := make([]byte, 20, 20+udpLen)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+udpLen))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+udpLen)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:], srcIP)
+	copy(ip[24:], dstIP)
+	return append(ip, udp...)
+}
+
+// fitsIPv4 reports whether ip can be written into an IPv4 header; an unset
+// or unspecified address adapts to the family of the other endpoint.
+func fitsIPv4(ip net.IP) bool {
+	return len(ip) == 0 || ip.IsUnspecified() || ip.To4() != nil
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
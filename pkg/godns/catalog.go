@@ -0,0 +1,207 @@
+package godns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Catalog zones (RFC 9432) list the member zones a primary serves, so
+// secondaries pick up new zones without being reconfigured. A zone with
+// catalog: true and a primary is consumed: every zone listed in it becomes
+// a secondary zone transferred from the same primary, with the catalog
+// zone's key, transfer policy and notify list. A catalog zone with neither
+// file nor primary is produced: godns generates it from its zone file
+// zones.
+
+// catalogVersion is the only catalog zone schema version supported.
+const catalogVersion = "2"
+
+type catalogMember struct {
+	zone    ZoneConfig
+	catalog string
+	stop    chan struct{}
+}
+
+// catalogMemberConfig returns the configuration of a member zone of a
+// consumed catalog, or nil.
+func (s *Server) catalogMemberConfig(name string) *ZoneConfig {
+	s.catalogMu.Lock()
+	defer s.catalogMu.Unlock()
+	if m := s.catalogMembers[name]; m != nil {
+		zone := m.zone
+		return &zone
+	}
+	return nil
+}
+
+// catalogMemberZones returns the configurations of all member zones of
+// consumed catalogs.
+func (s *Server) catalogMemberZones() []ZoneConfig {
+	s.catalogMu.Lock()
+	defer s.catalogMu.Unlock()
+	zones := make([]ZoneConfig, 0, len(s.catalogMembers))
+	for _, m := range s.catalogMembers {
+		zones = append(zones, m.zone)
+	}
+	return zones
+}
+
+// syncCatalogMembers starts following the zones newly listed in a consumed
+// catalog zone and drops the zones no longer listed.
+func (s *Server) syncCatalogMembers(catalog ZoneConfig, z *zoneData) {
+	members, err := parseCatalog(z)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Ignoring catalog zone %s: %v", catalog.Name, err))
+		return
+	}
+
+	s.catalogMu.Lock()
+	var started []*catalogMember
+	var stopped []string
+	for name, m := range s.catalogMembers {
+		if m.catalog == catalog.Name && !members[name] {
+			close(m.stop)
+			delete(s.catalogMembers, name)
+			stopped = append(stopped, name)
+		}
+	}
+	for name := range members {
+		// Zones configured explicitly, or listed by another catalog
+		// first, are left alone.
+		if s.catalogMembers[name] != nil || s.configuredZone(name) {
+			continue
+		}
+		m := &catalogMember{
+			zone: ZoneConfig{
+				Name:       name,
+				Transfer:   catalog.Transfer,
+				Primary:    catalog.Primary,
+				PrimaryKey: catalog.PrimaryKey,
+				Notify:     catalog.Notify,
+			},
+			catalog: catalog.Name,
+			stop:    make(chan struct{}),
+		}
+		s.catalogMembers[name] = m
+		started = append(started, m)
+	}
+	s.catalogMu.Unlock()
+
+	for _, name := range stopped {
+		s.logMessage(fmt.Sprintf("Removed zone %s, no longer in catalog %s", name, catalog.Name))
+	}
+	for _, m := range started {
+		s.logMessage(fmt.Sprintf("Added zone %s from catalog %s", m.zone.Name, catalog.Name))
+		m := m
+		s.goBackground(func() { s.runSecondary(m.zone, m.stop) })
+	}
+}
+
+func (s *Server) configuredZone(name string) bool {
+	for _, zone := range s.cfg.Zones {
+		if zone.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCatalog returns the member zones listed in a catalog zone: the
+// targets of the PTR records at <id>.zones.<catalog>.
+func parseCatalog(z *zoneData) (map[string]bool, error) {
+	version := ""
+	for _, rr := range z.rrs["version."+z.origin] {
+		if txt, ok := rr.(*dns.TXT); ok && len(txt.Txt) == 1 {
+			version = txt.Txt[0]
+		}
+	}
+	if version != catalogVersion {
+		return nil, fmt.Errorf("unsupported catalog version %q", version)
+	}
+
+	members := make(map[string]bool)
+	suffix := ".zones." + z.origin
+	for owner, rrs := range z.rrs {
+		id, ok := strings.CutSuffix(owner, suffix)
+		if !ok || strings.Contains(id, ".") {
+			continue
+		}
+		for _, rr := range rrs {
+			if ptr, ok := rr.(*dns.PTR); ok {
+				members[strings.ToLower(strings.TrimSuffix(ptr.Ptr, "."))] = true
+			}
+		}
+	}
+	return members, nil
+}
+
+// produceCatalogs adds the catalog zones godns generates to next, a freshly
+// loaded set of zones. A catalog whose members did not change is carried
+// over from prev as is; otherwise its serial is increased.
+func (s *Server) produceCatalogs(prev, next map[string]*zoneData) {
+	for _, catalog := range s.cfg.Zones {
+		if !catalog.Catalog || catalog.Primary != "" {
+			continue
+		}
+		var members []string
+		for _, zone := range s.cfg.Zones {
+			if zone.File != "" && !zone.Catalog {
+				members = append(members, zone.Name)
+			}
+		}
+		sort.Strings(members)
+
+		serial := uint32(time.Now().Unix())
+		if old := prev[catalog.Name]; old != nil {
+			if listed, err := parseCatalog(old); err == nil && sameMembers(listed, members) {
+				next[catalog.Name] = old
+				continue
+			}
+			if !serialAfter(serial, old.soa.Serial) {
+				serial = old.soa.Serial + 1
+			}
+		}
+		next[catalog.Name] = buildCatalog(catalog.Name, serial, members)
+	}
+}
+
+// buildCatalog generates a catalog zone listing members. The member IDs
+// are derived from the member names, so they stay the same across
+// restarts as RFC 9432 asks.
+func buildCatalog(origin string, serial uint32, members []string) *zoneData {
+	apex := dns.Fqdn(origin)
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET}
+	}
+	soa := &dns.SOA{
+		Hdr: hdr(apex, dns.TypeSOA), Ns: "invalid.", Mbox: "invalid.",
+		Serial: serial, Refresh: 3600, Retry: 600, Expire: 2419200,
+	}
+	z := &zoneData{origin: origin, soa: soa, rrs: make(map[string][]dns.RR)}
+	z.rrs[origin] = []dns.RR{soa, &dns.NS{Hdr: hdr(apex, dns.TypeNS), Ns: "invalid."}}
+	z.rrs["version."+origin] = []dns.RR{&dns.TXT{Hdr: hdr("version."+apex, dns.TypeTXT), Txt: []string{catalogVersion}}}
+	for _, member := range members {
+		sum := sha256.Sum256([]byte(member))
+		owner := hex.EncodeToString(sum[:8]) + ".zones." + origin
+		z.rrs[owner] = []dns.RR{&dns.PTR{Hdr: hdr(owner+".", dns.TypePTR), Ptr: dns.Fqdn(member)}}
+	}
+	return z
+}
+
+func sameMembers(listed map[string]bool, members []string) bool {
+	if len(listed) != len(members) {
+		return false
+	}
+	for _, member := range members {
+		if !listed[member] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package godns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const checkUsage = `Usage: godns check [flags]
+
+Checks the configuration and every file it refers to (hosts files, the
+hosts directory, zone files) without starting the server, printing each
+problem with its file and line. Exits non-zero if anything is wrong, so it
+can guard a restart:
+
+  godns check -config /etc/godns/godns.yaml && systemctl restart godns
+
+Flags are the same as the server's.
+
+Flags:
+`
+
+func checkCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"_CONFIG"), "Path to a YAML configuration file (env GODNS_CONFIG)")
+	cfg.registerFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), checkUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := loadConfig(cfg, fs, *configPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configuration:", err)
+		return 1
+	}
+
+	var problems []string
+	if err := cfg.validate(); err != nil {
+		problems = append(problems, configProblem(*configPath, err))
+	}
+	s := newServer(cfg)
+	recordFiles, hostsProblems := s.checkHostsFiles()
+	problems = append(problems, hostsProblems...)
+	zoneFiles, zoneProblems := s.checkZones()
+	problems = append(problems, zoneProblems...)
+	if _, err := s.loadViews(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	problems = append(problems, s.checkTenants()...)
+	if loaded, err := s.loadPlugins(cfg.Plugins, 1); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		closePlugins(loaded)
+	}
+	problems = append(problems, s.checkEndpoints()...)
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Printf("Configuration OK: %d record file(s), %d zone file(s)\n", recordFiles, zoneFiles)
+	return 0
+}
+
+func configProblem(path string, err error) string {
+	if path == "" {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s: %v", path, err)
+}
+
+// checkHostsFiles parses every record file and reports names that do not
+// map to an IP address, which the server would only notice when queried.
+func (s *Server) checkHostsFiles() (int, []string) {
+	sources, err := s.hostsSources()
+	if err != nil {
+		return 0, []string{err.Error()}
+	}
+	var problems []string
+	for _, path := range sources {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		records, _, err := parseHosts(data, path, s.cfg.LocalTTL)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if _, ok := hostsJSON(data); ok {
+			// JSON files are checked as they are loaded, with positions.
+			problems = append(problems, hostsProblems(data, path)...)
+			continue
+		}
+		hosts := make([]string, 0, len(records))
+		for host := range records {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			if _, ok := normalizeRecordHost(host); !ok {
+				problems = append(problems, fmt.Sprintf("%s:%d: invalid host name %q", path, keyLine(data, host), host))
+			}
+			if problem := checkRecordValue(records[host]); problem != "" {
+				problems = append(problems, fmt.Sprintf("%s:%d: %s: %s", path, keyLine(data, host), host, problem))
+			}
+		}
+	}
+	return len(sources), problems
+}
+
+// keyLine returns the line of the first mention of a host name in a hosts
+// file, which is where its record is defined.
+func keyLine(data []byte, host string) int {
+	i := bytes.Index(bytes.ToLower(data), []byte(host))
+	if i < 0 {
+		return 0
+	}
+	line, _ := position(data, i)
+	return line
+}
+
+// checkZones loads every zone file and checks the inline zone records.
+func (s *Server) checkZones() (int, []string) {
+	var problems []string
+	files := 0
+	for _, zone := range s.cfg.Zones {
+		if zone.File != "" {
+			files++
+			if _, err := loadZoneFile(zone.Name, zone.File); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		names := make([]string, 0, len(zone.Records))
+		for name := range zone.Records {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, err := expandRecord(zone.Records[name])
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("zones: %s: record %s: %v", zone.Name, name, err))
+			} else if problem := checkRecordValue(value); problem != "" {
+				problems = append(problems, fmt.Sprintf("zones: %s: record %s: %s", zone.Name, name, problem))
+			}
+		}
+	}
+	gitFiles, err := s.gitZoneFiles()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, path := range gitFiles {
+		files++
+		if _, err := loadZoneFile(gitZoneName(path), path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return files, problems
+}
+
+// checkTenants loads the records of every tenant.
+func (s *Server) checkTenants() []string {
+	var problems []string
+	for _, tc := range s.cfg.Tenants {
+		t := &tenant{srv: s, TenantConfig: tc}
+		if err := t.load(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// checkEndpoints checks the URLs and addresses of the remote source,
+// syslog, the audit log and webhooks without connecting to them, and the
+// certificate of the DNS over TLS listener.
+func (s *Server) checkEndpoints() []string {
+	var problems []string
+	if s.cfg.TLS.Listen != "" && s.cfg.TLS.CertFile != "" && s.cfg.TLS.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("tls: %v", err))
+		}
+	}
+	if s.cfg.Remote.URL != "" {
+		if err := checkHTTPURL(s.cfg.Remote.URL); err != nil {
+			problems = append(problems, fmt.Sprintf("remote.url: %v", err))
+		}
+		if _, err := s.newRemoteSource(s.cfg.Remote.URL, s.cfg.Remote.AuthHeader, s.cfg.Remote.Timeout); err != nil {
+			problems = append(problems, fmt.Sprintf("remote.auth_header: %v", err))
+		}
+	}
+	if s.cfg.Logging.Syslog != "" {
+		if _, err := parseSyslogTarget(s.cfg.Logging.Syslog, s.cfg.Logging.SyslogFacility); err != nil {
+			problems = append(problems, fmt.Sprintf("logging.syslog: %v", err))
+		}
+	}
+	if s.cfg.Logging.AuditLog != "" {
+		if info, err := os.Stat(filepath.Dir(s.cfg.Logging.AuditLog)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("logging.audit_log: directory of %s does not exist", s.cfg.Logging.AuditLog))
+		}
+	}
+	for i, hook := range s.cfg.Webhooks {
+		if err := checkHTTPURL(hook); err != nil {
+			problems = append(problems, fmt.Sprintf("webhooks[%d]: %v", i, err))
+		}
+	}
+	return problems
+}
+
+func checkHTTPURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package godns
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const checkServerUsage = `Usage: godns check-server [flags] <addr>
+
+Sends a battery of protocol-conformance probes to the DNS server at addr
+(host or host:port) and reports the ones it fails: EDNS handling,
+truncation and TCP fallback, unknown query types and opcodes, case
+preservation and malformed packets. Exits non-zero if any probe fails, so
+it can check an instance after an upgrade:
+
+  godns check-server 127.0.0.1:53
+
+The probes ask for -name, which any answer satisfies, including NXDOMAIN.
+
+Flags:
+`
+
+// serverProbe is one check of check-server. It returns why the server
+// failed it, or "" if it passed.
+type serverProbe struct {
+	name string
+	run  func(p *prober) string
+}
+
+var serverProbes = []serverProbe{
+	{"basic query over UDP", probeBasic("udp")},
+	{"basic query over TCP", probeBasic("tcp")},
+	{"case preservation", probeCase},
+	{"unknown query type", probeUnknownType},
+	{"unknown opcode", probeUnknownOpcode},
+	{"EDNS", probeEDNS},
+	{"EDNS version", probeEDNSVersion},
+	{"unknown EDNS option", probeEDNSOption},
+	{"UDP size without EDNS", probeTruncation},
+	{"short packet", probeMalformed("short", []byte{0x12, 0x34, 0x01})},
+	{"truncated question", probeMalformed("truncated", []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a',
+	})},
+	{"compression loop", probeMalformed("looping", []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01,
+	})},
+}
+
+type prober struct {
+	addr    string
+	name    string
+	timeout time.Duration
+}
+
+func checkServerCommand(args []string) int {
+	fs := flag.NewFlagSet("check-server", flag.ContinueOnError)
+	name := fs.String("name", "example.com", "Name the probes ask for")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), checkServerUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	addr := fs.Arg(0)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	p := &prober{addr: addr, name: dns.Fqdn(*name), timeout: *timeout}
+	failed := 0
+	for _, probe := range serverProbes {
+		if problem := probe.run(p); problem != "" {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", probe.name, problem)
+		} else {
+			fmt.Printf("ok   %s\n", probe.name)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d probe(s) failed\n", failed, len(serverProbes))
+		return 1
+	}
+	fmt.Printf("All %d probes passed\n", len(serverProbes))
+	return 0
+}
+
+func (p *prober) query(qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(p.name, qtype)
+	return m
+}
+
+// exchange sends m and checks the generic properties of the response: it
+// answers m and echoes its question.
+func (p *prober) exchange(m *dns.Msg, network string) (*dns.Msg, string) {
+	client := &dns.Client{Net: network, Timeout: p.timeout, UDPSize: dns.MaxMsgSize}
+	r, _, err := client.Exchange(m, p.addr)
+	if err != nil {
+		return nil, err.Error()
+	}
+	switch {
+	case !r.Response:
+		return r, "response does not have the QR bit set"
+	case r.Opcode != m.Opcode:
+		return r, fmt.Sprintf("response has opcode %s, want %s", dns.OpcodeToString[r.Opcode], dns.OpcodeToString[m.Opcode])
+	case r.RecursionDesired != m.RecursionDesired:
+		return r, "response does not copy the RD bit"
+	case r.Rcode == dns.RcodeNotImplemented || r.Rcode == dns.RcodeFormatError:
+		return r, "got " + dns.RcodeToString[r.Rcode]
+	}
+	if len(m.Question) > 0 {
+		if len(r.Question) != 1 {
+			return r, fmt.Sprintf("response has %d questions, want 1", len(r.Question))
+		}
+		if got, want := r.Question[0], m.Question[0]; got != want {
+			return r, fmt.Sprintf("response question is %s %s, want %s %s", got.Name, dns.Type(got.Qtype), want.Name, dns.Type(want.Qtype))
+		}
+	}
+	return r, ""
+}
+
+// alive checks that the server still answers after a probe.
+func (p *prober) alive() string {
+	if _, problem := p.exchange(p.query(dns.TypeA), "udp"); problem != "" {
+		return "server stopped answering: " + problem
+	}
+	return ""
+}
+
+func probeBasic(network string) func(p *prober) string {
+	return func(p *prober) string {
+		r, problem := p.exchange(p.query(dns.TypeA), network)
+		if problem == "" && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			problem = "got " + dns.RcodeToString[r.Rcode]
+		}
+		return problem
+	}
+}
+
+func probeCase(p *prober) string {
+	m := p.query(dns.TypeA)
+	name := []byte(p.name)
+	for i := range name {
+		if i%2 == 0 {
+			name[i] = bytes.ToUpper(name[i : i+1])[0]
+		}
+	}
+	m.Question[0].Name = string(name)
+	_, problem := p.exchange(m, "udp")
+	return problem
+}
+
+func probeUnknownType(p *prober) string {
+	r, problem := p.exchange(p.query(65280), "udp")
+	if problem == "" && r.Rcode == dns.RcodeServerFailure {
+		problem = "got SERVFAIL"
+	}
+	return problem
+}
+
+func probeUnknownOpcode(p *prober) string {
+	m := p.query(dns.TypeA)
+	m.Opcode = 3 // unassigned
+	client := &dns.Client{Timeout: p.timeout}
+	r, _, err := client.Exchange(m, p.addr)
+	switch {
+	case err != nil:
+		return err.Error()
+	case r.Rcode != dns.RcodeNotImplemented:
+		return fmt.Sprintf("got %s, want NOTIMP", dns.RcodeToString[r.Rcode])
+	}
+	return ""
+}
+
+func probeEDNS(p *prober) string {
+	m := p.query(dns.TypeA)
+	m.SetEdns0(1232, false)
+	r, problem := p.exchange(m, "udp")
+	if problem != "" {
+		return problem
+	}
+	if r.IsEdns0() == nil {
+		return "response to an EDNS query has no OPT record"
+	}
+	return ""
+}
+
+func probeEDNSVersion(p *prober) string {
+	m := p.query(dns.TypeA)
+	m.SetEdns0(1232, false)
+	m.IsEdns0().SetVersion(1)
+	client := &dns.Client{Timeout: p.timeout}
+	r, _, err := client.Exchange(m, p.addr)
+	if err != nil {
+		return err.Error()
+	}
+	opt := r.IsEdns0()
+	switch {
+	case opt == nil:
+		return "response to an EDNS version 1 query has no OPT record"
+	case r.Rcode != dns.RcodeBadVers:
+		return fmt.Sprintf("got %s, want BADVERS", dns.RcodeToString[r.Rcode])
+	case opt.Version() != 0:
+		return fmt.Sprintf("response has EDNS version %d, want 0", opt.Version())
+	}
+	return ""
+}
+
+func probeEDNSOption(p *prober) string {
+	m := p.query(dns.TypeA)
+	m.SetEdns0(1232, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}})
+	_, problem := p.exchange(m, "udp")
+	return problem
+}
+
+// probeTruncation asks for every record type of the name without EDNS: a
+// response larger than 512 bytes must be truncated, and then the full
+// answer must be available over TCP.
+func probeTruncation(p *prober) string {
+	m := p.query(dns.TypeANY)
+	conn, err := net.DialTimeout("udp", p.addr, p.timeout)
+	if err != nil {
+		return err.Error()
+	}
+	defer conn.Close()
+	data, err := m.Pack()
+	if err != nil {
+		return err.Error()
+	}
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	if _, err := conn.Write(data); err != nil {
+		return err.Error()
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err.Error()
+	}
+	if n > dns.MinMsgSize {
+		return fmt.Sprintf("%d byte UDP response to a query without EDNS, limit is %d", n, dns.MinMsgSize)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(buf[:n]); err != nil {
+		return fmt.Sprintf("unpacking response: %v", err)
+	}
+	if !r.Truncated {
+		return ""
+	}
+	full, problem := p.exchange(m, "tcp")
+	switch {
+	case problem != "":
+		return "retrying truncated response over TCP: " + problem
+	case full.Truncated:
+		return "TCP response has the TC bit set"
+	}
+	return ""
+}
+
+// probeMalformed sends a packet that does not parse. The server may answer
+// FORMERR or nothing, but must keep serving.
+func probeMalformed(what string, packet []byte) func(p *prober) string {
+	return func(p *prober) string {
+		conn, err := net.DialTimeout("udp", p.addr, p.timeout)
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+		if _, err := conn.Write(packet); err != nil {
+			return err.Error()
+		}
+		conn.SetReadDeadline(time.Now().Add(p.timeout / 2))
+		buf := make([]byte, dns.MaxMsgSize)
+		if n, err := conn.Read(buf); err == nil {
+			// Only the header of a response is of interest; the rest may
+			// echo the malformed question.
+			if n < 12 {
+				return fmt.Sprintf("%d byte response to a %s packet", n, what)
+			}
+			if rcode := int(buf[3] & 0xF); rcode != dns.RcodeFormatError {
+				return fmt.Sprintf("got %s to a %s packet, want FORMERR or no response", dns.RcodeToString[rcode], what)
+			}
+		}
+		return p.alive()
+	}
+}
@@ -0,0 +1,250 @@
+package godns
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// subcommands run instead of the DNS server when named as the first
+// argument, e.g. "godns record list". They return the exit status.
+var subcommands = map[string]func(args []string) int{
+	"record":       recordCommand,
+	"check":        checkCommand,
+	"check-server": checkServerCommand,
+	"import":       importCommand,
+	"service":      serviceCommand,
+	"update":       updateCommand,
+	"history":      historyCommand,
+}
+
+const recordUsage = `Usage: godns record [flags] <command>
+
+Commands:
+  list              List the live records
+  get <host>        Print the IP of host
+  add <host> <ip>   Add or change a record in the hosts file
+  remove <host>     Remove a record from the hosts file
+
+Records are managed through the admin API of a running instance, found
+from the configuration's admin address and token unless -server and
+-token are given. With -direct the hosts file is edited in place instead;
+a running instance picks the change up on its next reload.
+
+Flags:
+`
+
+func recordCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"_CONFIG"), "Path to a YAML configuration file (env GODNS_CONFIG)")
+	server := fs.String("server", "", "Admin API URL of the running instance, e.g. http://127.0.0.1:8053")
+	direct := fs.Bool("direct", false, "Edit the hosts file directly instead of using a running instance")
+	fs.StringVar(&cfg.Admin.Token, "token", cfg.Admin.Token, "Admin API token (env GODNS_ADMIN_TOKEN)")
+	fs.StringVar(&cfg.HostsFile, "hosts", cfg.HostsFile, "Path to the hosts JSON file edited with -direct")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), recordUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := loadConfig(cfg, fs, *configPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configuration:", err)
+		return 1
+	}
+
+	var store Store = FileStore{Config: cfg}
+	if !*direct {
+		base := *server
+		if base == "" {
+			base = adminURL(cfg.Admin.Listen)
+		}
+		if base == "" {
+			fmt.Fprintln(os.Stderr, "Error: no admin address configured; use -server or -direct")
+			return 1
+		}
+		store = &APIStore{URL: strings.TrimSuffix(base, "/"), Token: cfg.Admin.Token}
+	}
+
+	cmd := fs.Args()
+	if len(cmd) == 0 {
+		fs.Usage()
+		return 2
+	}
+	var err error
+	switch {
+	case cmd[0] == "list" && len(cmd) == 1:
+		var list []Record
+		if list, err = store.List(); err == nil {
+			for _, r := range list {
+				fmt.Printf("%s %s\n", r.Host, r.IP)
+			}
+		}
+	case cmd[0] == "get" && len(cmd) == 2:
+		host, ok := normalizeRecordHost(cmd[1])
+		if !ok {
+			err = fmt.Errorf("invalid host name %q", cmd[1])
+			break
+		}
+		var ip string
+		if ip, err = store.Get(host); err == nil {
+			fmt.Println(ip)
+		}
+	case cmd[0] == "add" && len(cmd) == 3:
+		host, ok := normalizeRecordHost(cmd[1])
+		switch {
+		case !ok:
+			err = fmt.Errorf("invalid host name %q", cmd[1])
+		case net.ParseIP(cmd[2]) == nil:
+			err = fmt.Errorf("invalid IP address %q", cmd[2])
+		default:
+			err = store.Set(host, cmd[2])
+		}
+	case cmd[0] == "remove" && len(cmd) == 2:
+		host, ok := normalizeRecordHost(cmd[1])
+		if !ok {
+			err = fmt.Errorf("invalid host name %q", cmd[1])
+		} else {
+			err = store.Remove(host)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// adminURL turns the admin listen address into a URL to reach it locally.
+func adminURL(listen string) string {
+	if listen == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// FileStore edits the hosts file of Config directly, or of the default
+// configuration if Config is nil; a running instance picks changes up on
+// its next reload.
+type FileStore struct {
+	Config *Config
+}
+
+func (f FileStore) config() *Config {
+	if f.Config == nil {
+		return DefaultConfig()
+	}
+	return f.Config
+}
+
+func (f FileStore) List() ([]Record, error) {
+	records, _, err := newServer(f.config()).loadHosts()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Record, 0, len(records))
+	for host, ip := range records {
+		list = append(list, Record{Host: host, IP: ip})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list, nil
+}
+
+func (f FileStore) Get(host string) (string, error) {
+	records, _, err := newServer(f.config()).loadHosts()
+	if err != nil {
+		return "", err
+	}
+	ip, ok := records[host]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", host, errRecordNotFound)
+	}
+	return ip, nil
+}
+
+func (f FileStore) Set(host, ip string) error {
+	return editHostsFile(f.config().HostsFile, host, ip)
+}
+
+func (f FileStore) Remove(host string) error {
+	return editHostsFile(f.config().HostsFile, host, "")
+}
+
+// APIStore manages records through the /records admin API of a running
+// instance.
+type APIStore struct {
+	// URL is the base URL of the admin endpoints, e.g.
+	// http://127.0.0.1:8053.
+	URL   string
+	Token string
+}
+
+func (s *APIStore) List() ([]Record, error) {
+	var list []Record
+	err := s.do(http.MethodGet, "/records", nil, &list)
+	return list, err
+}
+
+func (s *APIStore) Get(host string) (string, error) {
+	var r Record
+	err := s.do(http.MethodGet, "/records/"+url.PathEscape(host), nil, &r)
+	return r.IP, err
+}
+
+func (s *APIStore) Set(host, ip string) error {
+	body, err := json.Marshal(Record{Host: host, IP: ip})
+	if err != nil {
+		return err
+	}
+	return s.do(http.MethodPut, "/records/"+url.PathEscape(host), body, nil)
+}
+
+func (s *APIStore) Remove(host string) error {
+	return s.do(http.MethodDelete, "/records/"+url.PathEscape(host), nil, nil)
+}
+
+func (s *APIStore) do(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
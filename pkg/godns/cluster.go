@@ -0,0 +1,192 @@
+package godns
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A cluster is a primary whose live records and blocklists are replicated
+// by followers. A follower pulls the primary's /cluster/records like a
+// remote source, every interval and whenever the primary posts to its
+// /cluster/sync after a change. Instances of a cluster share the admin
+// token.
+
+func init() {
+	handleAdmin("/cluster/records", func(s *Server) http.HandlerFunc { return s.requireToken(s.clusterRecordsHandler) })
+	handleAdmin("/cluster/sync", func(s *Server) http.HandlerFunc { return s.requireToken(s.clusterSyncHandler) })
+}
+
+// clusterRecords is what followers replicate: the live records as a v2
+// hosts file, typed records and tags included, with the blocked domains of
+// every blocklist alongside.
+type clusterRecords struct {
+	Version    int                     `json:"version"`
+	Records    map[string][]hostsEntry `json:"records"`
+	Blocklists map[string][]string     `json:"blocklists"`
+}
+
+// newClusterRecords returns the live records and blocked domains.
+func (s *Server) newClusterRecords() clusterRecords {
+	c := clusterRecords{Version: 2, Records: make(map[string][]hostsEntry), Blocklists: make(map[string][]string)}
+	set := s.liveRecords.Load()
+	if set == nil {
+		set = &recordSet{}
+	}
+	for host, value := range set.records {
+		c.Records[host] = []hostsEntry{{Value: value}}
+	}
+	if set.typed != nil {
+		for host, rrs := range set.typed.rrs {
+			for _, rr := range rrs {
+				ttl := rr.Header().Ttl
+				c.Records[host] = append(c.Records[host], hostsEntry{
+					Type:  dns.TypeToString[rr.Header().Rrtype],
+					TTL:   &ttl,
+					Value: strings.TrimPrefix(rr.String(), rr.Header().String()),
+				})
+			}
+		}
+		for host, tags := range set.typed.tags {
+			if entries := c.Records[host]; len(entries) > 0 {
+				entries[0].Tags = tags
+			}
+		}
+	}
+	if blocks := s.liveBlocks.Load(); blocks != nil {
+		for domain, source := range blocks.rules {
+			c.Blocklists[source] = append(c.Blocklists[source], domain)
+		}
+		for _, domains := range c.Blocklists {
+			sort.Strings(domains)
+		}
+	}
+	return c
+}
+
+// applyClusterBlocklists replaces the blocked domains with those of the
+// primary's records data, on a follower.
+func (s *Server) applyClusterBlocklists(data []byte) error {
+	var c clusterRecords
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	if c.Blocklists == nil {
+		// A primary that does not replicate its blocklists.
+		return nil
+	}
+	sources := make([]string, 0, len(c.Blocklists))
+	for source := range c.Blocklists {
+		sources = append(sources, source)
+	}
+	// Lists are sorted so that a domain on several is always kept with
+	// the same one.
+	sort.Strings(sources)
+	next := &blockSet{rules: make(map[string]string)}
+	for _, source := range sources {
+		for _, domain := range c.Blocklists[source] {
+			if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+				return fmt.Errorf("blocklist %s: invalid domain %q", source, domain)
+			}
+			next.add(strings.ToLower(strings.TrimSuffix(domain, ".")), source)
+		}
+	}
+	s.setBlocks(next)
+	s.logMessage(fmt.Sprintf("Loaded %d blocked domains from %d blocklists of primary %s", len(next.rules), len(sources), s.cfg.Cluster.Primary))
+	return nil
+}
+
+// clusterRecordsHandler serves the live records and blocked domains, with
+// an ETag so followers only transfer changed sets.
+func (s *Server) clusterRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.Marshal(s.newClusterRecords())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// clusterSyncHandler fetches the primary's records now, on a follower.
+func (s *Server) clusterSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.clusterSource == nil {
+		http.Error(w, "not a cluster follower", http.StatusConflict)
+		return
+	}
+	if err := s.syncFromPrimary(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startClusterFollower fetches the primary's records before the first
+// load of the record set and keeps them current in the background.
+func (s *Server) startClusterFollower() error {
+	source, err := s.newRemoteSource(strings.TrimSuffix(s.cfg.Cluster.Primary, "/")+"/cluster/records", "Authorization: Bearer "+s.cfg.Admin.Token, s.cfg.Cluster.Timeout)
+	if err != nil {
+		return err
+	}
+	source.apply = s.applyClusterBlocklists
+	s.clusterSource = source
+	if _, err := s.clusterSource.fetch(); err != nil {
+		s.notify(eventRemoteFetchFailed, fmt.Sprintf("fetching records from primary %s failed: %v", s.cfg.Cluster.Primary, err))
+	}
+	s.goBackground(func() { s.clusterSource.refresh(s.cfg.Cluster.Interval) })
+	return nil
+}
+
+func (s *Server) syncFromPrimary() error {
+	changed, err := s.clusterSource.fetch()
+	if err != nil {
+		return err
+	}
+	if changed {
+		return s.reloadHosts("cluster:" + s.cfg.Cluster.Primary)
+	}
+	return nil
+}
+
+// notifyFollowers asks every follower to sync, in the background. Those
+// it cannot reach catch up at their next interval.
+func (s *Server) notifyFollowers() {
+	for _, follower := range s.cfg.Cluster.Followers {
+		go func(url string) {
+			req, err := http.NewRequest(http.MethodPost, url, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+s.cfg.Admin.Token)
+			client := &http.Client{Timeout: s.cfg.Cluster.Timeout}
+			resp, err := client.Do(req)
+			if err != nil {
+				s.logMessage(fmt.Sprintf("Error notifying follower %s: %v", url, err))
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				s.logMessage(fmt.Sprintf("Error notifying follower %s: %s", url, resp.Status))
+			}
+		}(strings.TrimSuffix(follower, "/") + "/cluster/sync")
+	}
+}
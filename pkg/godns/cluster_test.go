@@ -0,0 +1,76 @@
+package godns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClusterReplication(t *testing.T) {
+	s := newTestServer()
+
+	records, typed, err := parseHosts([]byte(`{
+    "version": 2,
+    "records": {
+        "nas.lan": {"value": "192.168.1.10", "tags": ["storage"]},
+        "web.lan": {"values": ["10.0.0.1", "10.0.0.2"], "tags": ["web"]},
+        "example.lan": [
+            {"type": "MX", "ttl": 300, "value": "10 mail.example.lan."},
+            {"type": "TXT", "value": "v=spf1 -all"}
+        ]
+    }
+}`), "hosts.json", s.cfg.LocalTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setRecords(records, typed, nil)
+	blocks := &blockSet{rules: make(map[string]string)}
+	blocks.add("ads.example.com", "ads.txt")
+	blocks.add("tracker.example.net", "trackers.txt")
+	s.setBlocks(blocks)
+
+	primary := httptest.NewServer(http.HandlerFunc(s.clusterRecordsHandler))
+	defer primary.Close()
+	source, err := s.newRemoteSource(primary.URL, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.apply = func(data []byte) error {
+		// The follower starts without the primary's blocked domains.
+		s.liveBlocks.Store(nil)
+		return s.applyClusterBlocklists(data)
+	}
+
+	if changed, err := source.fetch(); err != nil || !changed {
+		t.Fatalf("fetch: %t, %v", changed, err)
+	}
+	got, gotTyped, _ := source.typedRecords()
+	if got["nas.lan"] != "192.168.1.10" || len(got) != 1 {
+		t.Errorf("records: got %v", got)
+	}
+	for host, want := range typed.rrs {
+		if len(gotTyped.rrs[host]) != len(want) {
+			t.Fatalf("%s: got %v, want %v", host, gotTyped.rrs[host], want)
+		}
+		for i, rr := range gotTyped.rrs[host] {
+			if !dns.IsDuplicate(rr, want[i]) || rr.Header().Ttl != want[i].Header().Ttl {
+				t.Errorf("%s: got %v, want %v", host, rr, want[i])
+			}
+		}
+	}
+	if gotTyped.tags["nas.lan"][0] != "storage" || gotTyped.tags["web.lan"][0] != "web" {
+		t.Errorf("tags: got %v", gotTyped.tags)
+	}
+	for domain, list := range map[string]string{"ads.example.com": "ads.txt", "x.tracker.example.net": "trackers.txt"} {
+		if _, source, ok := s.blockingRule(domain); !ok || source != list {
+			t.Errorf("%s: blocked %t by %q, want %q", domain, ok, source, list)
+		}
+	}
+
+	if changed, err := source.fetch(); err != nil || changed {
+		t.Errorf("unchanged fetch: %t, %v", changed, err)
+	}
+}
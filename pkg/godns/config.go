@@ -0,0 +1,1390 @@
+package godns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "GODNS"
+
+// Config holds every tunable setting. Values come from the built-in
+// defaults, then the optional -config file, then GODNS_* environment
+// variables, then explicitly set flags.
+type Config struct {
+	// Listen is the list of addresses to serve DNS on, over UDP and TCP.
+	Listen stringList `yaml:"listen"`
+	// TLS serves DNS over TLS (RFC 7858) on an address of its own.
+	TLS TLSConfig `yaml:"tls"`
+	// Workers is the number of queries answered at the same time.
+	Workers int `yaml:"workers"`
+	// QueueSize is the number of queries that may wait for a worker.
+	QueueSize int `yaml:"queue_size"`
+	// Shards splits the UDP sockets, workers and queue into independent
+	// shards, one UDP socket per shard and listen address; 0 means one per
+	// CPU. More than one needs Linux.
+	Shards int `yaml:"shards"`
+	// MemoryLimit is the soft memory limit of the Go runtime, as
+	// GOMEMLIMIT; 0 leaves GOMEMLIMIT in effect.
+	MemoryLimit byteSize `yaml:"memory_limit"`
+	// MemoryBudget caps the estimated memory of the response cache, the
+	// query summary counters and the blocklists together; 0 leaves them
+	// unbounded by size.
+	MemoryBudget byteSize `yaml:"memory_budget"`
+	// MaxUDPSize caps the size of UDP queries read and of UDP responses,
+	// which are truncated to the smaller of it and the client's EDNS
+	// buffer size.
+	MaxUDPSize int `yaml:"max_udp_size"`
+	// SocketReceiveBuffer and SocketSendBuffer size the kernel buffers of
+	// the UDP listeners; 0 keeps the system default.
+	SocketReceiveBuffer byteSize `yaml:"socket_receive_buffer"`
+	SocketSendBuffer    byteSize `yaml:"socket_send_buffer"`
+	// QueryTimeout bounds the time from receiving a query to answering it,
+	// including waiting for a worker and every upstream tried, after
+	// which it is answered with SERVFAIL; 0 leaves it unbounded.
+	QueryTimeout time.Duration `yaml:"query_timeout"`
+	// Overload is what happens to queries that find the queue full: "drop"
+	// or "servfail".
+	Overload string `yaml:"overload"`
+	// Malformed is what happens to messages that cannot be parsed or do
+	// not have exactly one question: "formerr" answers FORMERR with their
+	// ID, "drop" ignores them.
+	Malformed string `yaml:"malformed"`
+	// ShedThreshold is the fraction of the queue from which queries of low
+	// priority, repeats of a query still pending and queries from clients
+	// outside ShedTrusted, are turned away as on overload; 0 disables
+	// shedding.
+	ShedThreshold float64 `yaml:"shed_threshold"`
+	// ShedTrusted lists the client networks whose queries are not shed
+	// before the queue is full; empty means private, loopback and
+	// link-local addresses.
+	ShedTrusted stringList `yaml:"shed_trusted"`
+	// ShutdownTimeout bounds how long a shutdown waits for the queries in
+	// flight and the pending log writes.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Daemon detaches godns from its terminal to run in the background.
+	Daemon bool `yaml:"daemon"`
+	// PIDFile is written with the process ID once the server has started.
+	PIDFile string `yaml:"pid_file"`
+	// User is the account godns switches to after binding its listeners.
+	User string `yaml:"user"`
+	// HostsFile is the JSON file mapping host names to IPs. Empty runs
+	// godns without it, e.g. as a caching or filtering forwarder only.
+	HostsFile string `yaml:"hosts_file"`
+	// GeoIPDatabase is a MaxMind DB file (.mmdb) record selectors by
+	// country and continent look clients up in.
+	GeoIPDatabase string `yaml:"geoip_database"`
+	// EtcHosts is an optional additional file in /etc/hosts format. Its
+	// records are overridden by HostsFile.
+	EtcHosts string `yaml:"etc_hosts"`
+	// ExtraHostsFiles are further record files loaded after HostsFile;
+	// later files override earlier ones.
+	ExtraHostsFiles stringList `yaml:"extra_hosts_files"`
+	// HostsDir is a directory whose *.json and *.hosts files are loaded
+	// last, in lexical order.
+	HostsDir string `yaml:"hosts_dir"`
+	// HistoryDir keeps a snapshot of the hosts file, the extra hosts files
+	// and the zone files after every record change, to list the changes
+	// and roll back to. Empty keeps no history.
+	HistoryDir string `yaml:"history_dir"`
+	// Remote optionally pulls records from an HTTP(S) URL.
+	Remote RemoteConfig `yaml:"remote"`
+	// Git optionally pulls record and zone files from a git repository.
+	Git GitConfig `yaml:"git"`
+	// Etcd optionally watches records stored under a key prefix in etcd.
+	Etcd EtcdConfig `yaml:"etcd"`
+	// Consul optionally serves the services and nodes of a Consul catalog.
+	Consul ConsulConfig `yaml:"consul"`
+	// Kubernetes optionally serves the Services and Ingresses of a cluster.
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	// Docker optionally registers records for running containers.
+	Docker DockerConfig `yaml:"docker"`
+	// Redis optionally serves records kept in Redis hashes.
+	Redis RedisConfig `yaml:"redis"`
+	// DHCP optionally serves records for the active leases of a DHCP server.
+	DHCP DHCPConfig `yaml:"dhcp"`
+	// Tailscale optionally serves records for the nodes of the tailnet.
+	Tailscale TailscaleConfig `yaml:"tailscale"`
+	// WireGuard optionally serves records for named WireGuard peers.
+	WireGuard WireGuardConfig `yaml:"wireguard"`
+	// Blocking answers the domains of blocklists locally.
+	Blocking BlockingConfig `yaml:"blocking"`
+	// MDNS optionally answers multicast DNS queries for .local names.
+	MDNS MDNSConfig `yaml:"mdns"`
+	// WatchHosts reloads the hosts file automatically when it changes.
+	WatchHosts bool `yaml:"watch_hosts"`
+	// StrictHosts refuses to load a JSON hosts file with invalid entries,
+	// instead of logging them.
+	StrictHosts bool `yaml:"strict_hosts"`
+	// SearchDomains are tried in order for single-label names, as a
+	// client's resolver would with its search list.
+	SearchDomains stringList `yaml:"search_domains"`
+	// SpecialUseZones answers localhost, invalid, onion and the reverse
+	// zones of private addresses locally.
+	SpecialUseZones bool `yaml:"special_use_zones"`
+	// AutoPTR answers reverse lookups of the addresses of local records
+	// with their host names.
+	AutoPTR bool `yaml:"auto_ptr"`
+	// LocalTTL is the TTL, in seconds, of answers built from local records.
+	LocalTTL uint32 `yaml:"local_ttl"`
+	// Zones are domains godns is authoritative for. Names inside a zone
+	// that have no record are answered with NXDOMAIN instead of forwarded.
+	Zones []ZoneConfig `yaml:"zones"`
+	// Upstreams are the resolvers queries are forwarded to, tried in order.
+	Upstreams stringList `yaml:"upstreams"`
+	// UpstreamTimeout bounds a single exchange with an upstream, or with
+	// an authoritative server in recursive mode.
+	UpstreamTimeout time.Duration `yaml:"upstream_timeout"`
+	// Recursive resolves names from the root servers down instead of
+	// forwarding them to Upstreams. Forward zones are still forwarded.
+	Recursive bool `yaml:"recursive"`
+	// RootHints replace the built-in root server addresses of recursive
+	// mode, e.g. with the servers of a private root.
+	RootHints stringList `yaml:"root_hints"`
+	// RootZone keeps a local copy of the root zone (RFC 8806).
+	RootZone RootZoneConfig `yaml:"root_zone"`
+	// Authoritative only answers names in Zones, refusing the rest
+	// instead of forwarding them.
+	Authoritative bool `yaml:"authoritative"`
+	// CacheSize is how many upstream answers are cached; 0 disables the
+	// cache.
+	CacheSize int `yaml:"cache_size"`
+	// Warmup lists files or HTTP(S) URLs of names to resolve into the
+	// cache at startup and after reloads.
+	Warmup stringList `yaml:"warmup"`
+	// ForwardZones send queries for names in a domain to their own
+	// resolvers instead of Upstreams (conditional forwarding).
+	ForwardZones []ForwardZone `yaml:"forward_zones"`
+
+	// TSIGKeys are the keys zone update and transfer policies refer to.
+	TSIGKeys []TSIGKey `yaml:"tsig_keys"`
+
+	// Cluster replicates the records of a primary instance to followers.
+	Cluster ClusterConfig `yaml:"cluster"`
+
+	// Tenants serve their own zones on their own listeners.
+	Tenants []TenantConfig `yaml:"tenants"`
+
+	// Rewrites change the answers of the upstreams.
+	Rewrites []RewriteRule `yaml:"rewrites"`
+
+	// Services are DNS-SD service instances, browsable through the PTR,
+	// SRV and TXT records generated for them.
+	Services []ServiceConfig `yaml:"services"`
+
+	// Failover groups answer with a backup address while the primary's
+	// health check fails.
+	Failover []FailoverGroup `yaml:"failover"`
+
+	// Views answer clients in their networks with their own records in
+	// place of the global ones of the same name.
+	Views []ViewConfig `yaml:"views"`
+
+	// Hooks are scripts run at fixed points of every query.
+	Hooks HooksConfig `yaml:"hooks"`
+	// Plugins are WebAssembly modules run before the lookup and on the
+	// response, in order.
+	Plugins stringList `yaml:"plugins"`
+	// PluginTimeout bounds a single plugin call.
+	PluginTimeout time.Duration `yaml:"plugin_timeout"`
+
+	Admin    AdminConfig   `yaml:"admin"`
+	Logging  LoggingConfig `yaml:"logging"`
+	StatsD   StatsDConfig  `yaml:"statsd"`
+	Webhooks stringList    `yaml:"webhooks"`
+}
+
+// ZoneConfig describes a local authoritative zone. Record names are
+// relative to the zone name; "@" stands for the zone apex. File optionally
+// names an RFC 1035 zone file with the zone's records.
+type ZoneConfig struct {
+	Name    string            `yaml:"name"`
+	File    string            `yaml:"file"`
+	Records map[string]string `yaml:"records"`
+	// Update is the RFC 2136 dynamic update policy of a zone file zone.
+	Update AccessPolicy `yaml:"update"`
+	// Transfer decides which secondaries may transfer a zone file or
+	// secondary zone.
+	Transfer AccessPolicy `yaml:"transfer"`
+	// Primary makes this a secondary zone transferred from the given
+	// server (host or host:port) instead of read from a file.
+	Primary string `yaml:"primary"`
+	// PrimaryKey names the TSIG key transfers from Primary are signed with.
+	PrimaryKey string `yaml:"primary_key"`
+	// Notify lists secondaries (host or host:port) sent a NOTIFY when the
+	// zone changes.
+	Notify []string `yaml:"notify"`
+	// Catalog marks an RFC 9432 catalog zone: consumed when it has a
+	// primary, otherwise generated from the zone file zones.
+	Catalog bool `yaml:"catalog"`
+}
+
+// ForwardZone forwards the queries for a domain and its subdomains to
+// dedicated resolvers, e.g. a corporate DNS server over a VPN.
+type ForwardZone struct {
+	Name string `yaml:"name"`
+	// Upstreams are tried in order like the default upstreams.
+	Upstreams []string `yaml:"upstreams"`
+}
+
+// RewriteRule changes upstream answers, e.g. to work around missing NAT
+// hairpinning or to send clients to a local mirror. A rule either maps
+// answer addresses (Address and To), resolves the names under a domain
+// under another one (Suffix and To) or strips records (Strip).
+type RewriteRule struct {
+	// Address is an address or network whose answer addresses become To,
+	// a single address or a network of the same size, keeping host bits.
+	Address string `yaml:"address"`
+	// Suffix is a domain whose names are resolved as the same names under
+	// the domain To, and answered for the names asked for.
+	Suffix string `yaml:"suffix"`
+	To     string `yaml:"to"`
+	// Strip are record types, e.g. AAAA or HTTPS, removed from answers for
+	// names in Domain, or from every answer when Domain is empty.
+	Strip  stringList `yaml:"strip"`
+	Domain string     `yaml:"domain"`
+}
+
+// ServiceConfig describes a DNS-SD service instance (RFC 6763), e.g. the
+// web interface of a NAS, as the records wide-area service browsing needs.
+type ServiceConfig struct {
+	// Name is the instance name shown to users, e.g. "NAS web".
+	Name string `yaml:"name"`
+	// Type is the service type and protocol, e.g. _http._tcp.
+	Type   string `yaml:"type"`
+	Domain string `yaml:"domain"`
+	// Host and Port are the target of the SRV record.
+	Host     string   `yaml:"host"`
+	Port     uint16   `yaml:"port"`
+	Priority uint16   `yaml:"priority"`
+	Weight   uint16   `yaml:"weight"`
+	TXT      []string `yaml:"txt"`
+}
+
+// FailoverGroup answers a name with Primary while its health check passes
+// and with Backup while it fails.
+type FailoverGroup struct {
+	Name    string `yaml:"name"`
+	Primary string `yaml:"primary"`
+	Backup  string `yaml:"backup"`
+	// Check is tcp://host:port, passing when a connection is accepted, or
+	// an http:// or https:// URL, passing on a 2xx or 3xx response.
+	Check    string        `yaml:"check"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Failures is the number of consecutive failed checks that switch to
+	// the backup, and of passed checks that switch back.
+	Failures int `yaml:"failures"`
+}
+
+// AccessPolicy decides who may update or transfer a zone. Requests are
+// refused unless Allow or Keys is set; when both are set a client must
+// match a network and sign with one of the keys.
+type AccessPolicy struct {
+	// Allow lists the client networks (CIDR) requests are accepted from.
+	Allow []string `yaml:"allow"`
+	// Keys lists the TSIG key names that may sign requests.
+	Keys []string `yaml:"keys"`
+}
+
+// TSIGKey is a shared secret used to authenticate updates and transfers.
+type TSIGKey struct {
+	Name string `yaml:"name"`
+	// Algorithm is hmac-sha256 (default), hmac-sha1, hmac-sha512 or
+	// hmac-md5.
+	Algorithm string `yaml:"algorithm"`
+	// Secret is the base64 encoded key, as generated by tsig-keygen.
+	Secret string `yaml:"secret"`
+}
+
+// RemoteConfig describes a records file (JSON or /etc/hosts format) fetched
+// over HTTP(S). Remote records have the lowest precedence, so local files
+// can override them.
+type RemoteConfig struct {
+	URL string `yaml:"url"`
+	// AuthHeader is sent with every request, e.g.
+	// "Authorization: Bearer <token>".
+	AuthHeader string        `yaml:"auth_header"`
+	Interval   time.Duration `yaml:"interval"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+// GitConfig keeps record and zone files in a branch of a git repository,
+// so that DNS changes go through its reviews. The branch is checked out in
+// Dir and pulled every Interval, or when the webhook is called.
+type GitConfig struct {
+	// Repository is the URL of the repository, as git clone takes it.
+	Repository string `yaml:"repository"`
+	Branch     string `yaml:"branch"`
+	// Path is the directory within the repository of the *.json and
+	// *.hosts record files and the <zone>.zone zone files.
+	Path string `yaml:"path"`
+	// Dir is where the repository is checked out.
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// WebhookSecret authenticates pushes to the sync endpoint signed by
+	// GitHub or carrying a GitLab token, besides the admin token.
+	WebhookSecret string `yaml:"webhook_secret"`
+}
+
+// ClusterConfig makes an instance a follower replicating the live records
+// of a primary, or a primary notifying its followers of changes. Members
+// authenticate with the shared admin token.
+type ClusterConfig struct {
+	// Primary is the admin URL of the instance to replicate.
+	Primary string `yaml:"primary"`
+	// Followers are the admin URLs of the instances to notify.
+	Followers stringList    `yaml:"followers"`
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// TenantConfig describes a tenant: the zones it owns, the addresses it
+// serves them on and the token it manages its records with. Names outside
+// its zones are forwarded to the upstreams.
+type TenantConfig struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	// Listen is the list of addresses only this tenant's zones are served
+	// on, over UDP and TCP.
+	Listen stringList `yaml:"listen"`
+	// HostsFile is the tenant's JSON hosts file, edited through
+	// /tenants/<name>/records.
+	HostsFile string       `yaml:"hosts_file"`
+	Zones     []ZoneConfig `yaml:"zones"`
+}
+
+// ViewConfig describes a split-horizon view: the client networks it
+// answers and the records they see instead of the global ones. Names the
+// view does not define resolve as for every other client.
+type ViewConfig struct {
+	Name    string     `yaml:"name"`
+	Clients stringList `yaml:"clients"`
+	// HostsFile is a hosts file, JSON or /etc/hosts style, loaded before
+	// the inline records.
+	HostsFile string            `yaml:"hosts_file"`
+	Records   map[string]string `yaml:"records"`
+}
+
+// TLSConfig is the DNS over TLS listener.
+type TLSConfig struct {
+	// Listen is the address to serve DNS over TLS on; empty disables it.
+	Listen string `yaml:"listen"`
+	// CertFile and KeyFile are the PEM certificate chain and private key
+	// it presents.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// HooksConfig holds the hook scripts, Lua chunks that can rewrite the query
+// name, answer with addresses or set the response code.
+type HooksConfig struct {
+	// OnQuery runs before the records are looked up.
+	OnQuery string `yaml:"on_query"`
+	// OnLocalMiss runs when no local record or zone has the name, before
+	// the query is forwarded.
+	OnLocalMiss string `yaml:"on_local_miss"`
+	// OnResponse runs once the response is built.
+	OnResponse string `yaml:"on_response"`
+}
+
+type AdminConfig struct {
+	// Listen is the admin HTTP address; empty disables the admin API.
+	Listen string `yaml:"listen"`
+	// Token is the bearer token required by the record API, which is
+	// disabled while it is empty.
+	Token string `yaml:"token"`
+	// GRPCListen is the address of the gRPC admin API; empty disables it.
+	GRPCListen string `yaml:"grpc_listen"`
+	// DebugListen is the loopback address of the pprof and expvar
+	// endpoints; empty disables them.
+	DebugListen   string `yaml:"debug_listen"`
+	CaptureDir    string `yaml:"capture_dir"`
+	RecentQueries int    `yaml:"recent_queries"`
+}
+
+type LoggingConfig struct {
+	File            string        `yaml:"file"`
+	QuerySample     float64       `yaml:"query_sample"`
+	SummaryInterval time.Duration `yaml:"summary_interval"`
+	Syslog          string        `yaml:"syslog"`
+	SyslogFacility  string        `yaml:"syslog_facility"`
+	AnonymizeIPs    string        `yaml:"anonymize_ips"`
+	AuditLog        string        `yaml:"audit_log"`
+}
+
+type StatsDConfig struct {
+	Address  string        `yaml:"address"`
+	Prefix   string        `yaml:"prefix"`
+	Tags     string        `yaml:"tags"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// EtcdConfig describes records kept in etcd as keys <Prefix><host name>
+// with the IP address as value.
+type EtcdConfig struct {
+	// Endpoints are the etcd client URLs, e.g. http://10.0.0.5:2379;
+	// empty disables the backend.
+	Endpoints stringList `yaml:"endpoints"`
+	Prefix    string     `yaml:"prefix"`
+	Username  string     `yaml:"username"`
+	Password  string     `yaml:"password"`
+}
+
+// ConsulConfig describes the Consul agent whose catalog is served under
+// Domain.
+type ConsulConfig struct {
+	// Address is the agent's HTTP API, e.g. http://127.0.0.1:8500; empty
+	// disables the backend.
+	Address    string `yaml:"address"`
+	Token      string `yaml:"token"`
+	Datacenter string `yaml:"datacenter"`
+	Domain     string `yaml:"domain"`
+}
+
+// KubernetesConfig describes the cluster whose Services (and optionally
+// Ingresses) are served as <service>.<namespace>.<Domain>.
+type KubernetesConfig struct {
+	// APIServer is the API URL, e.g. https://kubernetes.default.svc inside
+	// the cluster or http://127.0.0.1:8001 through kubectl proxy; empty
+	// disables the backend.
+	APIServer string `yaml:"api_server"`
+	// TokenFile and CAFile default to the pod's service account.
+	TokenFile string `yaml:"token_file"`
+	CAFile    string `yaml:"ca_file"`
+	// Namespace limits the backend to one namespace; empty watches all.
+	Namespace string `yaml:"namespace"`
+	Domain    string `yaml:"domain"`
+	Ingresses bool   `yaml:"ingresses"`
+}
+
+// DockerConfig describes the Docker daemon whose containers get records.
+type DockerConfig struct {
+	// Endpoint is the Docker API, unix:///var/run/docker.sock or
+	// tcp://host:2375; empty disables the backend.
+	Endpoint string `yaml:"endpoint"`
+	// Label holds a container's host names, comma separated.
+	Label string `yaml:"label"`
+	// Domain, when set, also gives every container <name>.<Domain>.
+	Domain string `yaml:"domain"`
+	// Network selects the network whose container address is used.
+	Network string `yaml:"network"`
+	// HostIP points all records at the Docker host instead, for containers
+	// reached through published ports.
+	HostIP string `yaml:"host_ip"`
+}
+
+// RedisConfig describes the Redis server holding one hash of records per
+// zone under <Prefix><zone>.
+type RedisConfig struct {
+	// Address is host:port; empty disables the backend.
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	Prefix   string `yaml:"prefix"`
+}
+
+// DHCPConfig points at the lease file of a DHCP server on this host.
+type DHCPConfig struct {
+	// Leases is the lease file; empty disables the backend.
+	Leases string `yaml:"leases"`
+	// Format is dnsmasq, isc or kea.
+	Format string `yaml:"format"`
+	// Domain is appended to lease host names.
+	Domain string `yaml:"domain"`
+}
+
+// TailscaleConfig enables records for the nodes of the tailnet, read from
+// the local tailscaled.
+type TailscaleConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Socket is tailscaled's local API socket.
+	Socket string `yaml:"socket"`
+	// Domain is appended to node names.
+	Domain string `yaml:"domain"`
+}
+
+// BlockingConfig blocks the domains of blocklists, and their subdomains,
+// e.g. to sinkhole the command and control domains of malware. Local
+// records are answered even when blocked.
+type BlockingConfig struct {
+	// Lists are files or HTTP(S) URLs with a domain per line, alone or in
+	// /etc/hosts format.
+	Lists stringList `yaml:"lists"`
+	// Sinkhole are the addresses blocked names are answered with; without
+	// one of the query's family the answer is empty, and without any the
+	// name does not exist.
+	Sinkhole stringList `yaml:"sinkhole"`
+	// LogHits logs every blocked query with its client and rule.
+	LogHits bool `yaml:"log_hits"`
+}
+
+// MDNSConfig enables a multicast DNS responder for the local records of
+// .local names, for devices that only resolve those over mDNS.
+type MDNSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interfaces are the network interfaces the mDNS groups are joined on;
+	// empty joins them on the system default interface.
+	Interfaces stringList `yaml:"interfaces"`
+	// Domain, when set, answers <name>.local with the record of
+	// <name>.<domain> too.
+	Domain string `yaml:"domain"`
+	// Bridge resolves .local names missing from the local records with an
+	// mDNS query on the LAN, waiting up to BridgeTimeout for an answer.
+	Bridge        bool          `yaml:"bridge"`
+	BridgeTimeout time.Duration `yaml:"bridge_timeout"`
+}
+
+// RootZoneConfig sets up the local copy of the root zone, which answers
+// names under nonexistent top-level domains and the root referrals of
+// recursive mode.
+type RootZoneConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Sources are the servers (host or host:port) the zone is transferred
+	// from, tried in order.
+	Sources stringList `yaml:"sources"`
+}
+
+// WireGuardConfig points at a wg-quick configuration whose named peers are
+// served.
+type WireGuardConfig struct {
+	// Config is the configuration file; empty disables the backend.
+	Config string `yaml:"config"`
+	// Domain is appended to peer names.
+	Domain string `yaml:"domain"`
+}
+
+// stringList is a list flag that accepts comma separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// DefaultConfig returns the configuration godns runs with when nothing is
+// set.
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:          stringList{":53"},
+		Workers:         512,
+		QueueSize:       2048,
+		Shards:          1,
+		MaxUDPSize:      dns.DefaultMsgSize,
+		Overload:        "drop",
+		Malformed:       "formerr",
+		ShutdownTimeout: 10 * time.Second,
+		HostsFile:       "hosts.json",
+		LocalTTL:        1,
+		AutoPTR:         true,
+		SpecialUseZones: true,
+		Upstreams:       stringList{defaultResolver},
+		UpstreamTimeout: 2 * time.Second,
+		PluginTimeout:   100 * time.Millisecond,
+		Remote: RemoteConfig{
+			Interval: 5 * time.Minute,
+			Timeout:  30 * time.Second,
+		},
+		Cluster: ClusterConfig{
+			Interval: time.Minute,
+			Timeout:  10 * time.Second,
+		},
+		Git: GitConfig{
+			Branch:   "main",
+			Interval: 5 * time.Minute,
+			Timeout:  time.Minute,
+		},
+		Etcd: EtcdConfig{
+			Prefix: "/godns/records/",
+		},
+		Consul: ConsulConfig{
+			Domain: "consul",
+		},
+		Kubernetes: KubernetesConfig{
+			Domain: "svc.cluster.local",
+		},
+		Docker: DockerConfig{
+			Label: "dns.name",
+		},
+		Redis: RedisConfig{
+			Prefix: "godns:zone:",
+		},
+		DHCP: DHCPConfig{
+			Format: "dnsmasq",
+			Domain: "lan",
+		},
+		MDNS: MDNSConfig{
+			BridgeTimeout: time.Second,
+		},
+		RootZone: RootZoneConfig{
+			Sources: append(stringList(nil), rootZoneSources...),
+		},
+		Tailscale: TailscaleConfig{
+			Socket: "/var/run/tailscale/tailscaled.sock",
+			Domain: "ts.lan",
+		},
+		WireGuard: WireGuardConfig{
+			Domain: "wg.lan",
+		},
+		Admin: AdminConfig{
+			CaptureDir:    os.TempDir(),
+			RecentQueries: 1000,
+		},
+		Logging: LoggingConfig{
+			QuerySample:    1,
+			SyslogFacility: "daemon",
+			AnonymizeIPs:   "none",
+		},
+		StatsD: StatsDConfig{
+			Prefix:   "godns.",
+			Interval: 10 * time.Second,
+		},
+	}
+}
+
+// registerFlags binds command line flags to the fields of cfg.
+func (cfg *Config) registerFlags(fs *flag.FlagSet) {
+	fs.Var(&cfg.Listen, "listen", "Comma separated addresses to serve DNS on (UDP and TCP)")
+	fs.StringVar(&cfg.TLS.Listen, "tls-listen", cfg.TLS.Listen, "Address to serve DNS over TLS on, e.g. :853 (disabled if empty)")
+	fs.StringVar(&cfg.TLS.CertFile, "tls-cert", cfg.TLS.CertFile, "PEM certificate chain of the DNS over TLS listener")
+	fs.StringVar(&cfg.TLS.KeyFile, "tls-key", cfg.TLS.KeyFile, "PEM private key of the DNS over TLS listener")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "Number of queries answered concurrently")
+	fs.IntVar(&cfg.QueueSize, "queue-size", cfg.QueueSize, "Number of queries waiting for a worker before new ones are turned away")
+	fs.IntVar(&cfg.Shards, "shards", cfg.Shards, "Number of independent socket and worker shards, 0 for one per CPU (Linux)")
+	fs.Var(&cfg.MemoryLimit, "memory-limit", "Soft memory limit of the Go runtime, e.g. 64MiB (default GOMEMLIMIT)")
+	fs.Var(&cfg.MemoryBudget, "memory-budget", "Memory shared by the response cache, the query summary and the blocklists, e.g. 32MiB (default unbounded)")
+	fs.IntVar(&cfg.MaxUDPSize, "max-udp-size", cfg.MaxUDPSize, "Largest UDP query read and UDP response sent, in bytes")
+	fs.Var(&cfg.SocketReceiveBuffer, "socket-rcvbuf", "Kernel receive buffer of the UDP listeners, e.g. 1MiB (default system)")
+	fs.Var(&cfg.SocketSendBuffer, "socket-sndbuf", "Kernel send buffer of the UDP listeners, e.g. 1MiB (default system)")
+	fs.DurationVar(&cfg.QueryTimeout, "query-timeout", cfg.QueryTimeout, "Longest time to answer a query before answering SERVFAIL, e.g. 3s (0 disables)")
+	fs.StringVar(&cfg.Overload, "overload", cfg.Overload, "What to do with queries when the queue is full: drop or servfail")
+	fs.StringVar(&cfg.Malformed, "malformed", cfg.Malformed, "What to do with unparsable queries and queries without exactly one question: formerr or drop")
+	fs.Float64Var(&cfg.ShedThreshold, "shed-threshold", cfg.ShedThreshold, "Fraction of the queue from which repeated and untrusted queries are turned away (0 disables)")
+	fs.Var(&cfg.ShedTrusted, "shed-trusted", "Comma separated networks whose queries are not shed (default private and loopback)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "How long SIGTERM waits for queries in flight and pending log writes")
+	fs.BoolVar(&cfg.Daemon, "daemon", cfg.Daemon, "Run in the background, detached from the terminal")
+	fs.StringVar(&cfg.PIDFile, "pidfile", cfg.PIDFile, "File the process ID is written to once the server has started")
+	fs.StringVar(&cfg.User, "user", cfg.User, "User to switch to after binding the listeners, e.g. nobody")
+	fs.StringVar(&cfg.HostsFile, "hosts", cfg.HostsFile, "Path to the hosts JSON file (none if empty)")
+	fs.StringVar(&cfg.GeoIPDatabase, "geoip", cfg.GeoIPDatabase, "MaxMind DB file (.mmdb) to locate clients in for country: and continent: record selectors")
+	fs.StringVar(&cfg.EtcHosts, "etc-hosts", cfg.EtcHosts, "Additional records file in /etc/hosts format, e.g. /etc/hosts")
+	fs.Var(&cfg.ExtraHostsFiles, "extra-hosts", "Comma separated additional records files, loaded after -hosts")
+	fs.StringVar(&cfg.HostsDir, "hosts-dir", cfg.HostsDir, "Directory of *.json and *.hosts records files, loaded last in lexical order")
+	fs.StringVar(&cfg.HistoryDir, "history-dir", cfg.HistoryDir, "Directory keeping a snapshot of the record files after every record change (disabled if empty)")
+	fs.Var(&cfg.Blocking.Lists, "blocklist", "Comma separated files or HTTP(S) URLs of domains to block")
+	fs.Var(&cfg.Blocking.Sinkhole, "sinkhole", "Comma separated addresses blocked names are answered with (NXDOMAIN if empty)")
+	fs.BoolVar(&cfg.Blocking.LogHits, "log-blocked", cfg.Blocking.LogHits, "Log every blocked query with its client and the rule it hit")
+	fs.BoolVar(&cfg.MDNS.Enabled, "mdns", cfg.MDNS.Enabled, "Answer multicast DNS queries for .local names from the local records")
+	fs.StringVar(&cfg.MDNS.Domain, "mdns-domain", cfg.MDNS.Domain, "Also answer <name>.local over mDNS with the record of <name>.<domain>")
+	fs.BoolVar(&cfg.MDNS.Bridge, "mdns-bridge", cfg.MDNS.Bridge, "Resolve unicast queries for .local names missing from the records with an mDNS query on the LAN")
+	fs.StringVar(&cfg.Remote.URL, "remote", cfg.Remote.URL, "HTTP(S) URL of a records file fetched periodically (disabled if empty)")
+	fs.DurationVar(&cfg.Remote.Interval, "remote-interval", cfg.Remote.Interval, "Interval between fetches of -remote")
+	fs.StringVar(&cfg.Git.Repository, "git", cfg.Git.Repository, "URL of a git repository of record and zone files pulled periodically (disabled if empty)")
+	fs.StringVar(&cfg.Git.Branch, "git-branch", cfg.Git.Branch, "Branch of -git to serve")
+	fs.StringVar(&cfg.Git.Path, "git-path", cfg.Git.Path, "Directory within -git of the record and zone files")
+	fs.StringVar(&cfg.Git.Dir, "git-dir", cfg.Git.Dir, "Directory -git is checked out in")
+	fs.DurationVar(&cfg.Git.Interval, "git-interval", cfg.Git.Interval, "Interval between pulls of -git")
+	fs.StringVar(&cfg.Cluster.Primary, "cluster-primary", cfg.Cluster.Primary, "Admin URL of the primary whose records this instance replicates (disabled if empty)")
+	fs.Var(&cfg.Cluster.Followers, "cluster-followers", "Comma separated admin URLs of followers told to sync when records change")
+	fs.DurationVar(&cfg.Cluster.Interval, "cluster-interval", cfg.Cluster.Interval, "Interval between syncs from -cluster-primary")
+	fs.BoolVar(&cfg.WatchHosts, "watch", cfg.WatchHosts, "Reload the hosts file automatically when it changes")
+	fs.BoolVar(&cfg.StrictHosts, "strict-hosts", cfg.StrictHosts, "Refuse to load hosts files with invalid entries, keeping the previous records")
+	fs.Var(&cfg.SearchDomains, "search", "Comma separated domains single-label names are tried in, e.g. home.lan")
+	fs.BoolVar(&cfg.SpecialUseZones, "special-use-zones", cfg.SpecialUseZones, "Answer localhost, invalid, onion and private reverse zones locally instead of forwarding them")
+	fs.BoolVar(&cfg.AutoPTR, "auto-ptr", cfg.AutoPTR, "Answer reverse lookups of record addresses with their host names")
+	fs.Var(&cfg.Upstreams, "upstream", "Comma separated upstream resolvers, tried in order; tls://host for DNS over TLS")
+	fs.DurationVar(&cfg.UpstreamTimeout, "upstream-timeout", cfg.UpstreamTimeout, "Timeout for a single upstream exchange")
+	fs.BoolVar(&cfg.Recursive, "recursive", cfg.Recursive, "Resolve names from the root servers instead of forwarding them to -upstream")
+	fs.Var(&cfg.RootHints, "root-hints", "Comma separated root server addresses for -recursive (built-in if empty)")
+	fs.BoolVar(&cfg.Authoritative, "authoritative", cfg.Authoritative, "Only answer names in the configured zones, with REFUSED for the rest, and never forward")
+	fs.BoolVar(&cfg.RootZone.Enabled, "root-zone", cfg.RootZone.Enabled, "Transfer the root zone and answer nonexistent top-level domains and root referrals from it")
+	fs.IntVar(&cfg.CacheSize, "cache-size", cfg.CacheSize, "Number of upstream answers to cache (0 disables the cache)")
+	fs.Var(&cfg.Warmup, "warmup", "Comma separated files or URLs of names to resolve into the cache at startup and after reloads")
+	fs.Var(&cfg.Plugins, "plugin", "Comma separated WebAssembly plugins run for every query, in order")
+	fs.DurationVar(&cfg.PluginTimeout, "plugin-timeout", cfg.PluginTimeout, "Timeout for a single plugin call")
+	fs.StringVar(&cfg.Admin.Listen, "admin", cfg.Admin.Listen, "Address for the admin HTTP endpoints, e.g. 127.0.0.1:8053 (disabled if empty)")
+	fs.StringVar(&cfg.Admin.GRPCListen, "grpc", cfg.Admin.GRPCListen, "Address for the gRPC admin API, e.g. 127.0.0.1:8054 (disabled if empty)")
+	fs.StringVar(&cfg.Admin.DebugListen, "debug", cfg.Admin.DebugListen, "Loopback address for the pprof and expvar debug endpoints, e.g. 127.0.0.1:6060 (disabled if empty)")
+	fs.StringVar(&cfg.Admin.CaptureDir, "capture-dir", cfg.Admin.CaptureDir, "Directory where packet captures started via the admin API are written")
+	fs.IntVar(&cfg.Admin.RecentQueries, "recent-queries", cfg.Admin.RecentQueries, "Number of recent queries kept for the admin API (0 disables)")
+	fs.StringVar(&cfg.Logging.File, "log-file", cfg.Logging.File, "Append logs to this file instead of stdout; with -daemon also stdout and stderr")
+	fs.Float64Var(&cfg.Logging.QuerySample, "query-log-sample", cfg.Logging.QuerySample, "Fraction of queries written to the query log, between 0 and 1")
+	fs.DurationVar(&cfg.Logging.SummaryInterval, "query-log-summary", cfg.Logging.SummaryInterval, "Interval between aggregated query summaries in the log, e.g. 1m (disabled if 0)")
+	fs.StringVar(&cfg.Logging.Syslog, "syslog", cfg.Logging.Syslog, "Send logs to syslog: \"local\", udp://host:port, tcp://host:port or tls://host:port")
+	fs.StringVar(&cfg.Logging.SyslogFacility, "syslog-facility", cfg.Logging.SyslogFacility, "Syslog facility used with -syslog")
+	fs.StringVar(&cfg.Logging.AnonymizeIPs, "anonymize-ips", cfg.Logging.AnonymizeIPs, "Anonymize client IPs in logs and statistics: none, mask (/24 and /48) or hash")
+	fs.StringVar(&cfg.Logging.AuditLog, "audit-log", cfg.Logging.AuditLog, "Append-only file recording configuration and record changes (disabled if empty)")
+	fs.StringVar(&cfg.StatsD.Address, "statsd", cfg.StatsD.Address, "StatsD endpoint (host:port) to push metrics to over UDP (disabled if empty)")
+	fs.StringVar(&cfg.StatsD.Prefix, "statsd-prefix", cfg.StatsD.Prefix, "Prefix prepended to every StatsD metric name")
+	fs.StringVar(&cfg.StatsD.Tags, "statsd-tags", cfg.StatsD.Tags, "Comma separated DogStatsD tags, e.g. env:home,site:lab")
+	fs.DurationVar(&cfg.StatsD.Interval, "statsd-interval", cfg.StatsD.Interval, "Interval between StatsD flushes")
+	fs.Var(&cfg.Webhooks, "webhook", "Comma separated URLs that receive a JSON POST on operational events")
+}
+
+// loadConfig layers the optional YAML file at path and the GODNS_*
+// environment variables over cfg, then re-applies the flags that were set
+// explicitly on the command line so they take precedence over both.
+func loadConfig(cfg *Config, fs *flag.FlagSet, path string) error {
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return err
+	}
+
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadConfig returns the default configuration overlaid with the YAML file
+// at path, if not empty, and the GODNS_* environment variables.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if err := loadConfig(c, flag.NewFlagSet("godns", flag.ContinueOnError), path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv sets the fields of the struct v from environment variables named
+// after their YAML keys, e.g. GODNS_HOSTS_FILE for hosts_file and
+// GODNS_ADMIN_LISTEN for admin.listen. Lists take comma separated values;
+// other non-string values, including zones, are parsed as YAML.
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, tag := v.Field(i), t.Field(i).Tag.Get("yaml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch target := field.Addr().Interface().(type) {
+		case *stringList:
+			target.Set(value)
+		case *string:
+			*target = value
+		default:
+			if err := yaml.Unmarshal([]byte(value), target); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks cfg for values that would only fail later at runtime and
+// normalizes upstream addresses to host:port.
+func (cfg *Config) validate() error {
+	if len(cfg.Listen) == 0 {
+		return fmt.Errorf("at least one listen address is required")
+	}
+	if len(cfg.Upstreams) == 0 {
+		return fmt.Errorf("at least one upstream is required")
+	}
+	if cfg.TLS.Listen != "" && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("tls listen needs cert_file and key_file")
+	}
+	if cfg.Workers < 1 || cfg.QueueSize < 0 {
+		return fmt.Errorf("workers must be at least 1 and queue_size at least 0")
+	}
+	if cfg.Shards < 0 {
+		return fmt.Errorf("shards must be at least 0")
+	}
+	if cfg.Shards != 1 && !shardingSupported {
+		return fmt.Errorf("shards other than 1 are only supported on Linux")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative")
+	}
+	if cfg.MaxUDPSize < dns.MinMsgSize || cfg.MaxUDPSize > dns.MaxMsgSize {
+		return fmt.Errorf("max_udp_size must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	if cfg.Overload != "drop" && cfg.Overload != "servfail" {
+		return fmt.Errorf("overload must be drop or servfail, not %q", cfg.Overload)
+	}
+	if cfg.Malformed != "formerr" && cfg.Malformed != "drop" {
+		return fmt.Errorf("malformed must be formerr or drop, not %q", cfg.Malformed)
+	}
+	if cfg.QueryTimeout < 0 {
+		return fmt.Errorf("query_timeout must not be negative")
+	}
+	if cfg.ShedThreshold < 0 || cfg.ShedThreshold > 1 {
+		return fmt.Errorf("shed_threshold must be between 0 and 1")
+	}
+	for _, cidr := range cfg.ShedTrusted {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid shed_trusted network %q", cidr)
+		}
+	}
+	for i, u := range cfg.Upstreams {
+		cfg.Upstreams[i] = normalizeUpstream(u)
+	}
+	for i, hint := range cfg.RootHints {
+		if _, _, err := net.SplitHostPort(hint); err != nil {
+			hint = net.JoinHostPort(hint, "53")
+			cfg.RootHints[i] = hint
+		}
+		if host, _, _ := net.SplitHostPort(hint); net.ParseIP(host) == nil {
+			return fmt.Errorf("root hint %q is not an address", hint)
+		}
+	}
+	if cfg.Authoritative {
+		switch {
+		case len(cfg.Zones) == 0:
+			return fmt.Errorf("authoritative needs at least one zone")
+		case cfg.Recursive:
+			return fmt.Errorf("authoritative and recursive cannot be combined")
+		case cfg.RootZone.Enabled:
+			return fmt.Errorf("authoritative and root_zone cannot be combined")
+		}
+	}
+	if cfg.RootZone.Enabled && len(cfg.RootZone.Sources) == 0 {
+		return fmt.Errorf("root_zone needs at least one source")
+	}
+	for i, source := range cfg.RootZone.Sources {
+		if _, _, err := net.SplitHostPort(source); err != nil {
+			cfg.RootZone.Sources[i] = net.JoinHostPort(source, "53")
+		}
+	}
+	for i, f := range cfg.ForwardZones {
+		if f.Name == "" || len(f.Upstreams) == 0 {
+			return fmt.Errorf("forward zones need a name and at least one upstream")
+		}
+		cfg.ForwardZones[i].Name = strings.ToLower(strings.Trim(f.Name, "."))
+		for j, u := range f.Upstreams {
+			cfg.ForwardZones[i].Upstreams[j] = normalizeUpstream(u)
+		}
+	}
+	if cfg.Remote.URL != "" && (cfg.Remote.Interval <= 0 || cfg.Remote.Timeout <= 0) {
+		return fmt.Errorf("remote interval and timeout must be positive")
+	}
+	if cfg.Git.Repository != "" {
+		if cfg.Git.Dir == "" {
+			return fmt.Errorf("git: dir is required to check the repository out")
+		}
+		if cfg.Git.Branch == "" {
+			return fmt.Errorf("git: branch is required")
+		}
+		if cfg.Git.Path != "" && !filepath.IsLocal(cfg.Git.Path) {
+			return fmt.Errorf("git: path %q is not within the repository", cfg.Git.Path)
+		}
+		if cfg.Git.Interval <= 0 || cfg.Git.Timeout <= 0 {
+			return fmt.Errorf("git interval and timeout must be positive")
+		}
+	}
+	if cfg.UpstreamTimeout <= 0 {
+		return fmt.Errorf("upstream_timeout must be positive")
+	}
+	if cfg.CacheSize < 0 {
+		return fmt.Errorf("cache_size must not be negative")
+	}
+	if len(cfg.Warmup) > 0 && cfg.CacheSize == 0 {
+		return fmt.Errorf("warmup needs the cache; set cache_size")
+	}
+	if cfg.PluginTimeout <= 0 {
+		return fmt.Errorf("plugin_timeout must be positive")
+	}
+	if cfg.Cluster.Primary != "" || len(cfg.Cluster.Followers) > 0 {
+		if cfg.Admin.Token == "" {
+			return fmt.Errorf("cluster members authenticate with the admin token, which is not set")
+		}
+		if cfg.Cluster.Interval <= 0 || cfg.Cluster.Timeout <= 0 {
+			return fmt.Errorf("cluster interval and timeout must be positive")
+		}
+		if cfg.Cluster.Primary != "" && len(cfg.Blocking.Lists) > 0 {
+			return fmt.Errorf("blocking lists: a cluster follower blocks the domains of its primary's lists")
+		}
+		for _, member := range append([]string{cfg.Cluster.Primary}, cfg.Cluster.Followers...) {
+			if member == "" {
+				continue
+			}
+			if err := checkHTTPURL(member); err != nil {
+				return fmt.Errorf("cluster: %v", err)
+			}
+		}
+	}
+	for _, endpoint := range cfg.Etcd.Endpoints {
+		if err := checkHTTPURL(endpoint); err != nil {
+			return fmt.Errorf("etcd endpoints: %v", err)
+		}
+	}
+	if cfg.Consul.Address != "" {
+		if err := checkHTTPURL(cfg.Consul.Address); err != nil {
+			return fmt.Errorf("consul address: %v", err)
+		}
+		if _, ok := normalizeRecordHost(cfg.Consul.Domain); !ok {
+			return fmt.Errorf("consul domain %q is not a valid domain name", cfg.Consul.Domain)
+		}
+	}
+	if cfg.Kubernetes.APIServer != "" {
+		if err := checkHTTPURL(cfg.Kubernetes.APIServer); err != nil {
+			return fmt.Errorf("kubernetes api_server: %v", err)
+		}
+		if _, ok := normalizeRecordHost(cfg.Kubernetes.Domain); !ok {
+			return fmt.Errorf("kubernetes domain %q is not a valid domain name", cfg.Kubernetes.Domain)
+		}
+	}
+	switch cfg.DHCP.Format {
+	case "dnsmasq", "isc", "kea":
+	default:
+		return fmt.Errorf("dhcp format must be dnsmasq, isc or kea, not %q", cfg.DHCP.Format)
+	}
+	if _, ok := normalizeRecordHost(cfg.DHCP.Domain); cfg.DHCP.Domain != "" && !ok {
+		return fmt.Errorf("dhcp domain %q is not a valid domain name", cfg.DHCP.Domain)
+	}
+	for i, domain := range cfg.SearchDomains {
+		normalized, ok := normalizeRecordHost(domain)
+		if !ok {
+			return fmt.Errorf("search domain %q is not a valid domain name", domain)
+		}
+		cfg.SearchDomains[i] = normalized
+	}
+	for _, addr := range cfg.Blocking.Sinkhole {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid sinkhole address %q", addr)
+		}
+	}
+	if cfg.MDNS.BridgeTimeout <= 0 {
+		return fmt.Errorf("mdns bridge_timeout must be positive")
+	}
+	if cfg.MDNS.Domain != "" {
+		domain, ok := normalizeRecordHost(cfg.MDNS.Domain)
+		if !ok {
+			return fmt.Errorf("mdns domain %q is not a valid domain name", cfg.MDNS.Domain)
+		}
+		cfg.MDNS.Domain = domain
+	}
+	if _, ok := normalizeRecordHost(cfg.Tailscale.Domain); cfg.Tailscale.Enabled && !ok {
+		return fmt.Errorf("tailscale domain %q is not a valid domain name", cfg.Tailscale.Domain)
+	}
+	if _, ok := normalizeRecordHost(cfg.WireGuard.Domain); cfg.WireGuard.Config != "" && !ok {
+		return fmt.Errorf("wireguard domain %q is not a valid domain name", cfg.WireGuard.Domain)
+	}
+	if cfg.Redis.DB < 0 {
+		return fmt.Errorf("redis db must not be negative")
+	}
+	if cfg.Redis.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.Redis.Address); err != nil {
+			cfg.Redis.Address = net.JoinHostPort(cfg.Redis.Address, "6379")
+		}
+	}
+	if cfg.Docker.HostIP != "" && net.ParseIP(cfg.Docker.HostIP) == nil {
+		return fmt.Errorf("docker host_ip %q is not an IP address", cfg.Docker.HostIP)
+	}
+	if _, ok := normalizeRecordHost(cfg.Docker.Domain); cfg.Docker.Domain != "" && !ok {
+		return fmt.Errorf("docker domain %q is not a valid domain name", cfg.Docker.Domain)
+	}
+	for i, k := range cfg.TSIGKeys {
+		if k.Name == "" || k.Secret == "" {
+			return fmt.Errorf("TSIG keys need a name and a secret")
+		}
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil {
+			return fmt.Errorf("TSIG key %s: secret is not valid base64", k.Name)
+		}
+		algorithm, ok := tsigAlgorithms[strings.ToLower(k.Algorithm)]
+		if !ok {
+			return fmt.Errorf("TSIG key %s: unsupported algorithm %q", k.Name, k.Algorithm)
+		}
+		cfg.TSIGKeys[i].Name = dns.Fqdn(strings.ToLower(k.Name))
+		cfg.TSIGKeys[i].Algorithm = algorithm
+	}
+	for i, z := range cfg.Zones {
+		if z.Name == "" {
+			return fmt.Errorf("zone without a name")
+		}
+		cfg.Zones[i].Name = strings.ToLower(strings.TrimSuffix(z.Name, "."))
+		if err := cfg.validatePolicy(z.Update); err != nil {
+			return fmt.Errorf("zone %s: update: %v", z.Name, err)
+		}
+		if err := cfg.validatePolicy(z.Transfer); err != nil {
+			return fmt.Errorf("zone %s: transfer: %v", z.Name, err)
+		}
+		if z.Primary != "" {
+			if z.File != "" {
+				return fmt.Errorf("zone %s: a secondary zone cannot have a file", z.Name)
+			}
+			if _, _, err := net.SplitHostPort(z.Primary); err != nil {
+				cfg.Zones[i].Primary = net.JoinHostPort(z.Primary, "53")
+			}
+		}
+		for j, target := range z.Notify {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				cfg.Zones[i].Notify[j] = net.JoinHostPort(target, "53")
+			}
+		}
+		if z.Catalog && (z.File != "" || len(z.Records) > 0) {
+			return fmt.Errorf("zone %s: a catalog zone cannot have a file or records", z.Name)
+		}
+		if z.PrimaryKey != "" && cfg.findTSIGKey(z.PrimaryKey) == nil {
+			return fmt.Errorf("zone %s: unknown TSIG key %q", z.Name, z.PrimaryKey)
+		}
+	}
+	if err := cfg.validateRewrites(); err != nil {
+		return err
+	}
+	if err := cfg.validateServices(); err != nil {
+		return err
+	}
+	if err := cfg.validateFailover(); err != nil {
+		return err
+	}
+	if err := cfg.validateViews(); err != nil {
+		return err
+	}
+	if err := cfg.validateTenants(); err != nil {
+		return err
+	}
+	if _, err := compileHooks(cfg.Hooks); err != nil {
+		return err
+	}
+	if cfg.Admin.GRPCListen != "" && cfg.Admin.Token == "" {
+		return fmt.Errorf("the gRPC admin API requires an admin token")
+	}
+	if cfg.Admin.DebugListen != "" {
+		if err := validateDebugListen(cfg.Admin.DebugListen); err != nil {
+			return err
+		}
+	}
+	if cfg.Logging.QuerySample < 0 || cfg.Logging.QuerySample > 1 {
+		return fmt.Errorf("query_sample must be between 0 and 1")
+	}
+	if err := validateAnonymizeMode(cfg.Logging.AnonymizeIPs); err != nil {
+		return err
+	}
+	if _, ok := syslogFacilities[strings.ToLower(cfg.Logging.SyslogFacility)]; !ok {
+		return fmt.Errorf("unknown syslog facility %q", cfg.Logging.SyslogFacility)
+	}
+	return nil
+}
+
+var tsigAlgorithms = map[string]string{
+	"":            dns.HmacSHA256,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha512": dns.HmacSHA512,
+	"hmac-md5":    dns.HmacMD5,
+}
+
+func (cfg *Config) findTSIGKey(name string) *TSIGKey {
+	name = dns.Fqdn(strings.ToLower(name))
+	for i := range cfg.TSIGKeys {
+		if cfg.TSIGKeys[i].Name == name {
+			return &cfg.TSIGKeys[i]
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validatePolicy(p AccessPolicy) error {
+	for _, cidr := range p.Allow {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid network %q", cidr)
+		}
+	}
+	for _, name := range p.Keys {
+		if cfg.findTSIGKey(name) == nil {
+			return fmt.Errorf("unknown TSIG key %q", name)
+		}
+	}
+	return nil
+}
+
+// validateTenants checks that tenants have distinct names and listen
+// addresses of their own, and normalizes their zone names. Tenant zones
+// are changed through the API only, so they cannot take dynamic updates,
+// transfers or catalogs.
+func (cfg *Config) validateTenants() error {
+	listens := make(map[string]string)
+	for _, l := range cfg.Listen {
+		listens[l] = "the global listeners"
+	}
+	names := make(map[string]bool)
+	for i, t := range cfg.Tenants {
+		if t.Name == "" || strings.ContainsAny(t.Name, "/ ") {
+			return fmt.Errorf("tenants need a name without slashes or spaces")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tenant %s is defined twice", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Listen) == 0 || len(t.Zones) == 0 {
+			return fmt.Errorf("tenant %s: at least one listen address and one zone are required", t.Name)
+		}
+		for _, l := range t.Listen {
+			if _, port, err := net.SplitHostPort(l); err != nil || port == "0" {
+				return fmt.Errorf("tenant %s: listen address %q needs a fixed port", t.Name, l)
+			}
+			if owner, ok := listens[l]; ok {
+				return fmt.Errorf("tenant %s: %s is already used by %s", t.Name, l, owner)
+			}
+			listens[l] = "tenant " + t.Name
+		}
+		for j, z := range t.Zones {
+			if z.Name == "" {
+				return fmt.Errorf("tenant %s: zone without a name", t.Name)
+			}
+			cfg.Tenants[i].Zones[j].Name = strings.ToLower(strings.Trim(z.Name, "."))
+			if len(z.Update.Allow) > 0 || len(z.Update.Keys) > 0 || len(z.Transfer.Allow) > 0 || len(z.Transfer.Keys) > 0 ||
+				z.Primary != "" || z.Catalog || len(z.Notify) > 0 {
+				return fmt.Errorf("tenant %s: zone %s: tenant zones cannot have update, transfer, primary, notify or catalog settings", t.Name, z.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRewrites checks that every rewrite rule is of one kind and
+// normalizes its domains. Suffix targets cannot fall under a suffix, so
+// rewrites never loop.
+func (cfg *Config) validateRewrites() error {
+	for i, r := range cfg.Rewrites {
+		kinds := 0
+		for _, set := range []bool{r.Address != "", r.Suffix != "", len(r.Strip) > 0} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return fmt.Errorf("rewrite %d: set one of address, suffix or strip", i+1)
+		}
+		switch {
+		case r.Address != "":
+			from, err := parseNetwork(r.Address)
+			if err != nil {
+				return fmt.Errorf("rewrite %d: invalid address %q", i+1, r.Address)
+			}
+			to, err := parseNetwork(r.To)
+			if err != nil {
+				return fmt.Errorf("rewrite %d: invalid address %q", i+1, r.To)
+			}
+			fromOnes, fromBits := from.Mask.Size()
+			toOnes, toBits := to.Mask.Size()
+			if fromBits != toBits || (toOnes != toBits && fromOnes != toOnes) {
+				return fmt.Errorf("rewrite %d: %s must be a single address or a network the size of %s, of the same family", i+1, r.To, r.Address)
+			}
+		case r.Suffix != "":
+			suffix, ok := normalizeRecordHost(r.Suffix)
+			to, toOK := normalizeRecordHost(r.To)
+			if !ok || !toOK {
+				return fmt.Errorf("rewrite %d: suffix and to must be domain names", i+1)
+			}
+			cfg.Rewrites[i].Suffix, cfg.Rewrites[i].To = suffix, to
+		default:
+			for _, t := range r.Strip {
+				if _, ok := dns.StringToType[strings.ToUpper(t)]; !ok {
+					return fmt.Errorf("rewrite %d: unknown record type %q", i+1, t)
+				}
+			}
+			if r.Domain != "" {
+				domain, ok := normalizeRecordHost(r.Domain)
+				if !ok {
+					return fmt.Errorf("rewrite %d: invalid domain %q", i+1, r.Domain)
+				}
+				cfg.Rewrites[i].Domain = domain
+			}
+		}
+	}
+	for i, r := range cfg.Rewrites {
+		for _, other := range cfg.Rewrites {
+			if r.Suffix != "" && other.Suffix != "" && inDomain(r.To, other.Suffix) {
+				return fmt.Errorf("rewrite %d: %s falls under the rewritten suffix %s", i+1, r.To, other.Suffix)
+			}
+		}
+	}
+	return nil
+}
+
+// validateServices checks the DNS-SD services and normalizes their types,
+// domains and hosts.
+func (cfg *Config) validateServices() error {
+	for i, s := range cfg.Services {
+		if s.Name == "" || len(s.Name) > 63 {
+			return fmt.Errorf("services need a name of at most 63 bytes")
+		}
+		s.Type = strings.ToLower(strings.Trim(s.Type, "."))
+		service, proto, ok := strings.Cut(s.Type, ".")
+		if !ok || len(service) < 2 || service[0] != '_' || (proto != "_tcp" && proto != "_udp") {
+			return fmt.Errorf("service %s: type %q is not of the form _service._tcp or _service._udp", s.Name, s.Type)
+		}
+		domain, ok := normalizeRecordHost(s.Domain)
+		if !ok {
+			return fmt.Errorf("service %s: domain %q is not a valid domain name", s.Name, s.Domain)
+		}
+		host, ok := normalizeRecordHost(s.Host)
+		if !ok {
+			return fmt.Errorf("service %s: host %q is not a valid host name", s.Name, s.Host)
+		}
+		if s.Port == 0 {
+			return fmt.Errorf("service %s: port is required", s.Name)
+		}
+		s.Domain, s.Host = domain, host
+		cfg.Services[i] = s
+	}
+	return nil
+}
+
+// validateFailover checks the failover groups and fills in the defaults
+// of their checks: every 10 seconds, a 2 second timeout and 3 failures.
+func (cfg *Config) validateFailover() error {
+	names := make(map[string]bool)
+	for i, g := range cfg.Failover {
+		name := strings.ToLower(strings.Trim(g.Name, "."))
+		if name == "" {
+			return fmt.Errorf("failover groups need a name")
+		}
+		if names[name] {
+			return fmt.Errorf("failover group %s is defined twice", name)
+		}
+		names[name] = true
+		if net.ParseIP(g.Primary) == nil || net.ParseIP(g.Backup) == nil {
+			return fmt.Errorf("failover group %s: primary and backup must be IP addresses", name)
+		}
+		u, err := url.Parse(g.Check)
+		if err != nil || u.Host == "" || (u.Scheme != "tcp" && u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("failover group %s: check must be a tcp://host:port, http:// or https:// URL", name)
+		}
+		if _, _, err := net.SplitHostPort(u.Host); u.Scheme == "tcp" && err != nil {
+			return fmt.Errorf("failover group %s: check %s needs a port", name, g.Check)
+		}
+		if g.Interval < 0 || g.Timeout < 0 || g.Failures < 0 {
+			return fmt.Errorf("failover group %s: interval, timeout and failures cannot be negative", name)
+		}
+		g.Name = name
+		if g.Interval == 0 {
+			g.Interval = 10 * time.Second
+		}
+		if g.Timeout == 0 {
+			g.Timeout = 2 * time.Second
+		}
+		if g.Failures == 0 {
+			g.Failures = 3
+		}
+		cfg.Failover[i] = g
+	}
+	return nil
+}
+
+// validateViews checks that views have distinct names and valid client
+// networks, and normalizes their record names.
+func (cfg *Config) validateViews() error {
+	names := make(map[string]bool)
+	for i, v := range cfg.Views {
+		if v.Name == "" {
+			return fmt.Errorf("views need a name")
+		}
+		if names[v.Name] {
+			return fmt.Errorf("view %s is defined twice", v.Name)
+		}
+		names[v.Name] = true
+		if len(v.Clients) == 0 {
+			return fmt.Errorf("view %s: at least one client network is required", v.Name)
+		}
+		for _, cidr := range v.Clients {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("view %s: invalid client network %q", v.Name, cidr)
+			}
+		}
+		records := make(map[string]string, len(v.Records))
+		for name, value := range v.Records {
+			records[strings.ToLower(strings.Trim(name, "."))] = value
+		}
+		cfg.Views[i].Records = records
+	}
+	return nil
+}
+
+// findZoneConfig returns the configuration of a configured zone or of a
+// member zone of a consumed catalog zone.
+func (s *Server) findZoneConfig(name string) *ZoneConfig {
+	for i := range s.cfg.Zones {
+		if s.cfg.Zones[i].Name == name {
+			return &s.cfg.Zones[i]
+		}
+	}
+	return s.catalogMemberConfig(name)
+}
+
+// permits reports whether a client at ip, authenticated with key (nil when
+// the request was unsigned), is allowed by the policy.
+func (p AccessPolicy) permits(ip net.IP, key *TSIGKey) bool {
+	if len(p.Allow) == 0 && len(p.Keys) == 0 {
+		return false
+	}
+	if len(p.Allow) > 0 {
+		allowed := false
+		for _, cidr := range p.Allow {
+			if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(p.Keys) > 0 {
+		if key == nil {
+			return false
+		}
+		for _, name := range p.Keys {
+			if dns.Fqdn(strings.ToLower(name)) == key.Name {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package godns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulWait bounds a blocking catalog query, and so how stale health
+// information can get when the catalog itself does not change.
+const consulWait = 30 * time.Second
+
+// consulBackend mirrors the Consul catalog as records:
+// <service>.service.<domain> and <tag>.<service>.service.<domain> resolve
+// to a passing instance of the service, <node>.node.<domain> to the node.
+type consulBackend struct {
+	srv        *Server
+	address    string
+	token      string
+	datacenter string
+	domain     string
+	client     *http.Client
+}
+
+func (s *Server) newConsulBackend(c ConsulConfig) *consulBackend {
+	return &consulBackend{
+		srv:        s,
+		address:    strings.TrimSuffix(c.Address, "/"),
+		token:      c.Token,
+		datacenter: c.Datacenter,
+		domain:     strings.ToLower(strings.Trim(c.Domain, ".")),
+		client:     &http.Client{Timeout: consulWait + 10*time.Second},
+	}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string   `json:"ID"`
+		Address string   `json:"Address"`
+		Tags    []string `json:"Tags"`
+	} `json:"Service"`
+}
+
+// run rebuilds the records whenever the catalog changes, and at least every
+// consulWait so health changes are picked up.
+func (c *consulBackend) run() {
+	var index uint64
+	for attempt := 0; ; attempt++ {
+		next, err := c.refresh(index)
+		if err != nil {
+			if c.srv.ctx.Err() != nil {
+				return
+			}
+			c.srv.backendFailed("consul", err)
+			index = 0
+			if !c.srv.sleep(backoff(attempt)) {
+				return
+			}
+			continue
+		}
+		attempt = -1
+		// An index that goes backwards means Consul reset it; start over
+		// rather than block on an index that will not be reached.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// refresh waits for the catalog to change past index (or consulWait to
+// pass), then publishes the records and returns the new index.
+func (c *consulBackend) refresh(index uint64) (uint64, error) {
+	var services map[string][]string
+	query := url.Values{"index": {strconv.FormatUint(index, 10)}, "wait": {consulWait.String()}}
+	next, err := c.get("/v1/catalog/services", query, &services)
+	if err != nil {
+		return 0, err
+	}
+	records, err := c.records(services)
+	if err != nil {
+		return 0, err
+	}
+	c.srv.publishBackendRecords("consul", records)
+	return next, nil
+}
+
+// records builds the records of all services and nodes.
+func (c *consulBackend) records(services map[string][]string) (map[string]string, error) {
+	records := make(map[string]string)
+
+	var nodes []struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	}
+	if _, err := c.get("/v1/catalog/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		addRecord(records, node.Node+".node."+c.domain, node.Address)
+	}
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var entries []consulServiceEntry
+		if _, err := c.get("/v1/health/service/"+url.PathEscape(name), url.Values{"passing": {"true"}}, &entries); err != nil {
+			return nil, err
+		}
+		// One address per name: the first passing instance by ID, so
+		// the answer is stable while the instance stays healthy.
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Service.ID < entries[j].Service.ID })
+		for _, entry := range entries {
+			address := entry.Service.Address
+			if address == "" {
+				address = entry.Node.Address
+			}
+			addRecord(records, name+".service."+c.domain, address)
+			for _, tag := range entry.Service.Tags {
+				addRecord(records, tag+"."+name+".service."+c.domain, address)
+			}
+		}
+	}
+	return records, nil
+}
+
+// get decodes a Consul API response into out and returns its
+// X-Consul-Index, used for blocking queries.
+func (c *consulBackend) get(path string, query url.Values, out interface{}) (uint64, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.datacenter != "" {
+		query.Set("dc", c.datacenter)
+	}
+	req, err := http.NewRequestWithContext(c.srv.ctx, http.MethodGet, c.address+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return index, json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,21 @@
+package godns
+
+import (
+	"fmt"
+	"os"
+)
+
+// writePIDFile writes the process ID to path.
+func writePIDFile(path string) error {
+	return os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// removePIDFile removes the PID file, if it is still ours. After switching
+// users it may not be removable; a stale file names a process that no
+// longer exists.
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err == nil && string(data) == fmt.Sprintf("%d\n", os.Getpid()) {
+		os.Remove(path)
+	}
+}
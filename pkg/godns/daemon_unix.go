@@ -0,0 +1,145 @@
+//go:build !windows
+
+package godns
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// daemonEnv marks the background process started by daemonize, readyEnv
+// a process started by startAndWait. They lack the GODNS_ prefix so the
+// configuration does not pick them up.
+const (
+	daemonEnv = "_GODNS_DAEMON_CHILD"
+	readyEnv  = "_GODNS_NOTIFY_READY"
+)
+
+// daemonized reports whether this process is the background process of
+// -daemon.
+func daemonized() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// daemonize starts godns again with the same arguments in a new session,
+// with stdin from /dev/null and stdout and stderr appended to the log file,
+// and waits until it has started the server or failed to.
+func (s *Server) daemonize() error {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+	output := s.cfg.Logging.File
+	if output == "" {
+		output = os.DevNull
+	}
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	pid, err := startAndWait([]string{daemonEnv + "=1"}, []uintptr{devNull.Fd(), out.Fd(), out.Fd()}, &syscall.SysProcAttr{Setsid: true})
+	if err != nil {
+		if s.cfg.Logging.File == "" {
+			return fmt.Errorf("%v; run without -daemon or set -log-file to see why", err)
+		}
+		return fmt.Errorf("%v, see %s", err, s.cfg.Logging.File)
+	}
+	fmt.Printf("godns started in the background, pid %d\n", pid)
+	return nil
+}
+
+// startAndWait starts godns again with the same arguments, env added to
+// its environment and files as its file descriptors: stdin, stdout and
+// stderr, then from 4 on. It waits until the new process has started the
+// server, which it reports through notifyReady on descriptor 3.
+//
+// The descriptors are passed as they are: os/exec would switch them to
+// blocking mode, which sockets share with this process.
+func startAndWait(env []string, files []uintptr, sys *syscall.SysProcAttr) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	fds := append(append(files[:3:3], readyWriter.Fd()), files[3:]...)
+	pid, err := syscall.ForkExec(exe, os.Args, &syscall.ProcAttr{
+		Env:   append(append(os.Environ(), env...), readyEnv+"=1"),
+		Files: fds,
+		Sys:   sys,
+	})
+	readyWriter.Close()
+	if err != nil {
+		return 0, err
+	}
+	if p, err := os.FindProcess(pid); err == nil {
+		// Reap the process should it exit while this one runs.
+		go p.Wait()
+	}
+
+	// The pipe is closed when the process is ready, or exits.
+	status, _ := io.ReadAll(ready)
+	if string(status) != "ok" {
+		return pid, fmt.Errorf("process %d failed to start", pid)
+	}
+	return pid, nil
+}
+
+// notifyReady tells the process that started this one with startAndWait
+// that the server has started.
+func notifyReady() {
+	if os.Getenv(readyEnv) != "1" {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	ready := os.NewFile(3, "ready")
+	ready.Write([]byte("ok"))
+	ready.Close()
+}
+
+// dropPrivileges switches the process to the user and primary group of
+// the account name. The files it owns, such as the PID file, are given to
+// that user first, so a process started by an upgrade can rewrite them.
+func dropPrivileges(name string, owned ...string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if os.Getuid() == uid {
+		// Already switched, as a process started by an upgrade is.
+		return nil
+	}
+	for _, path := range owned {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setting groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setting group ID: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setting user ID: %v", err)
+	}
+	return nil
+}
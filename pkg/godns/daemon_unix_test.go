@@ -0,0 +1,116 @@
+//go:build !windows
+
+package godns
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// pidFileStageEnv runs TestPIDFileHelper as the process that writes the PID
+// file and drops privileges ("parent"), or as the one an upgrade starts
+// ("child").
+const (
+	pidFileStageEnv = "_GODNS_TEST_PIDFILE_STAGE"
+	pidFilePathEnv  = "_GODNS_TEST_PIDFILE"
+)
+
+// TestUpgradePIDFileAsUser runs a process that writes the PID file and
+// switches to nobody, which then starts another process, as SIGUSR2 does,
+// that must rewrite the PID file.
+func TestUpgradePIDFileAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("no user nobody")
+	}
+	// The processes run from a copy of the test binary that nobody can
+	// run, in a directory nobody can enter but not write to.
+	dir := t.TempDir()
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exe := filepath.Join(dir, "godns.test")
+	if err := copyExecutable(exe); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "godns.pid")
+
+	cmd := exec.Command(exe, "-test.run=^TestPIDFileHelper$")
+	cmd.Env = append(os.Environ(), pidFileStageEnv+"=parent", pidFilePathEnv+"="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := strconv.Atoi(string(data[:len(data)-1])); err != nil || pid == cmd.Process.Pid {
+		t.Errorf("PID file holds %q, want the upgraded process", data)
+	}
+}
+
+func TestPIDFileHelper(t *testing.T) {
+	path := os.Getenv(pidFilePathEnv)
+	switch os.Getenv(pidFileStageEnv) {
+	case "parent":
+		if err := writePIDFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := dropPrivileges("nobody", path); err != nil {
+			t.Fatal(err)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		child := exec.Command(exe, "-test.run=^TestPIDFileHelper$")
+		child.Env = append(os.Environ(), pidFileStageEnv+"=child")
+		if out, err := child.CombinedOutput(); err != nil {
+			t.Fatalf("upgraded process: %v: %s", err, out)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != fmt.Sprintf("%d\n", child.Process.Pid) {
+			t.Fatalf("PID file holds %q, %v", data, err)
+		}
+	case "child":
+		// Already switched, as a process started by an upgrade is.
+		if err := dropPrivileges("nobody"); err != nil {
+			t.Fatal(err)
+		}
+		if err := writePIDFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// copyExecutable copies the running test binary to path.
+func copyExecutable(path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,15 @@
+package godns
+
+import "errors"
+
+func daemonized() bool { return false }
+
+func (s *Server) daemonize() error {
+	return errors.New("-daemon is not supported on Windows; install godns as a service instead")
+}
+
+func notifyReady() {}
+
+func dropPrivileges(name string, owned ...string) error {
+	return errors.New("-user is not supported on Windows; set the account of the service instead")
+}
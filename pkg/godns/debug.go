@@ -0,0 +1,64 @@
+package godns
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// startDebugServer serves the pprof profiles under /debug/pprof/ and the
+// expvar variables, including the godns counters, under /debug/vars. They
+// are unauthenticated, so addr must be a loopback address.
+func (s *Server) startDebugServer(addr string) {
+	l, err := listenTCP("debug", addr)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error serving debug HTTP: %v", err))
+		return
+	}
+	s.debugListener = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", s.debugVarsHandler)
+	s.logMessage(fmt.Sprintf("Debug HTTP listening on %s", addr))
+	s.serveHTTP(l, mux, "debug HTTP")
+}
+
+// debugVarsHandler serves the expvar variables as expvar.Handler does, with
+// the counters of s as "godns".
+func (s *Server) debugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := map[string]json.RawMessage{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	counters, err := json.Marshal(s.statsCounters())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vars["godns"] = counters
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(vars)
+}
+
+// validateDebugListen requires the debug address to be on loopback.
+func validateDebugListen(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("debug_listen: %v", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("debug_listen must be a loopback address, as the debug endpoints are not authenticated")
+	}
+	return nil
+}
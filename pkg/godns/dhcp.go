@@ -0,0 +1,284 @@
+package godns
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dhcpExpiryCheck is how often leases are re-evaluated when the lease file
+// has not changed, so expired leases stop resolving.
+const dhcpExpiryCheck = time.Minute
+
+// dhcpLease is an active lease with the client's host name.
+type dhcpLease struct {
+	ip      string
+	host    string
+	expires time.Time // zero for infinite leases
+}
+
+// dhcpBackend publishes <hostname>.<domain> for every active lease in a
+// dnsmasq, ISC dhcpd or Kea lease file, and answers PTR queries for the
+// leased addresses.
+type dhcpBackend struct {
+	srv    *Server
+	path   string
+	format string
+	domain string
+}
+
+func (s *Server) newDHCPBackend(c DHCPConfig) *dhcpBackend {
+	return &dhcpBackend{srv: s, path: c.Leases, format: c.Format, domain: c.Domain}
+}
+
+// run loads the lease file whenever it changes, and every minute so that
+// expired leases are dropped even when the DHCP server is quiet, until the
+// server shuts down.
+func (d *dhcpBackend) run() {
+	changed := make(chan struct{}, 1)
+	if err := d.srv.watchFiles([]string{d.path}, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}); err != nil {
+		d.srv.logMessage(fmt.Sprintf("Error watching lease file %s, checking it every minute: %v", d.path, err))
+	}
+	ticker := time.NewTicker(dhcpExpiryCheck)
+	defer ticker.Stop()
+	for {
+		d.load()
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-d.srv.ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *dhcpBackend) load() {
+	file, err := os.Open(d.path)
+	if err != nil {
+		d.srv.backendFailed("dhcp", err)
+		return
+	}
+	defer file.Close()
+
+	var leases []dhcpLease
+	switch d.format {
+	case "isc":
+		leases, err = parseISCLeases(file)
+	case "kea":
+		leases, err = parseKeaLeases(file)
+	default:
+		leases, err = parseDnsmasqLeases(file)
+	}
+	if err != nil {
+		d.srv.backendFailed("dhcp", fmt.Errorf("%s: %v", d.path, err))
+		return
+	}
+
+	now := time.Now()
+	records := make(map[string]string)
+	reverse := make(map[string]string)
+	expires := make(map[string]time.Time)
+	for _, lease := range leases {
+		label := hostLabel(lease.host)
+		if label == "" || !lease.expires.IsZero() && lease.expires.Before(now) {
+			continue
+		}
+		name := label
+		if d.domain != "" {
+			name += "." + d.domain
+		}
+		// The same client may hold several leases; the newest wins.
+		if prev, ok := expires[name]; ok && !lease.expires.IsZero() && !prev.IsZero() && lease.expires.Before(prev) {
+			continue
+		}
+		if prev, ok := records[name]; ok {
+			if arpa, err := dns.ReverseAddr(prev); err == nil {
+				delete(reverse, strings.TrimSuffix(arpa, "."))
+			}
+		}
+		records[name] = lease.ip
+		expires[name] = lease.expires
+		if arpa, err := dns.ReverseAddr(lease.ip); err == nil {
+			reverse[strings.TrimSuffix(arpa, ".")] = name
+		}
+	}
+
+	d.srv.dhcpReverseMu.Lock()
+	d.srv.dhcpReverse = reverse
+	d.srv.dhcpReverseMu.Unlock()
+	d.srv.publishBackendRecords("dhcp", records)
+}
+
+// leaseHost returns the host name of the lease whose address has the
+// reverse name arpa.
+func (s *Server) leaseHost(arpa string) (string, bool) {
+	s.dhcpReverseMu.RLock()
+	defer s.dhcpReverseMu.RUnlock()
+	host, ok := s.dhcpReverse[arpa]
+	return host, ok
+}
+
+// hostLabel turns a host name chosen by a client into a DNS label: the first
+// label only, lower-cased, with anything but letters, digits and hyphens
+// replaced. It returns "" for clients that sent no usable name.
+func hostLabel(host string) string {
+	host, _, _ = strings.Cut(strings.TrimSpace(host), ".")
+	if host == "*" {
+		return ""
+	}
+	label := []byte(strings.ToLower(host))
+	for i, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			label[i] = '-'
+		}
+	}
+	trimmed := strings.Trim(string(label), "-")
+	if len(trimmed) > 63 {
+		trimmed = trimmed[:63]
+	}
+	return trimmed
+}
+
+// parseDnsmasqLeases reads dnsmasq.leases: one lease per line as
+// "<expiry> <mac> <ip> <hostname> <client-id>", expiry 0 meaning infinite.
+func parseDnsmasqLeases(r io.Reader) ([]dhcpLease, error) {
+	var leases []dhcpLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The DUID line of DHCPv6 leases has only two fields.
+		if len(fields) < 4 || net.ParseIP(fields[2]) == nil {
+			continue
+		}
+		lease := dhcpLease{ip: fields[2], host: fields[3]}
+		if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expiry != 0 {
+			lease.expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// parseISCLeases reads ISC dhcpd's dhcpd.leases. The file is append-only,
+// so a later block for an address replaces an earlier one.
+func parseISCLeases(r io.Reader) ([]dhcpLease, error) {
+	var (
+		order  []string
+		byIP   = make(map[string]dhcpLease)
+		active = make(map[string]bool)
+		lease  *dhcpLease
+		state  string
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{"):
+			ip := strings.Fields(line)[1]
+			lease, state = &dhcpLease{ip: ip}, ""
+		case lease == nil:
+		case line == "}":
+			if _, seen := byIP[lease.ip]; !seen {
+				order = append(order, lease.ip)
+			}
+			byIP[lease.ip] = *lease
+			active[lease.ip] = state == "" || state == "active"
+			lease = nil
+		case strings.HasPrefix(line, "client-hostname "):
+			lease.host = strings.Trim(strings.TrimSuffix(strings.TrimPrefix(line, "client-hostname "), ";"), `"`)
+		case strings.HasPrefix(line, "binding state "):
+			state = strings.TrimSuffix(strings.TrimPrefix(line, "binding state "), ";")
+		case strings.HasPrefix(line, "ends "):
+			// ends <weekday> <yyyy/mm/dd> <hh:mm:ss>; in UTC, or "ends never;".
+			fields := strings.Fields(strings.TrimSuffix(line, ";"))
+			if len(fields) == 4 {
+				ends, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+				if err != nil {
+					return nil, fmt.Errorf("lease %s: %v", lease.ip, err)
+				}
+				lease.expires = ends
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var leases []dhcpLease
+	for _, ip := range order {
+		if active[ip] {
+			leases = append(leases, byIP[ip])
+		}
+	}
+	return leases, nil
+}
+
+// parseKeaLeases reads a Kea memfile lease CSV (kea-leases4.csv or
+// kea-leases6.csv), locating the columns by the header row. Like ISC
+// dhcpd, Kea appends updates, so the last row for an address wins.
+func parseKeaLeases(r io.Reader) ([]dhcpLease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "expire", "hostname", "state"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing %q column", name)
+		}
+	}
+
+	var order []string
+	byIP := make(map[string]*dhcpLease)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(row) != len(header) {
+			continue
+		}
+		ip := row[columns["address"]]
+		if _, seen := byIP[ip]; !seen {
+			order = append(order, ip)
+		}
+		// State 0 is an assigned lease; 1 declined, 2 expired-reclaimed.
+		if row[columns["state"]] != "0" {
+			byIP[ip] = nil
+			continue
+		}
+		lease := &dhcpLease{ip: ip, host: row[columns["hostname"]]}
+		if expire, err := strconv.ParseInt(row[columns["expire"]], 10, 64); err == nil {
+			lease.expires = time.Unix(expire, 0)
+		}
+		byIP[ip] = lease
+	}
+	var leases []dhcpLease
+	for _, ip := range order {
+		if lease := byIP[ip]; lease != nil {
+			leases = append(leases, *lease)
+		}
+	}
+	return leases, nil
+}
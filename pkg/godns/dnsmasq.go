@@ -0,0 +1,257 @@
+package godns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// importDnsmasq converts a dnsmasq configuration file, or a directory of
+// *.conf files, following conf-file and conf-dir. It understands the
+// directives that map onto godns:
+//
+//	address=/name/ip       a record for name (not its subdomains)
+//	address=/name/         a local zone, answered with NXDOMAIN
+//	host-record=n[,n],ip   records
+//	dhcp-host=...,ip,name  records for static leases
+//	cname=alias,target     records, when target is a local record
+//	server=ip              upstreams
+//	server=/domain/ip      forward zones
+//	local=/domain/         local zones
+//	addn-hosts=file        records from an /etc/hosts style file
+//
+// Other directives that affect DNS answers are reported as warnings.
+func importDnsmasq(path string) (*importedConfig, error) {
+	d := &dnsmasqImport{
+		imported: &importedConfig{records: make(map[string]string)},
+		forwards: make(map[string][]string),
+		seen:     make(map[string]bool),
+	}
+	if err := d.load(path); err != nil {
+		return nil, err
+	}
+	d.imported.flattenCNAMEs(d.cnames)
+
+	imported := d.imported
+	names := make([]string, 0, len(d.forwards))
+	for name := range d.forwards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		imported.forwardZones = append(imported.forwardZones, ForwardZone{Name: name, Upstreams: d.forwards[name]})
+	}
+	sort.Strings(d.localZones)
+	imported.localZones = d.localZones
+	return imported, nil
+}
+
+type dnsmasqImport struct {
+	imported   *importedConfig
+	forwards   map[string][]string
+	localZones []string
+	cnames     []string
+	// seen guards against configuration files including each other.
+	seen map[string]bool
+}
+
+// dnsmasqIgnored lists directives that do not change DNS answers, or whose
+// effect godns has anyway, so they are skipped without a warning.
+var dnsmasqIgnored = map[string]bool{
+	"interface": true, "except-interface": true, "listen-address": true, "bind-interfaces": true,
+	"bind-dynamic": true, "port": true, "user": true, "group": true, "pid-file": true,
+	"domain-needed": true, "bogus-priv": true, "no-resolv": true, "no-poll": true, "no-hosts": true,
+	"cache-size": true, "log-queries": true, "log-facility": true, "log-dhcp": true, "strict-order": true,
+	"dhcp-range": true, "dhcp-option": true, "dhcp-authoritative": true, "dhcp-leasefile": true,
+	"dhcp-lease-max": true, "dhcp-script": true, "enable-ra": true, "resolv-file": true,
+}
+
+func (d *dnsmasqImport) load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return d.loadDir(path, ".conf")
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if d.seen[abs] {
+		return nil
+	}
+	d.seen[abs] = true
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		key, value, _ := strings.Cut(text, "=")
+		if err := d.directive(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadDir loads the files of dir, in lexical order, that end in suffix and
+// are not hidden or backups.
+func (d *dnsmasqImport) loadDir(dir, suffix string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if err := d.load(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dnsmasqImport) directive(key, value string) error {
+	imported := d.imported
+	switch key {
+	case "conf-file":
+		return d.load(value)
+	case "conf-dir":
+		// conf-dir=/etc/dnsmasq.d,.bak or conf-dir=/etc/dnsmasq.d/,*.conf
+		dir, filter, _ := strings.Cut(value, ",")
+		suffix := ""
+		if ext, ok := strings.CutPrefix(filter, "*"); ok {
+			suffix = ext
+		}
+		return d.loadDir(dir, suffix)
+	case "addn-hosts":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return err
+		}
+		hosts, err := parseEtcHosts(data, value)
+		if err != nil {
+			return err
+		}
+		for host, ip := range hosts {
+			imported.records[host] = ip
+		}
+	case "address":
+		domains, target := splitDnsmasqDomains(value)
+		switch {
+		case target == "":
+			d.localZones = append(d.localZones, domains...)
+		case target == "#" || net.ParseIP(target) != nil && net.ParseIP(target).IsUnspecified():
+			imported.warn("address=%s not imported: add the domains to a blocklist in blocking.lists", value)
+		case net.ParseIP(target) != nil:
+			for _, domain := range domains {
+				imported.records[domain] = target
+			}
+			imported.warn("address=%s imported for the name only; godns records do not cover subdomains", value)
+		default:
+			return fmt.Errorf("invalid address %q", value)
+		}
+	case "local":
+		domains, _ := splitDnsmasqDomains(value)
+		d.localZones = append(d.localZones, domains...)
+	case "server":
+		domains, target := splitDnsmasqDomains(value)
+		target, _, _ = strings.Cut(target, "@") // source address or interface
+		if host, port, ok := strings.Cut(target, "#"); ok && host != "" {
+			target = net.JoinHostPort(host, port)
+		}
+		switch {
+		case domains == nil:
+			imported.upstreams = append(imported.upstreams, target)
+		case target == "":
+			d.localZones = append(d.localZones, domains...)
+		case target == "#":
+			// Use the default upstreams, which godns does anyway.
+		default:
+			for _, domain := range domains {
+				d.forwards[domain] = append(d.forwards[domain], target)
+			}
+		}
+	case "host-record":
+		var names []string
+		ip := ""
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			switch parsed := net.ParseIP(field); {
+			case parsed != nil:
+				// The IPv4 address wins, as in /etc/hosts files.
+				if ip == "" || parsed.To4() != nil && net.ParseIP(ip).To4() == nil {
+					ip = field
+				}
+			case !isNumber(field):
+				names = append(names, field)
+			}
+		}
+		if ip == "" || len(names) == 0 {
+			return fmt.Errorf("invalid host-record %q", value)
+		}
+		for _, name := range names {
+			imported.records[strings.ToLower(strings.TrimSuffix(name, "."))] = ip
+		}
+	case "dhcp-host":
+		// [mac,...][id:...][set:tag,]ip,name[,lease]: the fields are told
+		// apart by their shape.
+		ip, name := "", ""
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			host, ok := normalizeRecordHost(field)
+			switch {
+			case net.ParseIP(field) != nil:
+				ip = field
+			case ip != "" && name == "" && ok && !isLeaseTime(field):
+				name = host
+			}
+		}
+		if ip != "" && name != "" {
+			imported.records[name] = ip
+		}
+	case "cname":
+		d.cnames = append(d.cnames, value)
+	default:
+		if !dnsmasqIgnored[key] {
+			imported.warn("%s not imported: unsupported directive", key)
+		}
+	}
+	return nil
+}
+
+// isLeaseTime reports whether a dhcp-host field is a lease time such as
+// 3600, 12h or infinite.
+func isLeaseTime(field string) bool {
+	return field == "infinite" || isNumber(strings.TrimRight(field, "smhdw"))
+}
+
+// splitDnsmasqDomains splits "/a.lan/b.lan/target" into its domains and
+// target. A value without leading slash has no domains.
+func splitDnsmasqDomains(value string) ([]string, string) {
+	if !strings.HasPrefix(value, "/") {
+		return nil, value
+	}
+	parts := strings.Split(value[1:], "/")
+	var domains []string
+	for _, domain := range parts[:len(parts)-1] {
+		if domain = strings.ToLower(strings.Trim(domain, ".")); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, parts[len(parts)-1]
+}
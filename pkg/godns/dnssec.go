@@ -0,0 +1,29 @@
+package godns
+
+import "github.com/miekg/dns"
+
+// setQueryDNSSEC passes the DNSSEC bits of the client's query req on to
+// query, the upstream query for it: DNSSEC OK, so that a validating client
+// gets the signatures, and Checking Disabled, so that it gets the data to
+// validate itself even when the upstream would fail it. Authenticated Data
+// asks the upstream to say whether it validated the answer (RFC 6840).
+func setQueryDNSSEC(req, query *dns.Msg) {
+	query.CheckingDisabled = req.CheckingDisabled
+	query.AuthenticatedData = true
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		query.IsEdns0().SetDo()
+	}
+}
+
+// setAnswerDNSSEC fixes the header of an upstream answer for the client's
+// query req. godns is not authoritative for it, and does not validate: AD
+// stays only where the upstream validated the answer, and only for clients
+// that asked for it with DO or AD.
+func setAnswerDNSSEC(req, response *dns.Msg) {
+	response.Authoritative = false
+	if !req.AuthenticatedData {
+		if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+			response.AuthenticatedData = false
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package godns_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/nodesocket/godns/pkg/godns/godnstest"
+)
+
+func TestDNSSECPassthrough(t *testing.T) {
+	// A validating upstream: it signs what it answers for DO queries and
+	// sets AD.
+	var mu sync.Mutex
+	asked := make(map[uint16]*dns.Msg)
+	s := godnstest.Start(t, godnstest.Options{
+		Upstream: godnstest.UpstreamFunc(func(m *dns.Msg) (*dns.Msg, error) {
+			q := m.Question[0]
+			mu.Lock()
+			asked[q.Qtype] = m.Copy()
+			mu.Unlock()
+			r := new(dns.Msg)
+			r.SetReply(m)
+			r.AuthenticatedData = true
+			var rr dns.RR
+			switch q.Qtype {
+			case dns.TypeDNSKEY:
+				rr, _ = dns.NewRR(q.Name + " 300 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==")
+			case dns.TypeDS:
+				rr, _ = dns.NewRR(q.Name + " 300 IN DS 2371 13 2 C988EC423E3880EB8DD8A46FE06CA230EE23F35B578D64D4A7DE0A4A5BB1C6A7")
+			default:
+				r.Rcode = dns.RcodeNameError
+				return r, nil
+			}
+			r.Answer = append(r.Answer, rr)
+			if opt := m.IsEdns0(); opt != nil && opt.Do() {
+				sig, _ := dns.NewRR(q.Name + " 300 IN RRSIG " + dns.TypeToString[q.Qtype] + " 13 2 300 20300101000000 20200101000000 2371 example.com. c2lnbmF0dXJl")
+				r.Answer = append(r.Answer, sig)
+			}
+			return r, nil
+		}),
+	})
+
+	for _, qtype := range []uint16{dns.TypeDNSKEY, dns.TypeDS} {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", qtype)
+		m.SetEdns0(1232, true)
+		m.CheckingDisabled = true
+		r, err := s.Exchange(m, "udp")
+		if err != nil {
+			t.Fatalf("query %s: %v", dns.TypeToString[qtype], err)
+		}
+
+		mu.Lock()
+		query := asked[qtype]
+		mu.Unlock()
+		if query == nil {
+			t.Fatalf("%s was not forwarded as %s", dns.TypeToString[qtype], dns.TypeToString[qtype])
+		}
+		if opt := query.IsEdns0(); opt == nil || !opt.Do() || !query.CheckingDisabled {
+			t.Errorf("%s was forwarded without DO and CD: %v", dns.TypeToString[qtype], query)
+		}
+
+		var types []uint16
+		for _, rr := range r.Answer {
+			types = append(types, rr.Header().Rrtype)
+		}
+		if len(types) != 2 || types[0] != qtype || types[1] != dns.TypeRRSIG {
+			t.Errorf("%s: got answer %v, want the records and their RRSIG", dns.TypeToString[qtype], r.Answer)
+		}
+		if !r.AuthenticatedData || r.Authoritative {
+			t.Errorf("%s: got AD %t and AA %t, want AD only", dns.TypeToString[qtype], r.AuthenticatedData, r.Authoritative)
+		}
+	}
+
+	// Without DO or AD a client gets neither the signatures nor AD.
+	m := new(dns.Msg)
+	m.SetQuestion("example.net.", dns.TypeDS)
+	r, err := s.Exchange(m, "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.AuthenticatedData {
+		t.Errorf("DS without DO: got answer %v with AD %t, want the DS only", r.Answer, r.AuthenticatedData)
+	}
+}
@@ -0,0 +1,187 @@
+package godns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dockerBackend registers records for running containers: the host names
+// in a container's label (dns.name by default, comma separated) and,
+// with a domain configured, <container name>.<domain>. Records follow the
+// Docker event stream, so they appear when a container starts and go away
+// when it stops.
+type dockerBackend struct {
+	srv     *Server
+	base    string
+	label   string
+	domain  string
+	network string
+	hostIP  string
+	client  *http.Client
+}
+
+type dockerContainer struct {
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (s *Server) newDockerBackend(c DockerConfig) (*dockerBackend, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	d := &dockerBackend{
+		srv:     s,
+		label:   c.Label,
+		domain:  strings.ToLower(strings.Trim(c.Domain, ".")),
+		network: c.Network,
+		hostIP:  c.HostIP,
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{DialContext: dialer.DialContext, ResponseHeaderTimeout: 30 * time.Second}
+	switch u.Scheme {
+	case "unix":
+		// The host in the URL is ignored; every request goes to the socket.
+		d.base = "http://docker"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", u.Path)
+		}
+	case "tcp", "http":
+		d.base = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported Docker endpoint %q", c.Endpoint)
+	}
+	// No overall timeout: the event stream stays open indefinitely.
+	d.client = &http.Client{Transport: transport}
+	return d, nil
+}
+
+// run lists the containers and relists on every container event, starting
+// over with a growing delay whenever the event stream fails, until the
+// server shuts down.
+func (d *dockerBackend) run() {
+	for attempt := 0; ; attempt++ {
+		listed, err := d.follow()
+		if listed {
+			attempt = 0
+		}
+		if d.srv.ctx.Err() != nil {
+			return
+		}
+		d.srv.backendFailed("docker", err)
+		if !d.srv.sleep(backoff(attempt)) {
+			return
+		}
+	}
+}
+
+func (d *dockerBackend) follow() (listed bool, err error) {
+	// Subscribe first so no event between the list and the subscription
+	// is missed.
+	filters := url.QueryEscape(`{"type":["container"],"event":["start","die","destroy","rename","connect","disconnect"]}`)
+	resp, err := d.get("/events?filters=" + filters)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := d.publish(); err != nil {
+		return false, err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event json.RawMessage
+		if err := decoder.Decode(&event); err != nil {
+			return true, err
+		}
+		if err := d.publish(); err != nil {
+			return true, err
+		}
+	}
+}
+
+// publish lists the running containers and publishes their records.
+func (d *dockerBackend) publish() error {
+	resp, err := d.get("/containers/json")
+	if err != nil {
+		return err
+	}
+	var containers []dockerContainer
+	err = json.NewDecoder(resp.Body).Decode(&containers)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return strings.Join(containers[i].Names, ",") < strings.Join(containers[j].Names, ",")
+	})
+
+	records := make(map[string]string)
+	for _, c := range containers {
+		ip := d.address(c)
+		for _, name := range strings.Split(c.Labels[d.label], ",") {
+			if name != "" {
+				addRecord(records, name, ip)
+			}
+		}
+		if d.domain != "" {
+			for _, name := range c.Names {
+				addRecord(records, strings.TrimPrefix(name, "/")+"."+d.domain, ip)
+			}
+		}
+	}
+	d.srv.publishBackendRecords("docker", records)
+	return nil
+}
+
+// address picks the IP a container's records point to: the configured
+// host IP (for containers reached through published ports), the
+// container's address on the configured network, or its address on the
+// first network by name.
+func (d *dockerBackend) address(c dockerContainer) string {
+	if d.hostIP != "" {
+		return d.hostIP
+	}
+	if d.network != "" {
+		return c.NetworkSettings.Networks[d.network].IPAddress
+	}
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+func (d *dockerBackend) get(path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(d.srv.ctx, http.MethodGet, d.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
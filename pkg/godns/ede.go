@@ -0,0 +1,71 @@
+package godns
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// setExtendedError explains response to the client with an Extended DNS
+// Error (RFC 8914), if its query has EDNS to carry one.
+func (s *Server) setExtendedError(req, response *dns.Msg, code uint16, text string) {
+	if req.IsEdns0() == nil {
+		return
+	}
+	s.echoEDNS(req, response)
+	opt := response.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// echoEDNS gives response an OPT record if the client's query req has EDNS
+// and response has none yet: a server that supports EDNS must answer such
+// a query with one (RFC 6891, section 7). It carries the DNSSEC OK bit of
+// the query.
+func (s *Server) echoEDNS(req, response *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil && response.IsEdns0() == nil {
+		response.SetEdns0(uint16(s.cfg.MaxUDPSize), opt.Do())
+	}
+}
+
+// upstreamErrorCode returns the Extended DNS Error code of a failed
+// upstream exchange: no reachable authority when every upstream timed out
+// or the query ran out of time, a network error when an upstream could
+// not be talked to, and other errors otherwise.
+func upstreamErrorCode(err error) uint16 {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dns.ExtendedErrorCodeNoReachableAuthority
+	case errors.As(err, &netErr):
+		return dns.ExtendedErrorCodeNetworkError
+	}
+	return dns.ExtendedErrorCodeOther
+}
+
+// relayEDNS replaces the OPT record of an upstream answer with the one the
+// client gets: none if its query had no EDNS, otherwise one with its DNSSEC
+// OK bit and the Extended DNS Errors of the upstream, which explain e.g. a
+// SERVFAIL for a DNSSEC validation failure, whether or not DO is set.
+func (s *Server) relayEDNS(req, response *dns.Msg) {
+	var upstreamErrors []*dns.EDNS0_EDE
+	extra := response.Extra[:0]
+	for _, rr := range response.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			extra = append(extra, rr)
+			continue
+		}
+		for _, option := range opt.Option {
+			if ede, ok := option.(*dns.EDNS0_EDE); ok {
+				upstreamErrors = append(upstreamErrors, ede)
+			}
+		}
+	}
+	response.Extra = extra
+	s.echoEDNS(req, response)
+	for _, ede := range upstreamErrors {
+		s.setExtendedError(req, response, ede.InfoCode, ede.ExtraText)
+	}
+}
@@ -0,0 +1,220 @@
+package godns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etcdBackend keeps the records stored under a key prefix in etcd in sync
+// through the v3 JSON gateway: a range read followed by a watch from the
+// revision read, so every instance sees changes as soon as they commit.
+type etcdBackend struct {
+	srv       *Server
+	endpoints []string
+	prefix    string
+	username  string
+	password  string
+	client    *http.Client
+
+	next  int
+	token string
+}
+
+func (s *Server) newEtcdBackend(c EtcdConfig) *etcdBackend {
+	endpoints := make([]string, len(c.Endpoints))
+	for i, endpoint := range c.Endpoints {
+		endpoints[i] = strings.TrimSuffix(endpoint, "/")
+	}
+	return &etcdBackend{
+		srv:       s,
+		endpoints: endpoints,
+		prefix:    c.Prefix,
+		username:  c.Username,
+		password:  c.Password,
+		// No overall timeout: the watch response streams indefinitely.
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+		}},
+	}
+}
+
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// run syncs with etcd until the server shuts down, moving on to the next
+// endpoint with a growing delay whenever the connection fails.
+func (e *etcdBackend) run() {
+	for attempt := 0; ; attempt++ {
+		endpoint := e.endpoints[e.next%len(e.endpoints)]
+		synced, err := e.sync(endpoint)
+		if synced {
+			attempt = 0
+		}
+		if e.srv.ctx.Err() != nil {
+			return
+		}
+		e.srv.backendFailed("etcd", fmt.Errorf("%s: %v", endpoint, err))
+		e.next++
+		if !e.srv.sleep(backoff(attempt)) {
+			return
+		}
+	}
+}
+
+// sync loads all records from endpoint and then applies watch events until
+// the watch fails. synced reports whether the records were loaded.
+func (e *etcdBackend) sync(endpoint string) (synced bool, err error) {
+	if e.username != "" {
+		var auth struct {
+			Token string `json:"token"`
+		}
+		body := map[string]string{"name": e.username, "password": e.password}
+		if err := e.post(endpoint, "/v3/auth/authenticate", body, &auth); err != nil {
+			return false, err
+		}
+		e.token = auth.Token
+	}
+
+	var ranged struct {
+		Header etcdHeader `json:"header"`
+		Kvs    []etcdKV   `json:"kvs"`
+	}
+	keyRange := map[string][]byte{"key": []byte(e.prefix), "range_end": prefixEnd(e.prefix)}
+	if err := e.post(endpoint, "/v3/kv/range", keyRange, &ranged); err != nil {
+		return false, err
+	}
+	records := make(map[string]string, len(ranged.Kvs))
+	for _, kv := range ranged.Kvs {
+		e.apply(records, kv, false)
+	}
+	e.srv.publishBackendRecords("etcd", records)
+
+	watch := map[string]interface{}{"create_request": map[string]interface{}{
+		"key":            []byte(e.prefix),
+		"range_end":      prefixEnd(e.prefix),
+		"start_revision": fmt.Sprint(ranged.Header.Revision + 1),
+	}}
+	resp, err := e.request(endpoint, "/v3/watch", watch)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+				Events       []struct {
+					Type string `json:"type"`
+					Kv   etcdKV `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			return true, err
+		}
+		if msg.Error != nil {
+			return true, fmt.Errorf("watch: %s", msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return true, fmt.Errorf("watch canceled: %s", msg.Result.CancelReason)
+		}
+		if len(msg.Result.Events) == 0 {
+			continue
+		}
+
+		next := make(map[string]string, len(records))
+		for k, v := range records {
+			next[k] = v
+		}
+		for _, event := range msg.Result.Events {
+			e.apply(next, event.Kv, event.Type == "DELETE")
+		}
+		records = next
+		e.srv.publishBackendRecords("etcd", records)
+	}
+}
+
+// apply stores or deletes the record of one key in records.
+func (e *etcdBackend) apply(records map[string]string, kv etcdKV, deleted bool) {
+	host, ok := normalizeRecordHost(strings.TrimPrefix(string(kv.Key), e.prefix))
+	if !ok {
+		e.srv.logMessage(fmt.Sprintf("Ignoring etcd key %q: invalid host name", kv.Key))
+		return
+	}
+	if deleted {
+		delete(records, host)
+		return
+	}
+	ip := strings.TrimSpace(string(kv.Value))
+	if net.ParseIP(ip) == nil {
+		e.srv.logMessage(fmt.Sprintf("Ignoring etcd key %q: invalid IP address %q", kv.Key, ip))
+		return
+	}
+	records[host] = ip
+}
+
+func (e *etcdBackend) post(endpoint, path string, body, out interface{}) error {
+	resp, err := e.request(endpoint, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (e *etcdBackend) request(endpoint, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(e.srv.ctx, http.MethodPost, endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.token != "" {
+		req.Header.Set("Authorization", e.token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// prefixEnd returns the range end that selects every key starting with
+// prefix: the prefix with its last byte incremented.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,131 @@
+package godns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	eventFailover = "failover"
+	eventFailback = "failback"
+)
+
+// failoverGroup is a name answered with its primary address while the
+// primary passes its health check and with the backup while it fails.
+type failoverGroup struct {
+	srv *Server
+	FailoverGroup
+	failed atomic.Bool
+	client *http.Client
+}
+
+// startFailover creates the configured failover groups and starts checking
+// their primaries. Groups start out on the primary.
+func (s *Server) startFailover() {
+	if len(s.cfg.Failover) == 0 {
+		return
+	}
+	s.failoverGroups = make(map[string]*failoverGroup, len(s.cfg.Failover))
+	for _, fc := range s.cfg.Failover {
+		g := &failoverGroup{srv: s, FailoverGroup: fc}
+		g.client = &http.Client{
+			Timeout: fc.Timeout,
+			// A redirect is a passed check, not one to follow.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		s.failoverGroups[fc.Name] = g
+		s.goBackground(g.run)
+	}
+}
+
+// failoverAddress returns the address a failover group answers host with.
+func (s *Server) failoverAddress(host string) (string, bool) {
+	g := s.failoverGroups[host]
+	if g == nil {
+		return "", false
+	}
+	if g.failed.Load() {
+		return g.Backup, true
+	}
+	return g.Primary, true
+}
+
+// run checks the primary every interval and switches after Failures
+// consecutive results that disagree with the current state, until the
+// server shuts down.
+func (g *failoverGroup) run() {
+	streak := 0
+	for {
+		err := g.check()
+		if failed := err != nil; failed != g.failed.Load() {
+			streak++
+			if streak >= g.Failures {
+				streak = 0
+				g.failed.Store(failed)
+				if failed {
+					g.srv.notify(eventFailover, fmt.Sprintf("%s: primary %s failed its check (%v), answering with %s", g.Name, g.Primary, err, g.Backup))
+				} else {
+					g.srv.notify(eventFailback, fmt.Sprintf("%s: primary %s passes its check again", g.Name, g.Primary))
+				}
+			}
+		} else {
+			streak = 0
+		}
+		if !g.srv.sleep(g.Interval) {
+			return
+		}
+	}
+}
+
+// check runs the group's health check once.
+func (g *failoverGroup) check() error {
+	u, err := url.Parse(g.Check)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", u.Host, g.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), g.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.Check, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// failoverStats reports which address every group answers with, 1 for
+// the primary and 0 for the backup.
+func (s *Server) failoverStats() string {
+	var b strings.Builder
+	for _, fc := range s.cfg.Failover {
+		g := s.failoverGroups[fc.Name]
+		if g == nil {
+			continue
+		}
+		primary := 1
+		if g.failed.Load() {
+			primary = 0
+		}
+		fmt.Fprintf(&b, "failover.%s.primary=%d\n", g.Name, primary)
+	}
+	return b.String()
+}
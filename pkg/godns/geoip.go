@@ -0,0 +1,299 @@
+package godns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// geoDatabase is a MaxMind DB file (.mmdb), as GeoLite2 Country or City
+// and the DB-IP lite databases are distributed, read into memory.
+type geoDatabase struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	treeSize   uint
+	// ipv4Start is the node IPv4 addresses are looked up from in an IPv6
+	// tree, ::/96.
+	ipv4Start uint
+}
+
+// mmdbMetadataStart marks the metadata at the end of a MaxMind DB file.
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// loadGeoIP reads the database at path and makes it the one records are
+// matched against.
+func (s *Server) loadGeoIP(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	db, err := parseGeoDatabase(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	s.geoDB.Store(db)
+	return nil
+}
+
+// reloadGeoIP reads the configured database again, e.g. after it was
+// updated, keeping the previous one if that fails.
+func (s *Server) reloadGeoIP() {
+	if s.cfg.GeoIPDatabase == "" {
+		return
+	}
+	if err := s.loadGeoIP(s.cfg.GeoIPDatabase); err != nil {
+		s.logMessage(fmt.Sprintf("Error reloading the GeoIP database: %v", err))
+	}
+}
+
+func parseGeoDatabase(data []byte) (*geoDatabase, error) {
+	start := bytes.LastIndex(data, mmdbMetadataStart)
+	if start < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	start += len(mmdbMetadataStart)
+	meta, _, err := (mmdbDecoder{data: data[start:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %v", err)
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+	db := &geoDatabase{data: data[:start-len(mmdbMetadataStart)], nodeCount: uint(nodeCount), recordSize: uint(recordSize)}
+	db.treeSize = db.nodeCount * db.recordSize / 4
+	if db.treeSize+16 > uint(len(db.data)) {
+		return nil, errors.New("search tree larger than the file")
+	}
+	if ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (db *geoDatabase) record(node, bit uint) uint {
+	b := db.data[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the data recorded for the network containing ip, or nil.
+func (db *geoDatabase) lookup(ip net.IP) map[string]any {
+	node, addr := uint(0), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		node, addr = db.ipv4Start, ip4
+	}
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(addr[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return nil
+	}
+	d := mmdbDecoder{data: db.data[db.treeSize+16:]}
+	value, _, err := d.decode(node - db.nodeCount - 16)
+	if err != nil {
+		return nil
+	}
+	fields, _ := value.(map[string]any)
+	return fields
+}
+
+// geoLocation returns the ISO country code and the continent code of ip,
+// or "" for what the database does not know.
+func (s *Server) geoLocation(ip net.IP) (country, continent string) {
+	db := s.geoDB.Load()
+	if db == nil || ip == nil {
+		return "", ""
+	}
+	fields := db.lookup(ip)
+	code := func(key, field string) string {
+		m, _ := fields[key].(map[string]any)
+		value, _ := m[field].(string)
+		return value
+	}
+	if country = code("country", "iso_code"); country == "" {
+		country = code("registered_country", "iso_code")
+	}
+	return country, code("continent", "code")
+}
+
+// geoClient returns the address a query is located by: the network of its
+// EDNS client subnet (RFC 7871) if it has one, e.g. when it comes through
+// another resolver, or else the client's own address.
+func geoClient(req *dns.Msg, client net.IP) net.IP {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok && ecs.SourceNetmask > 0 {
+				return ecs.Address
+			}
+		}
+	}
+	return client
+}
+
+// mmdbDecoder decodes values of the MaxMind DB data section format, with
+// pointers relative to the start of data.
+type mmdbDecoder struct {
+	data []byte
+}
+
+var errMMDBTruncated = errors.New("truncated data")
+
+// decode returns the value at offset and the offset after it.
+func (d mmdbDecoder) decode(offset uint) (any, uint, error) {
+	if offset >= uint(len(d.data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	ctrl := d.data[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == 1 {
+		// A pointer; the value it points to is decoded in its place.
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		n := ss + 1
+		if offset+n > uint(len(d.data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		b := d.data[offset : offset+n]
+		var target uint
+		switch ss {
+		case 0:
+			target = vvv<<8 | uint(b[0])
+		case 1:
+			target = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			target = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := d.decode(target)
+		return value, offset + n, err
+	}
+	if kind == 0 {
+		if offset >= uint(len(d.data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		kind = 7 + uint(d.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		b := d.data[offset : offset+n]
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+		offset += n
+	}
+
+	switch kind {
+	case 7: // map
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, _ := key.(string)
+			m[k], offset = value, next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, value), next
+		}
+		return a, offset, nil
+	case 14: // boolean, held in the size
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := d.data[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9, 10: // unsigned integers of up to 16 bytes, big-endian
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		var v int32
+		for _, c := range b {
+			v = v<<8 | int32(c)
+		}
+		return int64(v), offset, nil
+	case 4: // bytes
+		return b, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// geoSelector parses a record selector by location, "country:XX" or
+// "continent:XX", into its kind and code.
+func geoSelector(key string) (kind, code string, ok bool) {
+	kind, code, ok = strings.Cut(key, ":")
+	if !ok || (kind != "country" && kind != "continent") || len(code) != 2 {
+		return "", "", false
+	}
+	return kind, strings.ToUpper(code), true
+}
@@ -0,0 +1,231 @@
+package godns
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventGitSyncFailed = "git_sync_failed"
+
+// gitCheckout pulls the configured branch with the git command and applies
+// its commits one at a time.
+type gitCheckout struct {
+	srv *Server
+	mu  sync.Mutex
+	// commit is the commit checked out, whose files are loaded.
+	commit string
+	// failed is the last commit that failed to load, not tried again.
+	failed string
+}
+
+func init() {
+	handleAdmin("/git/sync", func(s *Server) http.HandlerFunc { return s.gitSyncHandler })
+}
+
+// startGit prepares the checkout of the repository before the first load
+// of the records: the files of an earlier checkout are loaded as they are,
+// commits since are applied by refresh, and otherwise the branch is cloned.
+// A repository that cannot be cloned is reported.
+func (s *Server) startGit() {
+	g := &gitCheckout{srv: s}
+	if _, err := os.Stat(filepath.Join(s.cfg.Git.Dir, ".git")); err == nil {
+		if g.commit, err = g.git("-C", s.cfg.Git.Dir, "rev-parse", "HEAD"); err != nil {
+			s.logMessage(fmt.Sprintf("Error reading git checkout %s: %v", s.cfg.Git.Dir, err))
+		}
+	} else if err := g.sync(false); err != nil {
+		s.notify(eventGitSyncFailed, fmt.Sprintf("cloning %s failed: %v", s.cfg.Git.Repository, err))
+	}
+	s.gitSource = g
+}
+
+// gitFilesDir returns the directory of the record and zone files in the
+// checkout, or "" without a git repository.
+func (s *Server) gitFilesDir() string {
+	if s.cfg.Git.Repository == "" {
+		return ""
+	}
+	return filepath.Join(s.cfg.Git.Dir, s.cfg.Git.Path)
+}
+
+// gitZoneFiles returns the zone files of the git repository, none without
+// one or before it is first checked out.
+func (s *Server) gitZoneFiles() ([]string, error) {
+	dir := s.gitFilesDir()
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := filesIn(dir, ".zone")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return files, err
+}
+
+// gitZoneName returns the name of the zone of a zone file of the git
+// repository, its file name without the .zone extension.
+func gitZoneName(path string) string {
+	return strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".zone"))
+}
+
+// git runs the git command with args and returns its trimmed output.
+func (g *gitCheckout) git(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(g.srv.ctx, g.srv.cfg.Git.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// Fail rather than wait for credentials on a terminal.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	command := args[0]
+	if command == "-C" {
+		command = args[2]
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return "", fmt.Errorf("git %s: %s", command, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if err != nil {
+		return "", fmt.Errorf("git: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pull clones the branch into Dir, or fetches it into the existing
+// checkout, and returns its head commit.
+func (g *gitCheckout) pull() (string, error) {
+	if _, err := os.Stat(filepath.Join(g.srv.cfg.Git.Dir, ".git")); errors.Is(err, fs.ErrNotExist) {
+		if _, err := g.git("clone", "--quiet", "--single-branch", "--branch", g.srv.cfg.Git.Branch, g.srv.cfg.Git.Repository, g.srv.cfg.Git.Dir); err != nil {
+			return "", err
+		}
+		return g.git("-C", g.srv.cfg.Git.Dir, "rev-parse", "HEAD")
+	}
+	// Fetched by URL, so that a changed repository takes effect.
+	if _, err := g.git("-C", g.srv.cfg.Git.Dir, "fetch", "--quiet", g.srv.cfg.Git.Repository, g.srv.cfg.Git.Branch); err != nil {
+		return "", err
+	}
+	return g.git("-C", g.srv.cfg.Git.Dir, "rev-parse", "FETCH_HEAD")
+}
+
+// sync pulls the branch and checks its head commit out if it moved. With
+// reload the records are reloaded from it; a commit whose files fail to
+// load is reverted in the checkout, so that the files there stay those
+// being served, and not tried again.
+func (g *gitCheckout) sync(reload bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	head, err := g.pull()
+	if err != nil || head == g.commit || head == g.failed {
+		return err
+	}
+	if _, err := g.git("-C", g.srv.cfg.Git.Dir, "reset", "--quiet", "--hard", head); err != nil {
+		return err
+	}
+	prev := g.commit
+	g.commit = head
+	if !reload {
+		return nil
+	}
+	if err := g.srv.reloadHosts("git:" + shortCommit(head)); err != nil {
+		g.failed = head
+		if prev != "" {
+			if _, resetErr := g.git("-C", g.srv.cfg.Git.Dir, "reset", "--quiet", "--hard", prev); resetErr != nil {
+				g.srv.logMessage(fmt.Sprintf("Error restoring git commit %s: %v", shortCommit(prev), resetErr))
+			} else {
+				g.commit = prev
+			}
+		}
+		return fmt.Errorf("commit %s: %v", shortCommit(head), err)
+	}
+	g.srv.logMessage(fmt.Sprintf("Applied git commit %s", shortCommit(head)))
+	return nil
+}
+
+func shortCommit(commit string) string {
+	return commit[:min(len(commit), 12)]
+}
+
+// refresh pulls the branch now and then every interval, once the records
+// are loaded, until the server shuts down. Failures are reported and keep
+// the records of the last commit applied.
+func (g *gitCheckout) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := g.sync(true); err != nil {
+			g.srv.notify(eventGitSyncFailed, fmt.Sprintf("syncing %s failed: %v", g.srv.cfg.Git.Repository, err))
+		}
+		select {
+		case <-ticker.C:
+		case <-g.srv.ctx.Done():
+			return
+		}
+	}
+}
+
+// gitSyncHandler pulls the branch now, for a push webhook of the
+// repository. It takes the admin token, or with a webhook secret a push
+// signed with it by GitHub or carrying it as a GitLab token.
+func (s *Server) gitSyncHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.gitWebhookAuthorized(r, body) {
+		s.syncGitNow(w, r)
+		return
+	}
+	s.requireToken(s.syncGitNow)(w, r)
+}
+
+func (s *Server) syncGitNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.gitSource == nil {
+		http.Error(w, "no git repository is configured", http.StatusConflict)
+		return
+	}
+	if err := s.gitSource.sync(true); err != nil {
+		s.notify(eventGitSyncFailed, fmt.Sprintf("syncing %s failed: %v", s.cfg.Git.Repository, err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gitWebhookAuthorized reports whether r carries the webhook secret: as
+// the HMAC-SHA256 signature of body GitHub sends in X-Hub-Signature-256,
+// or as the token GitLab sends in X-Gitlab-Token.
+func (s *Server) gitWebhookAuthorized(r *http.Request, body []byte) bool {
+	secret := s.cfg.Git.WebhookSecret
+	if secret == "" {
+		return false
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
@@ -0,0 +1,849 @@
+// Package godns is the godns DNS server: local records from hosts files
+// and record backends, zone files and secondary zones, and forwarding of
+// everything else to upstream resolvers. The godns command is a thin
+// wrapper around Main; other programs can embed a Server instead.
+//
+// Every Server has its own configuration, records and statistics, so a
+// process can run several, each on its own listen addresses.
+//
+// The exported API of this package and of godnstest follows semantic
+// versioning with the module github.com/nodesocket/godns: while the major
+// version is 0, incompatible changes only come with a new minor version,
+// and are listed in the release notes. Deprecated names stay until the
+// next major version.
+package godns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// Version is the release of this package and of the godns command.
+const Version = version
+
+// Resolver answers DNS queries. *Server implements it, so a program with
+// its own DNS listener can hand queries to godns.
+type Resolver interface {
+	Resolve(req *dns.Msg, client net.IP) *dns.Msg
+}
+
+// Store reads and writes the records godns serves. FileStore edits the
+// hosts file directly, APIStore goes through the admin API of a running
+// instance and *Server changes the records of the embedded server.
+type Store interface {
+	List() ([]Record, error)
+	Get(host string) (string, error)
+	Set(host, ip string) error
+	Remove(host string) error
+}
+
+// RecordStore is a source of host records, host name => address. Records
+// is called on every load of the record set; a store whose records change
+// on their own can call Server.Reload.
+type RecordStore interface {
+	Records() (map[string]string, error)
+}
+
+// Upstream answers the queries for names without a local record or zone.
+// The default sends them to the configured upstream resolvers over UDP,
+// or over TCP for truncated answers and queries received over TCP.
+type Upstream interface {
+	Exchange(msg *dns.Msg) (*dns.Msg, error)
+}
+
+// ContextUpstream is an Upstream that can give up on a query when ctx is
+// done, at the deadline of the query it forwards. An Upstream that is not
+// one is left to answer, but the query is answered with SERVFAIL at its
+// deadline regardless.
+type ContextUpstream interface {
+	Upstream
+	ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// Server serves DNS over UDP and TCP on the configured addresses, and over
+// TLS if configured. Set the exported fields before Start.
+type Server struct {
+	// RecordStores are loaded after the hosts files, in order, so their
+	// records take precedence over those of the files and of each other.
+	RecordStores []RecordStore
+	// Upstream replaces the configured upstream resolvers and forward
+	// zones if set.
+	Upstream Upstream
+
+	cfg *Config
+
+	udpConns     []*net.UDPConn
+	tcpListeners []*net.TCPListener
+	// tlsListener is the TCP listener DNS over TLS is served on.
+	tlsListener *net.TCPListener
+	// adminListener, grpcListener and debugListener are handed over on
+	// upgrades.
+	adminListener *net.TCPListener
+	grpcListener  *net.TCPListener
+	debugListener *net.TCPListener
+	adminMux      *http.ServeMux
+	servers       []*dns.Server
+	// pools holds the worker pool of every shard.
+	pools []*queryPool
+	// serving tracks the dns.Servers until they return.
+	serving sync.WaitGroup
+	// ctx is canceled by stop when the Server shuts down or fails to
+	// start, which ends the goroutines tracked by background.
+	ctx        context.Context
+	stop       context.CancelFunc
+	background sync.WaitGroup
+	// stopLogs ends the log writer, after the goroutines have stopped.
+	stopLogs context.CancelFunc
+
+	logger   *log.Logger
+	logChan  chan logEntry
+	logFlush chan chan struct{}
+	// auditMu guards auditFile, the audit log or nil.
+	auditMu   sync.Mutex
+	auditFile *os.File
+
+	startTime time.Time
+	stats     struct {
+		queries        atomic.Uint64
+		malformed      atomic.Uint64
+		localAnswers   atomic.Uint64
+		forwarded      atomic.Uint64
+		upstreamErrors atomic.Uint64
+		servfail       atomic.Uint64
+		sendErrors     atomic.Uint64
+		overloaded     atomic.Uint64
+		shed           atomic.Uint64
+		blocked        atomic.Uint64
+		rewritten      atomic.Uint64
+		// recursiveQueries counts the queries recursive mode sent to
+		// authoritative servers.
+		recursiveQueries atomic.Uint64
+		// rootZone counts the names answered from the local root zone.
+		rootZone atomic.Uint64
+		// deadlineExceeded counts queries answered with SERVFAIL at
+		// their query_timeout deadline.
+		deadlineExceeded atomic.Uint64
+		panics           atomic.Uint64
+		logsDropped      atomic.Uint64
+		coalesced        atomic.Uint64
+	}
+	statsd         *statsdClient
+	queryAggregate *queryCounts
+	recentQueries  *queryRing
+	listenerBound  atomic.Bool
+	hostsLoaded    atomic.Bool
+
+	// mutex serializes reading the record sources.
+	mutex sync.Mutex
+	// reloadMu serializes reloads, so that the set published last is the
+	// one loaded last and each is compared with the one it replaces.
+	reloadMu    sync.Mutex
+	liveRecords atomic.Pointer[recordSet]
+	// liveZones maps zone origins to their data. Like the records it is
+	// swapped in as a whole and never modified after being published.
+	liveZones atomic.Pointer[map[string]*zoneData]
+	// apiWriteMu serializes read-modify-write cycles on the hosts file.
+	apiWriteMu sync.Mutex
+	// historyMu serializes writing snapshots, which are numbered in order.
+	historyMu sync.Mutex
+	// updateMu serializes dynamic updates so each one applies to the
+	// result of the previous.
+	updateMu           sync.Mutex
+	secondaryRefreshMu sync.Mutex
+	// secondaryRefresh holds a channel per secondary zone that wakes its
+	// refresh loop early, when the primary sends a NOTIFY.
+	secondaryRefresh map[string]chan struct{}
+	// extraStores are the RecordStores of an embedding program, loaded
+	// after the hosts files.
+	extraStores []RecordStore
+	remote      *remoteSource
+	// clusterSource is the primary's record set on a follower.
+	clusterSource *remoteSource
+	// gitSource is the checkout of the git repository of record and zone
+	// files, or nil when none is configured.
+	gitSource *gitCheckout
+	// Record backends (etcd, Consul, ...) keep their own records up to
+	// date in the background and publish them in backendRecords;
+	// loadHosts merges them into every record set, below the remote
+	// source and the hosts files.
+	backendMu      sync.Mutex
+	backendRecords map[string]map[string]string
+	// dhcpReverse maps the reverse names (1.1.168.192.in-addr.arpa) of
+	// leased addresses to the host name of the lease.
+	dhcpReverseMu sync.RWMutex
+	dhcpReverse   map[string]string
+	catalogMu     sync.Mutex
+	// catalogMembers maps the member zones of consumed catalog zones to
+	// their configuration.
+	catalogMembers map[string]*catalogMember
+	liveRootZone   atomic.Pointer[rootZone]
+	tenants        []*tenant
+	// serviceRecords holds the DNS-SD records of the configured services
+	// by lowercase owner name, failoverGroups the failover groups by name
+	// and rewriteRules the compiled rewrites; they are set once at
+	// startup.
+	serviceRecords map[string][]dns.RR
+	failoverGroups map[string]*failoverGroup
+	rewriteRules   []rewriteRule
+	hooks          hookScripts
+	plugins        []*plugin
+	// geoDB is the GeoIP database record selectors by country and
+	// continent are matched against, or nil without geoip_database.
+	geoDB atomic.Pointer[geoDatabase]
+
+	liveBlocks atomic.Pointer[blockSet]
+	// blockMemory is the blocklists' share of the memory budget.
+	blockMemory     *budgetAccount
+	blockMemoryOnce sync.Once
+	// blockHits counts the queries of every client for every rule, so a
+	// device that keeps asking for a blocked domain stands out. Clients
+	// the memory budget has no room for are counted as otherKey.
+	blockHits struct {
+		sync.Mutex
+		counts map[blockHit]uint64
+		memory *budgetAccount
+	}
+	activeCapture atomic.Pointer[captureSession]
+
+	// forwarder answers the queries godns has no local answer for.
+	forwarder         Upstream
+	upstreamDNS       *dns.Client
+	upstreamTCP       *dns.Client
+	upstreams         []*upstream
+	forwardZones      []forwardZone
+	upstreamAvailable atomic.Bool
+	upstreamChecked   atomic.Bool
+	upstreamLatencyMu sync.Mutex
+	upstreamLatency   map[string]*latencyHistogram
+	// inflight collapses concurrent upstream queries for the same
+	// question.
+	inflight singleflight.Group
+	// cache keeps upstream answers, or is nil when cache_size is 0.
+	cache *responseCache
+	// budget caps the memory of the response cache and the query summary
+	// counters together, or is nil when memory_budget is 0.
+	budget        *memoryBudget
+	warmupRunning sync.Mutex
+}
+
+// New validates c and returns a Server with configuration c. Every Server
+// has its own records, caches and statistics, so a process can run
+// several, each on its own listen addresses.
+func New(c *Config) (*Server, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return newServer(c), nil
+}
+
+// newServer returns a Server with configuration c, which must be valid or
+// only used to read records, as the subcommands do.
+func newServer(c *Config) *Server {
+	s := &Server{
+		cfg:              c,
+		adminMux:         http.NewServeMux(),
+		logger:           log.New(os.Stdout, "", 0),
+		logChan:          make(chan logEntry, 8192),
+		logFlush:         make(chan chan struct{}),
+		startTime:        time.Now(),
+		backendRecords:   map[string]map[string]string{},
+		catalogMembers:   map[string]*catalogMember{},
+		secondaryRefresh: map[string]chan struct{}{},
+		upstreamDNS:      &dns.Client{Net: "udp", Timeout: 2 * time.Second},
+		upstreamTCP:      &dns.Client{Net: "tcp", Timeout: 2 * time.Second},
+		upstreamLatency:  make(map[string]*latencyHistogram),
+	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	s.blockHits.counts = make(map[blockHit]uint64)
+	s.forwarder = udpForwarder{s}
+	for _, route := range adminRoutes {
+		s.adminMux.HandleFunc(route.pattern, route.handler(s))
+	}
+	return s
+}
+
+// Start loads the records and zones, starts the configured record
+// backends and admin endpoints, binds the listeners and serves queries in
+// the background. If it fails, it stops what it already started.
+func (s *Server) Start() (err error) {
+	logs, stopLogs := context.WithCancel(context.Background())
+	s.stopLogs = stopLogs
+	go s.writeLogs(logs)
+	defer func() {
+		if err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+			defer cancel()
+			s.stopBackground(ctx)
+			s.stopLogWriter(ctx)
+		}
+	}()
+
+	s.upstreamDNS.Timeout = s.cfg.UpstreamTimeout
+	s.upstreamTCP.Timeout = s.cfg.UpstreamTimeout
+	s.upstreams = s.newUpstreams(s.cfg.Upstreams)
+	s.forwardZones = s.newForwardZones(s.cfg.ForwardZones)
+	if s.cfg.Recursive {
+		s.forwarder = s.newRecursor(s.cfg.RootHints)
+	}
+	if s.Upstream != nil {
+		s.forwarder = s.Upstream
+	}
+	s.extraStores = s.RecordStores
+	s.applyMemoryLimit()
+	if s.cfg.MemoryBudget > 0 {
+		s.budget = newMemoryBudget(int64(s.cfg.MemoryBudget))
+	}
+	if s.cfg.GeoIPDatabase != "" {
+		if err := s.loadGeoIP(s.cfg.GeoIPDatabase); err != nil {
+			return fmt.Errorf("loading GeoIP database: %v", err)
+		}
+	}
+	if s.hooks, err = compileHooks(s.cfg.Hooks); err != nil {
+		return err
+	}
+	if s.plugins, err = s.loadPlugins(s.cfg.Plugins, s.cfg.Workers); err != nil {
+		return err
+	}
+
+	var logOutputs []io.Writer
+	if s.cfg.Logging.File != "" {
+		file, err := os.OpenFile(s.cfg.Logging.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("opening log file: %v", err)
+		}
+		logOutputs = append(logOutputs, file)
+	}
+	if s.cfg.Logging.Syslog != "" {
+		w, err := newSyslogWriter(s.cfg.Logging.Syslog, s.cfg.Logging.SyslogFacility)
+		if err != nil {
+			return fmt.Errorf("connecting to syslog: %v", err)
+		}
+		logOutputs = append(logOutputs, w)
+	}
+	if len(logOutputs) > 0 {
+		// With both set, every message goes to the file and to syslog.
+		s.logger.SetOutput(io.MultiWriter(logOutputs...))
+	}
+
+	if s.cfg.Logging.AuditLog != "" {
+		if err := s.openAuditLog(s.cfg.Logging.AuditLog); err != nil {
+			return fmt.Errorf("opening audit log: %v", err)
+		}
+	}
+
+	if s.cfg.Remote.URL != "" {
+		r, err := s.newRemoteSource(s.cfg.Remote.URL, s.cfg.Remote.AuthHeader, s.cfg.Remote.Timeout)
+		if err != nil {
+			return fmt.Errorf("in remote records configuration: %v", err)
+		}
+		s.remote = r
+		if _, err := s.remote.fetch(); err != nil {
+			s.notify(eventRemoteFetchFailed, fmt.Sprintf("fetching records from %s failed: %v", s.cfg.Remote.URL, err))
+		}
+		s.goBackground(func() { s.remote.refresh(s.cfg.Remote.Interval) })
+	}
+
+	if s.cfg.Git.Repository != "" {
+		s.startGit()
+	}
+
+	if s.cfg.Cluster.Primary != "" {
+		if err := s.startClusterFollower(); err != nil {
+			return fmt.Errorf("in cluster configuration: %v", err)
+		}
+	}
+
+	dnsRecords, typedRecords, err := s.loadHosts()
+	if err != nil {
+		return fmt.Errorf("loading hosts file: %v", err)
+	}
+	zoneFiles, err := s.loadZoneFiles()
+	if err != nil {
+		return fmt.Errorf("loading zone file: %v", err)
+	}
+	views, err := s.loadViews()
+	if err != nil {
+		return fmt.Errorf("loading views: %v", err)
+	}
+	s.produceCatalogs(nil, zoneFiles)
+	s.setRecords(dnsRecords, typedRecords, views)
+	s.setZones(zoneFiles)
+	if s.tenants, err = s.newTenants(); err != nil {
+		return fmt.Errorf("loading tenants: %v", err)
+	}
+	s.startSecondaries()
+	s.startRootZone()
+	s.startFailover()
+	s.serviceRecords = s.buildServiceRecords(s.cfg.Services)
+	s.rewriteRules = compileRewrites(s.cfg.Rewrites)
+	s.reloadBlocklists()
+	if len(s.cfg.Etcd.Endpoints) > 0 {
+		s.goBackground(s.newEtcdBackend(s.cfg.Etcd).run)
+	}
+	if s.cfg.Consul.Address != "" {
+		s.goBackground(s.newConsulBackend(s.cfg.Consul).run)
+	}
+	if s.cfg.Kubernetes.APIServer != "" {
+		k, err := s.newKubernetesBackend(s.cfg.Kubernetes)
+		if err != nil {
+			return fmt.Errorf("in Kubernetes configuration: %v", err)
+		}
+		k.run()
+	}
+	if s.cfg.Docker.Endpoint != "" {
+		d, err := s.newDockerBackend(s.cfg.Docker)
+		if err != nil {
+			return fmt.Errorf("in Docker configuration: %v", err)
+		}
+		s.goBackground(d.run)
+	}
+	if s.cfg.Redis.Address != "" {
+		s.goBackground(s.newRedisBackend(s.cfg.Redis).run)
+	}
+	if s.cfg.DHCP.Leases != "" {
+		s.goBackground(s.newDHCPBackend(s.cfg.DHCP).run)
+	}
+	if s.cfg.Tailscale.Enabled {
+		s.goBackground(s.newTailscaleBackend(s.cfg.Tailscale).run)
+	}
+	if s.cfg.WireGuard.Config != "" {
+		s.goBackground(s.newWireGuardBackend(s.cfg.WireGuard).run)
+	}
+	if s.cfg.MDNS.Enabled {
+		if err := s.startMDNS(); err != nil {
+			return err
+		}
+	}
+	s.hostsLoaded.Store(true)
+	s.auditStartup(dnsRecords)
+	if s.gitSource != nil {
+		s.goBackground(func() { s.gitSource.refresh(s.cfg.Git.Interval) })
+	}
+	s.historyStartup()
+
+	if s.cfg.Admin.RecentQueries > 0 {
+		s.recentQueries = newQueryRing(s.cfg.Admin.RecentQueries)
+	}
+	if s.cfg.Logging.SummaryInterval > 0 {
+		s.queryAggregate = s.newQueryCounts()
+		s.goBackground(func() { s.logQuerySummaries(s.cfg.Logging.SummaryInterval) })
+	}
+	if s.cfg.StatsD.Address != "" {
+		s.statsd, err = s.newStatsdClient(s.cfg.StatsD.Address, s.cfg.StatsD.Prefix, s.cfg.StatsD.Tags)
+		if err != nil {
+			return fmt.Errorf("connecting to StatsD: %v", err)
+		}
+		s.goBackground(func() { s.statsd.run(s.cfg.StatsD.Interval) })
+	}
+	if s.cfg.Admin.Listen != "" {
+		s.startAdminServer(s.cfg.Admin.Listen)
+	}
+	if s.cfg.Admin.GRPCListen != "" {
+		if err := s.startGRPCServer(s.cfg.Admin.GRPCListen); err != nil {
+			return fmt.Errorf("listening for gRPC: %v", err)
+		}
+	}
+	if s.cfg.Admin.DebugListen != "" {
+		s.startDebugServer(s.cfg.Admin.DebugListen)
+	}
+	if s.forwarding() {
+		s.goBackground(s.probeUpstreams)
+	}
+	if s.cfg.CacheSize > 0 {
+		s.cache = s.newResponseCache(s.cfg.CacheSize)
+	}
+	if s.cfg.WatchHosts {
+		var watched []string
+		if s.cfg.HostsFile != "" {
+			watched = append(watched, s.cfg.HostsFile)
+		}
+		if s.cfg.EtcHosts != "" {
+			watched = append(watched, s.cfg.EtcHosts)
+		}
+		watched = append(watched, s.cfg.ExtraHostsFiles...)
+		if s.cfg.HostsDir != "" {
+			watched = append(watched, s.cfg.HostsDir)
+		}
+		for _, zone := range s.cfg.Zones {
+			if zone.File != "" {
+				watched = append(watched, zone.File)
+			}
+		}
+		for _, v := range s.cfg.Views {
+			if v.HostsFile != "" {
+				watched = append(watched, v.HostsFile)
+			}
+		}
+		for _, t := range s.cfg.Tenants {
+			if t.HostsFile != "" {
+				watched = append(watched, t.HostsFile)
+			}
+			for _, zone := range t.Zones {
+				if zone.File != "" {
+					watched = append(watched, zone.File)
+				}
+			}
+		}
+		if err := s.watchFiles(watched, func() { s.reloadHosts("watch") }); err != nil {
+			return fmt.Errorf("watching hosts file: %v", err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if s.cfg.TLS.Listen != "" {
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		return err
+	}
+	s.listenerBound.Store(true)
+	var bound []string
+	for i, serverConn := range s.udpConns {
+		if i == 0 || serverConn.LocalAddr().String() != bound[len(bound)-1] {
+			bound = append(bound, serverConn.LocalAddr().String())
+		}
+		s.setSocketBuffers(serverConn)
+	}
+	s.logger.Printf("godns listening on %s...", strings.Join(bound, ", "))
+	if s.tlsListener != nil {
+		s.logger.Printf("godns serving DNS over TLS on %s...", s.tlsListener.Addr())
+	}
+
+	// Each shard has its own workers and queue, and the sockets of every
+	// listen address are spread across the shards, so a query is read,
+	// answered and sent without touching another shard's queue or socket.
+	shards := s.shardCount()
+	queueSize := (s.cfg.QueueSize + shards - 1) / shards
+	shedAt := 0
+	if s.cfg.ShedThreshold > 0 {
+		shedAt = max(1, int(s.cfg.ShedThreshold*float64(queueSize)))
+	}
+	var trusted []*net.IPNet
+	for _, cidr := range s.cfg.ShedTrusted {
+		_, network, _ := net.ParseCIDR(cidr)
+		trusted = append(trusted, network)
+	}
+	for i := 0; i < shards; i++ {
+		s.pools = append(s.pools, s.newQueryPool((s.cfg.Workers+shards-1)/shards, queueSize, s.cfg.Overload, shedAt, trusted))
+	}
+	for i, serverConn := range s.udpConns {
+		h := releaseQuery(s.pools[i%shards].handle(handler{s, s.listenerTenant(serverConn.LocalAddr())}))
+		s.servers = append(s.servers, s.newDNSServer(&dns.Server{PacketConn: batchUDP(serverConn, s.cfg.MaxUDPSize, &s.stats.sendErrors)}, h))
+	}
+	for i, tcpListener := range s.tcpListeners {
+		h := s.pools[i%shards].handle(handler{s, s.listenerTenant(tcpListener.Addr())})
+		s.servers = append(s.servers, s.newDNSServer(&dns.Server{Listener: tcpListener}, h))
+	}
+	if s.tlsListener != nil {
+		h := s.pools[0].handle(handler{srv: s})
+		s.servers = append(s.servers, s.newDNSServer(&dns.Server{Listener: tls.NewListener(s.tlsListener, tlsConfig), Net: "tcp-tls"}, h))
+	}
+	// Wait for every server to be started, so Stop can shut them down.
+	var started sync.WaitGroup
+	for _, server := range s.servers {
+		started.Add(1)
+		server.NotifyStartedFunc = started.Done
+		s.serving.Add(1)
+		go func(server *dns.Server) {
+			defer s.serving.Done()
+			if err := server.ActivateAndServe(); err != nil {
+				s.logMessage(fmt.Sprintf("Error serving DNS: %v", err))
+			}
+		}(server)
+	}
+	started.Wait()
+	s.warmCache()
+	return nil
+}
+
+// newDNSServer completes a dns.Server for one listener.
+func (s *Server) newDNSServer(server *dns.Server, handler dns.Handler) *dns.Server {
+	server.Handler = handler
+	server.UDPSize = s.cfg.MaxUDPSize
+	server.MsgAcceptFunc = s.acceptQuery
+	server.TsigProvider = tsigKeyring{s.cfg}
+	server.DecorateReader = s.captureReader
+	if s.cfg.Malformed == "drop" {
+		server.DecorateReader = func(r dns.Reader) dns.Reader {
+			return malformedReader{s.captureReader(r).(dns.PacketConnReader), s}
+		}
+	}
+	// How long a TCP client may sit idle between queries before its
+	// connection is closed (RFC 7766 section 6.2.3).
+	server.IdleTimeout = func() time.Duration { return 10 * time.Second }
+	return server
+}
+
+// listen binds a UDP socket per shard and a TCP listener for every listen
+// address, the tenants' included, and the DNS over TLS listener, unless it
+// inherits them from the process this one upgrades. Inherited listeners of addresses no longer configured
+// are closed, along with the sockets of other endpoints no longer
+// configured.
+func (s *Server) listen() error {
+	inherited, err := inheritListeners()
+	if err != nil {
+		return err
+	}
+	defer closeInherited()
+	defer inherited.close()
+	for _, addr := range s.listenAddrs() {
+		serverAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return fmt.Errorf("resolving address: %v", err)
+		}
+		if serverConns, tcpListener := inherited.take(serverAddr); serverConns != nil {
+			if len(serverConns) != s.shardCount() {
+				s.logMessage(fmt.Sprintf("Inherited %d UDP socket(s) for %s but %d are configured; restart to apply shard changes", len(serverConns), addr, s.shardCount()))
+			}
+			s.udpConns = append(s.udpConns, serverConns...)
+			s.tcpListeners = append(s.tcpListeners, tcpListener)
+			continue
+		}
+		if serverAddr.Port == 0 {
+			if err := s.listenEphemeral(serverAddr); err != nil {
+				return fmt.Errorf("listening: %v", err)
+			}
+			continue
+		}
+		serverConns, err := listenUDPShards(serverAddr, s.shardCount())
+		if err != nil {
+			return fmt.Errorf("listening: %v", err)
+		}
+		s.udpConns = append(s.udpConns, serverConns...)
+
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("resolving address: %v", err)
+		}
+		tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return fmt.Errorf("listening: %v", err)
+		}
+		s.tcpListeners = append(s.tcpListeners, tcpListener)
+	}
+	if s.cfg.TLS.Listen != "" {
+		if s.tlsListener, err = listenTCP("tls", s.cfg.TLS.Listen); err != nil {
+			return fmt.Errorf("listening for DNS over TLS: %v", err)
+		}
+	}
+	return nil
+}
+
+// listenAddrs returns the global listen addresses followed by the
+// tenants'.
+func (s *Server) listenAddrs() []string {
+	addrs := append([]string(nil), s.cfg.Listen...)
+	for _, t := range s.cfg.Tenants {
+		addrs = append(addrs, t.Listen...)
+	}
+	return addrs
+}
+
+// listenEphemeral binds the UDP sockets to a port picked by the system and
+// a TCP listener to the same port, trying another port if it is taken for
+// TCP.
+func (s *Server) listenEphemeral(addr *net.UDPAddr) error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		var serverConns []*net.UDPConn
+		if serverConns, err = listenUDPShards(addr, s.shardCount()); err != nil {
+			return err
+		}
+		bound := serverConns[0].LocalAddr().(*net.UDPAddr)
+		var tcpListener *net.TCPListener
+		tcpListener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: bound.Port, Zone: addr.Zone})
+		if err == nil {
+			s.udpConns = append(s.udpConns, serverConns...)
+			s.tcpListeners = append(s.tcpListeners, tcpListener)
+			return nil
+		}
+		for _, serverConn := range serverConns {
+			serverConn.Close()
+		}
+	}
+	return err
+}
+
+// Addr returns the address the first listener is bound to, over both UDP
+// and TCP, e.g. to find the port picked for a listen address with port 0.
+// It is empty before Start.
+func (s *Server) Addr() string {
+	if len(s.udpConns) == 0 {
+		return ""
+	}
+	return s.udpConns[0].LocalAddr().String()
+}
+
+// goBackground runs f in a goroutine that Shutdown waits for. f must
+// return once s.ctx is done.
+func (s *Server) goBackground(f func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+}
+
+// sleep waits for d, or reports false without waiting it out once s.ctx is
+// done.
+func (s *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// stopBackground stops the goroutines started with goBackground and the
+// admin endpoints, and waits for them until ctx is done.
+func (s *Server) stopBackground(ctx context.Context) error {
+	s.stop()
+	stopped := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background work still running: %w", ctx.Err())
+	}
+}
+
+// stopLogWriter waits until the queued log messages are written, or ctx is
+// done, and then stops the log writer.
+func (s *Server) stopLogWriter(ctx context.Context) error {
+	if s.stopLogs == nil {
+		return nil
+	}
+	defer s.stopLogs()
+	return s.flushLogs(ctx)
+}
+
+func (s *Server) closeListeners() {
+	for _, serverConn := range s.udpConns {
+		serverConn.Close()
+	}
+	for _, tcpListener := range s.tcpListeners {
+		tcpListener.Close()
+	}
+	if s.tlsListener != nil {
+		s.tlsListener.Close()
+	}
+}
+
+// Shutdown stops accepting queries and waits for the queries in flight to
+// be answered, then writes the last query summary, StatsD counters and log
+// messages. Record backends, refreshes and the admin endpoints stop too.
+// It gives up when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	for _, server := range s.servers {
+		server.ShutdownContext(ctx)
+	}
+	drained := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return fmt.Errorf("queries still in flight: %w", ctx.Err())
+	}
+	s.servers = nil
+	for _, pool := range s.pools {
+		pool.close()
+	}
+	s.pools = nil
+	closePlugins(s.plugins)
+	s.plugins = nil
+	if err := s.stopBackground(ctx); err != nil {
+		return err
+	}
+
+	if s.queryAggregate != nil {
+		s.logQuerySummary()
+	}
+	if s.statsd != nil {
+		s.statsd.flush()
+	}
+	return s.stopLogWriter(ctx)
+}
+
+// Stop is Shutdown without a deadline.
+func (s *Server) Stop() {
+	s.Shutdown(context.Background())
+}
+
+// Reload loads the records and zones again, like SIGHUP.
+func (s *Server) Reload() error {
+	s.reloadGeoIP()
+	s.reloadBlocklists()
+	err := s.reloadHosts("library")
+	s.warmCache()
+	return err
+}
+
+// Resolve answers a query from the records, the zones or the upstreams,
+// without the logging and statistics of queries received
+// by the listeners. Dynamic updates, NOTIFY and zone transfers are not
+// handled.
+func (s *Server) Resolve(req *dns.Msg, client net.IP) (response *dns.Msg) {
+	if len(req.Question) != 1 {
+		response := new(dns.Msg)
+		response.SetRcode(req, dns.RcodeFormatError)
+		return response
+	}
+	defer s.recoverQuery(req, func(m *dns.Msg) { response = m })
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	response, _ = s.resolve(ctx, req, s.clientRecords(client), client)
+	return response
+}
+
+// List returns the live records from every source, typed records
+// included.
+func (s *Server) List() ([]Record, error) {
+	return s.liveRecordList(""), nil
+}
+
+// Get returns the live address of host.
+func (s *Server) Get(host string) (string, error) {
+	ip, ok := s.currentRecords()[host]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", host, errRecordNotFound)
+	}
+	return ip, nil
+}
+
+// Set adds or changes a record in the hosts file and reloads.
+func (s *Server) Set(host, ip string) error {
+	return s.updateHostsFile("library", host, ip)
+}
+
+// Remove deletes a record from the hosts file and reloads.
+func (s *Server) Remove(host string) error {
+	return s.updateHostsFile("library", host, "")
+}
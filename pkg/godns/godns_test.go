@@ -0,0 +1,263 @@
+package godns_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nodesocket/godns/pkg/godns"
+	"github.com/nodesocket/godns/pkg/godns/godnstest"
+)
+
+func TestLocalRecords(t *testing.T) {
+	s := godnstest.Start(t, godnstest.Options{
+		Records: map[string]string{
+			"nas.lan":     "192.168.1.10",
+			"printer.lan": "fd00::10",
+		},
+	})
+	s.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.1.10")
+	s.AssertAnswer(t, "NAS.lan", dns.TypeA, "192.168.1.10")
+	s.AssertAnswer(t, "printer.lan", dns.TypeAAAA, "fd00::10")
+	s.AssertRcode(t, "missing.lan", dns.TypeA, dns.RcodeNameError)
+
+	// Other types of a local name have no data, rather than the address.
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeMX, dns.TypeTXT} {
+		s.AssertAnswer(t, "nas.lan", qtype)
+		s.AssertRcode(t, "nas.lan", qtype, dns.RcodeSuccess)
+	}
+	s.AssertAnswer(t, "printer.lan", dns.TypeA)
+}
+
+func TestForwarding(t *testing.T) {
+	// The upstream runs on the server's goroutines.
+	var mu sync.Mutex
+	var asked []dns.Question
+	static := godnstest.StaticUpstream{
+		"www.example.com": "2001:db8::80",
+	}
+	s := godnstest.Start(t, godnstest.Options{
+		Upstream: godnstest.UpstreamFunc(func(m *dns.Msg) (*dns.Msg, error) {
+			mu.Lock()
+			asked = append(asked, m.Question[0])
+			mu.Unlock()
+			if m.Question[0].Qtype != dns.TypeMX {
+				return static.Exchange(m)
+			}
+			r := new(dns.Msg)
+			r.SetReply(m)
+			r.Answer = append(r.Answer, &dns.MX{
+				Hdr:        dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60},
+				Preference: 10,
+				Mx:         "mail.example.com.",
+			})
+			return r, nil
+		}),
+	})
+	s.AssertAnswer(t, "www.example.com", dns.TypeAAAA, "2001:db8::80")
+	s.AssertAnswer(t, "example.com", dns.TypeMX, "10 mail.example.com.")
+	s.AssertRcode(t, "missing.example.com", dns.TypeAAAA, dns.RcodeNameError)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []uint16{dns.TypeAAAA, dns.TypeMX, dns.TypeAAAA}
+	if len(asked) != len(want) {
+		t.Fatalf("upstream got %d queries, want %d", len(asked), len(want))
+	}
+	for i, q := range asked {
+		if q.Qtype != want[i] || q.Qclass != dns.ClassINET {
+			t.Errorf("upstream query %d is for %s %s, want IN %s", i, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype], dns.TypeToString[want[i]])
+		}
+	}
+}
+
+func TestTCP(t *testing.T) {
+	s := godnstest.Start(t, godnstest.Options{
+		Records:  map[string]string{"nas.lan": "192.168.1.10"},
+		Upstream: godnstest.StaticUpstream{"www.example.com": "192.0.2.80"},
+	})
+	for name, want := range map[string]string{"nas.lan.": "192.168.1.10", "www.example.com.": "192.0.2.80"} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		r, err := s.Exchange(m, "tcp")
+		if err != nil {
+			t.Fatalf("query %s over TCP: %v", name, err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != want {
+			t.Errorf("%s over TCP: got %v, want %s", name, r.Answer, want)
+		}
+	}
+}
+
+func TestEDNS(t *testing.T) {
+	s := godnstest.Start(t, godnstest.Options{
+		Records:  map[string]string{"nas.lan": "192.168.1.10"},
+		Upstream: godnstest.StaticUpstream{"www.example.com": "192.0.2.80"},
+	})
+	// The local answer, its fast path, and the forwarded one.
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{{"nas.lan.", dns.TypeA}, {"nas.lan.", dns.TypeMX}, {"www.example.com.", dns.TypeA}} {
+		for _, do := range []bool{false, true} {
+			m := new(dns.Msg)
+			m.SetQuestion(q.name, q.qtype)
+			m.SetEdns0(1232, do)
+			r, err := s.Exchange(m, "udp")
+			if err != nil {
+				t.Fatalf("query %s: %v", q.name, err)
+			}
+			opt := r.IsEdns0()
+			if opt == nil {
+				t.Errorf("%s %s with EDNS (DO %t): no OPT in the response", q.name, dns.TypeToString[q.qtype], do)
+				continue
+			}
+			if opt.Do() != do {
+				t.Errorf("%s %s: got DO %t in the response, want %t", q.name, dns.TypeToString[q.qtype], opt.Do(), do)
+			}
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(q.name, q.qtype)
+		r, err := s.Exchange(m, "udp")
+		if err != nil {
+			t.Fatalf("query %s: %v", q.name, err)
+		}
+		if r.IsEdns0() != nil {
+			t.Errorf("%s %s without EDNS: got an OPT in the response", q.name, dns.TypeToString[q.qtype])
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	s := godnstest.Start(t, godnstest.Options{
+		Records: map[string]string{"nas.lan": "192.168.1.10", "old.lan": "192.168.1.20"},
+	})
+	err := godnstest.WriteHosts(s.HostsFile, map[string]string{"nas.lan": "192.168.1.11", "new.lan": "fd00::30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	s.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.1.11")
+	s.AssertAnswer(t, "new.lan", dns.TypeAAAA, "fd00::30")
+	s.AssertRcode(t, "old.lan", dns.TypeA, dns.RcodeNameError)
+
+	// A hosts file that does not parse keeps the records.
+	if err := os.WriteFile(s.HostsFile, []byte(`{"bad.lan": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("reload of an invalid hosts file succeeded")
+	}
+	s.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.1.11")
+}
+
+func TestTypedHosts(t *testing.T) {
+	s := godnstest.Start(t, godnstest.Options{})
+	hosts := `{
+    "version": 2,
+    "records": {
+        "multi.lan": ["192.168.1.21", "192.168.1.22"],
+        "v6.lan": {"type": "AAAA", "value": "fd00::23", "ttl": 60},
+        "example.lan": {"type": "MX", "value": "10 mail.example.lan."}
+    }
+}`
+	if err := os.WriteFile(s.HostsFile, []byte(hosts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	s.AssertAnswer(t, "multi.lan", dns.TypeA, "192.168.1.21", "192.168.1.22")
+	s.AssertAnswer(t, "22.1.168.192.in-addr.arpa", dns.TypePTR, "multi.lan.")
+	s.AssertAnswer(t, "3.2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", dns.TypePTR, "v6.lan.")
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range list {
+		got = append(got, r.Host+" "+r.Type+" "+r.IP)
+	}
+	want := []string{
+		"example.lan MX 10 mail.example.lan.",
+		"multi.lan A 192.168.1.21",
+		"multi.lan A 192.168.1.22",
+		"v6.lan AAAA fd00::23",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got records %q, want %q", got, want)
+	}
+}
+
+func TestSeveralServers(t *testing.T) {
+	a := godnstest.Start(t, godnstest.Options{
+		Records:  map[string]string{"nas.lan": "192.168.1.10"},
+		Upstream: godnstest.StaticUpstream{"www.example.com": "192.0.2.1"},
+	})
+	b := godnstest.Start(t, godnstest.Options{
+		Records:  map[string]string{"nas.lan": "192.168.2.10", "printer.lan": "192.168.2.20"},
+		Upstream: godnstest.StaticUpstream{"www.example.com": "192.0.2.2"},
+	})
+	a.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.1.10")
+	a.AssertRcode(t, "printer.lan", dns.TypeA, dns.RcodeNameError)
+	a.AssertAnswer(t, "www.example.com", dns.TypeA, "192.0.2.1")
+	b.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.2.10")
+	b.AssertAnswer(t, "printer.lan", dns.TypeA, "192.168.2.20")
+	b.AssertAnswer(t, "www.example.com", dns.TypeA, "192.0.2.2")
+
+	// Reloading one server leaves the other's records alone.
+	if err := godnstest.WriteHosts(a.HostsFile, map[string]string{"nas.lan": "192.168.1.11"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	a.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.1.11")
+	b.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.2.10")
+}
+
+func TestStartFailure(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts.json")
+	if err := godnstest.WriteHosts(hostsFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+
+	// The certificate is loaded after the admin endpoint, the file watch
+	// and the query summaries have started.
+	cfg := godns.DefaultConfig()
+	cfg.Listen = []string{"127.0.0.1:0"}
+	cfg.HostsFile = hostsFile
+	cfg.WatchHosts = true
+	cfg.Admin.Listen = "127.0.0.1:0"
+	cfg.Logging.SummaryInterval = time.Minute
+	cfg.TLS.Listen = "127.0.0.1:0"
+	cfg.TLS.CertFile = filepath.Join(dir, "missing.pem")
+	cfg.TLS.KeyFile = filepath.Join(dir, "missing.key")
+	server, err := godns.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err == nil {
+		t.Fatal("started without the TLS certificate")
+	}
+
+	// Goroutines take a moment to exit after the ones waiting for them
+	// were told.
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines left running after Start failed", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
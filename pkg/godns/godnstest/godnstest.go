@@ -0,0 +1,194 @@
+// Package godnstest runs a godns server in-process for tests. The server
+// listens on an ephemeral localhost port and is queried with real DNS
+// messages over UDP or TCP:
+//
+//	func TestLocalRecord(t *testing.T) {
+//		s := godnstest.Start(t, godnstest.Options{
+//			Records: map[string]string{"nas.lan": "192.168.1.10"},
+//		})
+//		s.AssertAnswer(t, "nas.lan", dns.TypeA, "192.168.1.10")
+//		s.AssertRcode(t, "missing.example", dns.TypeA, dns.RcodeNameError)
+//	}
+//
+// Every test gets its own server, so tests may run in parallel.
+package godnstest
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nodesocket/godns/pkg/godns"
+)
+
+// Options configure the server Start runs.
+type Options struct {
+	// Records are written to the server's hosts file.
+	Records map[string]string
+	// Upstream answers the queries godns forwards. The default, NXDomain,
+	// keeps tests off the network; in recursive mode the recursor answers
+	// them, from the root hints the test configures.
+	Upstream godns.Upstream
+	// Configure, if set, adjusts the configuration before the server
+	// starts, e.g. to add zones.
+	Configure func(*godns.Config)
+}
+
+// Server is a running godns server.
+type Server struct {
+	*godns.Server
+	// HostsFile is the path of the server's hosts file. Tests may rewrite
+	// it and call Reload.
+	HostsFile string
+}
+
+// Start runs a godns server for the duration of the test.
+func Start(t testing.TB, opts Options) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts.json")
+	if err := WriteHosts(hostsFile, opts.Records); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := godns.DefaultConfig()
+	cfg.Listen = []string{"127.0.0.1:0"}
+	cfg.HostsFile = hostsFile
+	cfg.Logging.QuerySample = 0
+	if opts.Configure != nil {
+		opts.Configure(cfg)
+	}
+	server, err := godns.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Upstream = opts.Upstream
+	if server.Upstream == nil && !cfg.Recursive {
+		server.Upstream = NXDomain{}
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down godns: %v", err)
+		}
+	})
+	return &Server{Server: server, HostsFile: hostsFile}
+}
+
+// WriteHosts writes records to a JSON hosts file.
+func WriteHosts(path string, records map[string]string) error {
+	hosts := make([]string, 0, len(records))
+	for host := range records {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var b strings.Builder
+	b.WriteString("{\n")
+	for i, host := range hosts {
+		sep := ","
+		if i == len(hosts)-1 {
+			sep = ""
+		}
+		b.WriteString("    \"" + host + "\": \"" + records[host] + "\"" + sep + "\n")
+	}
+	b.WriteString("}\n")
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// Exchange sends m to the server over network, "udp" or "tcp".
+func (s *Server) Exchange(m *dns.Msg, network string) (*dns.Msg, error) {
+	client := &dns.Client{Net: network, Timeout: 5 * time.Second}
+	r, _, err := client.Exchange(m, s.Addr())
+	return r, err
+}
+
+// Query asks the server for name and qtype over UDP.
+func (s *Server) Query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	return s.Exchange(m, "udp")
+}
+
+// AssertAnswer fails the test unless the answer to name and qtype holds
+// exactly the records whose data (the text after the type, e.g. an
+// address) is want, in any order.
+func (s *Server) AssertAnswer(t testing.TB, name string, qtype uint16, want ...string) {
+	t.Helper()
+	r, err := s.Query(name, qtype)
+	if err != nil {
+		t.Fatalf("query %s %s: %v", name, dns.TypeToString[qtype], err)
+	}
+	got := make([]string, len(r.Answer))
+	for i, rr := range r.Answer {
+		got[i] = strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+	sort.Strings(got)
+	want = append([]string(nil), want...)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s %s: got answer %q (%s), want %q", name, dns.TypeToString[qtype], got, dns.RcodeToString[r.Rcode], want)
+	}
+}
+
+// AssertRcode fails the test unless the response to name and qtype has
+// rcode.
+func (s *Server) AssertRcode(t testing.TB, name string, qtype uint16, rcode int) {
+	t.Helper()
+	r, err := s.Query(name, qtype)
+	if err != nil {
+		t.Fatalf("query %s %s: %v", name, dns.TypeToString[qtype], err)
+	}
+	if r.Rcode != rcode {
+		t.Errorf("%s %s: got %s, want %s", name, dns.TypeToString[qtype], dns.RcodeToString[r.Rcode], dns.RcodeToString[rcode])
+	}
+}
+
+// NXDomain is an Upstream that knows no names.
+type NXDomain struct{}
+
+func (NXDomain) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetRcode(m, dns.RcodeNameError)
+	return r, nil
+}
+
+// UpstreamFunc adapts a function to an Upstream, to answer or inspect the
+// queries godns forwards.
+type UpstreamFunc func(m *dns.Msg) (*dns.Msg, error)
+
+func (f UpstreamFunc) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return f(m)
+}
+
+// StaticUpstream is an Upstream answering A and AAAA queries for its names
+// and NXDOMAIN for all others, to test forwarding.
+type StaticUpstream map[string]string
+
+func (u StaticUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	q := m.Question[0]
+	ip := net.ParseIP(u[strings.ToLower(strings.TrimSuffix(q.Name, "."))])
+	if ip == nil {
+		r.Rcode = dns.RcodeNameError
+		return r, nil
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch {
+	case q.Qtype == dns.TypeA && ip.To4() != nil:
+		r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+	case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	return r, nil
+}
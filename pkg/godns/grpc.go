@@ -0,0 +1,169 @@
+package godns
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/nodesocket/godns/api/godnspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcAdminServer implements the Admin service from api/godnspb/admin.proto
+// on top of the same operations as the HTTP record API.
+type grpcAdminServer struct {
+	godnspb.UnimplementedAdminServer
+	srv *Server
+}
+
+func (s *Server) startGRPCServer(addr string) error {
+	lis, err := listenTCP("grpc", addr)
+	if err != nil {
+		return err
+	}
+	s.grpcListener = lis
+	server := grpc.NewServer(grpc.UnaryInterceptor(s.grpcAuth))
+	godnspb.RegisterAdminServer(server, grpcAdminServer{srv: s})
+
+	s.logMessage(fmt.Sprintf("Admin gRPC listening on %s", addr))
+	context.AfterFunc(s.ctx, server.Stop)
+	s.goBackground(func() {
+		if err := server.Serve(lis); err != nil {
+			s.logMessage(fmt.Sprintf("Error serving admin gRPC: %v", err))
+		}
+	})
+	return nil
+}
+
+// grpcAuth requires the admin token as a bearer token in the
+// "authorization" metadata of every call.
+func (s *Server) grpcAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	var ok bool
+	if values := md.Get("authorization"); len(values) > 0 {
+		token, ok = strings.CutPrefix(values[0], "Bearer ")
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Admin.Token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid admin token")
+	}
+	return handler(ctx, req)
+}
+
+func grpcActor(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return "grpc:" + p.Addr.String()
+	}
+	return "grpc"
+}
+
+func (g grpcAdminServer) ListRecords(ctx context.Context, req *godnspb.ListRecordsRequest) (*godnspb.ListRecordsResponse, error) {
+	list := g.srv.liveRecordList("")
+	resp := &godnspb.ListRecordsResponse{Records: make([]*godnspb.Record, 0, len(list))}
+	for _, r := range list {
+		resp.Records = append(resp.Records, &godnspb.Record{Host: r.Host, Ip: r.IP, Type: r.Type, Ttl: r.TTL, Tags: r.Tags})
+	}
+	return resp, nil
+}
+
+func (g grpcAdminServer) GetRecord(ctx context.Context, req *godnspb.GetRecordRequest) (*godnspb.Record, error) {
+	host, ok := normalizeRecordHost(req.Host)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "invalid host name")
+	}
+	ip, ok := g.srv.currentRecords()[host]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "record not found")
+	}
+	return &godnspb.Record{Host: host, Ip: ip}, nil
+}
+
+func (g grpcAdminServer) PutRecord(ctx context.Context, req *godnspb.PutRecordRequest) (*godnspb.Record, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+	host, ok := normalizeRecordHost(req.Record.Host)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "invalid host name")
+	}
+	if net.ParseIP(req.Record.Ip) == nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid IP address")
+	}
+	if err := g.srv.updateHostsFile(grpcActor(ctx), host, req.Record.Ip); err != nil {
+		if errors.Is(err, errNoHostsFile) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if g.srv.currentRecords()[host] != req.Record.Ip {
+		return nil, status.Error(codes.FailedPrecondition, "record saved but overridden by another record source")
+	}
+	return &godnspb.Record{Host: host, Ip: req.Record.Ip}, nil
+}
+
+func (g grpcAdminServer) DeleteRecord(ctx context.Context, req *godnspb.DeleteRecordRequest) (*godnspb.DeleteRecordResponse, error) {
+	host, ok := normalizeRecordHost(req.Host)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "invalid host name")
+	}
+	if err := g.srv.updateHostsFile(grpcActor(ctx), host, ""); err != nil {
+		if errors.Is(err, errRecordNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		if errors.Is(err, errNoHostsFile) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if _, ok := g.srv.currentRecords()[host]; ok {
+		return nil, status.Error(codes.FailedPrecondition, "record deleted but still defined by another record source")
+	}
+	return &godnspb.DeleteRecordResponse{}, nil
+}
+
+func (g grpcAdminServer) Reload(ctx context.Context, req *godnspb.ReloadRequest) (*godnspb.ReloadResponse, error) {
+	if err := g.srv.reloadHosts(grpcActor(ctx)); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &godnspb.ReloadResponse{Records: uint64(g.srv.liveRecords.Load().size())}, nil
+}
+
+func (g grpcAdminServer) GetStats(ctx context.Context, req *godnspb.GetStatsRequest) (*godnspb.Stats, error) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	resp := &godnspb.Stats{
+		UptimeSeconds:  time.Since(g.srv.startTime).Seconds(),
+		Queries:        g.srv.stats.queries.Load(),
+		Malformed:      g.srv.stats.malformed.Load(),
+		LocalAnswers:   g.srv.stats.localAnswers.Load(),
+		Forwarded:      g.srv.stats.forwarded.Load(),
+		Servfail:       g.srv.stats.servfail.Load(),
+		SendErrors:     g.srv.stats.sendErrors.Load(),
+		Goroutines:     uint64(runtime.NumGoroutine()),
+		HeapAllocBytes: mem.HeapAlloc,
+	}
+	latency := g.srv.upstreamLatencySummaries()
+	for _, u := range g.srv.upstreams {
+		l := latency[u.addr]
+		resp.Upstreams = append(resp.Upstreams, &godnspb.Upstream{
+			Address: u.addr,
+			Healthy: u.healthy.Load(),
+			Errors:  u.errors.Load(),
+			P50Ms:   l.P50Ms,
+			P95Ms:   l.P95Ms,
+			P99Ms:   l.P99Ms,
+		})
+	}
+	return resp, nil
+}
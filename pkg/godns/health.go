@@ -0,0 +1,80 @@
+package godns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminRoutes are the admin endpoints, added by the init functions of the
+// files that handle them. Every Server serves them on its own mux.
+var adminRoutes []adminRoute
+
+type adminRoute struct {
+	pattern string
+	handler func(s *Server) http.HandlerFunc
+}
+
+// handleAdmin adds the admin endpoint pattern, whose handler for a Server
+// is made by handler.
+func handleAdmin(pattern string, handler func(s *Server) http.HandlerFunc) {
+	adminRoutes = append(adminRoutes, adminRoute{pattern, handler})
+}
+
+func init() {
+	handleAdmin("/healthz", func(*Server) http.HandlerFunc { return healthzHandler })
+	handleAdmin("/readyz", func(s *Server) http.HandlerFunc { return s.readyzHandler })
+}
+
+// healthzHandler reports liveness: if the process can answer HTTP it is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports readiness: the listener is bound, the hosts file is
+// loaded and at least one upstream answered its most recent query or probe.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	var failing []string
+	if !s.listenerBound.Load() {
+		failing = append(failing, "listener not bound")
+	}
+	if !s.hostsLoaded.Load() {
+		failing = append(failing, "hosts not loaded")
+	}
+	if s.forwarding() && !s.anyUpstreamHealthy() {
+		failing = append(failing, "no healthy upstream")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failing, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) startAdminServer(addr string) {
+	l, err := listenTCP("admin", addr)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error serving admin HTTP: %v", err))
+		return
+	}
+	s.adminListener = l
+	s.logMessage(fmt.Sprintf("Admin HTTP listening on %s", addr))
+	s.serveHTTP(l, s.adminMux, "admin HTTP")
+}
+
+// serveHTTP serves handler on l in the background until s shuts down.
+func (s *Server) serveHTTP(l net.Listener, handler http.Handler, what string) {
+	server := &http.Server{Handler: handler}
+	context.AfterFunc(s.ctx, func() { server.Close() })
+	s.goBackground(func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			s.logMessage(fmt.Sprintf("Error serving %s: %v", what, err))
+		}
+	})
+}
@@ -0,0 +1,461 @@
+package godns
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHistory is how many snapshots history_dir keeps. Older ones are
+// removed as new changes are made.
+const maxHistory = 100
+
+// historyEntry is a change of the records, with a snapshot of the record
+// files as the change left them. It is stored in history_dir as <id>.json.
+type historyEntry struct {
+	ID      int            `json:"id"`
+	Time    time.Time      `json:"time"`
+	Actor   string         `json:"actor"`
+	Changes []recordChange `json:"changes"`
+	// Files maps the paths of the record files to their content.
+	Files map[string]string `json:"files,omitempty"`
+}
+
+var (
+	errHistoryNotFound = errors.New("history entry not found")
+	// errHistoryIncomplete is returned for rollbacks to a snapshot that
+	// does not hold a record file loaded now.
+	errHistoryIncomplete = errors.New("not in the snapshot")
+	// errNoHistory is returned for history requests when godns runs
+	// without a history directory.
+	errNoHistory = errors.New("no history directory is configured")
+)
+
+func init() {
+	handleAdmin("/history", func(s *Server) http.HandlerFunc { return s.requireToken(s.historyHandler) })
+	handleAdmin("/history/", func(s *Server) http.HandlerFunc { return s.requireToken(s.historyEntryHandler) })
+}
+
+// historyFiles returns the record files snapshots hold: those the records
+// are loaded from, as hostsSources lists them, and the zone files, those
+// of the git repository included.
+func (s *Server) historyFiles() ([]string, error) {
+	files, err := s.hostsSources()
+	if err != nil {
+		return nil, err
+	}
+	for _, z := range s.cfg.Zones {
+		if z.File != "" {
+			files = append(files, z.File)
+		}
+	}
+	gitZones, err := s.gitZoneFiles()
+	if err != nil {
+		return nil, err
+	}
+	return append(files, gitZones...), nil
+}
+
+// snapshotFiles reads the record files. Those that do not exist are left
+// out.
+func (s *Server) snapshotFiles() (map[string]string, error) {
+	paths, err := s.historyFiles()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[path] = string(data)
+	}
+	return files, nil
+}
+
+// saveHistory snapshots the record files after actor made changes. It is a
+// no-op without a history directory or changes.
+func (s *Server) saveHistory(actor string, changes []recordChange) {
+	if s.cfg.HistoryDir == "" || len(changes) == 0 {
+		return
+	}
+	if err := s.writeHistory(actor, changes, false); err != nil {
+		s.logMessage(fmt.Sprintf("Error writing history: %v", err))
+	}
+}
+
+// historyStartup snapshots the record files when the server starts, if
+// they differ from the last snapshot, so that changes made while godns was
+// not running can be rolled back too.
+func (s *Server) historyStartup() {
+	if s.cfg.HistoryDir == "" {
+		return
+	}
+	if err := s.writeHistory("startup", nil, true); err != nil {
+		s.logMessage(fmt.Sprintf("Error writing history: %v", err))
+	}
+}
+
+// writeHistory writes the next snapshot and removes those beyond
+// maxHistory. With ifChanged nothing is written when the files are those
+// of the last snapshot.
+func (s *Server) writeHistory(actor string, changes []recordChange, ifChanged bool) error {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	files, err := s.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	ids, err := historyIDs(s.cfg.HistoryDir)
+	if err != nil {
+		return err
+	}
+	entry := historyEntry{ID: 1, Time: time.Now().UTC(), Actor: actor, Changes: changes, Files: files}
+	if len(ids) > 0 {
+		last, err := readHistory(s.cfg.HistoryDir, ids[len(ids)-1])
+		if err != nil {
+			return err
+		}
+		if ifChanged && maps.Equal(last.Files, files) {
+			return nil
+		}
+		entry.ID = last.ID + 1
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.cfg.HistoryDir, 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(historyPath(s.cfg.HistoryDir, entry.ID), append(data, '\n')); err != nil {
+		return err
+	}
+	for _, id := range ids[:max(0, len(ids)+1-maxHistory)] {
+		os.Remove(historyPath(s.cfg.HistoryDir, id))
+	}
+	return nil
+}
+
+func historyPath(dir string, id int) string {
+	return filepath.Join(dir, strconv.Itoa(id)+".json")
+}
+
+// historyIDs returns the IDs of the snapshots in dir, oldest first. A
+// missing directory has none.
+func historyIDs(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, e := range entries {
+		if id, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json")); err == nil && strings.HasSuffix(e.Name(), ".json") {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func readHistory(dir string, id int) (*historyEntry, error) {
+	data, err := os.ReadFile(historyPath(dir, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%d: %w", id, errHistoryNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := new(historyEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("%s: %v", historyPath(dir, id), err)
+	}
+	return entry, nil
+}
+
+// listHistory returns the snapshots in dir newest first, without the
+// content of their files.
+func listHistory(dir string) ([]*historyEntry, error) {
+	ids, err := historyIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*historyEntry, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		entry, err := readHistory(dir, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		entry.Files = nil
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+// restoreHistory writes the record files of snapshot id back, and removes
+// the files added to the hosts directory or the git repository since. A
+// snapshot without another record file loaded now is refused: what that
+// file held then is unknown.
+func (s *Server) restoreHistory(dir string, id int) error {
+	entry, err := readHistory(dir, id)
+	if err != nil {
+		return err
+	}
+	current, err := s.historyFiles()
+	if err != nil {
+		return err
+	}
+	var added []string
+	for _, path := range current {
+		if _, ok := entry.Files[path]; ok {
+			continue
+		}
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if !s.inHistoryDir(path) {
+			return fmt.Errorf("rollback to %d: %s is %w", id, path, errHistoryIncomplete)
+		}
+		added = append(added, path)
+	}
+	for path, content := range entry.Files {
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			return err
+		}
+	}
+	for _, path := range added {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// inHistoryDir reports whether the record file at path is in one of the
+// directories whose files are all loaded, the hosts directory or that of
+// the git repository, so that its absence from a snapshot means it did not
+// exist yet.
+func (s *Server) inHistoryDir(path string) bool {
+	for _, dir := range []string{s.cfg.HostsDir, s.gitFilesDir()} {
+		if dir != "" && filepath.Dir(path) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackHistory restores the record files of snapshot id and reloads the
+// records. The rollback is itself a change, recorded in the history.
+func (s *Server) rollbackHistory(actor string, id int) error {
+	if s.cfg.HistoryDir == "" {
+		return errNoHistory
+	}
+	s.apiWriteMu.Lock()
+	defer s.apiWriteMu.Unlock()
+
+	// Dynamic updates rewrite zone files; hold them off while restoring.
+	s.updateMu.Lock()
+	err := s.restoreHistory(s.cfg.HistoryDir, id)
+	s.updateMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.reloadHosts(fmt.Sprintf("%s (rollback to %d)", actor, id))
+}
+
+// historyHandler lists the record changes, newest first.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cfg.HistoryDir == "" {
+		http.Error(w, errNoHistory.Error(), http.StatusConflict)
+		return
+	}
+	list, err := listHistory(s.cfg.HistoryDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// historyEntryHandler shows a record change (GET /history/<id>) or rolls
+// the record files back to the snapshot taken after it (POST
+// /history/<id>/rollback).
+func (s *Server) historyEntryHandler(w http.ResponseWriter, r *http.Request) {
+	path, rollback := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/history/"), "/rollback")
+	id, err := strconv.Atoi(path)
+	if err != nil {
+		http.Error(w, "invalid history entry", http.StatusBadRequest)
+		return
+	}
+	if s.cfg.HistoryDir == "" {
+		http.Error(w, errNoHistory.Error(), http.StatusConflict)
+		return
+	}
+
+	switch {
+	case !rollback && r.Method == http.MethodGet:
+		entry, err := readHistory(s.cfg.HistoryDir, id)
+		if err != nil {
+			http.Error(w, err.Error(), historyStatus(err))
+			return
+		}
+		entry.Files = nil
+		writeJSON(w, http.StatusOK, entry)
+	case rollback && r.Method == http.MethodPost:
+		if err := s.rollbackHistory("api:"+r.RemoteAddr, id); err != nil {
+			http.Error(w, err.Error(), historyStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case rollback:
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func historyStatus(err error) int {
+	if errors.Is(err, errHistoryNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errHistoryIncomplete) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+const historyUsage = `Usage: godns history [flags] <command>
+
+Commands:
+  list              List the record changes, newest first
+  show <id>         Print the records a change created, updated or deleted
+  rollback <id>     Restore the record files as they were after a change
+
+The history is read from the admin API of a running instance, found from
+the configuration's admin address and token unless -server and -token
+are given; a rollback is applied immediately. With -direct the history
+directory is used instead, and a running instance picks a rollback up on
+its next reload.
+
+Flags:
+`
+
+func historyCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"_CONFIG"), "Path to a YAML configuration file (env GODNS_CONFIG)")
+	server := fs.String("server", "", "Admin API URL of the running instance, e.g. http://127.0.0.1:8053")
+	direct := fs.Bool("direct", false, "Use the history directory instead of a running instance")
+	fs.StringVar(&cfg.Admin.Token, "token", cfg.Admin.Token, "Admin API token (env GODNS_ADMIN_TOKEN)")
+	fs.StringVar(&cfg.HistoryDir, "history-dir", cfg.HistoryDir, "History directory used with -direct")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), historyUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := loadConfig(cfg, fs, *configPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configuration:", err)
+		return 1
+	}
+
+	var api *APIStore
+	if !*direct {
+		base := *server
+		if base == "" {
+			base = adminURL(cfg.Admin.Listen)
+		}
+		if base == "" {
+			fmt.Fprintln(os.Stderr, "Error: no admin address configured; use -server or -direct")
+			return 1
+		}
+		api = &APIStore{URL: strings.TrimSuffix(base, "/"), Token: cfg.Admin.Token}
+	} else if cfg.HistoryDir == "" {
+		fmt.Fprintln(os.Stderr, "Error:", errNoHistory)
+		return 1
+	}
+
+	cmd := fs.Args()
+	var id int
+	if len(cmd) == 2 {
+		var err error
+		if id, err = strconv.Atoi(cmd[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid history entry %q\n", cmd[1])
+			return 2
+		}
+	}
+	var err error
+	switch {
+	case len(cmd) == 1 && cmd[0] == "list":
+		var list []*historyEntry
+		if api != nil {
+			err = api.do(http.MethodGet, "/history", nil, &list)
+		} else {
+			list, err = listHistory(cfg.HistoryDir)
+		}
+		for _, entry := range list {
+			fmt.Printf("%d %s %s %d change(s)\n", entry.ID, entry.Time.Local().Format(time.RFC3339), entry.Actor, len(entry.Changes))
+		}
+	case len(cmd) == 2 && cmd[0] == "show":
+		entry := new(historyEntry)
+		if api != nil {
+			err = api.do(http.MethodGet, "/history/"+strconv.Itoa(id), nil, entry)
+		} else {
+			entry, err = readHistory(cfg.HistoryDir, id)
+		}
+		if err == nil {
+			fmt.Printf("%d %s %s\n", entry.ID, entry.Time.Local().Format(time.RFC3339), entry.Actor)
+			for _, c := range entry.Changes {
+				switch c.Action {
+				case "record.create":
+					fmt.Printf("+ %s %s\n", c.Key, c.New)
+				case "record.delete":
+					fmt.Printf("- %s %s\n", c.Key, c.Old)
+				default:
+					fmt.Printf("~ %s %s -> %s\n", c.Key, c.Old, c.New)
+				}
+			}
+		}
+	case len(cmd) == 2 && cmd[0] == "rollback":
+		if api != nil {
+			err = api.do(http.MethodPost, "/history/"+strconv.Itoa(id)+"/rollback", nil, nil)
+		} else {
+			err = newServer(cfg).restoreHistory(cfg.HistoryDir, id)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
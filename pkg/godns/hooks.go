@@ -0,0 +1,322 @@
+package godns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Hook scripts are Lua chunks run at three points of a query on the global
+// listeners:
+//
+//	on_query       before the records are looked up
+//	on_local_miss  when no local record or zone has the name, before forwarding
+//	on_response    once the response is built
+//
+// A script reads the query from the table query (query.name, query.type,
+// query.client and, in on_response, query.rcode and query.answers) and
+// changes the outcome by calling:
+//
+//	rewrite("name")       look up another name and answer for the asked one
+//	answer("ip", ...)     answer with these addresses
+//	respond("NXDOMAIN")   answer with this response code
+//	log("message")        write a line to the log
+//
+// Scripts run in a sandbox with the base, string, table and math
+// libraries but no access to files, and are stopped after hookTimeout.
+
+// hookTimeout bounds a single run of a hook script.
+const hookTimeout = 50 * time.Millisecond
+
+// hookScript is a compiled hook script.
+type hookScript struct {
+	name  string
+	proto *lua.FunctionProto
+}
+
+// hookScripts are the compiled hook scripts; nil ones are not configured.
+type hookScripts struct {
+	onQuery     *hookScript
+	onLocalMiss *hookScript
+	onResponse  *hookScript
+}
+
+// hookStates are the Lua states scripts run in, one per concurrent run.
+// Every run gets its own global environment, so nothing a script sets is
+// seen by the next one.
+var hookStates = sync.Pool{New: func() any { return newHookState() }}
+
+// newHookState opens a Lua state with the libraries and helpers hook
+// scripts may use.
+func newHookState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("matches", L.NewFunction(func(L *lua.LState) int {
+		re, err := regexp.Compile(L.CheckString(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		L.Push(lua.LBool(re.MatchString(L.CheckString(2))))
+		return 1
+	}))
+	L.SetGlobal("in_net", L.NewFunction(func(L *lua.LState) int {
+		_, network, err := net.ParseCIDR(L.CheckString(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		L.Push(lua.LBool(network.Contains(net.ParseIP(L.CheckString(2)))))
+		return 1
+	}))
+	return L
+}
+
+// compileHooks parses the configured hook scripts.
+func compileHooks(c HooksConfig) (hookScripts, error) {
+	var compiled hookScripts
+	for _, h := range []struct {
+		name   string
+		script string
+		dst    **hookScript
+	}{
+		{"on_query", c.OnQuery, &compiled.onQuery},
+		{"on_local_miss", c.OnLocalMiss, &compiled.onLocalMiss},
+		{"on_response", c.OnResponse, &compiled.onResponse},
+	} {
+		if strings.TrimSpace(h.script) == "" {
+			continue
+		}
+		chunk, err := parse.Parse(strings.NewReader(h.script), h.name)
+		if err != nil {
+			// Syntax errors come padded with spaces and a newline.
+			return hookScripts{}, fmt.Errorf("hooks: %s", strings.Join(strings.Fields(err.Error()), " "))
+		}
+		proto, err := lua.Compile(chunk, h.name)
+		if err != nil {
+			return hookScripts{}, fmt.Errorf("hooks: %s: %v", h.name, err)
+		}
+		*h.dst = &hookScript{name: h.name, proto: proto}
+	}
+	return compiled, nil
+}
+
+// hookCall is a run of a hook script: the query it runs for and what the
+// script decided.
+type hookCall struct {
+	srv *Server
+	// name is the query name in lower case without the trailing dot.
+	name string
+	// qtype is the query type, e.g. "A".
+	qtype string
+	// client is the IP address of the client.
+	client string
+	// rcodeName is the response code of the response, e.g. "NOERROR", in
+	// on_response.
+	rcodeName string
+	// answers are the values of the answer records in on_response:
+	// addresses, names or text.
+	answers []string
+
+	rewrite   string
+	addresses []string
+	rcode     int
+}
+
+// env builds the global environment of the call: the query table and the
+// functions acting on the call, over the globals of L.
+func (c *hookCall) env(L *lua.LState, onResponse bool) *lua.LTable {
+	query := L.NewTable()
+	query.RawSetString("name", lua.LString(c.name))
+	query.RawSetString("type", lua.LString(c.qtype))
+	query.RawSetString("client", lua.LString(c.client))
+	if onResponse {
+		query.RawSetString("rcode", lua.LString(c.rcodeName))
+		answers := L.NewTable()
+		for _, answer := range c.answers {
+			answers.Append(lua.LString(answer))
+		}
+		query.RawSetString("answers", answers)
+	}
+
+	env := L.NewTable()
+	env.RawSetString("query", query)
+	env.RawSetString("rewrite", L.NewFunction(c.luaRewrite))
+	env.RawSetString("answer", L.NewFunction(c.luaAnswer))
+	env.RawSetString("respond", L.NewFunction(c.luaRespond))
+	env.RawSetString("log", L.NewFunction(c.srv.luaLog))
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.G.Global)
+	L.SetMetatable(env, meta)
+	return env
+}
+
+// luaRewrite makes the query look up name instead. The answer keeps the
+// name that was asked for.
+func (c *hookCall) luaRewrite(L *lua.LState) int {
+	name := L.CheckString(1)
+	host, ok := normalizeRecordHost(name)
+	if !ok {
+		L.RaiseError("invalid host name %q", name)
+	}
+	c.rewrite = host
+	return 0
+}
+
+// luaAnswer answers the query with the given addresses: the IPv4 ones to
+// A queries and the IPv6 ones to AAAA queries.
+func (c *hookCall) luaAnswer(L *lua.LState) int {
+	for i := 1; i <= L.GetTop(); i++ {
+		ip := L.CheckString(i)
+		if net.ParseIP(ip) == nil {
+			L.RaiseError("invalid IP address %q", ip)
+		}
+		c.addresses = append(c.addresses, ip)
+	}
+	return 0
+}
+
+// luaRespond sets the response code, e.g. "NXDOMAIN" or "REFUSED".
+func (c *hookCall) luaRespond(L *lua.LState) int {
+	rcode := L.CheckString(1)
+	code, ok := dns.StringToRcode[strings.ToUpper(rcode)]
+	if !ok {
+		L.RaiseError("unknown response code %q", rcode)
+	}
+	c.rcode = code
+	return 0
+}
+
+// luaLog writes its argument to the log.
+func (s *Server) luaLog(L *lua.LState) int {
+	s.logMessage(fmt.Sprintf("Hook: %s", L.ToStringMeta(L.Get(1)).String()))
+	return 0
+}
+
+// runHook runs script for the question q asked by clientIP, with the
+// response for on_response, and returns the call with what the script
+// decided. A failing script changes nothing.
+func (s *Server) runHook(script *hookScript, q dns.Question, clientIP net.IP, response *dns.Msg) *hookCall {
+	c := &hookCall{
+		srv:    s,
+		name:   strings.ToLower(strings.TrimSuffix(q.Name, ".")),
+		qtype:  dns.Type(q.Qtype).String(),
+		client: clientIP.String(),
+		rcode:  -1,
+	}
+	if response != nil {
+		c.rcodeName = dns.RcodeToString[response.Rcode]
+		for _, rr := range response.Answer {
+			c.answers = append(c.answers, answerValue(rr))
+		}
+	}
+
+	L := hookStates.Get().(*lua.LState)
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	fn := L.NewFunctionFromProto(script.proto)
+	fn.Env = c.env(L, response != nil)
+	L.Push(fn)
+	err := L.PCall(0, 0, nil)
+	L.RemoveContext()
+	if err != nil {
+		// The state may have been left mid-call; it is not reused.
+		L.Close()
+		s.logMessage(fmt.Sprintf("Error running %s hook: %v", script.name, err))
+		return &hookCall{srv: s, rcode: -1}
+	}
+	hookStates.Put(L)
+	return c
+}
+
+func answerValue(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	case *dns.CNAME:
+		return strings.TrimSuffix(rr.Target, ".")
+	case *dns.PTR:
+		return strings.TrimSuffix(rr.Ptr, ".")
+	case *dns.TXT:
+		return strings.Join(rr.Txt, "")
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// answered reports whether the script decided the answer itself.
+func (c *hookCall) answered() bool {
+	return c.rcode >= 0 || len(c.addresses) > 0
+}
+
+// reply builds the response the script decided on for req.
+func (c *hookCall) reply(req *dns.Msg) *dns.Msg {
+	response := newReply(req)
+	response.Authoritative = true
+	c.apply(req.Question[0], response)
+	return response
+}
+
+// apply replaces the answer of response with the script's addresses and
+// response code, if it set them.
+func (c *hookCall) apply(q dns.Question, response *dns.Msg) {
+	if len(c.addresses) > 0 {
+		response.Answer = nil
+		for _, ip := range c.addresses {
+			if rr := addressRecord(q.Name, net.ParseIP(ip), c.srv.cfg.LocalTTL); rr.Header().Rrtype == q.Qtype {
+				response.Answer = append(response.Answer, rr)
+			}
+		}
+		if c.rcode < 0 {
+			response.Rcode = dns.RcodeSuccess
+		}
+	}
+	if c.rcode >= 0 {
+		response.Rcode = c.rcode
+		if c.rcode != dns.RcodeSuccess {
+			response.Answer = nil
+		}
+	}
+}
+
+// resolveRewritten resolves req for the name a script rewrote it to and
+// answers for the name that was asked for. With hooked, on_local_miss runs
+// when the rewritten name is not local either.
+func (s *Server) resolveRewritten(ctx context.Context, req *dns.Msg, name string, records map[string]string, clientIP net.IP, hooked bool) (*dns.Msg, string) {
+	rewritten := req.Copy()
+	rewritten.Question[0].Name = dns.Fqdn(name)
+	response, source := s.lookup(ctx, rewritten, records, clientIP, hooked)
+	response.Id = req.Id
+	// The question is copied rather than shared, as a released response
+	// reuses its question section.
+	response.Question = append(response.Question[:0], req.Question...)
+	for _, rr := range response.Answer {
+		if strings.EqualFold(rr.Header().Name, rewritten.Question[0].Name) {
+			rr.Header().Name = req.Question[0].Name
+		}
+	}
+	return response, source
+}
@@ -0,0 +1,98 @@
+package godns
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHooks(t *testing.T) {
+	scripts, err := compileHooks(HooksConfig{
+		OnQuery: `
+if query.name:sub(-#".ads.example") == ".ads.example" then
+  respond("NXDOMAIN")
+end
+seen = (seen or 0) + 1
+if seen > 1 then respond("SERVFAIL") end`,
+		OnLocalMiss: `
+local host = query.name:match("^(.*)%.corp$")
+if host then
+  rewrite(host .. ".lan")
+elseif query.name == "printer.lan" and in_net("10.1.0.0/16", query.client) then
+  answer("10.1.0.9", "fd00::9")
+elseif matches("^loop[0-9]+$", query.name) then
+  while true do end
+end`,
+		OnResponse: `
+for _, a in ipairs(query.answers) do
+  if a == "0.0.0.0" then respond("nxdomain") end
+end
+if query.rcode == "SERVFAIL" then answer("not an address") end`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	client := net.IPv4(10, 1, 2, 3)
+	question := func(name string, qtype uint16) dns.Question {
+		return dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	}
+	answered := func(rr string) *dns.Msg {
+		response := new(dns.Msg)
+		if rr != "" {
+			a, err := dns.NewRR(rr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Answer = append(response.Answer, a)
+		}
+		return response
+	}
+
+	for _, tt := range []struct {
+		name      string
+		script    *hookScript
+		q         dns.Question
+		response  *dns.Msg
+		rcode     int
+		rewrite   string
+		addresses []string
+	}{
+		{name: "respond", script: scripts.onQuery, q: question("x.ads.example", dns.TypeA), rcode: dns.RcodeNameError},
+		// Globals a script sets are gone by the next run.
+		{name: "fresh globals", script: scripts.onQuery, q: question("www.example", dns.TypeA), rcode: -1},
+		{name: "rewrite", script: scripts.onLocalMiss, q: question("NAS.corp", dns.TypeA), rcode: -1, rewrite: "nas.lan"},
+		{name: "answer", script: scripts.onLocalMiss, q: question("printer.lan", dns.TypeAAAA), rcode: -1, addresses: []string{"10.1.0.9", "fd00::9"}},
+		{name: "timeout", script: scripts.onLocalMiss, q: question("loop1", dns.TypeA), rcode: -1},
+		{name: "response", script: scripts.onResponse, q: question("ads.lan", dns.TypeA), response: answered("ads.lan. 60 IN A 0.0.0.0"), rcode: dns.RcodeNameError},
+		{name: "error", script: scripts.onResponse, q: question("down.lan", dns.TypeA), response: new(dns.Msg).SetRcode(new(dns.Msg).SetQuestion("down.lan.", dns.TypeA), dns.RcodeServerFailure), rcode: -1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			call := s.runHook(tt.script, tt.q, client, tt.response)
+			if call.rcode != tt.rcode || call.rewrite != tt.rewrite || !slices.Equal(call.addresses, tt.addresses) {
+				t.Errorf("got rcode %d, rewrite %q and addresses %v, want %d, %q and %v", call.rcode, call.rewrite, call.addresses, tt.rcode, tt.rewrite, tt.addresses)
+			}
+		})
+	}
+}
+
+func TestHooksSandbox(t *testing.T) {
+	s := newTestServer()
+	for _, script := range []string{`dofile("/etc/passwd")`, `os.exit(1)`, `io.open("/etc/passwd")`, `require("os")`} {
+		scripts, err := compileHooks(HooksConfig{OnQuery: script})
+		if err != nil {
+			t.Fatal(err)
+		}
+		call := s.runHook(scripts.onQuery, dns.Question{Name: "a.lan.", Qtype: dns.TypeA}, net.IPv4(127, 0, 0, 1), nil)
+		if call.answered() {
+			t.Errorf("%s: answered", script)
+		}
+	}
+	if _, err := compileHooks(HooksConfig{OnQuery: "if then"}); err == nil || !strings.Contains(err.Error(), "on_query") {
+		t.Errorf("syntax error: got %v", err)
+	}
+}
@@ -0,0 +1,654 @@
+package godns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// hostsSources lists the record files to load, lowest precedence first:
+// the /etc/hosts style file, the record files of the git repository, the
+// main hosts file, the extra hosts files in configured order and finally
+// the *.json and *.hosts files of the hosts directory in lexical order. A
+// name defined in several files takes the value from the last one. There
+// may be none at all, with godns only forwarding.
+func (s *Server) hostsSources() ([]string, error) {
+	var sources []string
+	if s.cfg.EtcHosts != "" {
+		sources = append(sources, s.cfg.EtcHosts)
+	}
+	if dir := s.gitFilesDir(); dir != "" {
+		// Missing until the repository is first checked out.
+		files, err := filesIn(dir, ".json", ".hosts")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		sources = append(sources, files...)
+	}
+	if s.cfg.HostsFile != "" {
+		sources = append(sources, s.cfg.HostsFile)
+	}
+	sources = append(sources, s.cfg.ExtraHostsFiles...)
+
+	if s.cfg.HostsDir != "" {
+		files, err := filesIn(s.cfg.HostsDir, ".json", ".hosts")
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, files...)
+	}
+	return sources, nil
+}
+
+// filesIn returns the paths of the regular files in dir with one of the
+// extensions exts, in lexical order. Hidden files are left out.
+func filesIn(dir string, exts ...string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") && slices.Contains(exts, filepath.Ext(entry.Name())) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	files := make([]string, len(names))
+	for i, name := range names {
+		files[i] = filepath.Join(dir, name)
+	}
+	return files, nil
+}
+
+// HostsFile is the RecordStore of a records file at a path, either JSON or
+// in /etc/hosts format.
+type HostsFile string
+
+// Records reads the file with the default configuration. Hosts with
+// several addresses get the first one, other typed records are left out.
+func (f HostsFile) Records() (map[string]string, error) {
+	return hostsFile{newServer(DefaultConfig()), string(f)}.Records()
+}
+
+func (f HostsFile) typedRecords() (map[string]string, *typedHosts, error) {
+	return hostsFile{newServer(DefaultConfig()), string(f)}.typedRecords()
+}
+
+// hostsFile is a records file read by srv, with its local TTL and
+// strict_hosts setting.
+type hostsFile struct {
+	srv  *Server
+	path string
+}
+
+func (f hostsFile) Records() (map[string]string, error) {
+	records, typed, err := f.typedRecords()
+	typed.addFirstAddresses(records)
+	return records, err
+}
+
+func (f hostsFile) typedRecords() (map[string]string, *typedHosts, error) {
+	return f.srv.readHostsFile(f.path)
+}
+
+// typedStore is a RecordStore that may also hold typed records.
+type typedStore interface {
+	RecordStore
+	typedRecords() (map[string]string, *typedHosts, error)
+}
+
+// typedHosts holds what the v2 hosts format adds to host records: records
+// of any type, with TTLs and several values, keyed by lower-cased owner
+// name, and the tags of host names.
+type typedHosts struct {
+	rrs  map[string][]dns.RR
+	tags map[string][]string
+}
+
+func newTypedHosts() *typedHosts {
+	return &typedHosts{rrs: make(map[string][]dns.RR), tags: make(map[string][]string)}
+}
+
+// addFirstAddresses adds to records the first address of each host whose
+// typed records are all addresses, for the loaders that only take host
+// records.
+func (t *typedHosts) addFirstAddresses(records map[string]string) {
+	if t == nil {
+		return
+	}
+hosts:
+	for host, rrs := range t.rrs {
+		if _, ok := records[host]; ok {
+			continue
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeA && rr.Header().Rrtype != dns.TypeAAAA {
+				continue hosts
+			}
+		}
+		records[host] = strings.TrimPrefix(rrs[0].String(), rrs[0].Header().String())
+	}
+}
+
+// recordStores returns the stores the records are loaded from, in order of
+// precedence from lowest to highest: the record backends, the remote
+// source, the hosts files and the stores of an embedding program.
+func (s *Server) recordStores() ([]RecordStore, error) {
+	sources, err := s.hostsSources()
+	if err != nil {
+		return nil, err
+	}
+	stores := []RecordStore{backendStore{s}}
+	if s.remote != nil {
+		stores = append(stores, s.remote)
+	}
+	for _, path := range sources {
+		stores = append(stores, hostsFile{s, path})
+	}
+	if s.clusterSource != nil {
+		stores = append(stores, s.clusterSource)
+	}
+	return append(stores, s.extraStores...), nil
+}
+
+// readHostsFile loads records from the file at path. Invalid entries are
+// logged, or with strict_hosts fail the load.
+func (s *Server) readHostsFile(path string) (map[string]string, *typedHosts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, &fileError{path, err}
+	}
+	records, typed, err := parseHosts(data, path, s.cfg.LocalTTL)
+	if err != nil {
+		return nil, nil, &fileError{path, err}
+	}
+	if problems := hostsProblems(data, path); len(problems) > 0 {
+		if s.cfg.StrictHosts {
+			return nil, nil, &fileError{path, fmt.Errorf("%d invalid entries: %s", len(problems), strings.Join(problems, "; "))}
+		}
+		for _, p := range problems {
+			s.logMessage(fmt.Sprintf("Invalid hosts entry: %s", p))
+		}
+	}
+	return records, typed, nil
+}
+
+// jsonMember is a member of a JSON object, with the byte offsets of its
+// key and value.
+type jsonMember struct {
+	key         string
+	value       json.RawMessage
+	keyOffset   int
+	valueOffset int
+}
+
+// objectMembers returns the members of the JSON object data in order,
+// including the duplicates json.Unmarshal silently drops.
+func objectMembers(data []byte) ([]jsonMember, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("not a JSON object")
+	}
+	// The decoder's offset is the end of the previous token, before the
+	// separators of the next one.
+	next := func() int {
+		offset := int(dec.InputOffset())
+		for offset < len(data) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+			offset++
+		}
+		return offset
+	}
+	var members []jsonMember
+	for dec.More() {
+		m := jsonMember{keyOffset: next()}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		m.key, _ = tok.(string)
+		m.valueOffset = next()
+		if err := dec.Decode(&m.value); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// hostsProblems checks the entries of a JSON hosts file, v1 or v2, that
+// parses, and describes each invalid one with its position, key and value:
+// an invalid host name, a name defined twice, of which only the last
+// definition counts, a v1 value that is neither an address nor a list of
+// addresses, which is left out, and an address or selector that does not
+// parse. Typed records of v2 files are checked by parsing them.
+func hostsProblems(data []byte, name string) []string {
+	data, ok := hostsJSON(data)
+	if !ok {
+		return nil
+	}
+	members, err := objectMembers(data)
+	if err != nil {
+		return nil
+	}
+	base, v2 := 0, isHostsV2(data)
+	if v2 {
+		file := members
+		members = nil
+		for _, m := range file {
+			if m.key == "records" {
+				members, _ = objectMembers(m.value)
+				base = m.valueOffset
+			}
+		}
+	}
+
+	var problems []string
+	report := func(m jsonMember, offset int, problem string) {
+		line, column := position(data, base+offset)
+		problems = append(problems, fmt.Sprintf("%s:%d:%d: offset %d: key %q, value %s: %s", name, line, column, base+offset, m.key, m.value, problem))
+	}
+	seen := make(map[string]int)
+	for _, m := range members {
+		host, ok := normalizeRecordHost(m.key)
+		if !ok {
+			report(m, m.keyOffset, "invalid host name")
+			continue
+		}
+		if first, ok := seen[host]; ok {
+			line, _ := position(data, base+first)
+			report(m, m.keyOffset, fmt.Sprintf("duplicate host, also defined on line %d", line))
+		} else {
+			seen[host] = m.keyOffset
+		}
+		decode := decodeHostsAddresses
+		if v2 {
+			decode = decodeHostsEntries
+		}
+		entries, err := decode(m.value)
+		if err != nil {
+			if !v2 {
+				report(m, m.valueOffset, "not an address or a list of addresses")
+			}
+			continue
+		}
+		if value, plain := plainHostsValue(entries); plain {
+			if expanded, err := expandRecord(value); err == nil {
+				if problem := checkRecordValue(expanded); problem != "" {
+					report(m, m.valueOffset, problem)
+				}
+			}
+			continue
+		}
+		for _, e := range entries {
+			if e.Type != "" {
+				continue
+			}
+			for _, v := range e.values() {
+				if expanded, err := expandRecord(v); err == nil && net.ParseIP(expanded) == nil {
+					report(m, m.valueOffset, fmt.Sprintf("invalid IP address %q", expanded))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// parseHosts decodes records that are either a JSON object of host names to
+// IPs, the v2 JSON format, or a classic /etc/hosts style file. The format
+// is detected from the content; name is used in error messages. Hosts of a
+// JSON file with several addresses, and the typed records of v2 files, are
+// returned as typed records, with a TTL of ttl unless they set their own.
+func parseHosts(data []byte, name string, ttl uint32) (map[string]string, *typedHosts, error) {
+	if data, ok := hostsJSON(data); ok {
+		if isHostsV2(data) {
+			return parseHostsV2(data, name, ttl)
+		}
+		raw := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, nil, jsonError(data, name, err)
+		}
+		records := make(map[string]string, len(raw))
+		typed := newTypedHosts()
+		for k, v := range raw {
+			entries, err := decodeHostsAddresses(v)
+			if err != nil {
+				// Left out, and reported by hostsProblems.
+				continue
+			}
+			if err := addHostsEntries(records, typed, k, entries, ttl); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s: %v", name, k, err)
+			}
+		}
+		return records, typed, nil
+	}
+	records, err := parseEtcHosts(data, name)
+	return records, nil, err
+}
+
+// decodeHostsAddresses decodes the value of a host in a v1 JSON file: an
+// address or record, or a list of addresses answered together, e.g.
+// ["10.0.0.1", "fd00::1"] for a dual-stack host.
+func decodeHostsAddresses(raw json.RawMessage) ([]hostsEntry, error) {
+	if bytes.TrimSpace(raw)[0] != '[' {
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return []hostsEntry{{Values: []string{value}}}, err
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	return []hostsEntry{{Values: values}}, nil
+}
+
+// hostsJSON reports whether the records file data is JSON, and returns it
+// as standard JSON: JSON hosts files may have comments and trailing commas
+// (HuJSON). These are blanked out with spaces, so that positions in the
+// result are positions in data.
+func hostsJSON(data []byte) ([]byte, bool) {
+	var std []byte
+	blank := func(from, to int) {
+		if std == nil {
+			std = bytes.Clone(data)
+		}
+		for i := from; i < to; i++ {
+			if std[i] != '\n' {
+				std[i] = ' '
+			}
+		}
+	}
+	inString := false
+	comma := -1
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			end := bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data) - i
+			}
+			blank(i, i+end)
+			i += end - 1
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(data) - i - 4
+			}
+			blank(i, i+end+4)
+			i += end + 3
+		case c == ',':
+			comma = i
+		case c == '}' || c == ']':
+			if comma >= 0 {
+				blank(comma, comma+1)
+			}
+			comma = -1
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		default:
+			inString = c == '"'
+			comma = -1
+		}
+	}
+	if std == nil {
+		std = data
+	}
+	trimmed := bytes.TrimSpace(std)
+	return std, len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// hostsV2 is the v2 JSON hosts format: the version and the entries by host
+// name.
+type hostsV2 struct {
+	Version int                        `json:"version"`
+	Records map[string]json.RawMessage `json:"records"`
+}
+
+// hostsEntry is an entry of a v2 hosts file. Without a type its values are
+// addresses, answered as A or AAAA records. The TTL defaults to local_ttl.
+type hostsEntry struct {
+	Type   string   `json:"type,omitempty"`
+	TTL    *uint32  `json:"ttl,omitempty"`
+	Value  string   `json:"value,omitempty"`
+	Values []string `json:"values,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// isHostsV2 reports whether the JSON object data is a v2 hosts file: one
+// with a numeric version, which no v1 host name maps to.
+func isHostsV2(data []byte) bool {
+	var probe struct {
+		Version json.RawMessage `json:"version"`
+	}
+	if json.Unmarshal(data, &probe) != nil || len(probe.Version) == 0 {
+		return false
+	}
+	_, err := strconv.Atoi(string(probe.Version))
+	return err == nil
+}
+
+// parseHostsV2 decodes a v2 hosts file. An entry is a plain value like in
+// the v1 format, an object, or a list of objects for several types. A
+// single address without type or TTL stays a host record, so selectors,
+// views and reverse records work for it as for v1 records; other entries
+// become typed records.
+func parseHostsV2(data []byte, name string, ttl uint32) (map[string]string, *typedHosts, error) {
+	var file hostsV2
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, jsonError(data, name, err)
+	}
+	if file.Version != 2 {
+		return nil, nil, fmt.Errorf("%s: unsupported hosts file version %d", name, file.Version)
+	}
+	records := make(map[string]string)
+	typed := newTypedHosts()
+	for k, raw := range file.Records {
+		entries, err := decodeHostsEntries(raw)
+		if err == nil {
+			err = addHostsEntries(records, typed, k, entries, ttl)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s: %v", name, k, err)
+		}
+	}
+	return records, typed, nil
+}
+
+// addHostsEntries adds the entries of the host k of a JSON file: to records
+// if they are a host record, or else to typed with a TTL of ttl unless they
+// set their own.
+func addHostsEntries(records map[string]string, typed *typedHosts, k string, entries []hostsEntry, ttl uint32) error {
+	host := strings.ToLower(strings.TrimSuffix(k, "."))
+	for _, e := range entries {
+		if len(e.Tags) > 0 {
+			typed.tags[host] = append(typed.tags[host], e.Tags...)
+		}
+	}
+	if value, ok := plainHostsValue(entries); ok {
+		value, err := expandRecord(value)
+		if err != nil {
+			return err
+		}
+		records[host] = value
+		return nil
+	}
+	for _, e := range entries {
+		rrs, err := e.records(host, ttl)
+		if err != nil {
+			return err
+		}
+		typed.rrs[host] = append(typed.rrs[host], rrs...)
+	}
+	return nil
+}
+
+// decodeHostsEntries decodes the entry of a host in a v2 file: a string,
+// an object, a list of objects or, as in v1 files, a list of addresses.
+func decodeHostsEntries(raw json.RawMessage) ([]hostsEntry, error) {
+	switch bytes.TrimSpace(raw)[0] {
+	case '"':
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return []hostsEntry{{Value: value}}, err
+	case '[':
+		var values []string
+		if json.Unmarshal(raw, &values) == nil && len(values) > 0 {
+			return []hostsEntry{{Values: values}}, nil
+		}
+		var entries []hostsEntry
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, errors.New("no records")
+		}
+		return entries, nil
+	}
+	var e hostsEntry
+	err := json.Unmarshal(raw, &e)
+	return []hostsEntry{e}, err
+}
+
+// plainHostsValue returns the value of the entries of a host in a v2
+// file if they are a host record: a single value without type or TTL.
+func plainHostsValue(entries []hostsEntry) (string, bool) {
+	if len(entries) != 1 || entries[0].Type != "" || entries[0].TTL != nil || len(entries[0].values()) != 1 {
+		return "", false
+	}
+	return entries[0].values()[0], true
+}
+
+// values returns the value followed by the values of e.
+func (e hostsEntry) values() []string {
+	if e.Value == "" {
+		return e.Values
+	}
+	return append([]string{e.Value}, e.Values...)
+}
+
+// records returns the records of e for host, with its values expanded as
+// templates and given in zone file syntax for their type, e.g.
+// "10 mail.example.com." for MX. TXT values are quoted unless they are
+// already. The records have e's TTL, or else ttl.
+func (e hostsEntry) records(host string, ttl uint32) ([]dns.RR, error) {
+	values := e.values()
+	if len(values) == 0 {
+		return nil, errors.New("no value")
+	}
+	if e.TTL != nil {
+		ttl = *e.TTL
+	}
+	rrtype := strings.ToUpper(e.Type)
+	if _, ok := dns.StringToType[rrtype]; !ok && rrtype != "" {
+		return nil, fmt.Errorf("unknown record type %q", e.Type)
+	}
+	if rrtype == "SOA" {
+		return nil, errors.New("SOA records belong in zones")
+	}
+	rrs := make([]dns.RR, 0, len(values))
+	for _, v := range values {
+		value, err := expandRecord(v)
+		if err != nil {
+			return nil, err
+		}
+		if rrtype == "" {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q; set the type of other records", value)
+			}
+			rrs = append(rrs, addressRecord(dns.Fqdn(host), ip, ttl))
+			continue
+		}
+		if rrtype == "TXT" && !strings.HasPrefix(value, `"`) {
+			value = strconv.Quote(value)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(host), ttl, rrtype, value))
+		if err != nil {
+			return nil, fmt.Errorf("%s record %q: %v", rrtype, value, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("%s record %q is empty", rrtype, value)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// jsonError prefixes a JSON decoding error with the file name and, when
+// the error has a position, the line and column.
+func jsonError(data []byte, name string, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	line, column := position(data, int(min(offset, int64(len(data)))))
+	return fmt.Errorf("%s:%d:%d: %v", name, line, column, err)
+}
+
+// position converts a byte offset in data to a 1-based line and column.
+func position(data []byte, offset int) (int, int) {
+	before := data[:offset]
+	return bytes.Count(before, []byte("\n")) + 1, offset - bytes.LastIndexByte(before, '\n')
+}
+
+// parseEtcHosts parses lines of the form "IP hostname [aliases...]", with
+// "#" starting a comment. As only one address is kept per name, the first
+// IPv4 address wins and IPv6 addresses are used only for IPv6-only names.
+func parseEtcHosts(data []byte, path string) (map[string]string, error) {
+	records := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing host name after %q", path, line, fields[0])
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IP address %q", path, line, fields[0])
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if existing, ok := records[name]; ok && (ip.To4() == nil || net.ParseIP(existing).To4() != nil) {
+				continue
+			}
+			records[name] = fields[0]
+		}
+	}
+	return records, scanner.Err()
+}
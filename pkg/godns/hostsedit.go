@@ -0,0 +1,275 @@
+package godns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// hostsText is a JSON hosts file being edited in place: data as it is
+// and std, data as standard JSON from hostsJSON, with the same offsets.
+type hostsText struct {
+	data, std []byte
+}
+
+// hostsEdit replaces the bytes from to to of a file with text.
+type hostsEdit struct {
+	from, to int
+	text     string
+}
+
+// patchHostsFile returns the JSON hosts file data, v1 or v2, with the
+// entries of the hosts in records, in any spelling, set to their values,
+// or removed for empty values, and reports whether it had any of them.
+// The rest of the file stays as it is, comments, trailing commas and order
+// included: a value is replaced where it stands, and new entries go after
+// the last one, indented like it. In a v2 file the entry is replaced
+// whole, typed records and tags included, with a plain value.
+func patchHostsFile(data []byte, name string, records map[string]string) ([]byte, bool, error) {
+	std, ok := hostsJSON(data)
+	if !ok {
+		return nil, false, fmt.Errorf("%s is not a JSON hosts file", name)
+	}
+	t := hostsText{data: data, std: std}
+	values := make(map[string]string, len(records))
+	for host, ip := range records {
+		values[host] = ""
+		if ip != "" {
+			value, _ := json.Marshal(ip)
+			values[host] = string(value)
+		}
+	}
+
+	open := bytes.IndexByte(std, '{')
+	end := bytes.LastIndexByte(std, '}') + 1
+	if isHostsV2(std) {
+		top, err := objectMembers(std[open:end])
+		if err != nil {
+			return nil, false, jsonError(std, name, err)
+		}
+		var entries *jsonMember
+		for i := range top {
+			if top[i].key == "records" {
+				entries = &top[i]
+			}
+		}
+		if entries == nil {
+			// Add an empty records object to set the records in.
+			edits, _ := t.patchObject(open, end, top, map[string]string{"records": "{}"})
+			return patchHostsFile(applyHostsEdits(data, edits), name, records)
+		}
+		if len(entries.value) == 0 || entries.value[0] != '{' {
+			return nil, false, fmt.Errorf("%s: records is not an object", name)
+		}
+		open, end = open+entries.valueOffset, open+entries.valueOffset+len(entries.value)
+	}
+	members, err := objectMembers(std[open:end])
+	if err != nil {
+		return nil, false, jsonError(std, name, err)
+	}
+	edits, found := t.patchObject(open, end, members, values)
+	return applyHostsEdits(data, edits), found, nil
+}
+
+// patchObject returns the edits that set the members of the object at
+// open to end, whose members are given, to values, JSON texts by host,
+// and remove those whose value is empty, and reports whether the object
+// had any of them. Hosts are matched in any spelling; the last member of
+// a host keeps its place, and its duplicates are removed.
+func (t hostsText) patchObject(open, end int, members []jsonMember, values map[string]string) ([]hostsEdit, bool) {
+	type member struct {
+		start, valueStart, end int
+		// comma is the offset of the comma after the member, or -1.
+		comma int
+		keep  bool
+	}
+	ms := make([]member, len(members))
+	last := make(map[string]int)
+	for i, m := range members {
+		valueStart := open + m.valueOffset
+		ms[i] = member{start: open + m.keyOffset, valueStart: valueStart, end: valueStart + len(m.value), keep: true}
+		ms[i].comma = t.commaAfter(ms[i].end)
+		if _, ok := values[hostsKey(m.key)]; ok {
+			last[hostsKey(m.key)] = i
+		}
+	}
+
+	var edits []hostsEdit
+	for i, m := range members {
+		host := hostsKey(m.key)
+		value, ok := values[host]
+		switch {
+		case !ok:
+		case value != "" && last[host] == i:
+			edits = append(edits, hostsEdit{ms[i].valueStart, ms[i].end, value})
+		default:
+			ms[i].keep = false
+			edits = append(edits, t.removeMember(ms[i].start, ms[i].end, ms[i].comma))
+		}
+	}
+	var added []string
+	for host, value := range values {
+		if _, ok := last[host]; !ok && value != "" {
+			added = append(added, host)
+		}
+	}
+	sort.Strings(added)
+
+	// A file with a comma after its last member gets one after new
+	// members too.
+	trailing := len(ms) > 0 && ms[len(ms)-1].comma >= 0
+	lastKept := -1
+	for i := range ms {
+		if ms[i].keep {
+			lastKept = i
+		}
+	}
+	memberText := func(i int, host string) string {
+		key, _ := json.Marshal(host)
+		text := string(key) + ": " + values[host]
+		if i < len(added)-1 || trailing {
+			text += ","
+		}
+		return text
+	}
+
+	if lastKept < 0 {
+		if len(added) == 0 {
+			return edits, len(last) > 0
+		}
+		braceIndent := t.lineIndent(open)
+		indent := braceIndent + "    "
+		if len(ms) > 0 {
+			if s, ok := t.indent(ms[0].start); ok {
+				indent = s
+			}
+		}
+		var text strings.Builder
+		for i, host := range added {
+			text.WriteString("\n" + indent + memberText(i, host))
+		}
+		if bytes.IndexByte(t.data[open:end], '\n') < 0 {
+			text.WriteString("\n" + braceIndent)
+		}
+		return append(edits, hostsEdit{open + 1, open + 1, text.String()}), len(last) > 0
+	}
+
+	l := ms[lastKept]
+	if len(added) == 0 {
+		// The new last member loses the comma that separated it from
+		// the removed ones.
+		if lastKept < len(ms)-1 && !trailing && l.comma >= 0 {
+			edits = append(edits, hostsEdit{l.comma, l.comma + 1, ""})
+		}
+		return edits, len(last) > 0
+	}
+	after, comma := l.end, ""
+	if l.comma >= 0 {
+		after = l.comma + 1
+	} else {
+		comma = ","
+	}
+	nl := bytes.IndexByte(t.data[after:end-1], '\n')
+	if nl < 0 {
+		// On the line of the closing brace the new members follow the
+		// last one.
+		text := comma
+		for i, host := range added {
+			text += " " + memberText(i, host)
+		}
+		return append(edits, hostsEdit{after, after, text}), len(last) > 0
+	}
+	if comma != "" {
+		edits = append(edits, hostsEdit{l.end, l.end, comma})
+	}
+	indent, ok := t.indent(l.start)
+	if !ok {
+		indent = t.lineIndent(open) + "    "
+	}
+	var text strings.Builder
+	for i, host := range added {
+		text.WriteString(indent + memberText(i, host) + "\n")
+	}
+	at := after + nl + 1
+	return append(edits, hostsEdit{at, at, text.String()}), len(last) > 0
+}
+
+// removeMember returns the edit that removes the member from start to end
+// with its comma, if any: its whole line, along with a comment after it,
+// when it is alone on it.
+func (t hostsText) removeMember(start, end, comma int) hostsEdit {
+	if comma >= 0 {
+		end = comma + 1
+	}
+	lineStart := bytes.LastIndexByte(t.data[:start], '\n') + 1
+	if len(bytes.Trim(t.data[lineStart:start], " \t")) > 0 {
+		return hostsEdit{start, end, ""}
+	}
+	rest := end
+	for rest < len(t.data) && (t.data[rest] == ' ' || t.data[rest] == '\t' || t.data[rest] == '\r') {
+		rest++
+	}
+	if rest < len(t.data) && (t.data[rest] == '\n' || bytes.HasPrefix(t.data[rest:], []byte("//"))) {
+		if nl := bytes.IndexByte(t.data[rest:], '\n'); nl >= 0 {
+			return hostsEdit{lineStart, rest + nl + 1, ""}
+		}
+	}
+	return hostsEdit{start, end, ""}
+}
+
+// commaAfter returns the offset of the comma after the value ending at
+// end, separating it from the next member or trailing it, or -1.
+func (t hostsText) commaAfter(end int) int {
+	// A trailing comma is blanked in std, a comment before a separating
+	// one in std only.
+	for _, text := range [][]byte{t.data, t.std} {
+		i := end
+		for i < len(text) && strings.IndexByte(" \t\r\n", text[i]) >= 0 {
+			i++
+		}
+		if i < len(text) && text[i] == ',' {
+			return i
+		}
+	}
+	return -1
+}
+
+// indent returns the blanks before offset i on its line, if there is
+// nothing else.
+func (t hostsText) indent(i int) (string, bool) {
+	prefix := t.data[bytes.LastIndexByte(t.data[:i], '\n')+1 : i]
+	return string(prefix), len(bytes.Trim(prefix, " \t")) == 0
+}
+
+// lineIndent returns the blanks at the start of the line of offset i.
+func (t hostsText) lineIndent(i int) string {
+	line := t.data[bytes.LastIndexByte(t.data[:i], '\n')+1:]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// applyHostsEdits returns data with the edits, which do not overlap,
+// applied. An insertion goes before a removal at the same offset.
+func applyHostsEdits(data []byte, edits []hostsEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].from != edits[j].from {
+			return edits[i].from < edits[j].from
+		}
+		return edits[i].to < edits[j].to
+	})
+	var out bytes.Buffer
+	prev := 0
+	for _, e := range edits {
+		out.Write(data[prev:e.from])
+		out.WriteString(e.text)
+		prev = e.to
+	}
+	out.Write(data[prev:])
+	return out.Bytes()
+}
+
+// hostsKey returns the host name a key of a hosts file stands for.
+func hostsKey(key string) string {
+	return strings.ToLower(strings.TrimSuffix(key, "."))
+}
@@ -0,0 +1,123 @@
+package godns
+
+import "testing"
+
+func TestPatchHostsFile(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		file    string
+		records map[string]string
+		want    string
+		found   bool
+	}{
+		{
+			name: "replace keeps comments and order",
+			file: `{
+    // Storage
+    "nas.lan": "192.168.1.10", // office
+    "printer.lan": "192.168.1.20",
+}
+`,
+			records: map[string]string{"nas.lan": "192.168.1.11"},
+			want: `{
+    // Storage
+    "nas.lan": "192.168.1.11", // office
+    "printer.lan": "192.168.1.20",
+}
+`,
+			found: true,
+		},
+		{
+			name:    "add after the last entry",
+			file:    "{\n    \"nas.lan\": \"192.168.1.10\" // office\n}\n",
+			records: map[string]string{"b.lan": "10.0.0.2", "a.lan": "10.0.0.1"},
+			want:    "{\n    \"nas.lan\": \"192.168.1.10\", // office\n    \"a.lan\": \"10.0.0.1\",\n    \"b.lan\": \"10.0.0.2\"\n}\n",
+		},
+		{
+			name:    "add with trailing commas",
+			file:    "{\n  \"nas.lan\": \"192.168.1.10\",\n}\n",
+			records: map[string]string{"a.lan": "10.0.0.1"},
+			want:    "{\n  \"nas.lan\": \"192.168.1.10\",\n  \"a.lan\": \"10.0.0.1\",\n}\n",
+		},
+		{
+			name:    "add to an empty file",
+			file:    "{}\n",
+			records: map[string]string{"a.lan": "10.0.0.1"},
+			want:    "{\n    \"a.lan\": \"10.0.0.1\"\n}\n",
+		},
+		{
+			name:    "add on one line",
+			file:    `{"nas.lan": "192.168.1.10"}`,
+			records: map[string]string{"a.lan": "10.0.0.1"},
+			want:    `{"nas.lan": "192.168.1.10", "a.lan": "10.0.0.1"}`,
+		},
+		{
+			name:    "remove the line with its comment",
+			file:    "{\n    \"nas.lan\": \"192.168.1.10\", // office\n    \"printer.lan\": \"192.168.1.20\"\n}\n",
+			records: map[string]string{"nas.lan": ""},
+			want:    "{\n    \"printer.lan\": \"192.168.1.20\"\n}\n",
+			found:   true,
+		},
+		{
+			name:    "remove the last entry",
+			file:    "{\n    \"nas.lan\": \"192.168.1.10\",\n    \"printer.lan\": \"192.168.1.20\"\n}\n",
+			records: map[string]string{"printer.lan": ""},
+			want:    "{\n    \"nas.lan\": \"192.168.1.10\"\n}\n",
+			found:   true,
+		},
+		{
+			name:    "remove duplicates in any spelling",
+			file:    "{\n    \"NAS.lan.\": \"192.168.1.9\",\n    \"nas.lan\": \"192.168.1.10\"\n}\n",
+			records: map[string]string{"nas.lan": "192.168.1.11"},
+			want:    "{\n    \"nas.lan\": \"192.168.1.11\"\n}\n",
+			found:   true,
+		},
+		{
+			name:    "remove a missing entry",
+			file:    "{\n    \"nas.lan\": \"192.168.1.10\"\n}\n",
+			records: map[string]string{"printer.lan": ""},
+			want:    "{\n    \"nas.lan\": \"192.168.1.10\"\n}\n",
+		},
+		{
+			name: "v2 replaces a typed entry",
+			file: `{
+    "version": 2,
+    /* Mail */
+    "records": {
+        "example.lan": {"type": "MX", "value": "10 mail.example.lan."},
+    },
+}
+`,
+			records: map[string]string{"example.lan": "10.0.0.1", "a.lan": "10.0.0.2"},
+			want: `{
+    "version": 2,
+    /* Mail */
+    "records": {
+        "example.lan": "10.0.0.1",
+        "a.lan": "10.0.0.2",
+    },
+}
+`,
+			found: true,
+		},
+		{
+			name:    "v2 without records",
+			file:    "{\n    \"version\": 2\n}\n",
+			records: map[string]string{"a.lan": "10.0.0.1"},
+			want:    "{\n    \"version\": 2,\n    \"records\": {\n        \"a.lan\": \"10.0.0.1\"\n    }\n}\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := patchHostsFile([]byte(tt.file), "hosts.json", tt.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want || found != tt.found {
+				t.Errorf("got %t and\n%s\nwant %t and\n%s", found, got, tt.found, tt.want)
+			}
+			if _, _, err := parseHosts(got, "hosts.json", DefaultConfig().LocalTTL); err != nil {
+				t.Errorf("patched file does not parse: %v", err)
+			}
+		})
+	}
+}
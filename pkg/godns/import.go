@@ -0,0 +1,168 @@
+package godns
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const importUsage = `Usage: godns import [flags] <source> <path>
+
+Sources:
+  pihole <dir>      Pi-hole's configuration directory, e.g. /etc/pihole
+  dnsmasq <path>    A dnsmasq configuration file or directory of *.conf files
+
+Records are merged into the hosts JSON file, replacing records of the same
+name. Settings that belong in the configuration file, such as upstreams
+and forward zones, are printed, or written to a new file with -config-out.
+Anything that cannot be converted is listed as a warning.
+
+Flags:
+`
+
+// importers convert the configuration of another DNS server found at a
+// path.
+var importers = map[string]func(path string) (*importedConfig, error){
+	"pihole":  importPihole,
+	"dnsmasq": importDnsmasq,
+}
+
+// importedConfig is what an importer could convert.
+type importedConfig struct {
+	records      map[string]string
+	upstreams    []string
+	forwardZones []ForwardZone
+	// localZones are answered from the records only, never forwarded.
+	localZones []string
+	// warnings describe what was not converted.
+	warnings []string
+}
+
+func (c *importedConfig) warn(format string, args ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+// flattenCNAMEs adds records for the aliases of every CNAME, given as
+// "alias[,alias...],target[,ttl]" like dnsmasq's cname option, whose target
+// is an imported record. godns has no CNAME records for host names.
+func (c *importedConfig) flattenCNAMEs(cnames []string) {
+	for _, cname := range cnames {
+		fields := strings.Split(cname, ",")
+		if len(fields) > 2 && isNumber(fields[len(fields)-1]) {
+			fields = fields[:len(fields)-1]
+		}
+		if len(fields) < 2 {
+			c.warn("invalid CNAME record %q", cname)
+			continue
+		}
+		target := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(fields[len(fields)-1]), "."))
+		ip, ok := c.records[target]
+		if !ok {
+			c.warn("CNAME %s not imported: its target is not a local record", cname)
+			continue
+		}
+		for _, alias := range fields[:len(fields)-1] {
+			c.records[strings.ToLower(strings.TrimSuffix(strings.TrimSpace(alias), "."))] = ip
+		}
+	}
+}
+
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	hostsFile := flags.String("hosts", DefaultConfig().HostsFile, "Path to the hosts JSON file records are merged into")
+	configOut := flags.String("config-out", "", "Write the imported settings to this new YAML configuration file")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), importUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	importer, ok := importers[flags.Arg(0)]
+	if flags.NArg() != 2 || !ok {
+		flags.Usage()
+		return 2
+	}
+
+	imported, err := importer(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	type zone struct {
+		Name string `yaml:"name"`
+	}
+	settings := struct {
+		HostsFile    string        `yaml:"hosts_file"`
+		Upstreams    []string      `yaml:"upstreams,omitempty"`
+		ForwardZones []ForwardZone `yaml:"forward_zones,omitempty"`
+		Zones        []zone        `yaml:"zones,omitempty"`
+	}{HostsFile: *hostsFile, Upstreams: imported.upstreams, ForwardZones: imported.forwardZones}
+	for _, name := range imported.localZones {
+		settings.Zones = append(settings.Zones, zone{name})
+	}
+	out, err := yaml.Marshal(settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	// The configuration is written first: it is the step that refuses to
+	// overwrite an existing file.
+	if *configOut != "" {
+		if err := writeNewFile(*configOut, out); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+	if err := mergeHostsFile(*hostsFile, imported.records); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	fmt.Printf("Imported %d record(s) into %s\n", len(imported.records), *hostsFile)
+	if *configOut != "" {
+		fmt.Printf("Wrote configuration to %s\n", *configOut)
+	} else if len(imported.upstreams) > 0 || len(imported.forwardZones) > 0 || len(imported.localZones) > 0 {
+		fmt.Printf("Add to the configuration file:\n\n%s\n", out)
+	}
+
+	for _, w := range imported.warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+	return 0
+}
+
+// writeNewFile writes data to a file that must not exist yet.
+func writeNewFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// mergeHostsFile adds records to the JSON hosts file at path, creating it
+// if needed. Existing records of the same name are replaced.
+func mergeHostsFile(path string, records map[string]string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && len(bytes.TrimSpace(data)) == 0 {
+		data, err = []byte("{}\n"), nil
+	}
+	if err != nil {
+		return err
+	}
+	data, _, err = patchHostsFile(data, path, records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,92 @@
+package godns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// maxJournal is how many changes are kept per zone for IXFR. Secondaries
+// further behind get a full transfer.
+const maxJournal = 100
+
+// zoneDelta is the change of a zone from one serial to the next.
+type zoneDelta struct {
+	from, to *dns.SOA
+	removed  []dns.RR
+	added    []dns.RR
+}
+
+// recordChange appends the difference between prev and z to z's journal,
+// which is inherited from prev. The journal is dropped when the change
+// cannot be expressed as a delta: the serial did not increase (RFC 1982
+// arithmetic) although the records changed.
+func (z *zoneData) recordChange(prev *zoneData) {
+	delta := zoneDelta{from: prev.soa, to: z.soa}
+	for _, rr := range prev.records()[1:] {
+		if !containsRR(z.rrs[ownerName(rr)], rr) {
+			delta.removed = append(delta.removed, rr)
+		}
+	}
+	for _, rr := range z.records()[1:] {
+		if !containsRR(prev.rrs[ownerName(rr)], rr) {
+			delta.added = append(delta.added, rr)
+		}
+	}
+
+	switch {
+	case z.soa.Serial == prev.soa.Serial && len(delta.removed) == 0 && len(delta.added) == 0:
+		z.journal = prev.journal
+	case !serialAfter(z.soa.Serial, prev.soa.Serial):
+		z.journal = nil
+	default:
+		journal := prev.journal
+		if len(journal) >= maxJournal {
+			journal = journal[len(journal)-maxJournal+1:]
+		}
+		// Copy rather than append in place: prev may still be serving.
+		z.journal = append(append([]zoneDelta(nil), journal...), delta)
+	}
+}
+
+// incrementalRecords returns the answer records of an IXFR (RFC 1995) from
+// serial to the current one, or nil if the journal does not reach back to
+// serial and a full transfer is needed.
+func (z *zoneData) incrementalRecords(serial uint32) []dns.RR {
+	if serial == z.soa.Serial || serialAfter(serial, z.soa.Serial) {
+		return []dns.RR{z.soa}
+	}
+	start := -1
+	for i, delta := range z.journal {
+		if delta.from.Serial == serial {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+
+	rrs := []dns.RR{z.soa}
+	for _, delta := range z.journal[start:] {
+		rrs = append(rrs, delta.from)
+		rrs = append(rrs, delta.removed...)
+		rrs = append(rrs, delta.to)
+		rrs = append(rrs, delta.added...)
+	}
+	return append(rrs, z.soa)
+}
+
+// serialAfter reports whether serial a is newer than b using RFC 1982
+// serial number arithmetic.
+func serialAfter(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// carryJournals gives every reloaded zone the journal of its previous
+// version, extended with the changes made to the zone file.
+func carryJournals(prev, next map[string]*zoneData) {
+	for origin, z := range next {
+		if old := prev[origin]; old != nil {
+			z.recordChange(old)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package godns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// k8sHostnameAnnotation lists extra host names (comma separated) for a
+// Service or Ingress, e.g. "grafana.lab".
+const k8sHostnameAnnotation = "godns.io/hostname"
+
+const k8sServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesBackend watches Services, Endpoints and optionally Ingresses
+// through the Kubernetes API and serves <service>.<namespace>.<domain>,
+// Ingress hosts and annotated host names.
+type kubernetesBackend struct {
+	srv       *Server
+	server    string
+	tokenFile string
+	namespace string
+	domain    string
+	ingresses bool
+	client    *http.Client
+
+	mu sync.Mutex
+	// objects holds the raw objects of each watched resource, keyed by
+	// namespace/name.
+	objects map[string]map[string]json.RawMessage
+}
+
+type k8sMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type k8sLoadBalancer struct {
+	Ingress []struct {
+		IP string `json:"ip"`
+	} `json:"ingress"`
+}
+
+type k8sService struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		ClusterIP string `json:"clusterIP"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer k8sLoadBalancer `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+type k8sEndpoints struct {
+	Metadata k8sMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+	} `json:"subsets"`
+}
+
+type k8sIngress struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		Rules []struct {
+			Host string `json:"host"`
+		} `json:"rules"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer k8sLoadBalancer `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+func (s *Server) newKubernetesBackend(c KubernetesConfig) (*kubernetesBackend, error) {
+	// Inside a pod, default to the service account's credentials.
+	if _, err := os.Stat(k8sServiceAccount + "/token"); err == nil && c.TokenFile == "" {
+		c.TokenFile = k8sServiceAccount + "/token"
+	}
+	if _, err := os.Stat(k8sServiceAccount + "/ca.crt"); err == nil && c.CAFile == "" {
+		c.CAFile = k8sServiceAccount + "/ca.crt"
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &kubernetesBackend{
+		srv:       s,
+		server:    strings.TrimSuffix(c.APIServer, "/"),
+		tokenFile: c.TokenFile,
+		namespace: c.Namespace,
+		domain:    strings.ToLower(strings.Trim(c.Domain, ".")),
+		ingresses: c.Ingresses,
+		// No overall timeout: watch responses stream indefinitely.
+		client:  &http.Client{Transport: transport},
+		objects: make(map[string]map[string]json.RawMessage),
+	}, nil
+}
+
+func (k *kubernetesBackend) run() {
+	resources := []string{"/api/v1/%sservices", "/api/v1/%sendpoints"}
+	if k.ingresses {
+		resources = append(resources, "/apis/networking.k8s.io/v1/%singresses")
+	}
+	scope := ""
+	if k.namespace != "" {
+		scope = "namespaces/" + k.namespace + "/"
+	}
+	for _, resource := range resources {
+		path := fmt.Sprintf(resource, scope)
+		k.srv.goBackground(func() { k.watch(path) })
+	}
+}
+
+// watch lists a resource and then follows its changes, starting over with
+// a growing delay whenever the watch fails or expires, until the server
+// shuts down.
+func (k *kubernetesBackend) watch(path string) {
+	for attempt := 0; ; attempt++ {
+		listed, err := k.listAndWatch(path)
+		if listed {
+			attempt = 0
+		}
+		if k.srv.ctx.Err() != nil {
+			return
+		}
+		k.srv.backendFailed("kubernetes", fmt.Errorf("%s: %v", path, err))
+		if !k.srv.sleep(backoff(attempt)) {
+			return
+		}
+	}
+}
+
+func (k *kubernetesBackend) listAndWatch(path string) (listed bool, err error) {
+	resp, err := k.get(path)
+	if err != nil {
+		return false, err
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	objects := make(map[string]json.RawMessage, len(list.Items))
+	for _, item := range list.Items {
+		objects[objectKey(item)] = item
+	}
+	k.mu.Lock()
+	k.objects[path] = objects
+	k.mu.Unlock()
+	k.publish()
+
+	resp, err = k.get(path + "?watch=1&resourceVersion=" + list.Metadata.ResourceVersion)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return true, err
+		}
+		key := objectKey(event.Object)
+		k.mu.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			k.objects[path][key] = event.Object
+		case "DELETED":
+			delete(k.objects[path], key)
+		case "ERROR":
+			k.mu.Unlock()
+			return true, fmt.Errorf("watch: %s", event.Object)
+		}
+		k.mu.Unlock()
+		k.publish()
+	}
+}
+
+// publish rebuilds the records from the watched objects.
+func (k *kubernetesBackend) publish() {
+	k.mu.Lock()
+	var services []k8sService
+	var ingresses []k8sIngress
+	endpoints := make(map[string]k8sEndpoints)
+	for path, objects := range k.objects {
+		for key, raw := range objects {
+			switch {
+			case strings.HasSuffix(path, "/services"):
+				var s k8sService
+				if json.Unmarshal(raw, &s) == nil {
+					services = append(services, s)
+				}
+			case strings.HasSuffix(path, "/endpoints"):
+				var e k8sEndpoints
+				if json.Unmarshal(raw, &e) == nil {
+					endpoints[key] = e
+				}
+			case strings.HasSuffix(path, "/ingresses"):
+				var i k8sIngress
+				if json.Unmarshal(raw, &i) == nil {
+					ingresses = append(ingresses, i)
+				}
+			}
+		}
+	}
+	k.mu.Unlock()
+
+	// Sorted, so a host name claimed twice always resolves the same way.
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Metadata.Namespace+"/"+services[i].Metadata.Name < services[j].Metadata.Namespace+"/"+services[j].Metadata.Name
+	})
+	sort.Slice(ingresses, func(i, j int) bool {
+		return ingresses[i].Metadata.Namespace+"/"+ingresses[i].Metadata.Name < ingresses[j].Metadata.Namespace+"/"+ingresses[j].Metadata.Name
+	})
+
+	records := make(map[string]string)
+	for _, s := range services {
+		ip := loadBalancerIP(s.Status.LoadBalancer)
+		if ip == "" && s.Spec.ClusterIP != "None" {
+			ip = s.Spec.ClusterIP
+		}
+		if ip == "" {
+			// Headless service: answer with a ready endpoint.
+			e := endpoints[s.Metadata.Namespace+"/"+s.Metadata.Name]
+			for _, subset := range e.Subsets {
+				if len(subset.Addresses) > 0 {
+					ip = subset.Addresses[0].IP
+					break
+				}
+			}
+		}
+		addRecord(records, s.Metadata.Name+"."+s.Metadata.Namespace+"."+k.domain, ip)
+		for _, host := range annotatedHosts(s.Metadata) {
+			addRecord(records, host, ip)
+		}
+	}
+	for _, i := range ingresses {
+		ip := loadBalancerIP(i.Status.LoadBalancer)
+		for _, rule := range i.Spec.Rules {
+			addRecord(records, rule.Host, ip)
+		}
+		for _, host := range annotatedHosts(i.Metadata) {
+			addRecord(records, host, ip)
+		}
+	}
+	k.srv.publishBackendRecords("kubernetes", records)
+}
+
+func (k *kubernetesBackend) get(path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(k.srv.ctx, http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Re-read on every request: projected service account tokens rotate.
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+func objectKey(raw json.RawMessage) string {
+	var obj struct {
+		Metadata k8sMeta `json:"metadata"`
+	}
+	json.Unmarshal(raw, &obj)
+	return obj.Metadata.Namespace + "/" + obj.Metadata.Name
+}
+
+func loadBalancerIP(lb k8sLoadBalancer) string {
+	for _, ingress := range lb.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+	}
+	return ""
+}
+
+func annotatedHosts(meta k8sMeta) []string {
+	value := meta.Annotations[k8sHostnameAnnotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
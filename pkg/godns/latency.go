@@ -0,0 +1,149 @@
+package godns
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in milliseconds, of the histogram
+// buckets; a final overflow bucket catches everything slower.
+var latencyBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// latencyHistogram counts upstream exchange durations in fixed buckets.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	total  uint64
+	sum    float64
+}
+
+type latencySummary struct {
+	Count   uint64          `json:"count"`
+	MeanMs  float64         `json:"mean_ms"`
+	P50Ms   float64         `json:"p50_ms"`
+	P95Ms   float64         `json:"p95_ms"`
+	P99Ms   float64         `json:"p99_ms"`
+	Buckets []latencyBucket `json:"buckets"`
+}
+
+type latencyBucket struct {
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+func init() {
+	handleAdmin("/upstreams/latency", func(s *Server) http.HandlerFunc { return s.upstreamLatencyHandler })
+}
+
+func (s *Server) observeUpstreamLatency(upstream string, d time.Duration) {
+	s.upstreamLatencyMu.Lock()
+	h, ok := s.upstreamLatency[upstream]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		s.upstreamLatency[upstream] = h
+	}
+	s.upstreamLatencyMu.Unlock()
+
+	s.statsdTiming("upstream."+statsdName(upstream)+".latency", d)
+
+	ms := float64(d.Microseconds()) / 1000
+	i := sort.SearchFloat64s(latencyBuckets, ms)
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	h.sum += ms
+	h.mu.Unlock()
+}
+
+func (h *latencyHistogram) summary() latencySummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := latencySummary{Count: h.total, Buckets: make([]latencyBucket, len(h.counts))}
+	for i, c := range h.counts {
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = fmt.Sprintf("%g", latencyBuckets[i])
+		}
+		s.Buckets[i] = latencyBucket{Le: le, Count: c}
+	}
+	if h.total == 0 {
+		return s
+	}
+	s.MeanMs = round3(h.sum / float64(h.total))
+	s.P50Ms = h.quantile(0.50)
+	s.P95Ms = h.quantile(0.95)
+	s.P99Ms = h.quantile(0.99)
+	return s
+}
+
+// quantile estimates the q-th quantile by interpolating linearly within the
+// bucket that contains it. Values in the overflow bucket are reported as the
+// largest finite bound.
+func (h *latencyHistogram) quantile(q float64) float64 {
+	rank := q * float64(h.total)
+	var seen float64
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if seen+float64(c) >= rank {
+			if i == len(latencyBuckets) {
+				return latencyBuckets[i-1]
+			}
+			lower := 0.0
+			if i > 0 {
+				lower = latencyBuckets[i-1]
+			}
+			return round3(lower + (latencyBuckets[i]-lower)*(rank-seen)/float64(c))
+		}
+		seen += float64(c)
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+func (s *Server) upstreamLatencySummaries() map[string]latencySummary {
+	s.upstreamLatencyMu.Lock()
+	defer s.upstreamLatencyMu.Unlock()
+
+	out := make(map[string]latencySummary, len(s.upstreamLatency))
+	for upstream, h := range s.upstreamLatency {
+		out[upstream] = h.summary()
+	}
+	return out
+}
+
+func (s *Server) upstreamLatencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.upstreamLatencySummaries())
+}
+
+// upstreamLatencyStats renders the latency percentiles as stats lines.
+func (s *Server) upstreamLatencyStats() string {
+	summaries := s.upstreamLatencySummaries()
+	upstreams := make([]string, 0, len(summaries))
+	for upstream := range summaries {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+
+	var b strings.Builder
+	for _, upstream := range upstreams {
+		summary := summaries[upstream]
+		fmt.Fprintf(&b, "upstream.%s.latency.count=%d\n", upstream, summary.Count)
+		fmt.Fprintf(&b, "upstream.%s.latency.p50_ms=%g\n", upstream, summary.P50Ms)
+		fmt.Fprintf(&b, "upstream.%s.latency.p95_ms=%g\n", upstream, summary.P95Ms)
+		fmt.Fprintf(&b, "upstream.%s.latency.p99_ms=%g\n", upstream, summary.P99Ms)
+	}
+	return b.String()
+}
@@ -0,0 +1,310 @@
+package godns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	mdnsPort = 5353
+	// mdnsTTL is the TTL RFC 6762 recommends for host address records.
+	mdnsTTL = 120
+	// mdnsUnicastResponse is the top bit of a question's class, set when
+	// the querier asks for a unicast reply, and of a record's class, where
+	// it tells caches to flush other records of the name.
+	mdnsUnicastResponse = 1 << 15
+)
+
+var (
+	mdnsGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+)
+
+// mdnsConn is the part of ipv4.PacketConn and ipv6.PacketConn the
+// responder needs, with the interface index of the control messages.
+type mdnsConn interface {
+	read(buf []byte) (n, ifIndex int, src net.Addr, err error)
+	write(b []byte, ifIndex int, dst net.Addr) error
+	Close() error
+}
+
+type mdnsConn4 struct{ *ipv4.PacketConn }
+
+func (c mdnsConn4) read(buf []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.ReadFrom(buf)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c mdnsConn4) write(b []byte, ifIndex int, dst net.Addr) error {
+	_, err := c.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, dst)
+	return err
+}
+
+type mdnsConn6 struct{ *ipv6.PacketConn }
+
+func (c mdnsConn6) read(buf []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.ReadFrom(buf)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c mdnsConn6) write(b []byte, ifIndex int, dst net.Addr) error {
+	_, err := c.WriteTo(b, &ipv6.ControlMessage{IfIndex: ifIndex}, dst)
+	return err
+}
+
+// startMDNS joins the mDNS groups on the configured interfaces, or the
+// system default one, and answers queries for .local names. It runs next
+// to other responders such as Avahi, which share the port.
+func (s *Server) startMDNS() error {
+	var ifaces []*net.Interface
+	for _, name := range s.cfg.MDNS.Interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("mdns interface %s: %v", name, err)
+		}
+		ifaces = append(ifaces, ifi)
+	}
+	if len(ifaces) == 0 {
+		ifaces = append(ifaces, nil)
+	}
+
+	joined := 0
+	if conn, err := net.ListenMulticastUDP("udp4", ifaces[0], mdnsGroup4); err == nil {
+		p := ipv4.NewPacketConn(conn)
+		for _, ifi := range ifaces[1:] {
+			if err := p.JoinGroup(ifi, mdnsGroup4); err != nil {
+				s.logMessage(fmt.Sprintf("Error joining mDNS group on %s: %v", ifi.Name, err))
+			}
+		}
+		p.SetControlMessage(ipv4.FlagInterface, true)
+		p.SetMulticastTTL(255)
+		p.SetMulticastLoopback(true)
+		s.goBackground(func() { s.serveMDNS(mdnsConn4{p}, mdnsGroup4) })
+		joined++
+	} else {
+		s.logMessage(fmt.Sprintf("Error listening for mDNS over IPv4: %v", err))
+	}
+	if conn, err := net.ListenMulticastUDP("udp6", ifaces[0], mdnsGroup6); err == nil {
+		p := ipv6.NewPacketConn(conn)
+		for _, ifi := range ifaces[1:] {
+			if err := p.JoinGroup(ifi, mdnsGroup6); err != nil {
+				s.logMessage(fmt.Sprintf("Error joining mDNS group on %s: %v", ifi.Name, err))
+			}
+		}
+		p.SetControlMessage(ipv6.FlagInterface, true)
+		p.SetMulticastHopLimit(255)
+		p.SetMulticastLoopback(true)
+		s.goBackground(func() { s.serveMDNS(mdnsConn6{p}, mdnsGroup6) })
+		joined++
+	} else {
+		s.logMessage(fmt.Sprintf("Error listening for mDNS over IPv6: %v", err))
+	}
+	if joined == 0 {
+		return fmt.Errorf("mdns: no multicast socket could be opened")
+	}
+	s.logMessage(fmt.Sprintf("mDNS responder listening on port %d", mdnsPort))
+	return nil
+}
+
+// serveMDNS answers the queries read from conn. Responses go to the group
+// on the interface the query came in on, or straight back to the querier
+// when it asked for a unicast reply or is a simple resolver querying from
+// a port other than 5353 (RFC 6762 section 6.7).
+func (s *Server) serveMDNS(conn mdnsConn, group *net.UDPAddr) {
+	// Shutting down closes the socket, which ends a blocked read.
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, ifIndex, src, err := conn.read(buf)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.logMessage(fmt.Sprintf("Error reading mDNS query: %v", err))
+			}
+			return
+		}
+		req := new(dns.Msg)
+		if req.Unpack(buf[:n]) != nil || req.Response || req.Opcode != dns.OpcodeQuery {
+			continue
+		}
+		from, _ := src.(*net.UDPAddr)
+		if from == nil {
+			continue
+		}
+		legacy := from.Port != mdnsPort
+		response, unicast := s.mdnsAnswer(req, from.IP, legacy)
+		if response == nil {
+			continue
+		}
+		data, err := response.Pack()
+		if err != nil {
+			continue
+		}
+		dst := net.Addr(group)
+		if unicast || legacy {
+			dst = from
+		}
+		if err := conn.write(data, ifIndex, dst); err != nil {
+			s.logMessage(fmt.Sprintf("Error sending mDNS response: %v", err))
+		}
+	}
+}
+
+// mdnsAnswer builds the response to an mDNS query from the local records,
+// or returns nil when none of its questions is for one of them. It also
+// reports whether every answered question asked for a unicast reply.
+func (s *Server) mdnsAnswer(req *dns.Msg, client net.IP, legacy bool) (*dns.Msg, bool) {
+	response := &dns.Msg{MsgHdr: dns.MsgHdr{Response: true, Authoritative: true}}
+	if legacy {
+		// Simple resolvers expect the ID and question back, and a TTL they
+		// will not cache for long.
+		response.Id = req.Id
+		response.Question = req.Question
+	}
+	records := s.clientRecords(client)
+	unicast := true
+	for _, q := range req.Question {
+		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA && q.Qtype != dns.TypeANY {
+			continue
+		}
+		value, ok := s.mdnsRecord(records, q.Name)
+		if !ok {
+			continue
+		}
+		ip := net.ParseIP(s.selectRecord(value, client, nil))
+		if ip == nil {
+			continue
+		}
+		rr := addressRecord(q.Name, ip, s.cfg.LocalTTL)
+		if q.Qtype != dns.TypeANY && rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		rr.Header().Ttl = mdnsTTL
+		if legacy {
+			rr.Header().Ttl = min(mdnsTTL, 10)
+		} else {
+			rr.Header().Class |= mdnsUnicastResponse
+		}
+		response.Answer = append(response.Answer, rr)
+		unicast = unicast && q.Qclass&mdnsUnicastResponse != 0
+	}
+	if len(response.Answer) == 0 {
+		return nil, false
+	}
+	return response, unicast
+}
+
+// mdnsRecord returns the record value of a .local name: the record of the
+// name itself or, with mdns.domain set, that of the same host name in the
+// domain.
+func (s *Server) mdnsRecord(records map[string]string, name string) (string, bool) {
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	label, ok := strings.CutSuffix(host, ".local")
+	if !ok || label == "" {
+		return "", false
+	}
+	if value, ok := s.failoverAddress(host); ok {
+		return value, true
+	}
+	if value, ok := records[host]; ok {
+		return value, true
+	}
+	if s.cfg.MDNS.Domain == "" {
+		return "", false
+	}
+	if value, ok := s.failoverAddress(label + "." + s.cfg.MDNS.Domain); ok {
+		return value, true
+	}
+	value, ok := records[label+"."+s.cfg.MDNS.Domain]
+	return value, ok
+}
+
+// bridgeMDNS resolves a .local name missing from the local records with a
+// one-shot mDNS query on the LAN (RFC 6762 section 5.1), for unicast
+// clients such as those on other VLANs or a VPN. Responders answer such
+// queries directly; the first response with an answer to the question is
+// used. Without one within mdns.bridge_timeout the name does not exist.
+func (s *Server) bridgeMDNS(ctx context.Context, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	response := newReply(req)
+	response.Rcode = dns.RcodeNameError
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error opening mDNS bridge socket: %v", err))
+		response.Rcode = dns.RcodeServerFailure
+		return response
+	}
+	defer conn.Close()
+
+	query := &dns.Msg{Question: []dns.Question{{Name: q.Name, Qtype: q.Qtype, Qclass: dns.ClassINET | mdnsUnicastResponse}}}
+	data, err := query.Pack()
+	if err != nil {
+		response.Rcode = dns.RcodeServerFailure
+		return response
+	}
+	p := ipv4.NewPacketConn(conn)
+	sent := false
+	for _, name := range s.cfg.MDNS.Interfaces {
+		if ifi, err := net.InterfaceByName(name); err == nil && p.SetMulticastInterface(ifi) == nil {
+			_, err = conn.WriteTo(data, mdnsGroup4)
+			sent = sent || err == nil
+		}
+	}
+	if len(s.cfg.MDNS.Interfaces) == 0 {
+		_, err = conn.WriteTo(data, mdnsGroup4)
+		sent = err == nil
+	}
+	if !sent {
+		s.logMessage(fmt.Sprintf("Error sending mDNS bridge query for %s: %v", q.Name, err))
+		response.Rcode = dns.RcodeServerFailure
+		return response
+	}
+
+	deadline := time.Now().Add(s.cfg.MDNS.BridgeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return response
+		}
+		answer := new(dns.Msg)
+		if answer.Unpack(buf[:n]) != nil || !answer.Response {
+			continue
+		}
+		for _, rr := range answer.Answer {
+			hdr := rr.Header()
+			if !strings.EqualFold(hdr.Name, q.Name) || (hdr.Rrtype != q.Qtype && q.Qtype != dns.TypeANY) {
+				continue
+			}
+			hdr.Name = q.Name
+			hdr.Class &^= mdnsUnicastResponse
+			response.Answer = append(response.Answer, rr)
+		}
+		if len(response.Answer) > 0 {
+			response.Rcode = dns.RcodeSuccess
+			return response
+		}
+	}
+}
+
+// isMDNSName reports whether host is a .local name.
+func isMDNSName(host string) bool {
+	return strings.HasSuffix(host, ".local")
+}
@@ -0,0 +1,34 @@
+package godns
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var msgPool = sync.Pool{New: func() any { return new(dns.Msg) }}
+
+// newReply returns a pooled message set up as the reply to req, as
+// new(dns.Msg).SetReply(req) would.
+func newReply(req *dns.Msg) *dns.Msg {
+	m := msgPool.Get().(*dns.Msg)
+	// SetReply allocates a question section; the pooled one is reused.
+	m.SetReply(&dns.Msg{MsgHdr: req.MsgHdr})
+	if len(req.Question) > 0 {
+		m.Question = append(m.Question[:0], req.Question[0])
+	}
+	return m
+}
+
+// releaseMsg resets m and returns it to the pool, keeping the arrays of its
+// sections for the next reply. Only messages nothing refers to any more
+// may be released: the ones built by newReply, or by the hooks and plugins
+// for a single query, never cached or upstream answers shared elsewhere.
+func releaseMsg(m *dns.Msg) {
+	// The records stay referenced past the length of a truncated section.
+	clear(m.Answer[:cap(m.Answer)])
+	clear(m.Ns[:cap(m.Ns)])
+	clear(m.Extra[:cap(m.Extra)])
+	*m = dns.Msg{Question: m.Question[:0], Answer: m.Answer[:0], Ns: m.Ns[:0], Extra: m.Extra[:0]}
+	msgPool.Put(m)
+}
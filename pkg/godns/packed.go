@@ -0,0 +1,118 @@
+package godns
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// packAnswers packs the answer record of every local record whose value is
+// a single address, in wire format after its owner name, which in a
+// response is a pointer to the question. Records that depend on the
+// client are left to the full path.
+func (s *Server) packAnswers(records map[string]string) map[string][]byte {
+	packed := make(map[string][]byte, len(records))
+	for host, value := range records {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			continue
+		}
+		rr := addressRecord(".", ip, s.cfg.LocalTTL)
+		buf := make([]byte, dns.Len(rr))
+		n, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			continue
+		}
+		// Drop the root name the record was packed with.
+		packed[host] = buf[1:n]
+	}
+	return packed
+}
+
+// optLen is the length of an OPT record without options in wire format.
+const optLen = 11
+
+// packedResponse returns the response to req from the precomputed answer
+// of its local record, or nil when the query takes the full path: it has
+// no plain local record, the client's view has a record of its own for the
+// name, or hooks, plugins or TSIG are involved.
+func (s *Server) packedResponse(req *dns.Msg, client net.IP) []byte {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 || s.hooks.onQuery != nil || s.hooks.onResponse != nil || len(s.plugins) > 0 {
+		return nil
+	}
+	q := req.Question[0]
+	if isTransfer(q.Qtype) || req.IsTsig() != nil {
+		return nil
+	}
+	set := s.liveRecords.Load()
+	if set == nil {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	answer := set.packed[host]
+	// Queries for another type than the record's, which have no answer,
+	// take the full path.
+	if answer == nil || binary.BigEndian.Uint16(answer) != q.Qtype || q.Qclass != dns.ClassINET {
+		return nil
+	}
+	if s.failoverGroups[host] != nil || s.cfg.Authoritative && !s.inLocalZone(host) {
+		return nil
+	}
+	if v := set.view(client); v != nil {
+		if _, own := v.own[host]; own {
+			return nil
+		}
+	}
+
+	opt := req.IsEdns0()
+	size := 12 + len(q.Name) + 2 + 4 + 2 + len(answer)
+	if opt != nil {
+		size += optLen
+	}
+	buf := getBuffer(size)
+	binary.BigEndian.PutUint16(buf[0:], req.Id)
+	// QR and AA, with the opcode, RD and CD of the query, as dns.Msg.SetReply.
+	flags := uint16(1<<15 | 1<<10 | req.Opcode<<11)
+	if req.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if req.CheckingDisabled {
+		flags |= 1 << 4
+	}
+	binary.BigEndian.PutUint16(buf[2:], flags)
+	binary.BigEndian.PutUint16(buf[4:], 1)
+	binary.BigEndian.PutUint16(buf[6:], 1)
+	binary.BigEndian.PutUint32(buf[8:], 0)
+	if opt != nil {
+		binary.BigEndian.PutUint16(buf[10:], 1)
+	}
+
+	off, err := dns.PackDomainName(q.Name, buf, 12, nil, false)
+	if err != nil {
+		putBuffer(buf)
+		return nil
+	}
+	binary.BigEndian.PutUint16(buf[off:], q.Qtype)
+	binary.BigEndian.PutUint16(buf[off+2:], q.Qclass)
+	// The answer's owner name points at the question's.
+	binary.BigEndian.PutUint16(buf[off+4:], 0xC000|12)
+	off += copy(buf[off+6:], answer) + 6
+	if opt != nil {
+		// The OPT record echoEDNS adds on the full path: the root name,
+		// the type, the UDP size as class and the DO bit in the TTL.
+		buf[off] = 0
+		binary.BigEndian.PutUint16(buf[off+1:], dns.TypeOPT)
+		binary.BigEndian.PutUint16(buf[off+3:], uint16(s.cfg.MaxUDPSize))
+		var ttl uint32
+		if opt.Do() {
+			ttl = 1 << 15
+		}
+		binary.BigEndian.PutUint32(buf[off+5:], ttl)
+		binary.BigEndian.PutUint16(buf[off+9:], 0)
+		off += optLen
+	}
+	s.stats.localAnswers.Add(1)
+	return buf[:off]
+}
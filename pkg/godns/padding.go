@@ -0,0 +1,67 @@
+package godns
+
+import "github.com/miekg/dns"
+
+// Block lengths of EDNS padding (RFC 7830) on encrypted transports, as
+// recommended by RFC 8467: queries are padded to a multiple of 128 bytes
+// and responses to a multiple of 468 bytes, so their sizes give away
+// little about the names asked and answered.
+const (
+	queryPaddingBlock    = 128
+	responsePaddingBlock = 468
+)
+
+// padMsg returns msg padded to a multiple of block bytes, or msg itself if
+// it has no EDNS to carry the padding or padding would make it too large.
+// msg is not modified: cached and shared messages can be padded.
+func padMsg(msg *dns.Msg, block int) *dns.Msg {
+	opt := msg.IsEdns0()
+	if opt == nil || msg.IsTsig() != nil {
+		return msg
+	}
+	padding := &dns.EDNS0_PADDING{}
+	padded := &dns.OPT{Hdr: opt.Hdr}
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			padded.Option = append(padded.Option, option)
+		}
+	}
+	padded.Option = append(padded.Option, padding)
+
+	out := *msg
+	out.Extra = make([]dns.RR, len(msg.Extra))
+	for i, rr := range msg.Extra {
+		if rr == opt {
+			rr = padded
+		}
+		out.Extra[i] = rr
+	}
+	size := out.Len()
+	if n := size % block; n != 0 {
+		if size+block-n > dns.MaxMsgSize {
+			return msg
+		}
+		padding.Padding = make([]byte, block-n)
+	}
+	return &out
+}
+
+// paddingRequested reports whether the response to req, received on w,
+// is to be padded: the query came over an encrypted transport and asked
+// for padding, as servers only pad for clients that do (RFC 7830).
+func paddingRequested(w dns.ResponseWriter, req *dns.Msg) bool {
+	conn, ok := w.(dns.ConnectionStater)
+	if !ok || conn.ConnectionState() == nil {
+		return false
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
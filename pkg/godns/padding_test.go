@@ -0,0 +1,173 @@
+package godns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testCertificate returns a self-signed certificate for localhost and
+// 127.0.0.1, and a pool to verify it with.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func paddingLength(msg *dns.Msg) int {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if padding, ok := option.(*dns.EDNS0_PADDING); ok {
+				return len(padding.Padding)
+			}
+		}
+	}
+	return -1
+}
+
+func TestPadMsg(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	if padded := padMsg(msg, queryPaddingBlock); padded != msg {
+		t.Error("padded a message without EDNS")
+	}
+
+	msg.SetEdns0(1232, true)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 300)}, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+	for _, block := range []int{queryPaddingBlock, responsePaddingBlock} {
+		padded := padMsg(msg, block)
+		data, err := padded.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data)%block != 0 {
+			t.Errorf("padded to %d bytes, want a multiple of %d", len(data), block)
+		}
+		if options := padded.IsEdns0().Option; len(options) != 2 || options[0].Option() != dns.EDNS0COOKIE || !padded.IsEdns0().Do() {
+			t.Errorf("padded OPT %v, want the cookie, DO and padding", padded.IsEdns0())
+		}
+	}
+	if len(opt.Option) != 2 || paddingLength(msg) != 300 {
+		t.Errorf("original message changed: %v", opt)
+	}
+}
+
+func TestForwardTLSPadded(t *testing.T) {
+	prevRootCAs := upstreamRootCAs
+	t.Cleanup(func() { upstreamRootCAs = prevRootCAs })
+	cert, pool := testCertificate(t)
+	upstreamRootCAs = pool
+
+	asked := make(chan int, 1)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		data, _ := req.Pack()
+		asked <- len(data)
+		r := new(dns.Msg)
+		r.SetReply(req)
+		w.WriteMsg(r)
+	})}
+	go upstream.ActivateAndServe()
+	t.Cleanup(func() { upstream.Shutdown() })
+
+	s := newTestServer()
+	s.upstreams = s.newUpstreams([]string{normalizeUpstream("tls://" + l.Addr().String() + "#localhost")})
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.SetEdns0(1232, false)
+	if _, err := s.forward(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if size := <-asked; size%queryPaddingBlock != 0 {
+		t.Errorf("upstream got a %d byte query, want a multiple of %d", size, queryPaddingBlock)
+	}
+	if paddingLength(msg) != -1 {
+		t.Error("forwarded message changed")
+	}
+}
+
+// tlsWriter is the ResponseWriter of a query received over TLS.
+type tlsWriter struct{ dns.ResponseWriter }
+
+func (tlsWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 853}
+}
+
+func (tlsWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (tlsWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{HandshakeComplete: true}
+}
+
+func TestPaddedResponse(t *testing.T) {
+	s := newTestServer()
+	s.setRecords(map[string]string{"nas.lan": "192.168.1.10"}, nil, nil)
+
+	for _, tt := range []struct {
+		name   string
+		w      dns.ResponseWriter
+		padded bool
+	}{
+		{"tls with padding", tlsWriter{}, true},
+		{"tls without padding", tlsWriter{}, false},
+		{"udp with padding", benchWriter{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("nas.lan.", dns.TypeA)
+			req.SetEdns0(1232, false)
+			if tt.name != "tls without padding" {
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 90)})
+			}
+			data := s.handleRequest(context.Background(), tt.w, req, nil, remoteUDPAddr(tt.w.RemoteAddr()))
+			response := new(dns.Msg)
+			if err := response.Unpack(data); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Answer) != 1 {
+				t.Fatalf("got answer %v", response.Answer)
+			}
+			if padded := paddingLength(response) >= 0; padded != tt.padded || padded && len(data)%responsePaddingBlock != 0 {
+				t.Errorf("got a %d byte response, padded %t, want padded %t", len(data), padded, tt.padded)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package godns
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importPihole converts a Pi-hole configuration directory: local DNS
+// records (custom.list, or dns.hosts in Pi-hole v6's pihole.toml), local
+// CNAME records and upstream servers. CNAMEs are flattened into records
+// when their target is a local record. Blocklists are not imported; they
+// are reported so they can be added to blocking.lists.
+func importPihole(dir string) (*importedConfig, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	imported := &importedConfig{records: make(map[string]string)}
+	var cnames []string
+	found := false
+
+	// Pi-hole v6 keeps everything in pihole.toml.
+	if data, err := readOptional(filepath.Join(dir, "pihole.toml")); err != nil {
+		return nil, err
+	} else if data != nil {
+		found = true
+		arrays := parseTOMLArrays(data, "dns")
+		imported.upstreams = append(imported.upstreams, arrays["upstreams"]...)
+		hosts, err := parseEtcHosts([]byte(strings.Join(arrays["hosts"], "\n")), "pihole.toml dns.hosts")
+		if err != nil {
+			return nil, err
+		}
+		for host, ip := range hosts {
+			imported.records[host] = ip
+		}
+		cnames = append(cnames, arrays["cnameRecords"]...)
+	}
+
+	// Pi-hole v5: custom.list, setupVars.conf and dnsmasq.d.
+	if data, err := readOptional(filepath.Join(dir, "custom.list")); err != nil {
+		return nil, err
+	} else if data != nil {
+		found = true
+		hosts, err := parseEtcHosts(data, filepath.Join(dir, "custom.list"))
+		if err != nil {
+			return nil, err
+		}
+		for host, ip := range hosts {
+			imported.records[host] = ip
+		}
+	}
+	if data, err := readOptional(filepath.Join(dir, "setupVars.conf")); err != nil {
+		return nil, err
+	} else if data != nil {
+		found = true
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+			if ok && strings.HasPrefix(key, "PIHOLE_DNS_") && value != "" {
+				imported.upstreams = append(imported.upstreams, value)
+			}
+		}
+	}
+	for _, cnameFile := range []string{
+		filepath.Join(dir, "05-pihole-custom-cname.conf"),
+		filepath.Join(dir, "..", "dnsmasq.d", "05-pihole-custom-cname.conf"),
+	} {
+		data, err := readOptional(cnameFile)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "cname="); ok {
+				cnames = append(cnames, value)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s contains neither pihole.toml nor custom.list nor setupVars.conf", dir)
+	}
+
+	for i, upstream := range imported.upstreams {
+		// Pi-hole writes custom ports as 127.0.0.1#5335.
+		if host, port, ok := strings.Cut(upstream, "#"); ok {
+			imported.upstreams[i] = net.JoinHostPort(host, port)
+		}
+	}
+	imported.flattenCNAMEs(cnames)
+
+	if data, err := readOptional(filepath.Join(dir, "adlists.list")); err != nil {
+		return nil, err
+	} else if n := len(bytes.Fields(data)); n > 0 {
+		imported.warn("%d adlist(s) not imported: add their URLs to blocking.lists", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gravity.db")); err == nil {
+		imported.warn("adlists and domain lists in gravity.db not imported: add the adlist URLs to blocking.lists")
+	}
+	return imported, nil
+}
+
+// readOptional reads a file, returning nil data and no error if it does
+// not exist.
+func readOptional(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func isNumber(s string) bool {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTOMLArrays extracts the string array values of one table of a TOML
+// file, which is all the Pi-hole importer needs: arrays may span lines and
+// "#" starts a comment outside strings.
+func parseTOMLArrays(data []byte, table string) map[string][]string {
+	arrays := make(map[string][]string)
+	current := ""
+	var key string
+	var inArray bool
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !inArray {
+			if strings.HasPrefix(line, "[") {
+				current = strings.Trim(line, "[] ")
+				continue
+			}
+			k, v, ok := strings.Cut(line, "=")
+			v = strings.TrimSpace(v)
+			if !ok || current != table || !strings.HasPrefix(v, "[") {
+				continue
+			}
+			key, line, inArray = strings.TrimSpace(k), v[1:], true
+			arrays[key] = []string{}
+		}
+		// Collect the quoted strings up to the closing bracket.
+		for line != "" {
+			switch line[0] {
+			case '"':
+				end := strings.IndexByte(line[1:], '"')
+				if end < 0 {
+					line = ""
+					continue
+				}
+				arrays[key] = append(arrays[key], line[1:end+1])
+				line = line[end+2:]
+			case ']':
+				inArray, line = false, ""
+			case '#':
+				line = ""
+			default:
+				line = line[1:]
+			}
+		}
+	}
+	return arrays
+}
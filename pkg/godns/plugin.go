@@ -0,0 +1,232 @@
+package godns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/miekg/dns"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WebAssembly plugins extend query handling from a sandbox: they see only
+// the messages passed to them and what the host module "godns" exports, and
+// get WASI without any files, environment or clock beyond the defaults.
+//
+// A plugin exports its linear memory as "memory" and
+//
+//	godns_alloc(size i32) i32                 a buffer of size bytes for the host
+//	godns_on_query(ptr i32, len i32) i64      optional, before the lookup
+//	godns_on_response(ptr i32, len i32) i64   optional, once the response is built
+//
+// The hooks receive the client's address as 16 bytes (IPv4 addresses
+// mapped to IPv6) followed by the query, or the response, in DNS wire
+// format. They return 0 to let the query proceed, or the pointer to a DNS
+// response in wire format in the upper 32 bits and its length in the lower
+// 32 bits, which is sent instead. The buffer must stay valid until the
+// next call. The host module exports log(ptr i32, len i32), which writes
+// a message to the log.
+//
+// Reactor modules are initialized through their _initialize export.
+
+// pluginMemoryPages caps the linear memory of a plugin instance: 64 MiB.
+const pluginMemoryPages = 1024
+
+// plugin is a compiled plugin and a pool of its instances. An instance
+// handles one call at a time, so there are up to one per worker.
+type plugin struct {
+	srv       *Server
+	name      string
+	runtime   wazero.Runtime
+	compiled  wazero.CompiledModule
+	instances chan api.Module
+	onQuery   bool
+	onResp    bool
+}
+
+// loadPlugins compiles the configured plugins.
+func (s *Server) loadPlugins(paths []string, workers int) ([]*plugin, error) {
+	var loaded []*plugin
+	for _, path := range paths {
+		p, err := s.loadPlugin(path, workers)
+		if err != nil {
+			closePlugins(loaded)
+			return nil, fmt.Errorf("plugin %s: %v", path, err)
+		}
+		loaded = append(loaded, p)
+	}
+	return loaded, nil
+}
+
+func (s *Server) loadPlugin(path string, workers int) (*plugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pluginMemoryPages).
+		WithCloseOnContextDone(true))
+	p := &plugin{srv: s, name: filepath.Base(path), runtime: r, instances: make(chan api.Module, workers)}
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	_, err = r.NewHostModuleBuilder("godns").
+		NewFunctionBuilder().WithFunc(p.log).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	if p.compiled, err = r.CompileModule(ctx, code); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	exports := p.compiled.ExportedFunctions()
+	if _, ok := exports["godns_alloc"]; !ok {
+		r.Close(ctx)
+		return nil, fmt.Errorf("does not export godns_alloc")
+	}
+	_, p.onQuery = exports["godns_on_query"]
+	_, p.onResp = exports["godns_on_response"]
+	if !p.onQuery && !p.onResp {
+		r.Close(ctx)
+		return nil, fmt.Errorf("exports neither godns_on_query nor godns_on_response")
+	}
+
+	// Instantiate one right away so a plugin that cannot start fails at
+	// load time.
+	m, err := p.instantiate(ctx)
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	p.instances <- m
+	return p, nil
+}
+
+func (p *plugin) instantiate(ctx context.Context) (api.Module, error) {
+	return p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+}
+
+func (p *plugin) log(ctx context.Context, m api.Module, ptr, size uint32) {
+	if msg, ok := m.Memory().Read(ptr, size); ok {
+		p.srv.logMessage(fmt.Sprintf("Plugin %s: %s", p.name, msg))
+	}
+}
+
+// call runs the hook export fn with the client address and msg, and
+// returns the response the plugin answered with, or nil.
+func (p *plugin) call(fn string, clientIP net.IP, msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	in := make([]byte, net.IPv6len, net.IPv6len+len(packed))
+	if ip16 := clientIP.To16(); ip16 != nil {
+		copy(in, ip16)
+	}
+	in = append(in, packed...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.srv.cfg.PluginTimeout)
+	defer cancel()
+	var m api.Module
+	select {
+	case m = <-p.instances:
+	default:
+		if m, err = p.instantiate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := p.exchange(ctx, m, fn, in)
+	if err != nil {
+		// The instance may be closed by the timeout or left in a broken
+		// state; replace it.
+		m.Close(context.Background())
+		return nil, err
+	}
+	select {
+	case p.instances <- m:
+	default:
+		m.Close(context.Background())
+	}
+	if out == nil {
+		return nil, nil
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(out); err != nil {
+		return nil, fmt.Errorf("unpacking response: %v", err)
+	}
+	response.Id = msg.Id
+	response.Response = true
+	return response, nil
+}
+
+func (p *plugin) exchange(ctx context.Context, m api.Module, fn string, in []byte) ([]byte, error) {
+	res, err := m.ExportedFunction("godns_alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !m.Memory().Write(ptr, in) {
+		return nil, fmt.Errorf("godns_alloc returned %d, outside memory", ptr)
+	}
+	if res, err = m.ExportedFunction(fn).Call(ctx, uint64(ptr), uint64(len(in))); err != nil {
+		return nil, err
+	}
+	if res[0] == 0 {
+		return nil, nil
+	}
+	out, ok := m.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, fmt.Errorf("%s returned a buffer outside memory", fn)
+	}
+	return append([]byte(nil), out...), nil
+}
+
+// runPlugins offers req to the plugins in order, or response if not nil,
+// and returns the response to send instead, or nil. The first plugin to
+// answer a query wins; responses pass through every plugin, each seeing
+// the previous one's replacement. A failing plugin is logged and skipped.
+func (s *Server) runPlugins(req, response *dns.Msg, clientIP net.IP) *dns.Msg {
+	fn, msg := "godns_on_query", req
+	if response != nil {
+		fn, msg = "godns_on_response", response
+	}
+	for _, p := range s.plugins {
+		if (response == nil && !p.onQuery) || (response != nil && !p.onResp) {
+			continue
+		}
+		answer, err := p.call(fn, clientIP, msg)
+		if err != nil {
+			s.logMessage(fmt.Sprintf("Error running plugin %s: %v", p.name, err))
+			continue
+		}
+		if answer == nil {
+			continue
+		}
+		if response == nil {
+			return answer
+		}
+		msg = answer
+	}
+	if response != nil && msg != response {
+		return msg
+	}
+	return nil
+}
+
+func closePlugins(loaded []*plugin) {
+	for _, p := range loaded {
+		p.runtime.Close(context.Background())
+	}
+}
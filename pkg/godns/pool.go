@@ -0,0 +1,185 @@
+package godns
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// shardCount returns the number of shards the UDP sockets and the workers
+// are split into: the shards setting, or one per CPU when it is 0.
+func (s *Server) shardCount() int {
+	if s.cfg.Shards == 0 {
+		return runtime.NumCPU()
+	}
+	return s.cfg.Shards
+}
+
+// queryPool answers queries on a fixed number of workers shared by every
+// listener. dns.Server calls the handler returned by handle on a goroutine
+// per query; a query only waits there while it is in the bounded queue or
+// being answered, and is turned away at once when the queue is full, so a
+// flood cannot pile up goroutines.
+//
+// Before the queue is full, from shedAt queries waiting, queries of low
+// priority are turned away as well: repeats of a query from the same
+// client still waiting or being answered, typically retransmissions, and
+// queries from clients outside the trusted networks.
+type queryPool struct {
+	srv      *Server
+	queue    chan queryJob
+	overload string
+	shedAt   int
+	trusted  []*net.IPNet
+
+	// pendingMu guards pending, the queries waiting or being answered
+	// while shedding is enabled.
+	pendingMu sync.Mutex
+	pending   map[pendingQuery]int
+}
+
+type pendingQuery struct {
+	client string
+	name   string
+	qtype  uint16
+}
+
+type queryJob struct {
+	handler dns.Handler
+	ctx     context.Context
+	w       dns.ResponseWriter
+	req     *dns.Msg
+	done    chan struct{}
+}
+
+// contextHandler is a handler that answers a query within the deadline
+// of a context.
+type contextHandler interface {
+	serveContext(ctx context.Context, w dns.ResponseWriter, req *dns.Msg)
+}
+
+// queryContext returns the context a query is answered in, from the time
+// it is received: done at its deadline with query_timeout, or never.
+func (s *Server) queryContext() (context.Context, context.CancelFunc) {
+	if s.cfg.QueryTimeout > 0 {
+		return context.WithTimeout(context.Background(), s.cfg.QueryTimeout)
+	}
+	return context.Background(), func() {}
+}
+
+// newQueryPool starts a pool. With shedAt above 0, queries of low priority
+// are shed once that many are waiting; trusted lists the networks whose
+// clients are not, nil meaning private, loopback and link-local addresses.
+func (s *Server) newQueryPool(workers, queueSize int, overload string, shedAt int, trusted []*net.IPNet) *queryPool {
+	p := &queryPool{srv: s, queue: make(chan queryJob, queueSize), overload: overload, shedAt: shedAt, trusted: trusted}
+	if shedAt > 0 {
+		p.pending = make(map[pendingQuery]int)
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *queryPool) work() {
+	for job := range p.queue {
+		if job.ctx.Err() != nil {
+			// The deadline passed while the query waited for a worker.
+			p.srv.stats.queries.Add(1)
+			p.srv.stats.deadlineExceeded.Add(1)
+			p.srv.stats.servfail.Add(1)
+			p.srv.servfail(job.w, job.req, "query timed out waiting for a worker")
+		} else if h, ok := job.handler.(contextHandler); ok {
+			h.serveContext(job.ctx, job.w, job.req)
+		} else {
+			job.handler.ServeDNS(job.w, job.req)
+		}
+		close(job.done)
+	}
+}
+
+// handle returns a handler that answers queries with h on the pool.
+func (p *queryPool) handle(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		p.serve(h, w, req)
+	})
+}
+
+func (p *queryPool) serve(h dns.Handler, w dns.ResponseWriter, req *dns.Msg) {
+	if p.shedAt > 0 && len(req.Question) > 0 {
+		ip := remoteUDPAddr(w.RemoteAddr()).IP
+		key := pendingQuery{client: string(ip), name: strings.ToLower(req.Question[0].Name), qtype: req.Question[0].Qtype}
+		p.pendingMu.Lock()
+		repeat := p.pending[key] > 0
+		p.pending[key]++
+		p.pendingMu.Unlock()
+		defer p.done(key)
+		if len(p.queue) >= p.shedAt && (repeat || !p.isTrusted(ip)) {
+			p.srv.stats.shed.Add(1)
+			p.turnAway(w, req)
+			return
+		}
+	}
+
+	ctx, cancel := p.srv.queryContext()
+	defer cancel()
+	job := queryJob{handler: h, ctx: ctx, w: w, req: req, done: make(chan struct{})}
+	select {
+	case p.queue <- job:
+		<-job.done
+		return
+	default:
+	}
+
+	p.srv.stats.overloaded.Add(1)
+	p.turnAway(w, req)
+}
+
+// turnAway drops req, or answers it with SERVFAIL with overload servfail.
+func (p *queryPool) turnAway(w dns.ResponseWriter, req *dns.Msg) {
+	p.srv.stats.queries.Add(1)
+	if p.overload == "servfail" {
+		p.srv.servfail(w, req, "server overloaded")
+	}
+}
+
+// servfail answers req with SERVFAIL, explained by reason.
+func (s *Server) servfail(w dns.ResponseWriter, req *dns.Msg, reason string) {
+	response := new(dns.Msg)
+	response.SetRcode(req, dns.RcodeServerFailure)
+	s.setExtendedError(req, response, dns.ExtendedErrorCodeOther, reason)
+	if err := w.WriteMsg(response); err != nil {
+		s.stats.sendErrors.Add(1)
+	}
+}
+
+// done removes a query answered or turned away from the pending ones.
+func (p *queryPool) done(key pendingQuery) {
+	p.pendingMu.Lock()
+	if p.pending[key]--; p.pending[key] == 0 {
+		delete(p.pending, key)
+	}
+	p.pendingMu.Unlock()
+}
+
+// isTrusted reports whether the queries of a client at ip are never shed.
+func (p *queryPool) isTrusted(ip net.IP) bool {
+	if p.trusted == nil {
+		return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+	}
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// close stops the workers once the queries in flight are answered.
+func (p *queryPool) close() {
+	close(p.queue)
+}
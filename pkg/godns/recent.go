@@ -0,0 +1,123 @@
+package godns
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryEntry describes one answered query as kept in the recent-queries ring.
+type queryEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Rcode    string    `json:"rcode"`
+	Source   string    `json:"source"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// queryRing is a fixed-size ring buffer holding the most recent queries.
+type queryRing struct {
+	mu      sync.Mutex
+	entries []queryEntry
+	next    int
+	full    bool
+}
+
+func init() {
+	handleAdmin("/queries", func(s *Server) http.HandlerFunc { return s.requireTokenIfSet(s.recentQueriesHandler) })
+}
+
+func newQueryRing(size int) *queryRing {
+	return &queryRing{entries: make([]queryEntry, size)}
+}
+
+func (r *queryRing) add(e queryEntry) {
+	r.mu.Lock()
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// snapshot returns the buffered entries, newest first.
+func (r *queryRing) snapshot() []queryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	out := make([]queryEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return out
+}
+
+func (s *Server) recordQuery(client string, q dns.Question, rcode int, source string, started time.Time) {
+	if s.recentQueries == nil {
+		return
+	}
+	s.recentQueries.add(queryEntry{
+		Time:     started.UTC(),
+		Client:   client,
+		Name:     strings.ToLower(strings.TrimSuffix(q.Name, ".")),
+		Type:     dns.TypeToString[q.Qtype],
+		Rcode:    dns.RcodeToString[rcode],
+		Source:   source,
+		Duration: float64(time.Since(started).Microseconds()) / 1000,
+	})
+}
+
+// recentQueriesHandler lists recent queries, newest first. The optional
+// client, domain (suffix match), rcode and limit parameters narrow the result.
+func (s *Server) recentQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.recentQueries == nil {
+		http.Error(w, "recent query tracking is disabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	client := params.Get("client")
+	domain := strings.ToLower(strings.TrimSuffix(params.Get("domain"), "."))
+	rcode := strings.ToUpper(params.Get("rcode"))
+	limit := 100
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	result := []queryEntry{}
+	for _, e := range s.recentQueries.snapshot() {
+		if len(result) == limit {
+			break
+		}
+		if client != "" && e.Client != client {
+			continue
+		}
+		if domain != "" && e.Name != domain && !strings.HasSuffix(e.Name, "."+domain) {
+			continue
+		}
+		if rcode != "" && e.Rcode != rcode {
+			continue
+		}
+		result = append(result, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,365 @@
+package godns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxReferrals bounds the delegations followed for one name.
+	maxReferrals = 16
+	// maxRecursionDepth bounds the name server names resolved, and CNAMEs
+	// followed, to resolve one query.
+	maxRecursionDepth = 8
+	// maxDelegations bounds the delegation and name server address caches.
+	maxDelegations = 10000
+)
+
+// rootHints are the addresses of the root servers, a to m.
+var rootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+var errNoServers = errors.New("no name server answered")
+
+// recursor is the Upstream of recursive mode: it resolves names itself,
+// following delegations from the root servers down to the authoritative
+// servers, instead of asking upstream resolvers. Names in forward zones
+// still go to their resolvers. The response cache holds its answers like
+// those of upstreams; the delegations, and the addresses of the name
+// servers, are cached here for their TTLs.
+type recursor struct {
+	srv    *Server
+	roots  []string
+	client *dns.Client
+	tcp    *dns.Client
+
+	mu          sync.Mutex
+	delegations map[string]cachedServers
+	addresses   map[string]cachedServers
+}
+
+// cachedServers are the name server addresses of a zone, or the addresses
+// of a name server.
+type cachedServers struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newRecursor returns a recursor starting from the root servers at hints,
+// host:port addresses, or at the built-in ones if there are none.
+func (s *Server) newRecursor(hints []string) *recursor {
+	roots := hints
+	if len(roots) == 0 {
+		for _, addr := range rootHints {
+			roots = append(roots, net.JoinHostPort(addr, "53"))
+		}
+	}
+	return &recursor{
+		srv:         s,
+		roots:       roots,
+		client:      &dns.Client{Net: "udp", Timeout: s.cfg.UpstreamTimeout},
+		tcp:         &dns.Client{Net: "tcp", Timeout: s.cfg.UpstreamTimeout},
+		delegations: make(map[string]cachedServers),
+		addresses:   make(map[string]cachedServers),
+	}
+}
+
+func (r *recursor) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	return r.ExchangeContext(context.Background(), msg)
+}
+
+// ExchangeContext resolves the question of msg, following CNAMEs across
+// zones, and answers it as a recursive resolver would.
+func (r *recursor) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	q := msg.Question[0]
+	if r.srv.inForwardZone(q.Name) {
+		return r.srv.forward(ctx, msg)
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.RecursionAvailable = true
+
+	name := q.Name
+	for depth := 0; depth < maxRecursionDepth; depth++ {
+		resp, err := r.iterate(ctx, name, q.Qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		reply.Rcode = resp.Rcode
+		chain, next := answerChain(resp.Answer, name, q.Qtype)
+		reply.Answer = append(reply.Answer, chain...)
+		if next == "" || resp.Rcode != dns.RcodeSuccess {
+			if len(resp.Answer) == 0 {
+				// The SOA of negative answers sets how long they are cached.
+				reply.Ns = resp.Ns
+			}
+			return reply, nil
+		}
+		name = next
+	}
+	return nil, fmt.Errorf("resolving %s: too many CNAMEs", q.Name)
+}
+
+// answerChain returns the records of answer that answer name, following
+// CNAMEs within it, and the name still to resolve if the chain ends in a
+// CNAME whose target is not in answer.
+func answerChain(answer []dns.RR, name string, qtype uint16) ([]dns.RR, string) {
+	var chain []dns.RR
+	for i := 0; i <= maxRecursionDepth; i++ {
+		var cname *dns.CNAME
+		found := false
+		for _, rr := range answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				chain = append(chain, rr)
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok && cname == nil {
+				cname = c
+			}
+		}
+		if found {
+			return chain, ""
+		}
+		if cname == nil {
+			if len(chain) == 0 {
+				return nil, ""
+			}
+			// The chain leaves answer: name is the last CNAME's target.
+			return chain, name
+		}
+		chain = append(chain, cname)
+		name = cname.Target
+	}
+	return chain, ""
+}
+
+// iterate asks the servers of the closest known zone of name, following
+// referrals until a server answers with records, NXDOMAIN or no data.
+func (r *recursor) iterate(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	zone, servers := r.closestDelegation(name)
+	for i := 0; i < maxReferrals; i++ {
+		resp, local := (*dns.Msg)(nil), false
+		if zone == "." {
+			// With a local copy of the root zone, the root servers are
+			// not asked.
+			resp, local = r.srv.rootReferral(name, qtype)
+		}
+		var err error
+		if !local {
+			resp, err = r.queryServers(ctx, servers, name, qtype)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s in %s: %v", name, zone, err)
+		}
+		cut, nsNames, ttl := referral(resp, zone, name)
+		if cut == "" || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+			return resp, nil
+		}
+		addrs := glueAddresses(resp.Extra, nsNames, zone)
+		if len(addrs) == 0 {
+			addrs = r.resolveServers(ctx, nsNames, depth)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("resolving %s: no address for the name servers of %s", name, cut)
+		}
+		r.store(r.delegations, cut, addrs, ttl)
+		zone, servers = cut, addrs
+	}
+	return nil, fmt.Errorf("resolving %s: too many referrals", name)
+}
+
+// referral returns the zone a response delegates name to, below zone, with
+// its name servers and the TTL of their NS records, or "" when it is not
+// a referral.
+func referral(resp *dns.Msg, zone, name string) (string, []string, uint32) {
+	var cut string
+	var names []string
+	var ttl uint32
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		// Only delegations below the zone asked and above the name are
+		// followed, so a server cannot claim other zones.
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, strings.ToLower(name)) {
+			continue
+		}
+		if cut == "" {
+			cut, ttl = owner, ns.Hdr.Ttl
+		}
+		if owner == cut {
+			names = append(names, strings.ToLower(ns.Ns))
+			ttl = min(ttl, ns.Hdr.Ttl)
+		}
+	}
+	return cut, names, ttl
+}
+
+// glueAddresses returns the addresses of the name servers in extra, taking
+// only glue within zone, whose servers are trusted for it. IPv4 addresses
+// come first.
+func glueAddresses(extra []dns.RR, nsNames []string, zone string) []string {
+	var v4, v6 []string
+	for _, rr := range extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, owner) || !containsName(nsNames, owner) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			v4 = append(v4, net.JoinHostPort(rr.A.String(), "53"))
+		case *dns.AAAA:
+			v6 = append(v6, net.JoinHostPort(rr.AAAA.String(), "53"))
+		}
+	}
+	return append(v4, v6...)
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveServers resolves the addresses of the first name servers that
+// have one.
+func (r *recursor) resolveServers(ctx context.Context, nsNames []string, depth int) []string {
+	if depth+1 >= maxRecursionDepth {
+		return nil
+	}
+	for _, ns := range nsNames {
+		if cached := r.cached(r.addresses, ns); cached != nil {
+			return cached
+		}
+		resp, err := r.iterate(ctx, ns, dns.TypeA, depth+1)
+		if err != nil {
+			continue
+		}
+		var addrs []string
+		ttl := uint32(0)
+		chain, _ := answerChain(resp.Answer, ns, dns.TypeA)
+		for _, rr := range chain {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), "53"))
+				ttl = a.Hdr.Ttl
+			}
+		}
+		if len(addrs) > 0 {
+			r.store(r.addresses, ns, addrs, ttl)
+			return addrs
+		}
+	}
+	return nil
+}
+
+// queryServers asks the servers, in random order so the load spreads, for
+// name until one gives a usable response. Truncated responses are retried
+// over TCP.
+func (r *recursor) queryServers(ctx context.Context, servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	query.RecursionDesired = false
+	query.SetEdns0(1232, false)
+
+	lastErr := errNoServers
+	for _, i := range rand.Perm(len(servers)) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		r.srv.stats.recursiveQueries.Add(1)
+		resp, _, err := r.client.ExchangeContext(ctx, query, servers[i])
+		if err == nil && resp.Truncated {
+			resp, _, err = r.tcp.ExchangeContext(ctx, query, servers[i])
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", servers[i], dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// closestDelegation returns the closest enclosing zone of name whose name
+// servers are cached, or the root and its servers.
+func (r *recursor) closestDelegation(name string) (string, []string) {
+	zone := strings.ToLower(dns.Fqdn(name))
+	for {
+		if zone == "." {
+			return ".", r.roots
+		}
+		if addrs := r.cached(r.delegations, zone); addrs != nil {
+			return zone, addrs
+		}
+		_, parent, _ := strings.Cut(zone, ".")
+		if parent == "" {
+			parent = "."
+		}
+		zone = parent
+	}
+}
+
+func (r *recursor) cached(m map[string]cachedServers, name string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := m[name]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(m, name)
+		return nil
+	}
+	return entry.addrs
+}
+
+// store caches addrs for name for ttl seconds. A full cache drops its
+// expired entries, or else starts over.
+func (r *recursor) store(m map[string]cachedServers, name string, addrs []string, ttl uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(m) >= maxDelegations {
+		now := time.Now()
+		for key, entry := range m {
+			if now.After(entry.expires) {
+				delete(m, key)
+			}
+		}
+		if len(m) >= maxDelegations {
+			clear(m)
+		}
+	}
+	m[name] = cachedServers{addrs: addrs, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// snapshot returns the recursor's counters in the format of
+// statsSnapshot.
+func (r *recursor) snapshot() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("recursor.queries=%d\nrecursor.delegations=%d\nrecursor.server_addresses=%d\n",
+		r.srv.stats.recursiveQueries.Load(), len(r.delegations), len(r.addresses))
+}
@@ -0,0 +1,61 @@
+package godns_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/nodesocket/godns/pkg/godns"
+	"github.com/nodesocket/godns/pkg/godns/godnstest"
+)
+
+// startAuthority runs a name server on an ephemeral localhost port that
+// answers authoritatively with those of records matching the question,
+// and returns its address.
+func startAuthority(t *testing.T, records ...string) string {
+	t.Helper()
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(req)
+		r.Authoritative = true
+		q := req.Question[0]
+		for _, rr := range rrs {
+			if dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(q.Name) && rr.Header().Rrtype == q.Qtype {
+				r.Answer = append(r.Answer, rr)
+			}
+		}
+		w.WriteMsg(r)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestRecursorTypes(t *testing.T) {
+	root := startAuthority(t,
+		"www.example.com. 300 IN A 192.0.2.80",
+		"www.example.com. 300 IN AAAA 2001:db8::80",
+		"example.com. 300 IN MX 10 mail.example.com.",
+	)
+	s := godnstest.Start(t, godnstest.Options{
+		Configure: func(cfg *godns.Config) {
+			cfg.Recursive = true
+			cfg.RootHints = []string{root}
+		},
+	})
+	s.AssertAnswer(t, "www.example.com", dns.TypeAAAA, "2001:db8::80")
+	s.AssertAnswer(t, "www.example.com", dns.TypeA, "192.0.2.80")
+	s.AssertAnswer(t, "example.com", dns.TypeMX, "10 mail.example.com.")
+}
@@ -0,0 +1,252 @@
+package godns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisBackend serves records kept in Redis as one hash per zone: the key
+// <prefix><zone> maps record names relative to the zone ("@" for the apex,
+// or absolute names ending in a dot) to IP addresses. Keyspace
+// notifications keep the records current, so a HSET propagates within
+// milliseconds; Redis must have notify-keyspace-events include "Kh" (or
+// "KA"), which godns tries to enable itself.
+type redisBackend struct {
+	srv      *Server
+	address  string
+	username string
+	password string
+	db       int
+	prefix   string
+}
+
+func (s *Server) newRedisBackend(c RedisConfig) *redisBackend {
+	return &redisBackend{srv: s, address: c.Address, username: c.Username, password: c.Password, db: c.DB, prefix: c.Prefix}
+}
+
+// run follows Redis until the server shuts down, reconnecting with a
+// growing delay.
+func (r *redisBackend) run() {
+	for attempt := 0; ; attempt++ {
+		loaded, err := r.follow()
+		if loaded {
+			attempt = 0
+		}
+		if r.srv.ctx.Err() != nil {
+			return
+		}
+		r.srv.backendFailed("redis", err)
+		if !r.srv.sleep(backoff(attempt)) {
+			return
+		}
+	}
+}
+
+// follow subscribes to changes of the zone hashes, loads them all and then
+// reloads a hash whenever it is notified to have changed.
+func (r *redisBackend) follow() (loaded bool, err error) {
+	sub, err := r.dial()
+	if err != nil {
+		return false, err
+	}
+	defer sub.close()
+	conn, err := r.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.close()
+
+	// Best effort: managed Redis services often refuse CONFIG.
+	if _, err := conn.do("CONFIG", "SET", "notify-keyspace-events", "KA"); err != nil {
+		r.srv.logMessage(fmt.Sprintf("Could not enable Redis keyspace notifications, make sure notify-keyspace-events includes Kh: %v", err))
+	}
+	channel := fmt.Sprintf("__keyspace@%d__:", r.db)
+	if _, err := sub.do("PSUBSCRIBE", channel+r.prefix+"*"); err != nil {
+		return false, err
+	}
+
+	zones := make(map[string]map[string]string)
+	cursor := "0"
+	for {
+		reply, err := conn.do("SCAN", cursor, "MATCH", r.prefix+"*", "COUNT", "1000")
+		if err != nil {
+			return false, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return false, fmt.Errorf("unexpected SCAN reply")
+		}
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			name, _ := key.(string)
+			if zones[name], err = r.load(conn, name); err != nil {
+				return false, err
+			}
+		}
+		if cursor, _ = page[0].(string); cursor == "0" {
+			break
+		}
+	}
+	r.publish(zones)
+
+	for {
+		msg, err := sub.read()
+		if err != nil {
+			return true, err
+		}
+		// ["pmessage", pattern, channel, event]
+		parts, _ := msg.([]interface{})
+		if len(parts) != 4 {
+			continue
+		}
+		key, _ := parts[2].(string)
+		key = strings.TrimPrefix(key, channel)
+		if zones[key], err = r.load(conn, key); err != nil {
+			return true, err
+		}
+		if len(zones[key]) == 0 {
+			delete(zones, key)
+		}
+		r.publish(zones)
+	}
+}
+
+// load reads one zone hash; a missing key yields no records.
+func (r *redisBackend) load(conn *redisConn, key string) (map[string]string, error) {
+	reply, err := conn.do("HGETALL", key)
+	if err != nil {
+		var redisErr redisError
+		if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "WRONGTYPE") {
+			r.srv.logMessage(fmt.Sprintf("Ignoring Redis key %s: not a hash", key))
+			return nil, nil
+		}
+		return nil, err
+	}
+	fields, _ := reply.([]interface{})
+	hash := make(map[string]string, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		ip, _ := fields[i+1].(string)
+		hash[name] = ip
+	}
+	return hash, nil
+}
+
+func (r *redisBackend) publish(zones map[string]map[string]string) {
+	records := make(map[string]string)
+	for key, hash := range zones {
+		zone := strings.ToLower(strings.Trim(strings.TrimPrefix(key, r.prefix), "."))
+		for name, ip := range hash {
+			addRecord(records, zoneRecordName(zone, name), ip)
+		}
+	}
+	r.srv.publishBackendRecords("redis", records)
+}
+
+func (r *redisBackend) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	netConn, err := dialer.DialContext(r.srv.ctx, "tcp", r.address)
+	if err != nil {
+		return nil, err
+	}
+	// Shutting down closes the connection, which ends a blocked read.
+	conn := &redisConn{conn: netConn, r: bufio.NewReader(netConn), stop: context.AfterFunc(r.srv.ctx, func() { netConn.Close() })}
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// redisConn speaks just enough RESP for the backend: commands as arrays of
+// bulk strings and the five reply types.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	stop func() bool
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (c *redisConn) close() {
+	c.stop()
+	c.conn.Close()
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	return c.read()
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,156 @@
+package godns
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+)
+
+// recordSet is the live set of records with their precomputed answers.
+// It is built in full before being published and never modified after, so
+// a reload swaps it in without blocking lookups, and in-flight queries
+// keep answering from the set they started with.
+type recordSet struct {
+	records map[string]string
+	packed  map[string][]byte
+	views   []*viewRecords
+	// reverse maps the reverse names of record addresses to their hosts,
+	// when auto_ptr is on.
+	reverse map[string][]string
+	// typed holds the typed records and tags of v2 hosts files.
+	typed *typedHosts
+}
+
+func (s *Server) currentRecords() map[string]string {
+	if set := s.liveRecords.Load(); set != nil {
+		return set.records
+	}
+	return nil
+}
+
+// setRecords swaps in a new record set, with views merged over next and
+// the typed records of typed, and returns the previous set, or nil, and
+// the new one.
+func (s *Server) setRecords(next map[string]string, typed *typedHosts, views []*viewRecords) (prev, set *recordSet) {
+	set = &recordSet{records: next, packed: s.packAnswers(next), views: mergeViews(views, next), typed: typed}
+	if s.cfg.AutoPTR {
+		set.reverse = reverseRecords(next, typed)
+	}
+	return s.liveRecords.Swap(set), set
+}
+
+// size returns the number of records of set: the host records and the
+// typed records.
+func (set *recordSet) size() int {
+	if set == nil {
+		return 0
+	}
+	n := len(set.records)
+	if set.typed != nil {
+		for _, rrs := range set.typed.rrs {
+			n += len(rrs)
+		}
+	}
+	return n
+}
+
+// tags returns the tags of the hosts of set.
+func (set *recordSet) tags() map[string][]string {
+	if set == nil || set.typed == nil {
+		return nil
+	}
+	return set.typed.tags
+}
+
+// audited returns the records of set for the audit log: the host records
+// and the typed records as "owner TYPE" keys mapped to their sorted data,
+// like zone records. A nil set has none.
+func (set *recordSet) audited() map[string]string {
+	if set == nil {
+		return nil
+	}
+	if set.typed == nil || len(set.typed.rrs) == 0 {
+		return set.records
+	}
+	audited := maps.Clone(set.records)
+	maps.Copy(audited, flattenZones(map[string]*zoneData{"": {rrs: set.typed.rrs}}))
+	return audited
+}
+
+// fileError is an error loading the records or zone of the file at path,
+// which the reload failure notification names.
+type fileError struct {
+	path string
+	err  error
+}
+
+func (e *fileError) Error() string { return e.err.Error() }
+
+func (e *fileError) Unwrap() error { return e.err }
+
+// reloadHosts re-reads the hosts file and zone files and replaces the live
+// record set, and records the changes in the history. If anything fails to
+// load the previous records stay in place.
+// The tenants are reloaded too, each on its own.
+func (s *Server) reloadHosts(actor string) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.reloadTenants()
+	next, typed, err := s.loadHosts()
+	var views []*viewRecords
+	var changes []recordChange
+	if err == nil {
+		views, err = s.loadViews()
+	}
+	if err == nil {
+		// Dynamic updates rewrite zone files; hold them off so none is
+		// lost between reading the files and swapping the zones.
+		s.updateMu.Lock()
+		var nextZones map[string]*zoneData
+		if nextZones, err = s.loadZoneFiles(); err == nil {
+			s.keepSecondaryZones(s.currentZones(), nextZones)
+			s.produceCatalogs(s.currentZones(), nextZones)
+			carryJournals(s.currentZones(), nextZones)
+			prevZones := s.setZones(nextZones)
+			changes = s.auditRecordChanges(actor, flattenZones(prevZones), flattenZones(nextZones))
+			s.notifyChangedZones(prevZones, nextZones)
+		}
+		s.updateMu.Unlock()
+	}
+	if err != nil {
+		failed := "records"
+		var fileErr *fileError
+		if errors.As(err, &fileErr) {
+			failed = fileErr.path
+		}
+		s.notify(eventHostsReloadFailed, fmt.Sprintf("reloading %s failed: %v", failed, err))
+		return err
+	}
+	prev, set := s.setRecords(next, typed, views)
+	changes = append(changes, s.auditRecordChanges(actor, prev.audited(), set.audited())...)
+	s.saveHistory(actor, changes)
+	// Followers replicate the host records and typed records with their
+	// tags.
+	if prev == nil || !maps.Equal(prev.audited(), set.audited()) || !maps.EqualFunc(prev.tags(), set.tags(), slices.Equal[[]string]) {
+		s.notifyFollowers()
+	}
+	s.logMessage(fmt.Sprintf("Reloaded %d records", set.size()))
+	return nil
+}
+
+// reloadOnSignal reloads the hosts file every time SIGHUP is received.
+func (s *Server) reloadOnSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		s.reloadGeoIP()
+		s.reloadBlocklists()
+		s.reloadHosts("signal:SIGHUP")
+		s.warmCache()
+	}
+}
@@ -0,0 +1,138 @@
+package godns
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventRemoteFetchFailed = "remote_fetch_failed"
+
+// remoteSource pulls records from an HTTP(S) URL, using ETag and
+// Last-Modified validators so unchanged content is not transferred again.
+type remoteSource struct {
+	srv          *Server
+	url          string
+	headerName   string
+	headerValue  string
+	client       *http.Client
+	etag         string
+	lastModified string
+
+	// apply, if set, takes the body of every new response before its
+	// records are stored, and may reject it.
+	apply func(data []byte) error
+
+	mu      sync.Mutex
+	records map[string]string
+	typed   *typedHosts
+}
+
+// newRemoteSource creates a source for url. authHeader is an optional
+// "Name: value" header sent with every request, e.g.
+// "Authorization: Bearer <token>".
+func (s *Server) newRemoteSource(url, authHeader string, timeout time.Duration) (*remoteSource, error) {
+	r := &remoteSource{srv: s, url: url, client: &http.Client{Timeout: timeout}}
+	if authHeader != "" {
+		name, value, ok := strings.Cut(authHeader, ":")
+		if !ok {
+			return nil, fmt.Errorf("auth header must have the form \"Name: value\"")
+		}
+		r.headerName, r.headerValue = strings.TrimSpace(name), strings.TrimSpace(value)
+	}
+	return r, nil
+}
+
+// Records returns the records of the last successful fetch, making the
+// remote source a RecordStore. Hosts with several addresses get the first
+// one, other typed records are left out.
+func (r *remoteSource) Records() (map[string]string, error) {
+	records, typed, _ := r.typedRecords()
+	records = maps.Clone(records)
+	if records == nil {
+		records = make(map[string]string)
+	}
+	typed.addFirstAddresses(records)
+	return records, nil
+}
+
+// typedRecords returns the host records and the typed records of the last
+// successful fetch.
+func (r *remoteSource) typedRecords() (map[string]string, *typedHosts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.records, r.typed, nil
+}
+
+// fetch downloads the records if they changed since the last fetch and
+// reports whether new records were stored.
+func (r *remoteSource) fetch() (bool, error) {
+	req, err := http.NewRequestWithContext(r.srv.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if r.headerName != "" {
+		req.Header.Set(r.headerName, r.headerValue)
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("%s: %s", r.url, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	records, typed, err := parseHosts(data, r.url, r.srv.cfg.LocalTTL)
+	if err != nil {
+		return false, err
+	}
+	if r.apply != nil {
+		if err := r.apply(data); err != nil {
+			return false, fmt.Errorf("%s: %v", r.url, err)
+		}
+	}
+
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	r.mu.Lock()
+	r.records, r.typed = records, typed
+	r.mu.Unlock()
+	return true, nil
+}
+
+// refresh fetches the remote records every interval and reloads the live
+// record set when they changed, until the server shuts down. Failed
+// fetches keep the previous records.
+func (r *remoteSource) refresh(interval time.Duration) {
+	for r.srv.sleep(interval) {
+		changed, err := r.fetch()
+		if err != nil {
+			r.srv.notify(eventRemoteFetchFailed, fmt.Sprintf("fetching records from %s failed: %v", r.url, err))
+			continue
+		}
+		if changed {
+			r.srv.reloadHosts("remote:" + r.url)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package godns
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// byteSize is a size in bytes, written as a number with an optional unit
+// as in GOMEMLIMIT: B, KiB, MiB, GiB or TiB.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+func (s *byteSize) String() string {
+	for _, u := range byteUnits {
+		if int64(*s) >= u.size && int64(*s)%u.size == 0 {
+			return fmt.Sprintf("%d%s", int64(*s)/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	number, multiplier := strings.TrimSpace(value), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(number, u.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(number, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q: want a number with an optional unit B, KiB, MiB, GiB or TiB", value)
+	}
+	*s = byteSize(n * multiplier)
+	return nil
+}
+
+func (s *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	return s.Set(node.Value)
+}
+
+// applyMemoryLimit sets the soft memory limit of the Go runtime, if one
+// is configured, overriding GOMEMLIMIT.
+func (s *Server) applyMemoryLimit() {
+	if s.cfg.MemoryLimit > 0 {
+		debug.SetMemoryLimit(int64(s.cfg.MemoryLimit))
+	}
+}
+
+// setSocketBuffers sizes the kernel buffers of a UDP listener, where
+// queries queue while the workers are busy.
+func (s *Server) setSocketBuffers(conn *net.UDPConn) {
+	if s.cfg.SocketReceiveBuffer > 0 {
+		if err := conn.SetReadBuffer(int(s.cfg.SocketReceiveBuffer)); err != nil {
+			s.logMessage(fmt.Sprintf("Error setting the receive buffer of %s: %v", conn.LocalAddr(), err))
+		}
+	}
+	if s.cfg.SocketSendBuffer > 0 {
+		if err := conn.SetWriteBuffer(int(s.cfg.SocketSendBuffer)); err != nil {
+			s.logMessage(fmt.Sprintf("Error setting the send buffer of %s: %v", conn.LocalAddr(), err))
+		}
+	}
+}
+
+// udpResponseSize is the largest UDP response req may get: the size its
+// EDNS record advertises, or 512 bytes without one, capped at
+// max_udp_size.
+func (s *Server) udpResponseSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > s.cfg.MaxUDPSize {
+		size = s.cfg.MaxUDPSize
+	}
+	return size
+}
@@ -0,0 +1,57 @@
+package godns
+
+import (
+	"net"
+	"slices"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// reverseRecords maps the reverse name (in-addr.arpa or ip6.arpa) of every
+// record holding a single address, and of every typed A and AAAA record,
+// to the hosts with that address, sorted. Records whose address depends on
+// the client are left out.
+func reverseRecords(records map[string]string, typed *typedHosts) map[string][]string {
+	reverse := make(map[string][]string)
+	add := func(host, addr string) {
+		arpa, err := dns.ReverseAddr(addr)
+		if err != nil {
+			return
+		}
+		arpa = arpa[:len(arpa)-1]
+		if !slices.Contains(reverse[arpa], host) {
+			reverse[arpa] = append(reverse[arpa], host)
+		}
+	}
+	for host, value := range records {
+		if net.ParseIP(value) != nil {
+			add(host, value)
+		}
+	}
+	if typed != nil {
+		for host, rrs := range typed.rrs {
+			for _, rr := range rrs {
+				switch rr := rr.(type) {
+				case *dns.A:
+					add(host, rr.A.String())
+				case *dns.AAAA:
+					add(host, rr.AAAA.String())
+				}
+			}
+		}
+	}
+	for _, hosts := range reverse {
+		sort.Strings(hosts)
+	}
+	return reverse
+}
+
+// reverseHosts returns the hosts whose records hold the address with the
+// reverse name arpa.
+func (s *Server) reverseHosts(arpa string) []string {
+	if set := s.liveRecords.Load(); set != nil {
+		return set.reverse[arpa]
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package godns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rewriteRule is a parsed RewriteRule.
+type rewriteRule struct {
+	// from and to are the networks of an address rewrite; to maps every
+	// address to its own when it is a single address.
+	from, to *net.IPNet
+	// suffix is resolved under target.
+	suffix, target string
+	// strip are the record types removed from answers in domain.
+	strip  map[uint16]bool
+	domain string
+}
+
+// compileRewrites parses the rewrite rules of the configuration, which
+// validate has checked.
+func compileRewrites(rules []RewriteRule) []rewriteRule {
+	var compiled []rewriteRule
+	for _, r := range rules {
+		var c rewriteRule
+		switch {
+		case r.Address != "":
+			c.from, _ = parseNetwork(r.Address)
+			c.to, _ = parseNetwork(r.To)
+		case r.Suffix != "":
+			c.suffix, c.target = r.Suffix, r.To
+		default:
+			c.strip = make(map[uint16]bool)
+			for _, t := range r.Strip {
+				c.strip[dns.StringToType[strings.ToUpper(t)]] = true
+			}
+			c.domain = r.Domain
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled
+}
+
+// parseNetwork parses an address as a single address network, or a CIDR.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// inDomain reports whether host is domain or one of its subdomains.
+func inDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// rewriteName returns the name host is resolved as under the first suffix
+// rule it falls under.
+func (s *Server) rewriteName(host string) (string, bool) {
+	for _, r := range s.rewriteRules {
+		if r.suffix != "" && inDomain(host, r.suffix) {
+			return strings.TrimSuffix(host, r.suffix) + r.target, true
+		}
+	}
+	return "", false
+}
+
+// rewriteAnswer applies the address and strip rules to an upstream answer.
+func (s *Server) rewriteAnswer(response *dns.Msg) {
+	if len(s.rewriteRules) == 0 {
+		return
+	}
+	rewritten := false
+	for _, r := range s.rewriteRules {
+		switch {
+		case r.from != nil:
+			for _, rr := range response.Answer {
+				var ip *net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = &rr.A
+				case *dns.AAAA:
+					ip = &rr.AAAA
+				}
+				if ip != nil && r.from.Contains(*ip) {
+					*ip = mapAddress(*ip, r.from, r.to)
+					rewritten = true
+				}
+			}
+		case r.strip != nil:
+			strip := func(rrs []dns.RR) []dns.RR {
+				kept := rrs[:0]
+				for _, rr := range rrs {
+					name := strings.ToLower(strings.TrimSuffix(rr.Header().Name, "."))
+					if r.strip[rr.Header().Rrtype] && (r.domain == "" || inDomain(name, r.domain)) {
+						rewritten = true
+						continue
+					}
+					kept = append(kept, rr)
+				}
+				return kept
+			}
+			response.Answer = strip(response.Answer)
+			response.Extra = strip(response.Extra)
+		}
+	}
+	if rewritten {
+		s.stats.rewritten.Add(1)
+	}
+}
+
+// mapAddress maps ip in from to the address with the same host bits in
+// to, or to to's address when it is a single address.
+func mapAddress(ip net.IP, from, to *net.IPNet) net.IP {
+	ones, bits := to.Mask.Size()
+	if ones == bits {
+		return to.IP
+	}
+	if v4 := ip.To4(); v4 != nil && len(to.IP) == net.IPv4len {
+		ip = v4
+	}
+	mapped := make(net.IP, len(to.IP))
+	for i := range mapped {
+		mapped[i] = to.IP[i] | ip[i]&^from.Mask[i]
+	}
+	return mapped
+}
@@ -0,0 +1,366 @@
+package godns
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootZoneSources are the servers RFC 8806 lists as allowing transfers of
+// the root zone: root servers b, c, d, f, g and k, and ICANN's transfer
+// servers.
+var rootZoneSources = []string{
+	"170.247.170.2", "192.33.4.12", "199.7.91.13", "192.5.5.241",
+	"192.112.36.4", "193.0.14.129", "192.0.32.132", "192.0.47.132",
+}
+
+// rootZone is a transferred copy of the root zone, its records keyed by
+// lower-cased owner name without the trailing dot: "" for the apex, "com"
+// for the delegation of com. Like zoneData it is never modified once
+// published.
+type rootZone struct {
+	soa *dns.SOA
+	rrs map[string][]dns.RR
+}
+
+// startRootZone starts keeping the local copy of the root zone in sync.
+// Until the first transfer succeeds names are resolved as without it.
+func (s *Server) startRootZone() {
+	if s.cfg.RootZone.Enabled {
+		s.goBackground(s.runRootZone)
+	}
+}
+
+// runRootZone refreshes the root zone from its sources like a secondary
+// zone, following its SOA timers, and drops it when it could not be
+// refreshed for the expire interval, until s shuts down.
+func (s *Server) runRootZone() {
+	var refreshed time.Time
+	for {
+		err := s.refreshRootZone()
+		z := s.liveRootZone.Load()
+		wait := secondaryRetry
+		switch {
+		case err == nil:
+			refreshed = time.Now()
+			wait = time.Duration(z.soa.Refresh) * time.Second
+		case z == nil:
+			s.logMessage(fmt.Sprintf("Error transferring the root zone: %v", err))
+		default:
+			s.logMessage(fmt.Sprintf("Error refreshing the root zone: %v", err))
+			wait = time.Duration(z.soa.Retry) * time.Second
+			if time.Since(refreshed) > time.Duration(z.soa.Expire)*time.Second {
+				s.liveRootZone.Store(nil)
+				s.notify(eventZoneExpired, fmt.Sprintf("root zone expired, not refreshed since %s", refreshed.Format(time.RFC3339)))
+			}
+		}
+		if !s.sleep(max(wait, secondaryMinRefresh)) {
+			return
+		}
+	}
+}
+
+// refreshRootZone transfers the root zone from the first source that has
+// a newer version than the loaded one, and publishes it once it verifies.
+func (s *Server) refreshRootZone() error {
+	prev := s.liveRootZone.Load()
+	var lastErr error
+	for _, source := range s.cfg.RootZone.Sources {
+		source := ZoneConfig{Name: ".", Primary: source}
+		if prev != nil {
+			serial, err := s.primarySerial(source, nil)
+			if err != nil {
+				lastErr = fmt.Errorf("%s: %v", source.Primary, err)
+				continue
+			}
+			if !serialAfter(serial, prev.soa.Serial) {
+				return nil
+			}
+		}
+		z, err := s.transferRootZone(source.Primary)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", source.Primary, err)
+			continue
+		}
+		s.liveRootZone.Store(z)
+		s.logMessage(fmt.Sprintf("Transferred the root zone from %s (serial %d, %d names)", source.Primary, z.soa.Serial, len(z.rrs)))
+		return nil
+	}
+	return lastErr
+}
+
+// transferRootZone transfers the root zone from source with AXFR and
+// checks its ZONEMD digest, if it has one.
+func (s *Server) transferRootZone(source string) (*rootZone, error) {
+	req := new(dns.Msg)
+	req.SetAxfr(".")
+	transfer := &dns.Transfer{DialTimeout: s.cfg.UpstreamTimeout, ReadTimeout: s.cfg.UpstreamTimeout}
+	envelopes, err := transfer.In(req, source)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	if len(rrs) < 2 {
+		return nil, fmt.Errorf("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok || soa.Hdr.Name != "." {
+		return nil, fmt.Errorf("transfer does not start with the root SOA")
+	}
+	// The transfer ends with the SOA again.
+	rrs = rrs[:len(rrs)-1]
+	if err := verifyZoneDigest(rrs, soa.Serial); err != nil {
+		return nil, err
+	}
+	z := &rootZone{soa: soa, rrs: make(map[string][]dns.RR)}
+	for _, rr := range rrs {
+		name := ownerName(rr)
+		z.rrs[name] = append(z.rrs[name], rr)
+	}
+	return z, nil
+}
+
+// verifyZoneDigest checks the zone's records against the digest of its
+// apex ZONEMD record (RFC 8976) with the SIMPLE scheme, so a zone
+// corrupted or changed on its way is not served. Zones without a ZONEMD
+// record pass, as do zones with only digests of unknown schemes.
+func verifyZoneDigest(rrs []dns.RR, serial uint32) error {
+	var digests []*dns.ZONEMD
+	var included []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Name == "." {
+			if md, ok := rr.(*dns.ZONEMD); ok {
+				digests = append(digests, md)
+				continue
+			}
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeZONEMD {
+				continue
+			}
+		}
+		included = append(included, rr)
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+
+	hashes := map[uint8]func() hash.Hash{1: sha512.New384, 2: sha512.New}
+	for _, md := range digests {
+		newHash, ok := hashes[md.Hash]
+		if md.Scheme != 1 || !ok {
+			continue
+		}
+		if md.Serial != serial {
+			return fmt.Errorf("ZONEMD serial %d does not match the SOA serial %d", md.Serial, serial)
+		}
+		digest, err := zoneDigest(included, newHash())
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(hex.EncodeToString(digest), md.Digest) {
+			return fmt.Errorf("zone digest does not match its ZONEMD record")
+		}
+		return nil
+	}
+	return nil
+}
+
+// zoneDigest hashes the records in the canonical form and order of DNSSEC
+// (RFC 4034 section 6), without duplicates, as RFC 8976 section 3.3.1
+// prescribes.
+func zoneDigest(rrs []dns.RR, h hash.Hash) ([]byte, error) {
+	type canonicalRR struct {
+		owner  [][]byte
+		rrtype uint16
+		wire   []byte
+		rdata  []byte
+	}
+	sorted := make([]canonicalRR, 0, len(rrs))
+	buf := make([]byte, dns.MaxMsgSize)
+	for _, rr := range rrs {
+		rr = canonicalRecord(rr)
+		n, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			return nil, fmt.Errorf("packing %s: %v", rr.Header().Name, err)
+		}
+		wire := append([]byte(nil), buf[:n]...)
+		owner, err := canonicalLabels(rr.Header().Name)
+		if err != nil {
+			return nil, err
+		}
+		// The RDATA follows the owner name and the ten bytes of type,
+		// class, TTL and length.
+		ownerLen, _ := dns.PackDomainName(rr.Header().Name, buf, 0, nil, false)
+		sorted = append(sorted, canonicalRR{owner: owner, rrtype: rr.Header().Rrtype, wire: wire, rdata: wire[ownerLen+10:]})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if c := compareLabels(a.owner, b.owner); c != 0 {
+			return c < 0
+		}
+		if a.rrtype != b.rrtype {
+			return a.rrtype < b.rrtype
+		}
+		return bytes.Compare(a.rdata, b.rdata) < 0
+	})
+	for i, rr := range sorted {
+		if i > 0 && bytes.Equal(rr.wire, sorted[i-1].wire) {
+			continue
+		}
+		h.Write(rr.wire)
+	}
+	return h.Sum(nil), nil
+}
+
+// canonicalRecord returns rr with its owner, and the names in the RDATA
+// of the types RFC 4034 section 6.2 lists as amended by RFC 6840, in lower
+// case.
+func canonicalRecord(rr dns.RR) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	switch rr := rr.(type) {
+	case *dns.NS:
+		rr.Ns = strings.ToLower(rr.Ns)
+	case *dns.CNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.SOA:
+		rr.Ns, rr.Mbox = strings.ToLower(rr.Ns), strings.ToLower(rr.Mbox)
+	case *dns.PTR:
+		rr.Ptr = strings.ToLower(rr.Ptr)
+	case *dns.MX:
+		rr.Mx = strings.ToLower(rr.Mx)
+	case *dns.SRV:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.DNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.RRSIG:
+		rr.SignerName = strings.ToLower(rr.SignerName)
+	}
+	return rr
+}
+
+// canonicalLabels returns the labels of name, lower-cased and with their
+// escapes decoded, from the last to the first.
+func canonicalLabels(name string) ([][]byte, error) {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(strings.ToLower(name), buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	var labels [][]byte
+	for off := 0; off < n && buf[off] != 0; off += int(buf[off]) + 1 {
+		labels = append(labels, buf[off+1:off+1+int(buf[off])])
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels, nil
+}
+
+// compareLabels orders names by their reversed labels, the canonical DNS
+// name order.
+func compareLabels(a, b [][]byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := bytes.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// rootZoneAnswers reports whether the local root zone answers host: the
+// root itself, and names under top-level domains it does not delegate,
+// unless a forward zone covers them.
+func (s *Server) rootZoneAnswers(host string) bool {
+	z := s.liveRootZone.Load()
+	if z == nil {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	tld := host[strings.LastIndexByte(host, '.')+1:]
+	_, delegated := z.rrs[tld]
+	return !delegated && !s.inForwardZone(host)
+}
+
+// answerRootZone answers a query rootZoneAnswers accepted: from the apex
+// records for the root, with NXDOMAIN for other names.
+func (s *Server) answerRootZone(q dns.Question, host string, response *dns.Msg) {
+	z := s.liveRootZone.Load()
+	s.stats.rootZone.Add(1)
+	if host == "" {
+		for _, rr := range z.rrs[""] {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				response.Answer = append(response.Answer, rr)
+			}
+		}
+	} else {
+		response.Rcode = dns.RcodeNameError
+	}
+	if len(response.Answer) == 0 {
+		soa := dns.Copy(z.soa)
+		soa.Header().Ttl = min(soa.Header().Ttl, z.soa.Minttl)
+		response.Ns = append(response.Ns, soa)
+	}
+}
+
+// rootReferral answers the query of the recursor for name at the root from
+// the local root zone, as a root server would: with the delegation of its
+// top-level domain and the glue of its name servers, or NXDOMAIN. It
+// reports false when there is no local root zone.
+func (s *Server) rootReferral(name string, qtype uint16) (*dns.Msg, bool) {
+	z := s.liveRootZone.Load()
+	if z == nil {
+		return nil, false
+	}
+	resp := new(dns.Msg)
+	resp.SetQuestion(name, qtype)
+	resp.Response = true
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	if s.rootZoneAnswers(host) {
+		s.answerRootZone(resp.Question[0], host, resp)
+		return resp, true
+	}
+	s.stats.rootZone.Add(1)
+	tld := host[strings.LastIndexByte(host, '.')+1:]
+	for _, rr := range z.rrs[tld] {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		resp.Ns = append(resp.Ns, ns)
+		for _, glue := range z.rrs[strings.ToLower(strings.TrimSuffix(ns.Ns, "."))] {
+			if t := glue.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				resp.Extra = append(resp.Extra, glue)
+			}
+		}
+	}
+	return resp, true
+}
+
+// rootZoneStats returns the serial of the local root zone in the format of
+// statsSnapshot.
+func (s *Server) rootZoneStats() string {
+	z := s.liveRootZone.Load()
+	if !s.cfg.RootZone.Enabled {
+		return ""
+	}
+	serial := uint32(0)
+	if z != nil {
+		serial = z.soa.Serial
+	}
+	return fmt.Sprintf("root_zone.serial=%d\nqueries.root_zone=%d\n", serial, s.stats.rootZone.Load())
+}
@@ -0,0 +1,253 @@
+package godns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const eventZoneExpired = "zone_expired"
+
+const (
+	// secondaryRetry is how often a zone that was never transferred is
+	// retried.
+	secondaryRetry = 30 * time.Second
+	// secondaryMinRefresh bounds how often a primary is polled, whatever
+	// its SOA says.
+	secondaryMinRefresh = 5 * time.Second
+)
+
+// startSecondaries starts keeping every configured secondary zone in sync
+// with its primary. Until the first transfer succeeds queries for the zone
+// are answered with SERVFAIL.
+func (s *Server) startSecondaries() {
+	for _, zone := range s.cfg.Zones {
+		if zone.Primary != "" {
+			zone := zone
+			s.goBackground(func() { s.runSecondary(zone, nil) })
+		}
+	}
+}
+
+// runSecondary follows the SOA timers of a secondary zone (RFC 1034 section
+// 4.3.5): it checks the primary's serial every refresh interval, transfers
+// the zone when it changed, retries failed checks after the retry interval
+// and stops serving the zone once it could not be refreshed for the expire
+// interval. A NOTIFY from the primary triggers a refresh right away. The
+// loop ends, dropping the zone, when stop is closed; it is nil for
+// configured zones. It also ends when s shuts down.
+func (s *Server) runSecondary(zone ZoneConfig, stop <-chan struct{}) {
+	refresh := s.secondaryRefreshChannel(zone.Name)
+	var refreshed time.Time
+	for {
+		err := s.refreshSecondary(zone)
+		z := s.currentZones()[zone.Name]
+		wait := secondaryRetry
+		switch {
+		case err == nil:
+			refreshed = time.Now()
+			wait = time.Duration(z.soa.Refresh) * time.Second
+		case z == nil:
+			s.logMessage(fmt.Sprintf("Error transferring zone %s from %s: %v", zone.Name, zone.Primary, err))
+		default:
+			s.logMessage(fmt.Sprintf("Error refreshing zone %s from %s: %v", zone.Name, zone.Primary, err))
+			wait = time.Duration(z.soa.Retry) * time.Second
+			if time.Since(refreshed) > time.Duration(z.soa.Expire)*time.Second {
+				s.updateMu.Lock()
+				s.replaceZone(zone.Name, nil)
+				s.updateMu.Unlock()
+				s.notify(eventZoneExpired, fmt.Sprintf("zone %s expired, %s unreachable since %s", zone.Name, zone.Primary, refreshed.Format(time.RFC3339)))
+			}
+		}
+		timer := time.NewTimer(max(wait, secondaryMinRefresh))
+		select {
+		case <-timer.C:
+		case <-refresh:
+			timer.Stop()
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-stop:
+			timer.Stop()
+			s.updateMu.Lock()
+			s.replaceZone(zone.Name, nil)
+			s.updateMu.Unlock()
+			return
+		}
+	}
+}
+
+// refreshSecondary brings a secondary zone up to date with its primary,
+// using IXFR when a previous version of the zone is loaded.
+func (s *Server) refreshSecondary(zone ZoneConfig) error {
+	key := s.cfg.findTSIGKey(zone.PrimaryKey)
+	prev := s.currentZones()[zone.Name]
+	if prev != nil {
+		serial, err := s.primarySerial(zone, key)
+		if err != nil {
+			return err
+		}
+		if !serialAfter(serial, prev.soa.Serial) {
+			return nil
+		}
+	}
+
+	req := new(dns.Msg)
+	if prev != nil {
+		req.SetIxfr(dns.Fqdn(zone.Name), prev.soa.Serial, prev.soa.Ns, prev.soa.Mbox)
+	} else {
+		req.SetAxfr(dns.Fqdn(zone.Name))
+	}
+	transfer := &dns.Transfer{DialTimeout: s.cfg.UpstreamTimeout, ReadTimeout: s.cfg.UpstreamTimeout}
+	if key != nil {
+		req.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+		transfer.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+	envelopes, err := transfer.In(req, zone.Primary)
+	if err != nil {
+		return err
+	}
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+
+	next, err := applyTransfer(zone.Name, prev, rrs)
+	if err != nil || next == nil {
+		return err
+	}
+	s.updateMu.Lock()
+	s.replaceZone(zone.Name, next)
+	s.updateMu.Unlock()
+
+	old := map[string]string{}
+	if prev != nil {
+		old = flattenZones(map[string]*zoneData{zone.Name: prev})
+	}
+	s.auditRecordChanges("transfer:"+zone.Primary, old, flattenZones(map[string]*zoneData{zone.Name: next}))
+	s.logMessage(fmt.Sprintf("Transferred zone %s from %s (serial %d)", zone.Name, zone.Primary, next.soa.Serial))
+	s.notifySecondaries(zone.Name, next.soa)
+	if zone.Catalog {
+		s.syncCatalogMembers(zone, next)
+	}
+	return nil
+}
+
+// primarySerial asks the primary for the zone's current SOA serial.
+func (s *Server) primarySerial(zone ZoneConfig, key *TSIGKey) (uint32, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(zone.Name), dns.TypeSOA)
+	client := &dns.Client{Timeout: s.cfg.UpstreamTimeout}
+	if key != nil {
+		req.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+		client.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+	resp, _, err := client.Exchange(req, zone.Primary)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA query answered with %s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("SOA query answered without an SOA")
+}
+
+// applyTransfer builds the next version of a secondary zone from the
+// answer records of an AXFR or IXFR response. prev is the loaded version,
+// nil before the first transfer; nil is returned when prev is current.
+func applyTransfer(origin string, prev *zoneData, rrs []dns.RR) (*zoneData, error) {
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, fmt.Errorf("transfer does not start with an SOA")
+	}
+	for _, rr := range rrs {
+		if name := ownerName(rr); name != origin && !strings.HasSuffix(name, "."+origin) {
+			return nil, fmt.Errorf("transfer contains %s, outside zone %s", rr.Header().Name, origin)
+		}
+	}
+	if len(rrs) == 1 {
+		return nil, nil
+	}
+
+	var next *zoneData
+	if _, incremental := rrs[1].(*dns.SOA); incremental && prev != nil {
+		// Sequences of SOA(old) removed... SOA(new) added..., RFC 1995
+		// section 4.
+		next = prev.clone()
+		adding := true
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			if _, ok := rr.(*dns.SOA); ok {
+				adding = !adding
+				continue
+			}
+			name := ownerName(rr)
+			if adding {
+				if !containsRR(next.rrs[name], rr) {
+					next.rrs[name] = append(next.rrs[name], rr)
+				}
+				continue
+			}
+			var kept []dns.RR
+			for _, e := range next.rrs[name] {
+				if !sameRR(e, rr) {
+					kept = append(kept, e)
+				}
+			}
+			next.setRRs(name, kept)
+		}
+		var apex []dns.RR
+		for _, rr := range next.rrs[origin] {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				apex = append(apex, rr)
+			}
+		}
+		next.rrs[origin] = apex
+	} else {
+		next = &zoneData{origin: origin, rrs: make(map[string][]dns.RR)}
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			name := ownerName(rr)
+			next.rrs[name] = append(next.rrs[name], rr)
+		}
+	}
+	next.soa = soa
+	next.rrs[origin] = append([]dns.RR{soa}, next.rrs[origin]...)
+	if prev != nil {
+		next.recordChange(prev)
+	}
+	return next, nil
+}
+
+// keepSecondaryZones copies the loaded secondary zones into a freshly
+// loaded set of zone file zones, so reloads do not drop them.
+func (s *Server) keepSecondaryZones(prev, next map[string]*zoneData) {
+	for _, zone := range append(s.catalogMemberZones(), s.cfg.Zones...) {
+		if z := prev[zone.Name]; zone.Primary != "" && z != nil {
+			next[zone.Name] = z
+		}
+	}
+}
+
+// inSecondaryZone reports whether host falls inside a secondary zone, for
+// names not answered from a loaded zone: the zone was not transferred yet
+// or has expired.
+func (s *Server) inSecondaryZone(host string) bool {
+	for _, zone := range append(s.catalogMemberZones(), s.cfg.Zones...) {
+		if zone.Primary != "" && (host == zone.Name || strings.HasSuffix(host, "."+zone.Name)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,352 @@
+package godns
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releasePublicKey is the base64 ed25519 key release checksums are signed
+// with, set at build time by build.sh. Without it updates are refused
+// unless godns update is run with -insecure, which checks the checksum
+// only.
+var releasePublicKey = ""
+
+const updateUsage = `Usage: godns update [flags]
+
+Replaces the running binary with the latest GitHub release, or the one
+given with -version. The release's SHA256SUMS file and its signature are
+checked before the download is installed; a binary built without a release
+key installs releases checked against SHA256SUMS only with -insecure. The
+new binary must run before it replaces the old one, which is kept next to
+it with the suffix .old:
+
+  godns update -check       report whether a newer release exists
+  godns update              install it
+  godns update -rollback    go back to the previous binary
+
+Restart godns afterwards, or send it SIGUSR2 to upgrade without dropping
+queries.
+
+Flags:
+`
+
+// githubRelease is the part of a GitHub release godns update needs.
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *githubRelease) assetURL(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+func updateCommand(args []string) int {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	check := fs.Bool("check", false, "Only report whether a newer release is available")
+	rollback := fs.Bool("rollback", false, "Restore the binary replaced by the last update")
+	target := fs.String("version", "", "Install this release, e.g. v0.4.0, even if it is older (default latest)")
+	repo := fs.String("repo", "nodesocket/godns", "GitHub repository releases are taken from")
+	apiURL := fs.String("api-url", "https://api.github.com", "GitHub API URL, for GitHub Enterprise or a mirror")
+	insecure := fs.Bool("insecure", false, "Install releases checked against SHA256SUMS only when this binary has no release key to verify its signature")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), updateUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: locating the godns binary:", err)
+		return 1
+	}
+	if *rollback {
+		if err := rollbackBinary(exe); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		fmt.Printf("Restored the previous binary at %s\n", exe)
+		return 0
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	release, err := fetchRelease(client, *apiURL, *repo, *target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	newer := compareVersions(release.TagName, version) > 0
+	if *check {
+		if newer {
+			fmt.Printf("godns %s is available (running v%s)\n", release.TagName, version)
+		} else {
+			fmt.Printf("godns v%s is up to date\n", version)
+		}
+		return 0
+	}
+	if !newer && *target == "" {
+		fmt.Printf("godns v%s is up to date\n", version)
+		return 0
+	}
+
+	if err := installRelease(client, release, exe, *insecure); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	fmt.Printf("Updated %s from v%s to %s; restart godns or send it SIGUSR2 to run it\n", exe, version, release.TagName)
+	return 0
+}
+
+// fetchRelease returns the latest release of repo, or the one tagged tag.
+func fetchRelease(client *http.Client, apiURL, repo, tag string) (*githubRelease, error) {
+	url := fmt.Sprintf("%s/repos/%s/releases/latest", strings.TrimSuffix(apiURL, "/"), repo)
+	if tag != "" {
+		if !strings.HasPrefix(tag, "v") {
+			tag = "v" + tag
+		}
+		url = fmt.Sprintf("%s/repos/%s/releases/tags/%s", strings.TrimSuffix(apiURL, "/"), repo, tag)
+	}
+	data, err := download(client, url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching release: %v", err)
+	}
+	var release githubRelease
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("fetching release: %v", err)
+	}
+	if release.TagName == "" {
+		return nil, fmt.Errorf("fetching release: no tag in %s", url)
+	}
+	return &release, nil
+}
+
+func download(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json, application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// releaseAssetName is the name build.sh gives the binary for this
+// platform.
+func releaseAssetName() string {
+	name := fmt.Sprintf("godns_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// installRelease downloads and verifies the release binary for this
+// platform and swaps it in for exe. Without a release key to verify the
+// signature of SHA256SUMS the release is refused, unless insecure.
+func installRelease(client *http.Client, release *githubRelease, exe string, insecure bool) error {
+	asset := releaseAssetName()
+	binaryURL, sumsURL := release.assetURL(asset), release.assetURL("SHA256SUMS")
+	if binaryURL == "" {
+		return fmt.Errorf("release %s has no binary for %s/%s", release.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	if sumsURL == "" {
+		return fmt.Errorf("release %s has no SHA256SUMS file", release.TagName)
+	}
+	if releasePublicKey == "" && !insecure {
+		return fmt.Errorf("this binary has no release key to verify release %s with; pass -insecure to install it checked against SHA256SUMS only", release.TagName)
+	}
+	sums, err := download(client, sumsURL)
+	if err != nil {
+		return err
+	}
+	if releasePublicKey != "" {
+		sigURL := release.assetURL("SHA256SUMS.sig")
+		if sigURL == "" {
+			return fmt.Errorf("release %s is not signed", release.TagName)
+		}
+		sig, err := download(client, sigURL)
+		if err != nil {
+			return err
+		}
+		if err := verifySignature(sums, sig); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "Warning: -insecure: this binary has no release key; verifying the checksum only")
+	}
+	want, err := checksumFor(sums, asset)
+	if err != nil {
+		return err
+	}
+
+	binary, err := download(client, binaryURL)
+	if err != nil {
+		return err
+	}
+	if got := sha256.Sum256(binary); !bytes.Equal(got[:], want) {
+		return fmt.Errorf("checksum mismatch for %s: got %x, want %x", asset, got, want)
+	}
+	return swapBinary(exe, binary, release.TagName)
+}
+
+func verifySignature(sums, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(releasePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid release public key")
+	}
+	if !ed25519.Verify(key, sums, sig) {
+		return fmt.Errorf("SHA256SUMS signature does not verify")
+	}
+	return nil
+}
+
+// checksumFor finds the checksum of name in a file in sha256sum format.
+func checksumFor(sums []byte, name string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return hex.DecodeString(fields[0])
+		}
+	}
+	return nil, fmt.Errorf("SHA256SUMS has no checksum for %s", name)
+}
+
+// swapBinary writes binary next to exe, checks that it runs and reports
+// version tag, then keeps exe as exe.old with a hard link and renames the
+// new binary over exe, so that there is always a binary at exe.
+func swapBinary(exe string, binary []byte, tag string) error {
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".godns.new.*")
+	if err != nil {
+		return err
+	}
+	newPath := tmp.Name()
+	defer os.Remove(newPath)
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(newPath, info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+
+	out, err := exec.Command(newPath, "-version").Output()
+	if err != nil {
+		return fmt.Errorf("the downloaded binary does not run: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "godns "+tag {
+		return fmt.Errorf("the downloaded binary reports %q, want godns %s", got, tag)
+	}
+
+	backup := exe + ".old"
+	os.Remove(backup)
+	if runtime.GOOS == "windows" {
+		// A running binary cannot be replaced on Windows, only renamed.
+		if err := os.Rename(exe, backup); err != nil {
+			return err
+		}
+		if err := os.Rename(newPath, exe); err != nil {
+			if rerr := os.Rename(backup, exe); rerr != nil {
+				return fmt.Errorf("%v; restoring %s from %s also failed: %v", err, exe, backup, rerr)
+			}
+			return err
+		}
+		return nil
+	}
+	if err := os.Link(exe, backup); err != nil {
+		return fmt.Errorf("keeping the previous binary: %v", err)
+	}
+	return os.Rename(newPath, exe)
+}
+
+// rollbackBinary puts exe.old back in place of exe.
+func rollbackBinary(exe string) error {
+	backup := exe + ".old"
+	if _, err := os.Stat(backup); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no previous binary at %s", backup)
+		}
+		return err
+	}
+	if runtime.GOOS != "windows" {
+		return os.Rename(backup, exe)
+	}
+	// A running binary cannot be replaced on Windows, only renamed.
+	failed := exe + ".failed"
+	os.Remove(failed)
+	if err := os.Rename(exe, failed); err != nil {
+		return err
+	}
+	if err := os.Rename(backup, exe); err != nil {
+		os.Rename(failed, exe)
+		return err
+	}
+	os.Remove(failed)
+	return nil
+}
+
+// compareVersions compares two versions of the form [v]MAJOR.MINOR.PATCH
+// and returns -1, 0 or 1. Missing or non-numeric parts count as 0.
+func compareVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < 3; i++ {
+		var x, y int
+		if i < len(pa) {
+			x, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			y, _ = strconv.Atoi(pb[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
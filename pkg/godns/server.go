@@ -0,0 +1,875 @@
+package godns
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	version         = "0.3.2"
+	defaultResolver = "1.1.1.1"
+)
+
+// Record is a host name and its address, as listed by a Store and the
+// record API.
+type Record struct {
+	Host string `json:"host"`
+	IP   string `json:"ip"`
+	// Type and TTL are set for the typed records of v2 hosts files,
+	// listed by the record API. IP then holds the record data, e.g.
+	// "10 mail.example.com." for MX.
+	Type string `json:"type,omitempty"`
+	TTL  uint32 `json:"ttl,omitempty"`
+	// Tags are the tags of the host in a v2 hosts file.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// DnsRecord is the former name of Record.
+//
+// Deprecated: use Record.
+type DnsRecord = Record
+
+// writeLogs writes the queued log messages until ctx is done.
+func (s *Server) writeLogs(ctx context.Context) {
+	for {
+		select {
+		case entry := <-s.logChan:
+			s.logger.Print(entry.String())
+		case done := <-s.logFlush:
+			for len(s.logChan) > 0 {
+				entry := <-s.logChan
+				s.logger.Print(entry.String())
+			}
+			close(done)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logEntry is a queued log message: text, or render to produce it on the
+// log writer, off the query path.
+type logEntry struct {
+	text   string
+	render func() string
+}
+
+func (e logEntry) String() string {
+	if e.render != nil {
+		return e.render()
+	}
+	return e.text
+}
+
+// logMessage queues msg for the log writer. It never waits: when the
+// writer has fallen behind and the queue is full, the message is dropped
+// and counted as logs.dropped, so slow log output cannot hold up queries.
+func (s *Server) logMessage(msg string) {
+	s.queueLog(logEntry{text: msg})
+}
+
+// logLazy is logMessage for a message that is costly to produce: render
+// runs on the log writer, and not at all if the message is dropped. It must
+// only use values that are not modified afterwards.
+func (s *Server) logLazy(render func() string) {
+	s.queueLog(logEntry{render: render})
+}
+
+func (s *Server) queueLog(entry logEntry) {
+	select {
+	case s.logChan <- entry:
+	default:
+		s.stats.logsDropped.Add(1)
+	}
+}
+
+// flushLogs waits until the messages queued on logChan are written, or ctx
+// is done.
+func (s *Server) flushLogs(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case s.logFlush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) loadHosts() (map[string]string, *typedHosts, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stores, err := s.recordStores()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := make(map[string]string)
+	typed := newTypedHosts()
+	for _, store := range stores {
+		var hosts map[string]string
+		var storeTyped *typedHosts
+		if ts, ok := store.(typedStore); ok {
+			hosts, storeTyped, err = ts.typedRecords()
+		} else {
+			hosts, err = store.Records()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// A name defined again replaces its records of either kind.
+		for k, v := range hosts {
+			records[k] = v
+			delete(typed.rrs, k)
+			delete(typed.tags, k)
+		}
+		if storeTyped != nil {
+			for k, rrs := range storeTyped.rrs {
+				typed.rrs[k] = rrs
+				delete(records, k)
+			}
+			for k, tags := range storeTyped.tags {
+				typed.tags[k] = tags
+			}
+		}
+	}
+	for _, zone := range s.cfg.Zones {
+		for name, value := range zone.Records {
+			ip, err := expandRecord(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("zones: %s: record %s: %v", zone.Name, name, err)
+			}
+			host := zoneRecordName(zone.Name, name)
+			records[host] = ip
+			delete(typed.rrs, host)
+		}
+	}
+	return records, typed, nil
+}
+
+// zoneRecordName turns a record name relative to zone into a lookup key.
+// "@" is the zone apex and names ending in a dot are already absolute.
+func zoneRecordName(zone, name string) string {
+	switch {
+	case name == "@":
+		return zone
+	case strings.HasSuffix(name, "."):
+		return strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	return strings.ToLower(name) + "." + zone
+}
+
+// inLocalZone reports whether host falls inside one of the configured zones.
+func (s *Server) inLocalZone(host string) bool {
+	for _, zone := range s.cfg.Zones {
+		if host == zone.Name || strings.HasSuffix(host, "."+zone.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeDNSMessage(data []byte, messageType string) string {
+	dnsMsg := new(dns.Msg)
+	err := dnsMsg.Unpack(data)
+	if err != nil {
+		return fmt.Sprintf("Error decoding DNS %s: %v", messageType, err)
+	}
+	return dnsMsg.String()
+}
+
+// logRequest logs a query from addr, formatting a copy of it on the log
+// writer.
+func (s *Server) logRequest(req *dns.Msg, addr *net.UDPAddr) {
+	now, label, req := time.Now(), s.clientAddrLabel(addr), req.Copy()
+	s.logLazy(func() string {
+		timestamp := now.UTC().Format("2006-01-02T15:04:05.000Z")
+		return fmt.Sprintf("[%s] (%s) REQUEST:\n%s", timestamp, label, req)
+	})
+}
+
+// logResponse logs a response sent to addr, decoding a copy of it on the
+// log writer, as the buffer is reused once the response is sent.
+func (s *Server) logResponse(response []byte, addr *net.UDPAddr) {
+	now, label, response := time.Now(), s.clientAddrLabel(addr), append([]byte(nil), response...)
+	s.logLazy(func() string {
+		timestamp := now.UTC().Format("2006-01-02T15:04:05.000Z")
+		return fmt.Sprintf("[%s] (%s) RESPONSE:\n%s", timestamp, label, decodeDNSMessage(response, "response"))
+	})
+}
+
+// handler answers the queries the listeners' dns.Servers of srv receive,
+// from the tenant's zones on a tenant's listeners.
+type handler struct {
+	srv    *Server
+	tenant *tenant
+}
+
+func (h handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	h.serveContext(context.Background(), w, req)
+}
+
+// serveContext answers req within the deadline of ctx, which the pool sets
+// when the query is received.
+func (h handler) serveContext(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	defer h.srv.recoverQuery(req, func(response *dns.Msg) {
+		if err := w.WriteMsg(response); err != nil {
+			h.srv.stats.sendErrors.Add(1)
+		}
+	})
+	addr := remoteUDPAddr(w.RemoteAddr())
+	if _, tcp := w.RemoteAddr().(*net.TCPAddr); tcp && isTransfer(req.Question[0].Qtype) && h.tenant == nil {
+		// Zone transfers are only served over TCP; over UDP resolve
+		// refuses them.
+		if err := h.srv.serveTransfer(w, req, addr); err != nil {
+			h.srv.stats.sendErrors.Add(1)
+			h.srv.logMessage(fmt.Sprintf("Error sending zone transfer: %v", err))
+			w.Close()
+		}
+		return
+	}
+
+	response := h.srv.handleRequest(ctx, w, req, h.tenant, addr)
+	if response == nil {
+		return
+	}
+	h.srv.capturePacket(response, addr, w.LocalAddr(), false)
+	if _, err := w.Write(response); err != nil {
+		h.srv.stats.sendErrors.Add(1)
+		h.srv.logMessage(fmt.Sprintf("Error sending response: %v", err))
+	}
+	putBuffer(response)
+}
+
+// recoverQuery is deferred around the answering of a query. If that
+// panics, it logs the panic with its stack and sends a SERVFAIL response
+// with send instead, so one query cannot take the process down.
+func (s *Server) recoverQuery(req *dns.Msg, send func(*dns.Msg)) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	s.stats.panics.Add(1)
+	s.stats.servfail.Add(1)
+	question := "no question"
+	if len(req.Question) > 0 {
+		question = fmt.Sprintf("%s %s", req.Question[0].Name, dns.Type(req.Question[0].Qtype))
+	}
+	s.logMessage(fmt.Sprintf("Error answering %s: panic: %v\n%s", question, r, debug.Stack()))
+	response := new(dns.Msg)
+	response.SetRcode(req, dns.RcodeServerFailure)
+	s.setExtendedError(req, response, dns.ExtendedErrorCodeOther, "internal error")
+	send(response)
+}
+
+// acceptQuery is the dns.MsgAcceptFunc of the listeners. Unlike the
+// default it accepts dynamic updates, whose sections hold any number of
+// records. Messages without exactly one question, or zone for updates,
+// are malformed: the dns package answers them with FORMERR and their ID,
+// unless they are dropped.
+func (s *Server) acceptQuery(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 {
+		// A response: answering it could be used for amplification.
+		return dns.MsgIgnore
+	}
+	switch opcode := int(dh.Bits>>11) & 0xF; opcode {
+	case dns.OpcodeQuery, dns.OpcodeNotify, dns.OpcodeUpdate:
+	default:
+		return dns.MsgRejectNotImplemented
+	}
+	if dh.Qdcount != 1 {
+		s.stats.queries.Add(1)
+		s.stats.malformed.Add(1)
+		if s.cfg.Malformed == "drop" {
+			return dns.MsgIgnore
+		}
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// malformedReader drops the messages that cannot be parsed, which the dns
+// package would otherwise answer with FORMERR, for malformed: drop. It
+// costs every message a second parse, so it is only used then.
+type malformedReader struct {
+	dns.PacketConnReader
+	srv *Server
+}
+
+func (r malformedReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	for {
+		data, err := r.PacketConnReader.ReadTCP(conn, timeout)
+		if err != nil || r.srv.parses(data) {
+			return data, err
+		}
+	}
+}
+
+func (r malformedReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	for {
+		data, session, err := r.PacketConnReader.ReadUDP(conn, timeout)
+		if err != nil || r.srv.parses(data) {
+			return data, session, err
+		}
+	}
+}
+
+func (r malformedReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	for {
+		data, addr, err := r.PacketConnReader.ReadPacketConn(conn, timeout)
+		if err != nil || r.srv.parses(data) {
+			return data, addr, err
+		}
+	}
+}
+
+// parses reports whether data is a DNS message, counting it as malformed
+// if not. Messages without a header are left to the dns package, which
+// drops them in any case.
+func (s *Server) parses(data []byte) bool {
+	if len(data) < 12 || new(dns.Msg).Unpack(data) == nil {
+		return true
+	}
+	s.stats.queries.Add(1)
+	s.stats.malformed.Add(1)
+	return false
+}
+
+// remoteUDPAddr converts the client address of a UDP or TCP query to the
+// *net.UDPAddr the logs, captures and access policies take.
+func remoteUDPAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a
+	case *batchAddr:
+		return a.UDPAddr
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	return &net.UDPAddr{}
+}
+
+// handleRequest answers a query, update or NOTIFY, for t if not nil, and
+// returns the packed response, or nil if there is none to send. Forwarding
+// gives up when ctx is done.
+func (s *Server) handleRequest(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, t *tenant, addr *net.UDPAddr) []byte {
+	started := time.Now()
+	sampled := s.sampleQuery()
+	if sampled {
+		s.logRequest(req, addr)
+	}
+	s.stats.queries.Add(1)
+	if _, udp := w.LocalAddr().(*net.UDPAddr); !udp {
+		ctx = withTCPQuery(ctx)
+	}
+
+	var handler func(*dns.Msg, dns.ResponseWriter, *net.UDPAddr) []byte
+	switch req.Opcode {
+	case dns.OpcodeUpdate:
+		handler = s.handleUpdate
+	case dns.OpcodeNotify:
+		handler = s.handleNotify
+	}
+	if handler != nil && t != nil {
+		handler = refuseRequest
+	}
+	if handler != nil {
+		responseData := handler(req, w, addr)
+		if sampled && responseData != nil {
+			s.logResponse(responseData, addr)
+		}
+		return responseData
+	}
+
+	q := req.Question[0]
+	pad := paddingRequested(w, req)
+	if t == nil && !pad {
+		// Plain local records are answered from their precomputed wire
+		// format, without building and packing a dns.Msg.
+		if responseData := s.packedResponse(req, addr.IP); responseData != nil {
+			client := s.clientLabel(addr.IP)
+			s.recordQuery(client, q, dns.RcodeSuccess, "local", started)
+			s.aggregateQuery(client, q, dns.RcodeSuccess)
+			if sampled {
+				s.logResponse(responseData, addr)
+			}
+			return responseData
+		}
+	}
+
+	var response *dns.Msg
+	var source string
+	if t != nil {
+		response, source = t.resolve(ctx, req)
+	} else {
+		response, source = s.resolve(ctx, req, s.clientRecords(addr.IP), addr.IP)
+	}
+	if response.Rcode == dns.RcodeServerFailure {
+		s.stats.servfail.Add(1)
+	}
+	client := s.clientLabel(addr.IP)
+	s.recordQuery(client, q, response.Rcode, source, started)
+	s.aggregateQuery(client, q, response.Rcode)
+	// Upstream and cached answers have theirs from relayEDNS.
+	s.echoEDNS(req, response)
+	if _, udp := w.LocalAddr().(*net.UDPAddr); udp {
+		// Truncate compresses names only when the response would not fit
+		// the client's buffer otherwise.
+		response.Truncate(s.udpResponseSize(req))
+	} else {
+		response.Compress = true
+	}
+
+	packed := response
+	if pad {
+		packed = padMsg(response, responsePaddingBlock)
+	}
+	responseData, err := packResponse(packed)
+	// Cached and upstream answers are not built for this query alone.
+	if source != "cache" && source != "upstream" {
+		releaseMsg(response)
+	}
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error packing DNS response: %v", err))
+		return nil
+	}
+
+	if sampled {
+		s.logResponse(responseData, addr)
+	}
+	return responseData
+}
+
+// resolve answers a standard query from the records, the zones or the
+// upstreams, running the hook scripts around the lookup. It also returns
+// where the answer came from, for the query log.
+func (s *Server) resolve(ctx context.Context, req *dns.Msg, records map[string]string, clientIP net.IP) (*dns.Msg, string) {
+	q := req.Question[0]
+	var response *dns.Msg
+	var source string
+	if s.hooks.onQuery != nil {
+		call := s.runHook(s.hooks.onQuery, q, clientIP, nil)
+		if call.answered() {
+			response, source = call.reply(req), "hook"
+		} else if call.rewrite != "" {
+			response, source = s.resolveRewritten(ctx, req, call.rewrite, records, clientIP, true)
+		}
+	}
+	if response == nil && len(s.plugins) > 0 {
+		if response = s.runPlugins(req, nil, clientIP); response != nil {
+			source = "plugin"
+		}
+	}
+	if response == nil {
+		response, source = s.lookup(ctx, req, records, clientIP, true)
+	}
+	if s.hooks.onResponse != nil {
+		if call := s.runHook(s.hooks.onResponse, q, clientIP, response); call.answered() {
+			call.apply(q, response)
+		}
+	}
+	if len(s.plugins) > 0 {
+		if replaced := s.runPlugins(req, response, clientIP); replaced != nil {
+			response = replaced
+		}
+	}
+	return response, source
+}
+
+// lookup answers a standard query from the records, the zones or the
+// upstreams, running the on_local_miss hook before forwarding if hooked.
+func (s *Server) lookup(ctx context.Context, req *dns.Msg, records map[string]string, clientIP net.IP, hooked bool) (*dns.Msg, string) {
+	q := req.Question[0]
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if s.cfg.Authoritative && !s.inLocalZone(host) && !s.inSecondaryZone(host) {
+		// Only the zones are served; nothing is resolved elsewhere.
+		response := newReply(req)
+		response.Rcode = dns.RcodeRefused
+		s.setExtendedError(req, response, dns.ExtendedErrorCodeNotAuthoritative, "")
+		return response, "refused"
+	}
+	if _, local := records[host]; len(s.cfg.SearchDomains) > 0 && !local && host != "" && !strings.Contains(host, ".") {
+		if response, source, ok := s.resolveSearch(ctx, req, host, records, clientIP, hooked); ok {
+			return response, source
+		}
+	}
+
+	response := newReply(req)
+	response.Authoritative = true
+
+	source := "local"
+	ip, found := s.failoverAddress(host)
+	if !found {
+		ip, found = records[host]
+	}
+	if found {
+		// A record may hold different addresses for different client subnets.
+		ip = s.selectRecord(ip, clientIP, geoClient(req, clientIP))
+		found = ip != ""
+	}
+	if isTransfer(q.Qtype) {
+		// Zone transfers are only served over TCP, by serveTransfer.
+		response.Rcode = dns.RcodeRefused
+	} else if found {
+		s.answerAddress(q, ip, response)
+	} else if typed := s.typedRecords(); typed[host] != nil {
+		s.answerTyped(q, host, typed, response)
+	} else if name, ok := s.leaseHost(host); ok && q.Qtype == dns.TypePTR {
+		s.stats.localAnswers.Add(1)
+		response.Answer = append(response.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: s.cfg.LocalTTL},
+			Ptr: dns.Fqdn(name),
+		})
+	} else if services, ok := s.serviceRecords[host]; ok {
+		s.answerService(q, services, records, response)
+	} else if zone := findZone(s.currentZones(), host); zone != nil {
+		zone.answer(q, response)
+		if response.Rcode == dns.RcodeSuccess {
+			s.stats.localAnswers.Add(1)
+		}
+	} else if hosts := s.reverseHosts(host); hosts != nil && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) {
+		s.stats.localAnswers.Add(1)
+		for _, name := range hosts {
+			response.Answer = append(response.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: s.cfg.LocalTTL},
+				Ptr: dns.Fqdn(name),
+			})
+		}
+	} else if zone := s.specialUseZone(host); zone != "" {
+		s.answerSpecialUse(q, host, zone, response)
+	} else if s.inSecondaryZone(host) {
+		response.Rcode = dns.RcodeServerFailure
+		s.setExtendedError(req, response, dns.ExtendedErrorCodeNotReady, "zone not transferred")
+	} else if s.inLocalZone(host) {
+		response.Rcode = dns.RcodeNameError
+	} else if rule, list, ok := s.blockingRule(host); ok {
+		s.answerBlocked(q, response)
+		s.setExtendedError(req, response, dns.ExtendedErrorCodeBlocked, "blocked by "+list)
+		source = "blocked"
+		if clientIP != nil {
+			s.recordBlockHit(s.clientLabel(clientIP), q, rule, list)
+		}
+	} else if s.cfg.MDNS.Bridge && isMDNSName(host) {
+		releaseMsg(response)
+		response, source = s.bridgeMDNS(ctx, req), "mdns"
+	} else {
+		releaseMsg(response)
+		if hooked && s.hooks.onLocalMiss != nil {
+			call := s.runHook(s.hooks.onLocalMiss, q, clientIP, nil)
+			if call.answered() {
+				return call.reply(req), "hook"
+			}
+			if call.rewrite != "" {
+				return s.resolveRewritten(ctx, req, call.rewrite, records, clientIP, false)
+			}
+		}
+		if name, ok := s.rewriteName(host); ok {
+			return s.resolveRewritten(ctx, req, name, records, clientIP, hooked)
+		}
+		if s.rootZoneAnswers(host) {
+			response = newReply(req)
+			response.Authoritative = true
+			s.answerRootZone(q, host, response)
+			return response, "root_zone"
+		}
+		response, source = s.forwardQuery(ctx, req)
+		s.rewriteAnswer(response)
+	}
+	return response, source
+}
+
+// resolveSearch resolves a single-label name in the search domains, in
+// order, and answers with the first that has an answer for it. It reports
+// false when none has.
+func (s *Server) resolveSearch(ctx context.Context, req *dns.Msg, host string, records map[string]string, clientIP net.IP, hooked bool) (*dns.Msg, string, bool) {
+	for _, domain := range s.cfg.SearchDomains {
+		response, source := s.resolveRewritten(ctx, req, host+"."+domain, records, clientIP, hooked)
+		if response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0 {
+			return response, source, true
+		}
+		if source != "cache" && source != "upstream" {
+			releaseMsg(response)
+		}
+	}
+	return nil, "", false
+}
+
+// answerAddress answers q with the address of a local record. Queries for
+// another type, including the other address family, get an empty answer.
+func (s *Server) answerAddress(q dns.Question, ip string, response *dns.Msg) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		s.logMessage(fmt.Sprintf("Invalid IP in hosts file: %s", ip))
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+	s.stats.localAnswers.Add(1)
+	if rr := addressRecord(q.Name, parsedIP, s.cfg.LocalTTL); rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+		response.Answer = append(response.Answer, rr)
+	}
+}
+
+// typedRecords returns the live typed records of v2 hosts files.
+func (s *Server) typedRecords() map[string][]dns.RR {
+	if set := s.liveRecords.Load(); set != nil && set.typed != nil {
+		return set.typed.rrs
+	}
+	return nil
+}
+
+// answerTyped answers q for host from the typed records, following CNAMEs
+// between them. A host without records of the type gets an empty answer.
+func (s *Server) answerTyped(q dns.Question, host string, typed map[string][]dns.RR, response *dns.Msg) {
+	s.stats.localAnswers.Add(1)
+	owner := q.Name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		var cname *dns.CNAME
+		matched := false
+		for _, rr := range typed[host] {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				response.Answer = append(response.Answer, withOwner(rr, owner))
+				matched = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if matched || cname == nil {
+			return
+		}
+		response.Answer = append(response.Answer, withOwner(cname, owner))
+		owner = cname.Target
+		host = strings.ToLower(strings.TrimSuffix(cname.Target, "."))
+	}
+}
+
+// addressRecord returns the A record of an IPv4 address or the AAAA
+// record of an IPv6 one.
+func addressRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeA,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{Hdr: hdr, A: ip4}
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+// forwardQuery asks the upstreams the question of req, unless the cache
+// has their answer. It also returns where the answer came from, "upstream"
+// or "cache". It answers SERVFAIL once ctx is done.
+func (s *Server) forwardQuery(ctx context.Context, req *dns.Msg) (*dns.Msg, string) {
+	q := req.Question[0]
+	fallbackMsg := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Id: req.Id, RecursionDesired: true},
+		Question: []dns.Question{
+			{Name: q.Name, Qtype: q.Qtype, Qclass: q.Qclass},
+		},
+	}
+	// With EDNS the upstreams can explain their failures.
+	fallbackMsg.SetEdns0(1232, false)
+	setQueryDNSSEC(req, fallbackMsg)
+	if s.cache != nil {
+		if cached := s.cache.get(fallbackMsg); cached != nil {
+			cached.Id = req.Id
+			setAnswerDNSSEC(req, cached)
+			s.relayEDNS(req, cached)
+			return cached, "cache"
+		}
+	}
+	s.stats.forwarded.Add(1)
+	// Concurrent misses for the same question share one upstream query.
+	// The first of them asks with its own deadline; each waits for the
+	// answer no longer than its deadline allows.
+	key, asked := newCacheKey(fallbackMsg), false
+	answer := s.inflight.DoChan(fmt.Sprintf("%s/%d/%d/%t/%t", key.name, key.qtype, key.qclass, key.do, key.cd), func() (any, error) {
+		asked = true
+		result, err := s.exchangeUpstream(ctx, fallbackMsg)
+		if err == nil && s.cache != nil {
+			s.cache.set(fallbackMsg, result)
+		}
+		return result, err
+	})
+	var v any
+	var err error
+	var shared bool
+	select {
+	case r := <-answer:
+		v, err, shared = r.Val, r.Err, r.Shared
+		if !asked {
+			s.stats.coalesced.Add(1)
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil && ctx.Err() != nil {
+		s.stats.deadlineExceeded.Add(1)
+	}
+	if err != nil {
+		response := new(dns.Msg)
+		response.SetReply(req)
+		response.Rcode = dns.RcodeServerFailure
+		s.setExtendedError(req, response, upstreamErrorCode(err), err.Error())
+		return response, "upstream"
+	}
+	result := v.(*dns.Msg)
+	if shared {
+		// Every query sharing the answer gets its own copy, with its ID
+		// and the name as it spelled it.
+		result = result.Copy()
+		result.Id = req.Id
+		setQuestion(result, fallbackMsg.Question[0])
+	}
+	setAnswerDNSSEC(req, result)
+	s.relayEDNS(req, result)
+	return result, "upstream"
+}
+
+// Main runs the godns command: a subcommand when args starts with one,
+// otherwise the DNS server until SIGINT or SIGTERM, or until a process
+// started on SIGUSR2 has taken over. args excludes the
+// program name. It returns the exit status.
+func Main(args []string) int {
+	if len(args) > 0 {
+		if cmd, ok := subcommands[args[0]]; ok {
+			return cmd(args[1:])
+		}
+	}
+
+	if status, ok := runAsService(args); ok {
+		return status
+	}
+
+	server, status := startServer(args, os.Stdout)
+	if server == nil {
+		return status
+	}
+	go server.dumpStatsOnSignal()
+	go server.reloadOnSignal()
+	upgraded := server.upgradeOnSignal()
+
+	// With WatchdogSec= systemd restarts godns unless it hears from it
+	// within the interval; the serve loop checks the workers twice per
+	// interval.
+	var watchdog <-chan time.Time
+	interval := watchdogInterval()
+	if interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case <-sigChan:
+			server.sdNotify("STOPPING=1")
+			return server.shutdown()
+		case <-upgraded:
+			return server.shutdown()
+		case <-watchdog:
+			server.petWatchdog(interval / 4)
+		}
+	}
+}
+
+// startServer parses the server flags in args, loads the configuration
+// and starts the server, printing errors, usage and, unless a log file or
+// syslog is configured, the log to out. If the process
+// should exit instead it returns nil and the exit status.
+func startServer(args []string, out io.Writer) (*Server, int) {
+	cfg := DefaultConfig()
+	flags := flag.NewFlagSet("godns", flag.ContinueOnError)
+	flags.SetOutput(out)
+	showVersion := flags.Bool("version", false, "Print version information")
+	configPath := flags.String("config", os.Getenv(envPrefix+"_CONFIG"), "Path to a YAML configuration file (env GODNS_CONFIG)")
+	cfg.registerFlags(flags)
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil, 0
+	} else if err != nil {
+		return nil, 2
+	}
+	if *showVersion {
+		fmt.Fprintf(out, "godns v%s\n", version)
+		return nil, 0
+	}
+
+	if err := loadConfig(cfg, flags, *configPath); err != nil {
+		fmt.Fprintln(out, "Error loading configuration:", err)
+		return nil, 1
+	}
+	server, err := New(cfg)
+	if err != nil {
+		fmt.Fprintln(out, "Error in configuration:", err)
+		return nil, 1
+	}
+	server.logger.SetOutput(out)
+	if cfg.Daemon && !daemonized() {
+		if err := server.daemonize(); err != nil {
+			fmt.Fprintln(out, "Error starting daemon:", err)
+			return nil, 1
+		}
+		return nil, 0
+	}
+	if err := server.Start(); err != nil {
+		fmt.Fprintln(out, "Error", err)
+		return nil, 1
+	}
+	if cfg.PIDFile != "" {
+		if err := writePIDFile(cfg.PIDFile); err != nil {
+			fmt.Fprintln(out, "Error writing PID file:", err)
+			server.Stop()
+			return nil, 1
+		}
+	}
+	if cfg.User != "" {
+		var owned []string
+		if cfg.PIDFile != "" {
+			owned = append(owned, cfg.PIDFile)
+		}
+		if err := dropPrivileges(cfg.User, owned...); err != nil {
+			fmt.Fprintf(out, "Error switching to user %s: %v\n", cfg.User, err)
+			server.Stop()
+			return nil, 1
+		}
+	}
+	notifyReady()
+	server.sdNotify("READY=1")
+	return server, 0
+}
+
+// shutdown stops s within the configured shutdown timeout and returns the
+// exit status.
+func (s *Server) shutdown() int {
+	s.logMessage("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		s.logger.Printf("Shutdown incomplete after %s: %v", s.cfg.ShutdownTimeout, err)
+		return 1
+	}
+	if s.cfg.PIDFile != "" {
+		removePIDFile(s.cfg.PIDFile)
+	}
+	return 0
+}
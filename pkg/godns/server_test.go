@@ -0,0 +1,85 @@
+package godns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestServer returns an unstarted Server with the default
+// configuration, which does not log queries.
+func newTestServer() *Server {
+	s := newServer(DefaultConfig())
+	s.cfg.Logging.QuerySample = 0
+	return s
+}
+
+// benchWriter is the UDP ResponseWriter of the benchmarks, which only
+// need its addresses.
+type benchWriter struct{ dns.ResponseWriter }
+
+func (benchWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (benchWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+// benchUpstream answers every query with an A record.
+type benchUpstream struct{}
+
+func (benchUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 80),
+	})
+	return r, nil
+}
+
+// BenchmarkHandleRequest measures the time and allocations of answering
+// a UDP query on each path: a plain local record from its packed answer,
+// a local name on the full path, and a forwarded name from the upstream
+// and from the cache.
+func BenchmarkHandleRequest(b *testing.B) {
+	s := newTestServer()
+	s.forwarder = benchUpstream{}
+	s.setRecords(map[string]string{"nas.lan": "192.168.1.10"}, nil, nil)
+
+	for _, bench := range []struct {
+		name  string
+		qname string
+		qtype uint16
+		cache bool
+	}{
+		{"local/packed", "nas.lan.", dns.TypeA, false},
+		{"local/full", "nas.lan.", dns.TypeAAAA, false},
+		{"forwarded", "www.example.com.", dns.TypeA, false},
+		{"forwarded/cached", "www.example.com.", dns.TypeA, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			s.cache = nil
+			if bench.cache {
+				s.cache = s.newResponseCache(1000)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(bench.qname, bench.qtype)
+			w := benchWriter{}
+			addr := w.RemoteAddr().(*net.UDPAddr)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				response := s.handleRequest(ctx, w, req, nil, addr)
+				if response == nil {
+					b.Fatal("no response")
+				}
+				putBuffer(response)
+			}
+		})
+	}
+}
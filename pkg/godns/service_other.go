@@ -0,0 +1,19 @@
+//go:build !windows
+
+package godns
+
+import (
+	"fmt"
+	"os"
+)
+
+// runAsService reports false: only Windows runs godns as a service.
+// Elsewhere the init system runs the godns command itself.
+func runAsService(args []string) (int, bool) {
+	return 0, false
+}
+
+func serviceCommand(args []string) int {
+	fmt.Fprintln(os.Stderr, "Error: godns service is only supported on Windows")
+	return 1
+}
@@ -0,0 +1,211 @@
+package godns
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the Windows service and of its event log
+// source.
+const serviceName = "godns"
+
+const serviceUsage = `Usage: godns service <command> [server flags]
+
+Commands:
+  install     Register godns as a Windows service started at boot
+  uninstall   Remove the service
+  start       Start the service
+  stop        Stop the service
+
+install passes the server flags that follow it to the service, e.g.
+
+  godns service install -config C:\godns\godns.yaml
+
+Use absolute paths: services run in the system directory. The service logs
+to the Windows event log under the source "godns". Managing services needs
+an elevated prompt.
+`
+
+// runAsService runs the server under the service control manager if the
+// process was started by it, and reports whether it was.
+func runAsService(args []string) (int, bool) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return 0, false
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return 1, true
+	}
+	defer elog.Close()
+	s := &windowsService{args: args, out: eventLogWriter{elog}}
+	if err := svc.Run(serviceName, s); err != nil {
+		elog.Error(1, fmt.Sprintf("Error running service: %v", err))
+		return 1, true
+	}
+	return s.status, true
+}
+
+// windowsService is the svc.Handler of the godns service.
+type windowsService struct {
+	args   []string
+	out    eventLogWriter
+	status int
+}
+
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	server, status := startServer(s.args, s.out)
+	if server == nil {
+		s.status = status
+		return true, uint32(status)
+	}
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			changes <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((server.cfg.ShutdownTimeout + time.Second) / time.Millisecond)}
+			s.status = server.shutdown()
+			return s.status != 0, uint32(s.status)
+		}
+	}
+	return false, 0
+}
+
+// eventLogWriter writes each log message as an event, as an error if it
+// starts with "Error".
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	var err error
+	if strings.HasPrefix(msg, "Error") {
+		err = w.elog.Error(1, msg)
+	} else {
+		err = w.elog.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func serviceCommand(args []string) int {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), serviceUsage) }
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = withService(func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = withService(stopService)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func installService(serverArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "godns",
+		Description: "godns DNS server",
+		StartType:   mgr.StartAutomatic,
+	}, serverArgs...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %v", err)
+	}
+	fmt.Printf("Installed service %s: %s %s\n", serviceName, exe, strings.Join(serverArgs, " "))
+	return nil
+}
+
+func uninstallService() error {
+	if err := withService(func(s *mgr.Service) error { return s.Delete() }); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(serviceName); err != nil {
+		return fmt.Errorf("removing event log source: %v", err)
+	}
+	return nil
+}
+
+// stopService asks the service to stop and waits until it has.
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Minute)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s did not stop within a minute", serviceName)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withService runs f with the installed godns service.
+func withService(f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %v", serviceName, err)
+	}
+	defer s.Close()
+	return f(s)
+}
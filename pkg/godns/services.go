@@ -0,0 +1,118 @@
+package godns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// buildServiceRecords generates the records wide-area DNS-SD browsing
+// reads (RFC 6763): for every domain the browsing domain pointers and the
+// service type enumeration, for every type a PTR to each instance, and
+// for every instance its SRV and TXT records.
+func (s *Server) buildServiceRecords(services []ServiceConfig) map[string][]dns.RR {
+	if len(services) == 0 {
+		return nil
+	}
+	records := make(map[string][]dns.RR)
+	add := func(rr dns.RR) {
+		owner := strings.ToLower(strings.TrimSuffix(rr.Header().Name, "."))
+		for _, existing := range records[owner] {
+			if dns.IsDuplicate(existing, rr) {
+				return
+			}
+		}
+		records[owner] = append(records[owner], rr)
+	}
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype, Class: dns.ClassINET, Ttl: s.cfg.LocalTTL}
+	}
+
+	for _, svc := range services {
+		domain := svc.Domain + "."
+		for _, browse := range []string{"b", "lb"} {
+			add(&dns.PTR{Hdr: hdr(browse+"._dns-sd._udp."+domain, dns.TypePTR), Ptr: domain})
+		}
+		serviceType := svc.Type + "." + domain
+		add(&dns.PTR{Hdr: hdr("_services._dns-sd._udp."+domain, dns.TypePTR), Ptr: serviceType})
+
+		instance := escapeLabel(svc.Name) + "." + serviceType
+		add(&dns.PTR{Hdr: hdr(serviceType, dns.TypePTR), Ptr: instance})
+		add(&dns.SRV{
+			Hdr:      hdr(instance, dns.TypeSRV),
+			Priority: svc.Priority,
+			Weight:   svc.Weight,
+			Port:     svc.Port,
+			Target:   dns.Fqdn(svc.Host),
+		})
+		// Every instance has a TXT record, a single empty string when it
+		// has no attributes.
+		txt := svc.TXT
+		if len(txt) == 0 {
+			txt = []string{""}
+		}
+		add(&dns.TXT{Hdr: hdr(instance, dns.TypeTXT), Txt: txt})
+	}
+	return records
+}
+
+// escapeLabel escapes an instance name for use as a single label in the
+// presentation format the dns package uses for names.
+func escapeLabel(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case strings.IndexByte(`. ()";@$\`, c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			b.WriteByte('\\')
+			b.WriteByte('0' + c/100)
+			b.WriteByte('0' + c/10%10)
+			b.WriteByte('0' + c%10)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// answerService answers q from the DNS-SD records rrs of its name, with the
+// records a browser looks up next in the additional section: the SRV and
+// TXT records of instances and the addresses of their targets.
+func (s *Server) answerService(q dns.Question, rrs []dns.RR, records map[string]string, response *dns.Msg) {
+	s.stats.localAnswers.Add(1)
+	for _, rr := range rrs {
+		if q.Qtype != dns.TypeANY && rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		answer := dns.Copy(rr)
+		answer.Header().Name = q.Name
+		response.Answer = append(response.Answer, answer)
+
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			for _, extra := range s.serviceRecords[strings.ToLower(strings.TrimSuffix(rr.Ptr, "."))] {
+				if extra.Header().Rrtype == dns.TypeSRV || extra.Header().Rrtype == dns.TypeTXT {
+					response.Extra = append(response.Extra, extra)
+					if srv, ok := extra.(*dns.SRV); ok {
+						response.Extra = s.appendTargetAddress(response.Extra, srv.Target, records)
+					}
+				}
+			}
+		case *dns.SRV:
+			response.Extra = s.appendTargetAddress(response.Extra, rr.Target, records)
+		}
+	}
+}
+
+// appendTargetAddress appends the address record of an SRV target that is
+// a plain local record.
+func (s *Server) appendTargetAddress(extra []dns.RR, target string, records map[string]string) []dns.RR {
+	if ip := net.ParseIP(records[strings.ToLower(strings.TrimSuffix(target, "."))]); ip != nil {
+		extra = append(extra, addressRecord(target, ip, s.cfg.LocalTTL))
+	}
+	return extra
+}
@@ -0,0 +1,50 @@
+package godns
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// shardingSupported tells whether the kernel balances the datagrams of a
+// port across several sockets, which sharding relies on.
+const shardingSupported = true
+
+// listenUDPShards binds n UDP sockets to addr. With more than one, they
+// share the address with SO_REUSEPORT and the kernel spreads the clients
+// across them by a hash of their address. For port 0 the first socket
+// gets a port from the system and the others join it.
+func listenUDPShards(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	if n == 1 {
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	conns := make([]*net.UDPConn, 0, n)
+	for len(conns) < n {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		conns = append(conns, conn)
+		addr = &net.UDPAddr{IP: addr.IP, Port: conn.LocalAddr().(*net.UDPAddr).Port, Zone: addr.Zone}
+	}
+	return conns, nil
+}
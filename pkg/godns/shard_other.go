@@ -0,0 +1,18 @@
+//go:build !linux
+
+package godns
+
+import "net"
+
+// shardingSupported tells whether the kernel balances the datagrams of a
+// port across several sockets, which sharding relies on.
+const shardingSupported = false
+
+// listenUDPShards binds a UDP socket to addr; only one shard is supported.
+func listenUDPShards(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{conn}, nil
+}
@@ -0,0 +1,90 @@
+package godns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// specialUseZones are the special-use domains answered locally instead of
+// being sent to public resolvers: localhost, invalid (RFC 6761), onion
+// (RFC 7686) and the reverse zones of private, loopback, link-local,
+// shared and documentation addresses (RFC 6303).
+var specialUseZones = func() map[string]bool {
+	zones := map[string]bool{
+		"localhost":                                  true,
+		"invalid":                                    true,
+		"onion":                                      true,
+		"10.in-addr.arpa":                            true,
+		"168.192.in-addr.arpa":                       true,
+		"0.in-addr.arpa":                             true,
+		"127.in-addr.arpa":                           true,
+		"254.169.in-addr.arpa":                       true,
+		"2.0.192.in-addr.arpa":                       true,
+		"100.51.198.in-addr.arpa":                    true,
+		"113.0.203.in-addr.arpa":                     true,
+		"255.255.255.255.in-addr.arpa":               true,
+		"d.f.ip6.arpa":                               true,
+		"8.e.f.ip6.arpa":                             true,
+		"9.e.f.ip6.arpa":                             true,
+		"a.e.f.ip6.arpa":                             true,
+		"b.e.f.ip6.arpa":                             true,
+		"8.b.d.0.1.0.0.2.ip6.arpa":                   true,
+		strings.Repeat("0.", 32) + "ip6.arpa":        true,
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa": true,
+	}
+	for i := 16; i <= 31; i++ {
+		zones[strconv.Itoa(i)+".172.in-addr.arpa"] = true
+	}
+	for i := 64; i <= 127; i++ {
+		zones[strconv.Itoa(i)+".100.in-addr.arpa"] = true
+	}
+	return zones
+}()
+
+// specialUseZone returns the special-use zone host falls in, or "" if
+// none does or special-use zones are off. Names in a forward zone are left
+// to it, e.g. a reverse zone forwarded to the router serving the LAN.
+func (s *Server) specialUseZone(host string) string {
+	if !s.cfg.SpecialUseZones {
+		return ""
+	}
+	for name := host; ; {
+		if specialUseZones[name] {
+			if s.inForwardZone(host) {
+				return ""
+			}
+			return name
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return ""
+		}
+		name = parent
+	}
+}
+
+// answerSpecialUse answers a query for a name in a special-use zone:
+// localhost and its subdomains with the loopback addresses, the loopback
+// addresses' reverse names with localhost, and everything else with
+// NXDOMAIN.
+func (s *Server) answerSpecialUse(q dns.Question, host, zone string, response *dns.Msg) {
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: s.cfg.LocalTTL}
+	switch {
+	case zone == "localhost":
+		switch q.Qtype {
+		case dns.TypeA:
+			response.Answer = append(response.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+		case dns.TypeAAAA:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		}
+	case host == "1.0.0.127.in-addr.arpa" || host == "1."+strings.Repeat("0.", 31)+"ip6.arpa":
+		if q.Qtype == dns.TypePTR {
+			response.Answer = append(response.Answer, &dns.PTR{Hdr: hdr, Ptr: "localhost."})
+		}
+	default:
+		response.Rcode = dns.RcodeNameError
+	}
+}
@@ -0,0 +1,104 @@
+package godns
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// statsCounters returns the query counters by StatsD name.
+func (s *Server) statsCounters() map[string]uint64 {
+	hits, misses := s.cache.counters()
+	refused, reclaimed := s.budget.counters()
+	return map[string]uint64{
+		"queries.total":             s.stats.queries.Load(),
+		"queries.malformed":         s.stats.malformed.Load(),
+		"queries.local":             s.stats.localAnswers.Load(),
+		"queries.forwarded":         s.stats.forwarded.Load(),
+		"queries.overloaded":        s.stats.overloaded.Load(),
+		"queries.shed":              s.stats.shed.Load(),
+		"queries.blocked":           s.stats.blocked.Load(),
+		"queries.deadline_exceeded": s.stats.deadlineExceeded.Load(),
+		"queries.panics":            s.stats.panics.Load(),
+		"responses.servfail":        s.stats.servfail.Load(),
+		"responses.send_errors":     s.stats.sendErrors.Load(),
+		"responses.rewritten":       s.stats.rewritten.Load(),
+		"upstream.errors":           s.stats.upstreamErrors.Load(),
+		"upstream.coalesced":        s.stats.coalesced.Load(),
+		"recursor.queries":          s.stats.recursiveQueries.Load(),
+		"queries.root_zone":         s.stats.rootZone.Load(),
+		"logs.dropped":              s.stats.logsDropped.Load(),
+		"cache.hits":                hits,
+		"cache.misses":              misses,
+		"memory.refused":            refused,
+		"memory.reclaimed":          reclaimed,
+	}
+}
+
+// statsSnapshot renders the current counters as key=value lines in the
+// style of unbound-control stats.
+func (s *Server) statsSnapshot() string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "time.up=%.3f\n", time.Since(s.startTime).Seconds())
+	fmt.Fprintf(&b, "queries.total=%d\n", s.stats.queries.Load())
+	fmt.Fprintf(&b, "queries.malformed=%d\n", s.stats.malformed.Load())
+	fmt.Fprintf(&b, "queries.local=%d\n", s.stats.localAnswers.Load())
+	fmt.Fprintf(&b, "queries.forwarded=%d\n", s.stats.forwarded.Load())
+	fmt.Fprintf(&b, "upstream.coalesced=%d\n", s.stats.coalesced.Load())
+	fmt.Fprintf(&b, "queries.overloaded=%d\n", s.stats.overloaded.Load())
+	fmt.Fprintf(&b, "queries.shed=%d\n", s.stats.shed.Load())
+	fmt.Fprintf(&b, "queries.blocked=%d\n", s.stats.blocked.Load())
+	fmt.Fprintf(&b, "queries.deadline_exceeded=%d\n", s.stats.deadlineExceeded.Load())
+	fmt.Fprintf(&b, "queries.panics=%d\n", s.stats.panics.Load())
+	fmt.Fprintf(&b, "responses.servfail=%d\n", s.stats.servfail.Load())
+	fmt.Fprintf(&b, "responses.send_errors=%d\n", s.stats.sendErrors.Load())
+	fmt.Fprintf(&b, "responses.rewritten=%d\n", s.stats.rewritten.Load())
+	fmt.Fprintf(&b, "logs.dropped=%d\n", s.stats.logsDropped.Load())
+	if s.cache != nil {
+		fmt.Fprintf(&b, "cache.entries=%d\n", s.cache.len())
+		hits, misses := s.cache.counters()
+		fmt.Fprintf(&b, "cache.hits=%d\n", hits)
+		fmt.Fprintf(&b, "cache.misses=%d\n", misses)
+	}
+	if s.budget != nil {
+		b.WriteString(s.budget.snapshot())
+	}
+	for _, u := range s.upstreams {
+		healthy := 0
+		if u.healthy.Load() {
+			healthy = 1
+		}
+		fmt.Fprintf(&b, "upstream.%s.healthy=%d\n", u.addr, healthy)
+		fmt.Fprintf(&b, "upstream.%s.errors=%d\n", u.addr, u.errors.Load())
+	}
+	b.WriteString(s.upstreamLatencyStats())
+	if r, ok := s.forwarder.(*recursor); ok {
+		b.WriteString(r.snapshot())
+	}
+	b.WriteString(s.rootZoneStats())
+	b.WriteString(s.failoverStats())
+	for _, t := range s.tenants {
+		b.WriteString(t.statsSnapshot() + "\n")
+	}
+	fmt.Fprintf(&b, "runtime.goroutines=%d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&b, "mem.heap_alloc=%d\n", mem.HeapAlloc)
+	fmt.Fprintf(&b, "mem.heap_inuse=%d\n", mem.HeapInuse)
+	fmt.Fprintf(&b, "mem.sys=%d\n", mem.Sys)
+	fmt.Fprintf(&b, "mem.gc_cycles=%d", mem.NumGC)
+	return b.String()
+}
+
+func init() {
+	handleAdmin("/stats", func(s *Server) http.HandlerFunc { return s.requireTokenIfSet(s.statsHandler) })
+}
+
+// statsHandler serves the snapshot SIGUSR1 logs.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, s.statsSnapshot())
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package godns
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpStatsOnSignal logs a stats snapshot every time SIGUSR1 is received.
+func (s *Server) dumpStatsOnSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	for range sigChan {
+		s.logMessage("STATS:\n" + s.statsSnapshot())
+	}
+}
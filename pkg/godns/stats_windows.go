@@ -0,0 +1,5 @@
+package godns
+
+// dumpStatsOnSignal does nothing: Windows has no SIGUSR1. The admin
+// endpoint /stats serves the same snapshot.
+func (s *Server) dumpStatsOnSignal() {}
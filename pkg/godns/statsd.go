@@ -0,0 +1,114 @@
+package godns
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsdMaxPacket  = 1432
+	statsdMaxTimings = 10000
+)
+
+// statsdClient pushes counters, gauges and timers to a StatsD endpoint over
+// UDP. Counters are sent as deltas since the previous flush; timer samples
+// are buffered between flushes.
+type statsdClient struct {
+	srv    *Server
+	conn   net.Conn
+	prefix string
+	tags   string
+
+	mu      sync.Mutex
+	last    map[string]uint64
+	timings []string
+}
+
+// newStatsdClient connects to addr. tags is an optional comma separated list
+// of DogStatsD tags (key:value) attached to every metric.
+func (s *Server) newStatsdClient(addr, prefix, tags string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &statsdClient{srv: s, conn: conn, prefix: prefix, last: make(map[string]uint64)}
+	if tags != "" {
+		c.tags = "|#" + tags
+	}
+	return c, nil
+}
+
+func statsdName(s string) string {
+	return strings.NewReplacer(".", "_", ":", "_").Replace(s)
+}
+
+func (s *Server) statsdTiming(name string, d time.Duration) {
+	if s.statsd == nil {
+		return
+	}
+	s.statsd.mu.Lock()
+	if len(s.statsd.timings) < statsdMaxTimings {
+		s.statsd.timings = append(s.statsd.timings, fmt.Sprintf("%s%s:%g|ms%s", s.statsd.prefix, name, float64(d.Microseconds())/1000, s.statsd.tags))
+	}
+	s.statsd.mu.Unlock()
+}
+
+func (c *statsdClient) run(interval time.Duration) {
+	for c.srv.sleep(interval) {
+		c.flush()
+	}
+}
+
+func (c *statsdClient) flush() {
+	counters := c.srv.statsCounters()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	healthy := 0
+	for _, u := range c.srv.upstreams {
+		if u.healthy.Load() {
+			healthy++
+		}
+	}
+
+	var lines []string
+	c.mu.Lock()
+	for name, value := range counters {
+		lines = append(lines, fmt.Sprintf("%s%s:%d|c%s", c.prefix, name, value-c.last[name], c.tags))
+		c.last[name] = value
+	}
+	lines = append(lines, c.timings...)
+	c.timings = c.timings[:0]
+	c.mu.Unlock()
+
+	lines = append(lines,
+		fmt.Sprintf("%supstream.healthy:%d|g%s", c.prefix, healthy, c.tags),
+		fmt.Sprintf("%sruntime.goroutines:%d|g%s", c.prefix, runtime.NumGoroutine(), c.tags),
+		fmt.Sprintf("%smem.heap_alloc:%d|g%s", c.prefix, mem.HeapAlloc, c.tags),
+	)
+
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			c.send(packet.String())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		c.send(packet.String())
+	}
+}
+
+func (c *statsdClient) send(packet string) {
+	if _, err := c.conn.Write([]byte(packet)); err != nil {
+		c.srv.logMessage(fmt.Sprintf("Error sending StatsD metrics: %v", err))
+	}
+}
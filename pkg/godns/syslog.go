@@ -0,0 +1,138 @@
+package godns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const (
+	syslogSeverityErr  = 3
+	syslogSeverityInfo = 6
+)
+
+// syslogWriter sends every Write as a single RFC 5424 message. Stream
+// transports (tcp, tls) use octet-counting framing and reconnect on error.
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	facility int
+	hostname string
+	appName  string
+	conn     net.Conn
+}
+
+// newSyslogWriter parses target, which is either "local" for the local
+// syslog socket or a URL of the form udp://host:port, tcp://host:port or
+// tls://host:port.
+func newSyslogWriter(target, facility string) (*syslogWriter, error) {
+	w, err := parseSyslogTarget(target, facility)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// parseSyslogTarget sets up a writer for target without connecting it.
+func parseSyslogTarget(target, facility string) (*syslogWriter, error) {
+	fac, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	w := &syslogWriter{facility: fac, appName: filepath.Base(os.Args[0])}
+	if w.hostname, _ = os.Hostname(); w.hostname == "" {
+		w.hostname = "-"
+	}
+
+	if target == "local" {
+		w.network = "unixgram"
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if _, err := os.Stat(path); err == nil {
+				w.addr = path
+				break
+			}
+		}
+		if w.addr == "" {
+			return nil, fmt.Errorf("no local syslog socket found")
+		}
+	} else {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "udp", "tcp", "tls":
+		default:
+			return nil, fmt.Errorf("unsupported syslog transport %q", u.Scheme)
+		}
+		w.network, w.addr = u.Scheme, u.Host
+		if u.Port() == "" {
+			port := "514"
+			if u.Scheme == "tls" {
+				port = "6514"
+			}
+			w.addr = net.JoinHostPort(u.Hostname(), port)
+		}
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	var err error
+	switch w.network {
+	case "tls":
+		w.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", w.addr, nil)
+	default:
+		w.conn, err = net.DialTimeout(w.network, w.addr, 5*time.Second)
+	}
+	return err
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	severity := syslogSeverityInfo
+	if strings.HasPrefix(msg, "Error") {
+		severity = syslogSeverityErr
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+severity,
+		time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"),
+		w.hostname, w.appName, os.Getpid(), msg)
+	if w.network == "tcp" || w.network == "tls" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err := w.connect(); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := w.conn.Write([]byte(line)); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return 0, fmt.Errorf("syslog write to %s failed", w.addr)
+}
@@ -0,0 +1,87 @@
+package godns
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// sdNotify sends state, e.g. "READY=1", to the service manager that
+// started godns, as sd_notify(3) does. Without NOTIFY_SOCKET, outside
+// systemd services of Type=notify, it does nothing.
+func (s *Server) sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		s.logMessage("Error notifying systemd: " + err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		s.logMessage("Error notifying systemd: " + err.Error())
+	}
+}
+
+// watchdogInterval returns the watchdog interval systemd set with
+// WatchdogSec=, or 0 when the watchdog is off or meant for another process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// petWatchdog tells systemd the server is alive, if a probe passes through
+// the worker pool of every shard within timeout. When workers are stuck
+// the watchdog is left to expire and systemd restarts godns.
+func (s *Server) petWatchdog(timeout time.Duration) {
+	var stuck atomic.Bool
+	var wg sync.WaitGroup
+	for _, pool := range s.pools {
+		wg.Add(1)
+		go func(pool *queryPool) {
+			defer wg.Done()
+			if !pool.probe(timeout) {
+				stuck.Store(true)
+			}
+		}(pool)
+	}
+	wg.Wait()
+	if !stuck.Load() {
+		s.sdNotify("WATCHDOG=1")
+	} else {
+		s.logMessage("Error: the query workers did not respond; not petting the systemd watchdog")
+	}
+}
+
+// probe queues a job that does nothing and reports whether a worker ran
+// it within timeout.
+func (p *queryPool) probe(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	job := queryJob{handler: dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {}), ctx: context.Background(), done: make(chan struct{})}
+	select {
+	case p.queue <- job:
+	case <-timer.C:
+		return false
+	}
+	select {
+	case <-job.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
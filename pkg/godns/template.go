@@ -0,0 +1,145 @@
+package godns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Record values in JSON hosts files and inline zone records may be
+// templates, so one file can be deployed to several sites unchanged:
+//
+//	${NAME}          the environment variable NAME
+//	${iface:eth0}    the IPv4 address of eth0, or its IPv6 address if it has none
+//	${iface6:eth0}   the IPv6 address of eth0
+//
+// Templates are expanded whenever the records are loaded. The expanded
+// value may also select an address by client subnet, e.g.
+// "10.1.0.0/16=10.1.0.5, 10.2.0.0/16=10.2.0.5, 192.0.2.10", which is
+// resolved per query: the first subnet containing the client wins and a
+// plain address is the fallback for everyone else.
+
+// expandRecord expands the ${...} references in value.
+func expandRecord(value string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", value)
+		}
+		expanded, err := expandReference(value[start+2 : start+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value[:start])
+		b.WriteString(expanded)
+		value = value[start+end+1:]
+	}
+}
+
+func expandReference(ref string) (string, error) {
+	kind, name, ok := strings.Cut(ref, ":")
+	if !ok {
+		value, set := os.LookupEnv(ref)
+		if !set {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return value, nil
+	}
+	if kind != "iface" && kind != "iface6" {
+		return "", fmt.Errorf("unknown template ${%s}", ref)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("${%s}: %v", ref, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("${%s}: %v", ref, err)
+	}
+	var ipv6 string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if kind == "iface" {
+				return ipNet.IP.String(), nil
+			}
+		} else if ipv6 == "" {
+			ipv6 = ipNet.IP.String()
+		}
+	}
+	if ipv6 == "" {
+		return "", fmt.Errorf("${%s}: interface %s has no usable address", ref, name)
+	}
+	return ipv6, nil
+}
+
+// selectRecord returns the address value holds for client: value itself
+// when it is a plain address, otherwise the address of the first selector
+// whose subnet contains client, or whose country or continent is where the
+// GeoIP database places located, or the fallback. It returns "" when no
+// selector applies and there is no fallback.
+func (s *Server) selectRecord(value string, client, located net.IP) string {
+	if !strings.Contains(value, "=") {
+		return value
+	}
+	fallback := ""
+	var country, continent string
+	geoLooked := false
+	for _, part := range strings.Split(value, ",") {
+		selector, ip, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			fallback = selector
+			continue
+		}
+		selector = strings.TrimSpace(selector)
+		if kind, code, ok := geoSelector(selector); ok {
+			if !geoLooked {
+				country, continent = s.geoLocation(located)
+				geoLooked = true
+			}
+			if (kind == "country" && code == country) || (kind == "continent" && code == continent) {
+				return strings.TrimSpace(ip)
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(selector); err == nil && network.Contains(client) {
+			return strings.TrimSpace(ip)
+		}
+	}
+	return fallback
+}
+
+// checkRecordValue reports what is wrong with an expanded record value, or
+// "" if it is an address or a valid list of subnet and location selectors.
+func checkRecordValue(value string) string {
+	if !strings.Contains(value, "=") {
+		if net.ParseIP(value) == nil {
+			return fmt.Sprintf("invalid IP address %q", value)
+		}
+		return ""
+	}
+	for _, part := range strings.Split(value, ",") {
+		subnet, ip, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			ip = subnet
+		} else if _, _, ok := geoSelector(strings.TrimSpace(subnet)); ok {
+			// A location, country:XX or continent:XX.
+		} else if _, _, err := net.ParseCIDR(strings.TrimSpace(subnet)); err != nil {
+			return fmt.Sprintf("invalid subnet or location %q", strings.TrimSpace(subnet))
+		}
+		if net.ParseIP(strings.TrimSpace(ip)) == nil {
+			return fmt.Sprintf("invalid IP address %q", strings.TrimSpace(ip))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,337 @@
+package godns
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// tenant serves its own zones on its own listeners. Its records are not
+// visible on other listeners, nor are the global records on its own:
+// names outside its zones are forwarded.
+type tenant struct {
+	srv *Server
+	TenantConfig
+
+	data atomic.Pointer[tenantData]
+
+	stats struct {
+		queries      atomic.Uint64
+		localAnswers atomic.Uint64
+		nxdomain     atomic.Uint64
+		forwarded    atomic.Uint64
+	}
+}
+
+func init() {
+	handleAdmin("/tenants/", func(s *Server) http.HandlerFunc { return s.tenantHandler })
+}
+
+// newTenants creates the configured tenants and loads their records.
+func (s *Server) newTenants() ([]*tenant, error) {
+	var loaded []*tenant
+	for _, tc := range s.cfg.Tenants {
+		t := &tenant{srv: s, TenantConfig: tc}
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, t)
+	}
+	return loaded, nil
+}
+
+func (s *Server) findTenant(name string) *tenant {
+	for _, t := range s.tenants {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// listenerTenant returns the tenant listening on addr, or nil for the
+// global listeners.
+func (s *Server) listenerTenant(addr net.Addr) *tenant {
+	bound, ok := addr.(*net.UDPAddr)
+	if !ok {
+		tcp, ok := addr.(*net.TCPAddr)
+		if !ok {
+			return nil
+		}
+		bound = &net.UDPAddr{IP: tcp.IP, Port: tcp.Port}
+	}
+	for _, t := range s.tenants {
+		for _, listen := range t.Listen {
+			a, err := net.ResolveUDPAddr("udp", listen)
+			if err == nil && a.Port == bound.Port && (a.IP.Equal(bound.IP) || (a.IP == nil && bound.IP.IsUnspecified())) {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// owns reports whether host falls inside one of the tenant's zones.
+func (t *tenant) owns(host string) bool {
+	for _, zone := range t.Zones {
+		if host == zone.Name || strings.HasSuffix(host, "."+zone.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the tenant's hosts file, inline zone records and zone files
+// and replaces its records. If anything fails to load the previous records
+// stay in place.
+func (t *tenant) load() error {
+	records := make(map[string]string)
+	if t.HostsFile != "" {
+		hosts, err := hostsFile{t.srv, t.HostsFile}.Records()
+		if err != nil {
+			return fmt.Errorf("tenant %s: %v", t.Name, err)
+		}
+		for host, ip := range hosts {
+			if !t.owns(host) {
+				return fmt.Errorf("tenant %s: %s: %s is outside the tenant's zones", t.Name, t.HostsFile, host)
+			}
+			records[host] = ip
+		}
+	}
+	zones := make(map[string]*zoneData)
+	for _, zone := range t.Zones {
+		for name, value := range zone.Records {
+			ip, err := expandRecord(value)
+			if err != nil {
+				return fmt.Errorf("tenant %s: zone %s: record %s: %v", t.Name, zone.Name, name, err)
+			}
+			records[zoneRecordName(zone.Name, name)] = ip
+		}
+		if zone.File != "" {
+			z, err := loadZoneFile(zone.Name, zone.File)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %v", t.Name, err)
+			}
+			zones[zone.Name] = z
+		}
+	}
+
+	t.data.Store(&tenantData{records: records, zones: zones})
+	return nil
+}
+
+// reloadTenants reloads every tenant, keeping the previous records of
+// those that fail to load.
+func (s *Server) reloadTenants() {
+	for _, t := range s.tenants {
+		if err := t.load(); err != nil {
+			s.notify(eventHostsReloadFailed, fmt.Sprintf("reloading %v", err))
+		}
+	}
+}
+
+// tenantData is what a tenant loads from its hosts file and zone files,
+// swapped in as a whole on reloads.
+type tenantData struct {
+	records map[string]string
+	zones   map[string]*zoneData
+}
+
+func (t *tenant) current() (map[string]string, map[string]*zoneData) {
+	if d := t.data.Load(); d != nil {
+		return d.records, d.zones
+	}
+	return nil, nil
+}
+
+// resolve answers a standard query on the tenant's listeners.
+func (t *tenant) resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, string) {
+	t.stats.queries.Add(1)
+	q := req.Question[0]
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if !t.owns(host) {
+		t.stats.forwarded.Add(1)
+		return t.srv.forwardQuery(ctx, req)
+	}
+
+	response := newReply(req)
+	response.Authoritative = true
+	records, zones := t.current()
+	if ip, found := records[host]; isTransfer(q.Qtype) {
+		response.Rcode = dns.RcodeRefused
+	} else if found {
+		t.srv.answerAddress(q, ip, response)
+	} else if zone := findZone(zones, host); zone != nil {
+		zone.answer(q, response)
+	} else {
+		response.Rcode = dns.RcodeNameError
+	}
+	switch response.Rcode {
+	case dns.RcodeSuccess:
+		t.stats.localAnswers.Add(1)
+	case dns.RcodeNameError:
+		t.stats.nxdomain.Add(1)
+	}
+	return response, "local"
+}
+
+// refuseRequest answers the dynamic updates and NOTIFYs sent to a
+// tenant's listeners, whose zones are only changed through the API.
+func refuseRequest(req *dns.Msg, w dns.ResponseWriter, addr *net.UDPAddr) []byte {
+	response := new(dns.Msg)
+	response.SetRcode(req, dns.RcodeRefused)
+	data, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// statsSnapshot returns the tenant's counters in the format of the global
+// statsSnapshot.
+func (t *tenant) statsSnapshot() string {
+	prefix := "tenant." + t.Name + "."
+	return fmt.Sprintf("%squeries=%d\n%slocal_answers=%d\n%snxdomain=%d\n%sforwarded=%d",
+		prefix, t.stats.queries.Load(),
+		prefix, t.stats.localAnswers.Load(),
+		prefix, t.stats.nxdomain.Load(),
+		prefix, t.stats.forwarded.Load())
+}
+
+// tenantHandler serves a tenant's part of the admin API:
+//
+//	GET    /tenants/<name>/records
+//	GET    /tenants/<name>/records/<host>
+//	PUT    /tenants/<name>/records/<host>
+//	DELETE /tenants/<name>/records/<host>
+//	GET    /tenants/<name>/stats
+//
+// Requests carry the tenant's token, or the admin token, as a bearer
+// token. Changes are written to the tenant's hosts file.
+func (s *Server) tenantHandler(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tenants/"), "/")
+	t := s.findTenant(name)
+	if t == nil {
+		http.Error(w, "unknown tenant", http.StatusNotFound)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !tokenMatches(token, t.Token) && !tokenMatches(token, s.cfg.Admin.Token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="godns"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case rest == "stats":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, t.statsSnapshot())
+	case rest == "records":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		records, _ := t.current()
+		list := make([]Record, 0, len(records))
+		for host, ip := range records {
+			list = append(list, Record{Host: host, IP: ip})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+		writeJSON(w, http.StatusOK, list)
+	case strings.HasPrefix(rest, "records/"):
+		t.recordHandler(w, r, strings.TrimPrefix(rest, "records/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *tenant) recordHandler(w http.ResponseWriter, r *http.Request, name string) {
+	host, ok := normalizeRecordHost(name)
+	if !ok {
+		http.Error(w, "invalid host name", http.StatusBadRequest)
+		return
+	}
+	if !t.owns(host) {
+		http.Error(w, "host is outside the tenant's zones", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		records, _ := t.current()
+		ip, ok := records[host]
+		if !ok {
+			http.Error(w, "record not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, Record{Host: host, IP: ip})
+	case http.MethodPut:
+		var body Record
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if net.ParseIP(body.IP) == nil {
+			http.Error(w, "invalid IP address", http.StatusBadRequest)
+			return
+		}
+		if err := t.update(tenantActor(t, r), host, body.IP); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, Record{Host: host, IP: body.IP})
+	case http.MethodDelete:
+		if err := t.update(tenantActor(t, r), host, ""); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errRecordNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// update sets host to ip in the tenant's hosts file, or removes it when ip
+// is empty, and reloads the tenant.
+func (t *tenant) update(actor, host, ip string) error {
+	if t.HostsFile == "" {
+		return fmt.Errorf("tenant %s has no hosts file", t.Name)
+	}
+	t.srv.apiWriteMu.Lock()
+	defer t.srv.apiWriteMu.Unlock()
+	if err := editHostsFile(t.HostsFile, host, ip); err != nil {
+		return err
+	}
+	prev, _ := t.current()
+	if err := t.load(); err != nil {
+		return err
+	}
+	next, _ := t.current()
+	t.srv.auditRecordChanges(actor, prev, next)
+	return nil
+}
+
+func tenantActor(t *tenant, r *http.Request) string {
+	return "tenant:" + t.Name + ":" + r.RemoteAddr
+}
+
+// tokenMatches compares a request token with a configured one, which must
+// not be empty.
+func tokenMatches(token, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
@@ -0,0 +1,115 @@
+package godns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// transferMessageSize is the compressed size at which a zone transfer is
+// split into another message. Well below the 64KiB limit, so a single
+// large record never pushes a message over it.
+const transferMessageSize = 16 * 1024
+
+// serveTransfer answers an AXFR (RFC 5936) or IXFR (RFC 1995) request for
+// a zone loaded from a zone file, if the zone's transfer policy permits the
+// client. IXFR is answered from the zone's journal, falling back to the
+// full zone when the client's serial is older than the journal. The zone is
+// taken from a single snapshot, so concurrent updates never produce a
+// mixed transfer.
+func (s *Server) serveTransfer(w dns.ResponseWriter, req *dns.Msg, addr *net.UDPAddr) error {
+	response := new(dns.Msg)
+	response.SetReply(req)
+	response.Authoritative = true
+
+	origin := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	key, err := s.requestKey(req, w)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Rejected transfer of %s to %s: %v", origin, s.clientLabel(addr.IP), err))
+		response.Rcode = dns.RcodeNotAuth
+		return writeTransferMessage(w, s.newResponseSigner(req, nil), response)
+	}
+	signer := s.newResponseSigner(req, key)
+
+	z := s.currentZones()[origin]
+	zoneCfg := s.findZoneConfig(origin)
+	if z == nil || zoneCfg == nil {
+		response.Rcode = dns.RcodeNotAuth
+		return writeTransferMessage(w, signer, response)
+	}
+	if !zoneCfg.Transfer.permits(addr.IP, key) {
+		s.logMessage(fmt.Sprintf("Refused transfer of %s to %s", origin, s.clientLabel(addr.IP)))
+		response.Rcode = dns.RcodeRefused
+		return writeTransferMessage(w, signer, response)
+	}
+
+	kind, rrs := "AXFR", append(z.records(), z.soa)
+	if req.Question[0].Qtype == dns.TypeIXFR {
+		soa, ok := ixfrSOA(req)
+		if !ok {
+			response.Rcode = dns.RcodeFormatError
+			return writeTransferMessage(w, signer, response)
+		}
+		if incremental := z.incrementalRecords(soa.Serial); incremental != nil {
+			kind, rrs = "IXFR", incremental
+		}
+	}
+
+	// Messages are filled up to their compressed size. Measuring that
+	// means compressing the message, so it is only measured again once
+	// the records added since, uncompressed, could have filled it.
+	response.Compress = true
+	size, added := response.Len(), 0
+	for _, rr := range rrs {
+		response.Answer = append(response.Answer, rr)
+		if added += dns.Len(rr); size+added < transferMessageSize {
+			continue
+		}
+		if size, added = response.Len(), 0; size < transferMessageSize {
+			continue
+		}
+		if err := writeTransferMessage(w, signer, response); err != nil {
+			return err
+		}
+		next := new(dns.Msg)
+		next.SetReply(req)
+		next.Authoritative = true
+		next.Compress = true
+		response = next
+		size = response.Len()
+	}
+	if len(response.Answer) > 0 {
+		if err := writeTransferMessage(w, signer, response); err != nil {
+			return err
+		}
+	}
+	s.logMessage(fmt.Sprintf("Sent %s of %s (serial %d, %d records) to %s", kind, origin, z.soa.Serial, len(rrs), s.clientLabel(addr.IP)))
+	return nil
+}
+
+// ixfrSOA returns the SOA an IXFR request carries in its authority section
+// to tell the server which serial the client has.
+func ixfrSOA(req *dns.Msg) (*dns.SOA, bool) {
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, true
+		}
+	}
+	return nil, false
+}
+
+func writeTransferMessage(w dns.ResponseWriter, signer *responseSigner, m *dns.Msg) error {
+	m.Compress = true
+	data, err := signer.pack(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func isTransfer(qtype uint16) bool {
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
@@ -0,0 +1,123 @@
+package godns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigKeyring signs and verifies TSIG MACs with the configured keys, each
+// with its configured algorithm only. It is the TsigProvider of the
+// listeners, which verify signed requests before the handler sees them,
+// and of the responses godns signs.
+type tsigKeyring struct {
+	cfg *Config
+}
+
+func (k tsigKeyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key := k.cfg.findTSIGKey(t.Hdr.Name)
+	if key == nil {
+		return nil, dns.ErrSecret
+	}
+	// The algorithm comes from the message: a client holding the secret
+	// must not pick a weaker one than the key's.
+	if dns.CanonicalName(t.Algorithm) != key.Algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+	var h func() hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA1:
+		h = sha1.New
+	case dns.HmacSHA256:
+		h = sha256.New
+	case dns.HmacSHA512:
+		h = sha512.New
+	case dns.HmacMD5:
+		h = md5.New
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	mac := hmac.New(h, secret)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (k tsigKeyring) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := k.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// requestKey returns the configured TSIG key req was signed with, or nil if
+// req is unsigned. The listener verified the signature when it received
+// req; w reports the result.
+func (s *Server) requestKey(req *dns.Msg, w dns.ResponseWriter) (*TSIGKey, error) {
+	tsig := req.IsTsig()
+	if tsig == nil {
+		return nil, nil
+	}
+	key := s.cfg.findTSIGKey(tsig.Hdr.Name)
+	if key == nil {
+		return nil, fmt.Errorf("unknown TSIG key %s", tsig.Hdr.Name)
+	}
+	if err := w.TsigStatus(); err != nil {
+		return nil, fmt.Errorf("TSIG verification failed for key %s: %v", tsig.Hdr.Name, err)
+	}
+	return key, nil
+}
+
+// responseSigner packs the responses to a request, signing them when the
+// request was signed. Each message after the first of a multi-message
+// response (a zone transfer) is signed over the previous MAC and the
+// timers only, as RFC 8945 section 5.3.1 describes.
+type responseSigner struct {
+	keyring tsigKeyring
+	key     *TSIGKey
+	tsig    *dns.TSIG
+	mac     string
+	signed  bool
+}
+
+func (s *Server) newResponseSigner(req *dns.Msg, key *TSIGKey) *responseSigner {
+	signer := &responseSigner{keyring: tsigKeyring{s.cfg}, key: key}
+	if key != nil {
+		signer.tsig = req.IsTsig()
+		signer.mac = signer.tsig.MAC
+	}
+	return signer
+}
+
+func (s *responseSigner) pack(m *dns.Msg) ([]byte, error) {
+	if s.key == nil {
+		return m.Pack()
+	}
+	m.SetTsig(s.tsig.Hdr.Name, s.tsig.Algorithm, 300, time.Now().Unix())
+	data, mac, err := dns.TsigGenerateWithProvider(m, s.keyring, s.mac, s.signed)
+	if err != nil {
+		return nil, err
+	}
+	s.mac, s.signed = mac, true
+	return data, nil
+}
@@ -0,0 +1,69 @@
+package godns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// anyAlgorithm signs with the secret of a key of cfg in whatever algorithm
+// the message names, as a client holding the secret could.
+type anyAlgorithm struct {
+	cfg *Config
+}
+
+func (a anyAlgorithm) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	secret, _ := base64.StdEncoding.DecodeString(a.cfg.findTSIGKey(t.Hdr.Name).Secret)
+	h := map[string]func() hash.Hash{
+		dns.HmacSHA1:   sha1.New,
+		dns.HmacSHA256: sha256.New,
+		dns.HmacSHA512: sha512.New,
+		dns.HmacMD5:    md5.New,
+	}[dns.CanonicalName(t.Algorithm)]
+	mac := hmac.New(h, secret)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (anyAlgorithm) Verify(msg []byte, t *dns.TSIG) error {
+	return nil
+}
+
+func TestTSIGAlgorithm(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TSIGKeys = []TSIGKey{{Name: "dhcp", Secret: "c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1kaGNwLXNlcnZlcg==", Algorithm: "hmac-sha256"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		algorithm string
+		want      error
+	}{
+		{dns.HmacSHA256, nil},
+		{"HMAC-SHA256.", nil},
+		{dns.HmacSHA1, dns.ErrKeyAlg},
+		{dns.HmacMD5, dns.ErrKeyAlg},
+		{dns.HmacSHA512, dns.ErrKeyAlg},
+	} {
+		m := new(dns.Msg)
+		m.SetUpdate("example.test.")
+		m.SetTsig("dhcp.", tt.algorithm, 300, time.Now().Unix())
+		data, _, err := dns.TsigGenerateWithProvider(m, anyAlgorithm{cfg}, "", false)
+		if err != nil {
+			t.Fatalf("%s: signing: %v", tt.algorithm, err)
+		}
+		if err := dns.TsigVerifyWithProvider(data, tsigKeyring{cfg}, "", false); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.algorithm, err, tt.want)
+		}
+	}
+}
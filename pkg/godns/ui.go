@@ -0,0 +1,31 @@
+package godns
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles holds the web dashboard. It only uses the admin API, so anything
+// it shows is available to scripts as well.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func init() {
+	assets, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix("/ui/", http.FileServer(http.FS(assets)))
+	handleAdmin("/ui/", func(*Server) http.HandlerFunc { return files.ServeHTTP })
+	handleAdmin("/", func(*Server) http.HandlerFunc { return redirectToUI })
+}
+
+func redirectToUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/ui/", http.StatusFound)
+}
@@ -0,0 +1,270 @@
+package godns
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// handleUpdate processes an RFC 2136 UPDATE message for a zone loaded from
+// a zone file. The zone's update policy decides which clients and TSIG keys
+// may change it; accepted changes bump the SOA serial, are written back to
+// the zone file and swapped into the live zones.
+func (s *Server) handleUpdate(req *dns.Msg, w dns.ResponseWriter, addr *net.UDPAddr) []byte {
+	response := new(dns.Msg)
+	response.SetReply(req)
+
+	key, err := s.requestKey(req, w)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Rejected update from %s: %v", s.clientLabel(addr.IP), err))
+		response.Rcode = dns.RcodeNotAuth
+	} else {
+		response.Rcode = s.applyUpdate(req, key, addr)
+	}
+
+	responseData, err := s.newResponseSigner(req, key).pack(response)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error packing DNS response: %v", err))
+		return nil
+	}
+	return responseData
+}
+
+func (s *Server) applyUpdate(req *dns.Msg, key *TSIGKey, addr *net.UDPAddr) int {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	origin := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	zoneCfg := s.findZoneConfig(origin)
+	if zoneCfg == nil || zoneCfg.File == "" {
+		return dns.RcodeNotAuth
+	}
+	if !zoneCfg.Update.permits(addr.IP, key) {
+		s.logMessage(fmt.Sprintf("Refused update of %s from %s", origin, s.clientLabel(addr.IP)))
+		return dns.RcodeRefused
+	}
+
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	z := s.currentZones()[origin]
+	if z == nil {
+		return dns.RcodeServerFailure
+	}
+	if rcode := z.checkPrerequisites(req.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	next := z.clone()
+	for _, rr := range req.Ns {
+		name := strings.ToLower(strings.TrimSuffix(rr.Header().Name, "."))
+		if name != origin && !strings.HasSuffix(name, "."+origin) {
+			return dns.RcodeNotZone
+		}
+	}
+	if !next.applyUpdates(req.Ns) {
+		return dns.RcodeSuccess
+	}
+	next.soa.Serial++
+	next.recordChange(z)
+
+	if err := writeZoneFile(zoneCfg.File, next); err != nil {
+		s.logMessage(fmt.Sprintf("Error writing zone file %s: %v", zoneCfg.File, err))
+		return dns.RcodeServerFailure
+	}
+
+	s.replaceZone(origin, next)
+	s.notifySecondaries(origin, next.soa)
+
+	actor := "update:" + s.clientLabel(addr.IP)
+	if key != nil {
+		actor = "update:" + strings.TrimSuffix(key.Name, ".")
+	}
+	s.saveHistory(actor, s.auditRecordChanges(actor, flattenZones(map[string]*zoneData{origin: z}), flattenZones(map[string]*zoneData{origin: next})))
+	s.logMessage(fmt.Sprintf("Applied update to %s (serial %d)", origin, next.soa.Serial))
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites evaluates the prerequisite section of an update
+// against the zone as described in RFC 2136 section 3.2.
+func (z *zoneData) checkPrerequisites(prereqs []dns.RR) int {
+	required := make(map[string][]dns.RR)
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := strings.ToLower(strings.TrimSuffix(hdr.Name, "."))
+		if name != z.origin && !strings.HasSuffix(name, "."+z.origin) {
+			return dns.RcodeNotZone
+		}
+		existing := z.rrs[name]
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if len(existing) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(filterType(existing, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if len(existing) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(filterType(existing, hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			key := name + " " + dns.TypeToString[hdr.Rrtype]
+			required[key] = append(required[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites must match the whole RRset exactly.
+	for key, want := range required {
+		name, typ, _ := strings.Cut(key, " ")
+		have := filterType(z.rrs[name], dns.StringToType[typ])
+		if len(have) != len(want) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range want {
+			if !containsRR(have, rr) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdates applies the update section to z as described in RFC 2136
+// section 3.4.2 and reports whether anything changed. The SOA and the apex
+// NS records are never deleted.
+func (z *zoneData) applyUpdates(updates []dns.RR) bool {
+	changed := false
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name := strings.ToLower(strings.TrimSuffix(hdr.Name, "."))
+		existing := z.rrs[name]
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			if hdr.Rrtype == dns.TypeSOA || containsRR(existing, rr) {
+				continue
+			}
+			z.rrs[name] = append(existing, dns.Copy(rr))
+			changed = true
+		case dns.ClassANY:
+			var kept []dns.RR
+			for _, e := range existing {
+				t := e.Header().Rrtype
+				protected := name == z.origin && (t == dns.TypeSOA || t == dns.TypeNS)
+				if protected || (hdr.Rrtype != dns.TypeANY && t != hdr.Rrtype) {
+					kept = append(kept, e)
+				}
+			}
+			changed = changed || len(kept) != len(existing)
+			z.setRRs(name, kept)
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeSOA || (name == z.origin && hdr.Rrtype == dns.TypeNS && len(filterType(existing, dns.TypeNS)) == 1) {
+				continue
+			}
+			var kept []dns.RR
+			for _, e := range existing {
+				if !sameRR(e, rr) {
+					kept = append(kept, e)
+				}
+			}
+			changed = changed || len(kept) != len(existing)
+			z.setRRs(name, kept)
+		}
+	}
+	return changed
+}
+
+func (z *zoneData) setRRs(name string, rrs []dns.RR) {
+	if len(rrs) == 0 {
+		delete(z.rrs, name)
+		return
+	}
+	z.rrs[name] = rrs
+}
+
+// clone returns a copy of z that can be modified without affecting
+// in-flight queries answered from z.
+func (z *zoneData) clone() *zoneData {
+	c := &zoneData{origin: z.origin, rrs: make(map[string][]dns.RR, len(z.rrs))}
+	for name, rrs := range z.rrs {
+		copied := make([]dns.RR, len(rrs))
+		for i, rr := range rrs {
+			copied[i] = dns.Copy(rr)
+			if soa, ok := copied[i].(*dns.SOA); ok && name == z.origin {
+				c.soa = soa
+			}
+		}
+		c.rrs[name] = copied
+	}
+	return c
+}
+
+func filterType(rrs []dns.RR, t uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, e := range rrs {
+		if sameRR(e, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameRR compares owner name, type and record data, ignoring name case,
+// class and TTL.
+func sameRR(a, b dns.RR) bool {
+	return dns.IsDuplicate(normalizedRR(a), normalizedRR(b))
+}
+
+func normalizedRR(rr dns.RR) dns.RR {
+	c := dns.Copy(rr)
+	c.Header().Class = dns.ClassINET
+	c.Header().Name = strings.ToLower(c.Header().Name)
+	return c
+}
+
+// writeZoneFile replaces path with the records of z in zone file format.
+func writeZoneFile(path string, z *zoneData) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "; Zone %s written by godns on %s\n", z.origin, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "$ORIGIN %s\n", dns.Fqdn(z.origin))
+	for _, rr := range z.records() {
+		fmt.Fprintln(&buf, rr.String())
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
@@ -0,0 +1,177 @@
+package godns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// listenersEnv lists the kinds of the sockets a process started by an
+// upgrade inherits, in order from file descriptor 4: "udp" and "tcp" for
+// the DNS listeners, "tls" for DNS over TLS, "admin" and "grpc" for the
+// admin endpoints and "debug" for the debug endpoints.
+const listenersEnv = "_GODNS_LISTENERS"
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string][]*os.File
+)
+
+// takeInherited returns the inherited sockets of kind, once.
+func takeInherited(kind string) []*os.File {
+	inheritOnce.Do(func() {
+		kinds := os.Getenv(listenersEnv)
+		if kinds == "" {
+			return
+		}
+		os.Unsetenv(listenersEnv)
+		inherited = make(map[string][]*os.File)
+		for i, kind := range strings.Split(kinds, ",") {
+			inherited[kind] = append(inherited[kind], os.NewFile(uintptr(4+i), kind))
+		}
+	})
+	files := inherited[kind]
+	delete(inherited, kind)
+	return files
+}
+
+// closeInherited closes the inherited sockets nothing took over, those of
+// endpoints no longer configured.
+func closeInherited() {
+	inheritOnce.Do(func() {})
+	for kind, files := range inherited {
+		for _, f := range files {
+			f.Close()
+		}
+		delete(inherited, kind)
+	}
+}
+
+// inheritedListeners are the DNS listeners passed by the process that
+// started this one for an upgrade, until they are taken for the listen
+// addresses they are bound to.
+type inheritedListeners struct {
+	udpConns     []*net.UDPConn
+	tcpListeners []*net.TCPListener
+}
+
+// inheritListeners takes over the DNS listeners passed by the process that
+// started this one for an upgrade, if any.
+func inheritListeners() (*inheritedListeners, error) {
+	l := new(inheritedListeners)
+	for _, f := range takeInherited("udp") {
+		conn, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("inheriting UDP socket: %v", err)
+		}
+		serverConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			conn.Close()
+			l.close()
+			return nil, fmt.Errorf("inherited socket %s is not a UDP socket", conn.LocalAddr())
+		}
+		l.udpConns = append(l.udpConns, serverConn)
+	}
+	for _, f := range takeInherited("tcp") {
+		tcpListener, err := fileTCPListener(f)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.tcpListeners = append(l.tcpListeners, tcpListener)
+	}
+	return l, nil
+}
+
+// take removes and returns the UDP sockets and the TCP listener inherited
+// for addr, if there are any.
+func (l *inheritedListeners) take(addr *net.UDPAddr) ([]*net.UDPConn, *net.TCPListener) {
+	var conns []*net.UDPConn
+	kept := l.udpConns[:0]
+	for _, conn := range l.udpConns {
+		// Sockets of a port picked by the system stay on that port.
+		if boundTo(addr.IP, addr.Port, conn.LocalAddr().(*net.UDPAddr)) && (len(conns) == 0 || conn.LocalAddr().String() == conns[0].LocalAddr().String()) {
+			conns = append(conns, conn)
+			continue
+		}
+		kept = append(kept, conn)
+	}
+	l.udpConns = kept
+	if len(conns) == 0 {
+		return nil, nil
+	}
+	for i, tcpListener := range l.tcpListeners {
+		if tcpListener.Addr().String() == conns[0].LocalAddr().String() {
+			l.tcpListeners = append(l.tcpListeners[:i], l.tcpListeners[i+1:]...)
+			return conns, tcpListener
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil, nil
+}
+
+// close closes the listeners not taken, those of listen addresses no
+// longer configured. The process that handed them over keeps serving them
+// until it shuts down.
+func (l *inheritedListeners) close() {
+	for _, conn := range l.udpConns {
+		conn.Close()
+	}
+	for _, tcpListener := range l.tcpListeners {
+		tcpListener.Close()
+	}
+}
+
+// boundTo reports whether a socket bound to bound listens on the listen
+// address ip and port, where port 0 matches any port and an unspecified
+// address matches the wildcard address of either IP version.
+func boundTo(ip net.IP, port int, bound *net.UDPAddr) bool {
+	if port != 0 && port != bound.Port {
+		return false
+	}
+	if len(ip) == 0 || ip.IsUnspecified() {
+		return bound.IP.IsUnspecified()
+	}
+	return ip.Equal(bound.IP)
+}
+
+// listenTCP listens on addr for kind, "tls", "admin", "grpc" or "debug",
+// or takes over the socket inherited for it if that is still bound to
+// addr.
+func listenTCP(kind, addr string) (*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if files := takeInherited(kind); len(files) > 0 {
+		l, err := fileTCPListener(files[0])
+		if err != nil {
+			return nil, err
+		}
+		bound := l.Addr().(*net.TCPAddr)
+		if boundTo(tcpAddr.IP, tcpAddr.Port, &net.UDPAddr{IP: bound.IP, Port: bound.Port}) {
+			return l, nil
+		}
+		l.Close()
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+func fileTCPListener(f *os.File) (*net.TCPListener, error) {
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("inheriting TCP listener: %v", err)
+	}
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("inherited socket %s is not a TCP listener", l.Addr())
+	}
+	return tcpListener, nil
+}
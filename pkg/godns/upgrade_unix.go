@@ -0,0 +1,91 @@
+//go:build !windows
+
+package godns
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// upgradeOnSignal starts a new godns process, from the binary now at the
+// executable's path, every time SIGUSR2 is received. The returned channel
+// is closed once one has taken over the listeners; the old process then
+// shuts down, answering the queries it already received.
+func (s *Server) upgradeOnSignal() <-chan struct{} {
+	upgraded := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+	go func() {
+		for range sigChan {
+			pid, err := s.upgrade()
+			if err != nil {
+				s.notify(eventUpgradeFailed, fmt.Sprintf("upgrading failed, still serving with the previous configuration: %v", err))
+				continue
+			}
+			s.logMessage(fmt.Sprintf("Upgraded: process %d took over the listeners", pid))
+			// Under systemd the new process becomes the service's main
+			// process, which the watchdog then expects to hear from.
+			s.sdNotify(fmt.Sprintf("MAINPID=%d", pid))
+			signal.Stop(sigChan)
+			close(upgraded)
+			return
+		}
+	}()
+	return upgraded
+}
+
+// upgrade starts a new godns process with the same arguments and the
+// listeners of s, and waits until it serves queries.
+func (s *Server) upgrade() (int, error) {
+	var kinds []string
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	add := func(kind string, c syscall.Conn) error {
+		raw, err := c.SyscallConn()
+		if err != nil {
+			return err
+		}
+		return raw.Control(func(fd uintptr) {
+			kinds = append(kinds, kind)
+			files = append(files, fd)
+		})
+	}
+	for _, serverConn := range s.udpConns {
+		if err := add("udp", serverConn); err != nil {
+			return 0, err
+		}
+	}
+	for _, tcpListener := range s.tcpListeners {
+		if err := add("tcp", tcpListener); err != nil {
+			return 0, err
+		}
+	}
+	if s.tlsListener != nil {
+		if err := add("tls", s.tlsListener); err != nil {
+			return 0, err
+		}
+	}
+	if s.adminListener != nil {
+		if err := add("admin", s.adminListener); err != nil {
+			return 0, err
+		}
+	}
+	if s.grpcListener != nil {
+		if err := add("grpc", s.grpcListener); err != nil {
+			return 0, err
+		}
+	}
+	if s.debugListener != nil {
+		if err := add("debug", s.debugListener); err != nil {
+			return 0, err
+		}
+	}
+	env := []string{listenersEnv + "=" + strings.Join(kinds, ",")}
+	if os.Getenv("WATCHDOG_PID") != "" {
+		// The watchdog moves to the new process with MAINPID.
+		env = append(env, "WATCHDOG_PID=")
+	}
+	return startAndWait(env, files, nil)
+}
@@ -0,0 +1,7 @@
+package godns
+
+// upgradeOnSignal returns a channel that is never closed: Windows has no
+// SIGUSR2.
+func (s *Server) upgradeOnSignal() <-chan struct{} {
+	return nil
+}
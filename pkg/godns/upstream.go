@@ -0,0 +1,272 @@
+package godns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const upstreamProbeInterval = 15 * time.Second
+
+// upstream is a resolver queries are forwarded to, with its health as
+// observed by the most recent exchange or probe.
+type upstream struct {
+	srv     *Server
+	addr    string
+	healthy atomic.Bool
+	errors  atomic.Uint64
+	// tls is the client of a DNS over TLS upstream, which it reaches at
+	// tlsAddr; nil for plain DNS.
+	tls     *dns.Client
+	tlsAddr string
+}
+
+// upstreamRootCAs verifies the certificates of DNS over TLS upstreams; nil
+// uses the system roots.
+var upstreamRootCAs *x509.CertPool
+
+// normalizeUpstream adds the default port to an upstream address: 53, or
+// 853 for DNS over TLS, written tls://host[:port][#server name].
+func normalizeUpstream(u string) string {
+	if rest, ok := strings.CutPrefix(u, "tls://"); ok {
+		addr, name, named := strings.Cut(rest, "#")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "853")
+		}
+		if named {
+			addr += "#" + name
+		}
+		return "tls://" + addr
+	}
+	if _, _, err := net.SplitHostPort(u); err != nil {
+		return net.JoinHostPort(u, "53")
+	}
+	return u
+}
+
+// forwardZone is a domain whose queries go to its own upstreams.
+type forwardZone struct {
+	name      string
+	upstreams []*upstream
+}
+
+func (s *Server) newForwardZones(zones []ForwardZone) []forwardZone {
+	list := make([]forwardZone, len(zones))
+	for i, z := range zones {
+		list[i] = forwardZone{name: z.Name, upstreams: s.newUpstreams(z.Upstreams)}
+	}
+	return list
+}
+
+// upstreamsFor returns the resolvers for a query name: those of the most
+// specific forward zone containing it, or else the default upstreams.
+func (s *Server) upstreamsFor(name string) []*upstream {
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	best := -1
+	for i, z := range s.forwardZones {
+		if (host == z.name || strings.HasSuffix(host, "."+z.name)) && (best < 0 || len(z.name) > len(s.forwardZones[best].name)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return s.upstreams
+	}
+	return s.forwardZones[best].upstreams
+}
+
+// inForwardZone reports whether name falls in a forward zone.
+func (s *Server) inForwardZone(name string) bool {
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, z := range s.forwardZones {
+		if inDomain(host, z.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// udpForwarder is the default Upstream: the configured upstream resolvers
+// and forward zones, over UDP, or TCP or TLS when exchange needs it.
+type udpForwarder struct {
+	srv *Server
+}
+
+func (f udpForwarder) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	return f.srv.forward(context.Background(), msg)
+}
+
+func (f udpForwarder) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return f.srv.forward(ctx, msg)
+}
+
+// exchangeUpstream forwards msg with the forwarder, giving up when ctx is
+// done if the forwarder supports it.
+func (s *Server) exchangeUpstream(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if u, ok := s.forwarder.(ContextUpstream); ok {
+		return u.ExchangeContext(ctx, msg)
+	}
+	return s.forwarder.Exchange(msg)
+}
+
+// forwarding reports whether queries go to the configured upstreams,
+// whose health then decides readiness.
+func (s *Server) forwarding() bool {
+	_, ok := s.forwarder.(udpForwarder)
+	return ok && !s.cfg.Authoritative
+}
+
+func (s *Server) newUpstreams(addrs []string) []*upstream {
+	list := make([]*upstream, len(addrs))
+	for i, addr := range addrs {
+		list[i] = &upstream{srv: s, addr: addr}
+		if rest, ok := strings.CutPrefix(addr, "tls://"); ok {
+			// The certificate is checked for the server name, by default
+			// the host of the address.
+			hostPort, name, _ := strings.Cut(rest, "#")
+			if name == "" {
+				name, _, _ = net.SplitHostPort(hostPort)
+			}
+			list[i].tlsAddr = hostPort
+			list[i].tls = &dns.Client{
+				Net:     "tcp-tls",
+				Timeout: s.upstreamTCP.Timeout,
+				TLSConfig: &tls.Config{
+					ServerName:         name,
+					RootCAs:            upstreamRootCAs,
+					ClientSessionCache: tls.NewLRUClientSessionCache(0),
+				},
+			}
+		}
+	}
+	return list
+}
+
+// forward sends msg to the upstreams for its name in configured order,
+// trying healthy ones first, and returns the first answer. It gives up
+// when ctx is done, without holding that against the upstream.
+func (s *Server) forward(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	candidates := s.upstreamsFor(msg.Question[0].Name)
+	ordered := make([]*upstream, 0, len(candidates))
+	for _, u := range candidates {
+		if u.healthy.Load() {
+			ordered = append(ordered, u)
+		}
+	}
+	for _, u := range candidates {
+		if !u.healthy.Load() {
+			ordered = append(ordered, u)
+		}
+	}
+
+	var lastErr error
+	for _, u := range ordered {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		result, rtt, err := u.exchange(ctx, msg)
+		if err != nil && ctx.Err() != nil {
+			// Out of time for this query; the upstream may be fine.
+			return nil, ctx.Err()
+		}
+		u.setHealthy(err == nil)
+		if err != nil {
+			u.errors.Add(1)
+			s.stats.upstreamErrors.Add(1)
+			s.logMessage(fmt.Sprintf("Error querying upstream resolver %s: %v", u.addr, err))
+			lastErr = err
+			continue
+		}
+		s.observeUpstreamLatency(u.addr, rtt)
+		return result, nil
+	}
+	return nil, lastErr
+}
+
+// tcpQueryKey is the context key marking a query received over TCP.
+type tcpQueryKey struct{}
+
+// withTCPQuery returns ctx marked as the context of a query received over
+// TCP, which is forwarded over TCP too.
+func withTCPQuery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tcpQueryKey{}, true)
+}
+
+// exchange sends msg to the upstream. A DNS over TLS upstream gets it
+// padded. Plain upstreams get it over TCP for a query received over TCP,
+// and otherwise over UDP, asked again over TCP when the answer is
+// truncated, so that clients get it whole.
+func (u *upstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if u.tls != nil {
+		return u.tls.ExchangeContext(ctx, padMsg(msg, queryPaddingBlock), u.tlsAddr)
+	}
+	if tcp, _ := ctx.Value(tcpQueryKey{}).(bool); tcp {
+		return u.srv.upstreamTCP.ExchangeContext(ctx, msg, u.addr)
+	}
+	result, rtt, err := u.srv.upstreamDNS.ExchangeContext(ctx, msg, u.addr)
+	if err != nil || !result.Truncated {
+		return result, rtt, err
+	}
+	return u.srv.upstreamTCP.ExchangeContext(ctx, msg, u.addr)
+}
+
+func (u *upstream) setHealthy(ok bool) {
+	u.healthy.Store(ok)
+	u.srv.checkUpstreamAvailability()
+}
+
+func (s *Server) anyUpstreamHealthy() bool {
+	for _, u := range s.upstreams {
+		if u.healthy.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpstreamAvailability sends a notification whenever the last healthy
+// upstream goes down or the first one comes back.
+func (s *Server) checkUpstreamAvailability() {
+	ok := s.anyUpstreamHealthy()
+	was := s.upstreamAvailable.Swap(ok)
+	first := !s.upstreamChecked.Swap(true)
+
+	addrs := make([]string, len(s.upstreams))
+	for i, u := range s.upstreams {
+		addrs[i] = u.addr
+	}
+	switch {
+	case !ok && (was || first):
+		s.notify(eventUpstreamsDown, fmt.Sprintf("all upstream resolvers are down (%s)", strings.Join(addrs, ", ")))
+	case ok && !was && !first:
+		s.notify(eventUpstreamsRecovered, "at least one upstream resolver is responding again")
+	}
+}
+
+// probeUpstreams periodically checks every upstream so readiness recovers
+// after an outage even when no client traffic is being forwarded, until s
+// shuts down.
+func (s *Server) probeUpstreams() {
+	probe := new(dns.Msg)
+	probe.SetQuestion(".", dns.TypeNS)
+
+	for {
+		for _, u := range s.upstreams {
+			_, _, err := u.exchange(s.ctx, probe)
+			if s.ctx.Err() != nil {
+				return
+			}
+			u.healthy.Store(err == nil)
+		}
+		s.checkUpstreamAvailability()
+		if !s.sleep(upstreamProbeInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package godns
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTruncatingUpstream runs an upstream on UDP and TCP answering with
+// 200 A records, which it truncates over UDP, and returns its address and
+// the networks it was asked over.
+func startTruncatingUpstream(t *testing.T) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var asked []string
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		network := "udp"
+		if _, tcp := w.RemoteAddr().(*net.TCPAddr); tcp {
+			network = "tcp"
+		}
+		mu.Lock()
+		asked = append(asked, network)
+		mu.Unlock()
+		r := new(dns.Msg)
+		r.SetReply(req)
+		for i := 0; i < 200; i++ {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+			})
+		}
+		if network == "udp" {
+			r.Truncate(512)
+		}
+		w.WriteMsg(r)
+	})
+
+	var pc net.PacketConn
+	var l net.Listener
+	for {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		// The TCP listener takes the port of the UDP one, unless it is
+		// taken over TCP.
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return pc.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), asked...)
+	}
+}
+
+func TestForwardTruncated(t *testing.T) {
+	s := newTestServer()
+	addr, asked := startTruncatingUpstream(t)
+	s.upstreams = s.newUpstreams([]string{addr})
+
+	for _, tt := range []struct {
+		name  string
+		ctx   context.Context
+		asked []string
+	}{
+		{"udp", context.Background(), []string{"udp", "tcp"}},
+		{"tcp", withTCPQuery(context.Background()), []string{"udp", "tcp", "tcp"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("many.example.com.", dns.TypeA)
+			r, err := s.forward(tt.ctx, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Truncated || len(r.Answer) != 200 {
+				t.Errorf("got TC %t and %d answers, want the 200 answers", r.Truncated, len(r.Answer))
+			}
+			if got := asked(); !slices.Equal(got, tt.asked) {
+				t.Errorf("upstream asked over %v, want %v", got, tt.asked)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package godns
+
+import (
+	"fmt"
+	"maps"
+	"net"
+)
+
+// viewRecords is a split-horizon view in a record set: the records its
+// clients see, which are the global records with the view's own in their
+// place.
+type viewRecords struct {
+	name     string
+	networks []*net.IPNet
+	own      map[string]string
+	records  map[string]string
+}
+
+// loadViews reads the records of every configured view, its hosts file
+// first and then its inline records. The merged records are filled in by
+// setRecords.
+func (s *Server) loadViews() ([]*viewRecords, error) {
+	var loaded []*viewRecords
+	for _, vc := range s.cfg.Views {
+		v := &viewRecords{name: vc.Name, own: make(map[string]string)}
+		for _, cidr := range vc.Clients {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %v", vc.Name, err)
+			}
+			v.networks = append(v.networks, network)
+		}
+		if vc.HostsFile != "" {
+			hosts, err := hostsFile{s, vc.HostsFile}.Records()
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %w", vc.Name, err)
+			}
+			maps.Copy(v.own, hosts)
+		}
+		for name, value := range vc.Records {
+			ip, err := expandRecord(value)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: record %s: %v", vc.Name, name, err)
+			}
+			v.own[name] = ip
+		}
+		loaded = append(loaded, v)
+	}
+	return loaded, nil
+}
+
+// mergeViews returns views with their records merged over global.
+func mergeViews(views []*viewRecords, global map[string]string) []*viewRecords {
+	merged := make([]*viewRecords, len(views))
+	for i, v := range views {
+		records := maps.Clone(global)
+		if records == nil {
+			records = make(map[string]string, len(v.own))
+		}
+		maps.Copy(records, v.own)
+		merged[i] = &viewRecords{name: v.name, networks: v.networks, own: v.own, records: records}
+	}
+	return merged
+}
+
+// view returns the first view whose networks hold ip, or nil.
+func (s *recordSet) view(ip net.IP) *viewRecords {
+	if ip == nil {
+		return nil
+	}
+	for _, v := range s.views {
+		for _, network := range v.networks {
+			if network.Contains(ip) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// clientRecords returns the records a client at ip sees: those of its
+// view, or the global records when it is in none.
+func (s *Server) clientRecords(ip net.IP) map[string]string {
+	set := s.liveRecords.Load()
+	if set == nil {
+		return nil
+	}
+	if v := set.view(ip); v != nil {
+		return v.records
+	}
+	return set.records
+}
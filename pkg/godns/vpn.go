@@ -0,0 +1,222 @@
+package godns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// tailscalePoll is how often the Tailscale peer list is read.
+const tailscalePoll = 15 * time.Second
+
+// tailscaleBackend publishes <peer>.<domain> for this node and every peer
+// in the tailnet, read from tailscaled's local API, so VPN nodes resolve
+// without MagicDNS.
+type tailscaleBackend struct {
+	srv    *Server
+	domain string
+	client *http.Client
+}
+
+type tailscaleNode struct {
+	HostName     string   `json:"HostName"`
+	DNSName      string   `json:"DNSName"`
+	TailscaleIPs []string `json:"TailscaleIPs"`
+}
+
+func (s *Server) newTailscaleBackend(c TailscaleConfig) *tailscaleBackend {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", c.Socket)
+		},
+	}
+	return &tailscaleBackend{
+		srv:    s,
+		domain: c.Domain,
+		client: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}
+}
+
+func (t *tailscaleBackend) run() {
+	for {
+		if err := t.poll(); err != nil {
+			t.srv.backendFailed("tailscale", err)
+		}
+		if !t.srv.sleep(tailscalePoll) {
+			return
+		}
+	}
+}
+
+func (t *tailscaleBackend) poll() error {
+	// tailscaled only accepts this host name on its local API.
+	req, err := http.NewRequestWithContext(t.srv.ctx, http.MethodGet, "http://local-tailscaled.sock/localapi/v0/status", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tailscale status: %s", resp.Status)
+	}
+	var status struct {
+		Self *tailscaleNode           `json:"Self"`
+		Peer map[string]tailscaleNode `json:"Peer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("tailscale status: %v", err)
+	}
+
+	records := make(map[string]string)
+	nodes := make([]tailscaleNode, 0, len(status.Peer)+1)
+	if status.Self != nil {
+		nodes = append(nodes, *status.Self)
+	}
+	for _, peer := range status.Peer {
+		nodes = append(nodes, peer)
+	}
+	for _, node := range nodes {
+		// The first label of the MagicDNS name is unique in the tailnet,
+		// unlike the host name the node reports.
+		name := hostLabel(node.DNSName)
+		if name == "" {
+			name = hostLabel(node.HostName)
+		}
+		if name == "" || len(node.TailscaleIPs) == 0 {
+			continue
+		}
+		addRecord(records, name+"."+t.domain, preferIPv4(node.TailscaleIPs))
+	}
+	t.srv.publishBackendRecords("tailscale", records)
+	return nil
+}
+
+// preferIPv4 returns the first IPv4 address of ips, or else the first one.
+func preferIPv4(ips []string) string {
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+// wireguardBackend publishes <peer>.<domain> for the named peers of a
+// wg-quick configuration file. WireGuard itself does not name peers, so a
+// peer is named by a "# Name = laptop" comment in its [Peer] section or on
+// the line before it, and resolves to the single address in its AllowedIPs.
+type wireguardBackend struct {
+	srv    *Server
+	path   string
+	domain string
+}
+
+func (s *Server) newWireGuardBackend(c WireGuardConfig) *wireguardBackend {
+	return &wireguardBackend{srv: s, path: c.Config, domain: c.Domain}
+}
+
+// run loads the configuration file now and whenever it changes.
+func (w *wireguardBackend) run() {
+	if err := w.srv.watchFiles([]string{w.path}, w.load); err != nil {
+		w.srv.logMessage(fmt.Sprintf("Error watching %s: %v", w.path, err))
+	}
+	w.load()
+}
+
+func (w *wireguardBackend) load() {
+	file, err := os.Open(w.path)
+	if err != nil {
+		w.srv.backendFailed("wireguard", err)
+		return
+	}
+	defer file.Close()
+	peers, err := parseWireGuardPeers(file)
+	if err != nil {
+		w.srv.backendFailed("wireguard", fmt.Errorf("%s: %v", w.path, err))
+		return
+	}
+	records := make(map[string]string)
+	for name, ip := range peers {
+		if label := hostLabel(name); label != "" {
+			addRecord(records, label+"."+w.domain, ip)
+		}
+	}
+	w.srv.publishBackendRecords("wireguard", records)
+}
+
+// parseWireGuardPeers returns the address of every named peer with a
+// single host (/32 or /128) in AllowedIPs.
+func parseWireGuardPeers(r io.Reader) (map[string]string, error) {
+	peers := make(map[string]string)
+	var (
+		inPeer       bool
+		pending      string // name from a comment just before [Peer]
+		name, ip     string
+		finishedPeer = func() {
+			if inPeer && name != "" && ip != "" {
+				peers[name] = ip
+			}
+		}
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			finishedPeer()
+			inPeer = strings.EqualFold(line, "[Peer]")
+			name, ip, pending = pending, "", ""
+			continue
+		}
+		if comment, ok := strings.CutPrefix(line, "#"); ok {
+			key, value, ok := cutConfigLine(comment)
+			if ok && strings.EqualFold(key, "name") {
+				if inPeer && ip == "" && name == "" {
+					name = value
+				} else {
+					pending = value
+				}
+			}
+			continue
+		}
+		pending = ""
+		key, value, ok := cutConfigLine(line)
+		if !inPeer || !ok || !strings.EqualFold(key, "AllowedIPs") || ip != "" {
+			continue
+		}
+		for _, prefix := range strings.Split(value, ",") {
+			addr, network, err := net.ParseCIDR(strings.TrimSpace(prefix))
+			if err != nil {
+				continue
+			}
+			if ones, bits := network.Mask.Size(); ones == bits {
+				ip = addr.String()
+				break
+			}
+		}
+	}
+	finishedPeer()
+	return peers, scanner.Err()
+}
+
+// cutConfigLine splits a "Key = value" (or "Key: value") line.
+func cutConfigLine(line string) (key, value string, ok bool) {
+	i := strings.IndexAny(line, "=:")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
@@ -0,0 +1,109 @@
+package godns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// warmupConcurrency is how many warm-up queries are in flight at once.
+const warmupConcurrency = 8
+
+// warmCache resolves the names of the warm-up lists in the background, so
+// their answers are in the cache before clients ask for them. Names with
+// a local answer are skipped. A run still in progress is not restarted;
+// shutting down ends it.
+func (s *Server) warmCache() {
+	if len(s.cfg.Warmup) == 0 || s.cache == nil {
+		return
+	}
+	if !s.warmupRunning.TryLock() {
+		return
+	}
+	s.goBackground(func() {
+		defer s.warmupRunning.Unlock()
+		var names []string
+		for _, source := range s.cfg.Warmup {
+			list, err := readWarmupList(source)
+			if err != nil {
+				s.logMessage(fmt.Sprintf("Error reading warm-up list %s: %v", source, err))
+				continue
+			}
+			names = append(names, list...)
+		}
+
+		started := time.Now()
+		jobs := make(chan string)
+		var wg sync.WaitGroup
+		for i := 0; i < warmupConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for name := range jobs {
+					req := new(dns.Msg)
+					req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+					s.lookup(s.ctx, req, s.currentRecords(), nil, false)
+				}
+			}()
+		}
+		for _, name := range names {
+			if s.ctx.Err() != nil {
+				break
+			}
+			jobs <- name
+		}
+		close(jobs)
+		wg.Wait()
+		if s.ctx.Err() == nil {
+			s.logMessage(fmt.Sprintf("Warmed up the cache with %d names in %s", len(names), time.Since(started).Round(time.Millisecond)))
+		}
+	})
+}
+
+// readWarmupList reads the names of a warm-up list, a file or an HTTP(S)
+// URL with one name per line. Blank lines and # comments are skipped.
+func readWarmupList(source string) ([]string, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchWarmupList(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if name := strings.TrimSpace(line); name != "" {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return nil, fmt.Errorf("invalid name %q", name)
+			}
+			names = append(names, name)
+		}
+	}
+	return names, scanner.Err()
+}
+
+func fetchWarmupList(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
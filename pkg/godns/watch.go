@@ -0,0 +1,78 @@
+package godns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce collapses the burst of events editors produce when saving a
+// file into a single reload.
+const watchDebounce = 250 * time.Millisecond
+
+// watchFiles calls onChange whenever one of paths is written, created,
+// renamed or removed. The parent directories are watched rather than the
+// files themselves so that editors replacing a file by rename are noticed.
+// A path naming a directory matches changes to any file inside it. The
+// watch ends when the server shuts down.
+func (s *Server) watchFiles(paths []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	watched := make(map[string]bool)
+	watchedDirs := make(map[string]bool)
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		dir := filepath.Dir(abs)
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			dir = abs
+			watchedDirs[abs] = true
+		} else {
+			watched[abs] = true
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	s.goBackground(func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		for {
+			select {
+			case <-s.ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !watched[event.Name] && !watchedDirs[filepath.Dir(event.Name)] || event.Op == fsnotify.Chmod {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(watchDebounce, onChange)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				s.logMessage(fmt.Sprintf("Error watching files: %v", err))
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,65 @@
+package godns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Operational events that trigger webhook notifications.
+const (
+	eventUpstreamsDown      = "upstreams_down"
+	eventUpstreamsRecovered = "upstreams_recovered"
+	eventHostsReloadFailed  = "hosts_reload_failed"
+	eventUpgradeFailed      = "upgrade_failed"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookPayload is POSTed as JSON to every configured webhook. Text repeats
+// the message in the field Slack and Mattermost incoming webhooks display.
+type webhookPayload struct {
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	Text    string    `json:"text"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+}
+
+// notify logs an operational event and posts it to the configured webhooks
+// in the background.
+func (s *Server) notify(event, message string) {
+	s.logMessage(fmt.Sprintf("Event %s: %s", event, message))
+	if len(s.cfg.Webhooks) == 0 {
+		return
+	}
+
+	host, _ := os.Hostname()
+	body, err := json.Marshal(webhookPayload{
+		Event:   event,
+		Message: message,
+		Text:    fmt.Sprintf("[godns@%s] %s", host, message),
+		Host:    host,
+		Time:    time.Now().UTC(),
+	})
+	if err != nil {
+		return
+	}
+
+	for _, url := range s.cfg.Webhooks {
+		go func(url string) {
+			resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				s.logMessage(fmt.Sprintf("Error sending webhook to %s: %v", url, err))
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				s.logMessage(fmt.Sprintf("Error sending webhook to %s: %s", url, resp.Status))
+			}
+		}(url)
+	}
+}
@@ -0,0 +1,333 @@
+package godns
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain bounds how many in-zone CNAMEs are followed for one answer.
+const maxCNAMEChain = 8
+
+// zoneData holds the records of one zone loaded from an RFC 1035 zone
+// file, keyed by lower-cased owner name without the trailing dot.
+type zoneData struct {
+	origin string
+	soa    *dns.SOA
+	rrs    map[string][]dns.RR
+	// journal lists the most recent changes, oldest first, for IXFR.
+	journal []zoneDelta
+}
+
+func (s *Server) currentZones() map[string]*zoneData {
+	if zones := s.liveZones.Load(); zones != nil {
+		return *zones
+	}
+	return nil
+}
+
+func (s *Server) setZones(next map[string]*zoneData) map[string]*zoneData {
+	if prev := s.liveZones.Swap(&next); prev != nil {
+		return *prev
+	}
+	return nil
+}
+
+// replaceZone publishes a copy of the live zones with the zone at origin
+// replaced by z, or removed if z is nil. Callers hold updateMu.
+func (s *Server) replaceZone(origin string, z *zoneData) {
+	current := s.currentZones()
+	updated := make(map[string]*zoneData, len(current))
+	for k, v := range current {
+		updated[k] = v
+	}
+	if z != nil {
+		updated[origin] = z
+	} else {
+		delete(updated, origin)
+	}
+	s.setZones(updated)
+}
+
+// loadZoneFiles parses the file of every configured zone that has one, and
+// the <zone>.zone files of the git repository.
+func (s *Server) loadZoneFiles() (map[string]*zoneData, error) {
+	loaded := make(map[string]*zoneData)
+	for _, zone := range s.cfg.Zones {
+		if zone.File == "" {
+			continue
+		}
+		z, err := loadZoneFile(zone.Name, zone.File)
+		if err != nil {
+			return nil, &fileError{zone.File, err}
+		}
+		loaded[zone.Name] = z
+	}
+	files, err := s.gitZoneFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		origin := gitZoneName(path)
+		if loaded[origin] != nil {
+			return nil, &fileError{path, fmt.Errorf("%s: zone %s also has a configured zone file", path, origin)}
+		}
+		z, err := loadZoneFile(origin, path)
+		if err != nil {
+			return nil, &fileError{path, err}
+		}
+		loaded[origin] = z
+	}
+	return loaded, nil
+}
+
+// loadZoneFile parses a BIND style zone file with miekg/dns, honouring
+// $ORIGIN, $TTL and $INCLUDE. The zone must contain an SOA at its apex.
+func loadZoneFile(origin, path string) (*zoneData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	z := &zoneData{origin: origin, rrs: make(map[string][]dns.RR)}
+	parser := dns.NewZoneParser(file, dns.Fqdn(origin), path)
+	parser.SetIncludeAllowed(true)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		name := strings.ToLower(strings.TrimSuffix(rr.Header().Name, "."))
+		if name != origin && !strings.HasSuffix(name, "."+origin) {
+			return nil, fmt.Errorf("%s: %s is outside zone %s", path, rr.Header().Name, origin)
+		}
+		if soa, ok := rr.(*dns.SOA); ok && name == origin {
+			z.soa = soa
+		}
+		z.rrs[name] = append(z.rrs[name], rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: zone %s has no SOA record", path, origin)
+	}
+	return z, nil
+}
+
+// findZone returns the loaded zone with the longest origin containing host.
+func findZone(zones map[string]*zoneData, host string) *zoneData {
+	var best *zoneData
+	for origin, z := range zones {
+		if host != origin && !strings.HasSuffix(host, "."+origin) {
+			continue
+		}
+		if best == nil || len(origin) > len(best.origin) {
+			best = z
+		}
+	}
+	return best
+}
+
+// answer fills response for q from the zone as in RFC 1034 section 4.3.2:
+// a referral to the name servers of a delegated child zone, with their
+// glue; matching records, of the name or of the wildcard covering it, with
+// in-zone CNAME chains and the zone's name servers as authority; or a
+// negative answer carrying the SOA.
+func (z *zoneData) answer(q dns.Question, response *dns.Msg) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	owner := q.Name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		if cut := z.delegation(name, q.Qtype); cut != nil {
+			// A CNAME into a child zone is left for the resolver to
+			// follow there.
+			if i == 0 {
+				z.refer(cut, response)
+				return
+			}
+			break
+		}
+		rrs, exists := z.rrs[name]
+		if !exists && !z.hasDescendant(name) {
+			rrs, exists = z.rrs[z.wildcard(name)]
+		}
+		if !exists {
+			if i == 0 && !z.hasDescendant(name) {
+				response.Rcode = dns.RcodeNameError
+			}
+			break
+		}
+
+		var cname *dns.CNAME
+		matched := false
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				response.Answer = append(response.Answer, withOwner(rr, owner))
+				matched = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if matched || cname == nil {
+			break
+		}
+
+		response.Answer = append(response.Answer, withOwner(cname, owner))
+		owner = cname.Target
+		name = strings.ToLower(strings.TrimSuffix(cname.Target, "."))
+		if name != z.origin && !strings.HasSuffix(name, "."+z.origin) {
+			break
+		}
+	}
+
+	if len(response.Answer) == 0 {
+		soa := dns.Copy(z.soa)
+		if soa.Header().Ttl > z.soa.Minttl {
+			soa.Header().Ttl = z.soa.Minttl
+		}
+		response.Ns = append(response.Ns, soa)
+		return
+	}
+	for _, rr := range response.Answer {
+		if rr.Header().Rrtype == dns.TypeNS && ownerName(rr) == z.origin {
+			return
+		}
+	}
+	for _, rr := range z.rrs[z.origin] {
+		if rr.Header().Rrtype == dns.TypeNS {
+			response.Ns = append(response.Ns, dns.Copy(rr))
+		}
+	}
+}
+
+// delegation returns the NS records of the zone cut at or above name,
+// below the apex, if name is delegated to a child zone. The DS records of
+// a child are the zone's own, so a DS query at the cut is not delegated.
+func (z *zoneData) delegation(name string, qtype uint16) []dns.RR {
+	rel := strings.TrimSuffix(name, "."+z.origin)
+	if name == z.origin || rel == name {
+		return nil
+	}
+	labels := strings.Split(rel, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut := strings.Join(labels[i:], ".") + "." + z.origin
+		if cut == name && qtype == dns.TypeDS {
+			return nil
+		}
+		var ns []dns.RR
+		for _, rr := range z.rrs[cut] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				ns = append(ns, rr)
+			}
+		}
+		if ns != nil {
+			return ns
+		}
+	}
+	return nil
+}
+
+// refer fills response with a referral to the name servers ns of a child
+// zone: they go in the authority section, and the addresses the zone has
+// for them, the glue, in the additional section.
+func (z *zoneData) refer(ns []dns.RR, response *dns.Msg) {
+	response.Authoritative = false
+	for _, rr := range ns {
+		response.Ns = append(response.Ns, dns.Copy(rr))
+	}
+	for _, rr := range ns {
+		target := strings.ToLower(strings.TrimSuffix(rr.(*dns.NS).Ns, "."))
+		if target != z.origin && !strings.HasSuffix(target, "."+z.origin) {
+			continue
+		}
+		for _, glue := range z.rrs[target] {
+			if t := glue.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				response.Extra = append(response.Extra, dns.Copy(glue))
+			}
+		}
+	}
+}
+
+// wildcard returns the owner name of the wildcard records that would
+// cover name, which does not exist: "*." followed by its closest
+// encloser, the nearest ancestor that exists in the zone.
+func (z *zoneData) wildcard(name string) string {
+	for encloser := name; encloser != z.origin; {
+		_, parent, ok := strings.Cut(encloser, ".")
+		if !ok {
+			return ""
+		}
+		encloser = parent
+		if _, exists := z.rrs[encloser]; exists || z.hasDescendant(encloser) {
+			return "*." + encloser
+		}
+	}
+	return ""
+}
+
+// hasDescendant reports whether name is an empty non-terminal of the zone,
+// which must be answered with NODATA rather than NXDOMAIN.
+func (z *zoneData) hasDescendant(name string) bool {
+	suffix := "." + name
+	for owner := range z.rrs {
+		if strings.HasSuffix(owner, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// records returns every record of the zone, SOA first and the rest sorted
+// by owner name, the order used for zone files and transfers.
+func (z *zoneData) records() []dns.RR {
+	names := make([]string, 0, len(z.rrs))
+	for name := range z.rrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rrs := []dns.RR{z.soa}
+	for _, name := range names {
+		for _, rr := range z.rrs[name] {
+			if rr != dns.RR(z.soa) {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+// ownerName returns the zone map key of rr: its lower-cased owner name
+// without the trailing dot.
+func ownerName(rr dns.RR) string {
+	return strings.ToLower(strings.TrimSuffix(rr.Header().Name, "."))
+}
+
+// withOwner copies rr with its owner name replaced, preserving the case the
+// client used in the question.
+func withOwner(rr dns.RR, owner string) dns.RR {
+	c := dns.Copy(rr)
+	c.Header().Name = owner
+	return c
+}
+
+// flattenZones renders zone records as "owner TYPE" keys mapped to their
+// sorted record data, so zone changes can be audited like host records.
+func flattenZones(zones map[string]*zoneData) map[string]string {
+	sets := make(map[string][]string)
+	for _, z := range zones {
+		for owner, rrs := range z.rrs {
+			for _, rr := range rrs {
+				key := owner + " " + dns.TypeToString[rr.Header().Rrtype]
+				data := strings.TrimPrefix(rr.String(), rr.Header().String())
+				sets[key] = append(sets[key], data)
+			}
+		}
+	}
+	flat := make(map[string]string, len(sets))
+	for key, values := range sets {
+		sort.Strings(values)
+		flat[key] = strings.Join(values, "; ")
+	}
+	return flat
+}
@@ -0,0 +1,141 @@
+package godns
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneAnswer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.test.zone")
+	err := os.WriteFile(path, []byte(`$ORIGIN example.test.
+$TTL 300
+@           SOA   ns1 hostmaster 1 3600 600 86400 60
+@           NS    ns1
+ns1         A     192.0.2.1
+www         A     192.0.2.10
+*.apps      A     192.0.2.20
+*.apps      TXT   "wildcard"
+alias.apps  CNAME www
+*.web       CNAME www
+empty.x     A     192.0.2.30
+sub         NS    ns.sub
+sub         NS    ns.other.net.
+sub         DS    12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+ns.sub      A     192.0.2.53
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := loadZoneFile("example.test", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		aa     bool
+		answer []string
+		ns     []string
+		extra  []string
+	}{
+		{
+			name: "www.example.test.", qtype: dns.TypeA, aa: true,
+			answer: []string{"www.example.test.\t300\tIN\tA\t192.0.2.10"},
+			ns:     []string{"example.test.\t300\tIN\tNS\tns1.example.test."},
+		},
+		{
+			name: "example.test.", qtype: dns.TypeNS, aa: true,
+			answer: []string{"example.test.\t300\tIN\tNS\tns1.example.test."},
+		},
+		{
+			name: "a.apps.example.test.", qtype: dns.TypeA, aa: true,
+			answer: []string{"a.apps.example.test.\t300\tIN\tA\t192.0.2.20"},
+			ns:     []string{"example.test.\t300\tIN\tNS\tns1.example.test."},
+		},
+		{
+			name: "b.a.apps.example.test.", qtype: dns.TypeTXT, aa: true,
+			answer: []string{"b.a.apps.example.test.\t300\tIN\tTXT\t\"wildcard\""},
+			ns:     []string{"example.test.\t300\tIN\tNS\tns1.example.test."},
+		},
+		{
+			// An existing name is not covered by the wildcard.
+			name: "alias.apps.example.test.", qtype: dns.TypeA, aa: true,
+			answer: []string{
+				"alias.apps.example.test.\t300\tIN\tCNAME\twww.example.test.",
+				"www.example.test.\t300\tIN\tA\t192.0.2.10",
+			},
+			ns: []string{"example.test.\t300\tIN\tNS\tns1.example.test."},
+		},
+		{
+			name: "a.apps.example.test.", qtype: dns.TypeMX, aa: true,
+			ns: []string{"example.test.\t60\tIN\tSOA\tns1.example.test. hostmaster.example.test. 1 3600 600 86400 60"},
+		},
+		{
+			name: "shop.web.example.test.", qtype: dns.TypeA, aa: true,
+			answer: []string{
+				"shop.web.example.test.\t300\tIN\tCNAME\twww.example.test.",
+				"www.example.test.\t300\tIN\tA\t192.0.2.10",
+			},
+			ns: []string{"example.test.\t300\tIN\tNS\tns1.example.test."},
+		},
+		{
+			// The closest encloser x exists, as an empty non-terminal,
+			// and has no wildcard.
+			name: "other.x.example.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, aa: true,
+			ns: []string{"example.test.\t60\tIN\tSOA\tns1.example.test. hostmaster.example.test. 1 3600 600 86400 60"},
+		},
+		{
+			name: "x.example.test.", qtype: dns.TypeA, aa: true,
+			ns: []string{"example.test.\t60\tIN\tSOA\tns1.example.test. hostmaster.example.test. 1 3600 600 86400 60"},
+		},
+		{
+			name: "host.sub.example.test.", qtype: dns.TypeA,
+			ns: []string{
+				"sub.example.test.\t300\tIN\tNS\tns.sub.example.test.",
+				"sub.example.test.\t300\tIN\tNS\tns.other.net.",
+			},
+			extra: []string{"ns.sub.example.test.\t300\tIN\tA\t192.0.2.53"},
+		},
+		{
+			name: "ns.sub.example.test.", qtype: dns.TypeA,
+			ns: []string{
+				"sub.example.test.\t300\tIN\tNS\tns.sub.example.test.",
+				"sub.example.test.\t300\tIN\tNS\tns.other.net.",
+			},
+			extra: []string{"ns.sub.example.test.\t300\tIN\tA\t192.0.2.53"},
+		},
+		{
+			name: "sub.example.test.", qtype: dns.TypeDS, aa: true,
+			answer: []string{"sub.example.test.\t300\tIN\tDS\t12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"},
+			ns:     []string{"example.test.\t300\tIN\tNS\tns1.example.test."},
+		},
+	} {
+		t.Run(dns.TypeToString[tt.qtype]+" "+tt.name, func(t *testing.T) {
+			response := new(dns.Msg)
+			response.Authoritative = true
+			z.answer(dns.Question{Name: tt.name, Qtype: tt.qtype, Qclass: dns.ClassINET}, response)
+			if response.Rcode != tt.rcode || response.Authoritative != tt.aa {
+				t.Errorf("got rcode %d and AA %t, want %d and %t", response.Rcode, response.Authoritative, tt.rcode, tt.aa)
+			}
+			for _, section := range []struct {
+				name string
+				got  []dns.RR
+				want []string
+			}{{"answer", response.Answer, tt.answer}, {"authority", response.Ns, tt.ns}, {"additional", response.Extra, tt.extra}} {
+				var got []string
+				for _, rr := range section.got {
+					got = append(got, rr.String())
+				}
+				if !slices.Equal(got, section.want) {
+					t.Errorf("%s: got %q, want %q", section.name, got, section.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package godns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// notifyAttempts is how many times a NOTIFY is sent to a secondary that
+// does not answer.
+const notifyAttempts = 3
+
+// secondaryRefreshChannel returns the refresh channel of a secondary zone,
+// creating it on first use.
+func (s *Server) secondaryRefreshChannel(origin string) chan struct{} {
+	s.secondaryRefreshMu.Lock()
+	defer s.secondaryRefreshMu.Unlock()
+	ch := s.secondaryRefresh[origin]
+	if ch == nil {
+		ch = make(chan struct{}, 1)
+		s.secondaryRefresh[origin] = ch
+	}
+	return ch
+}
+
+// notifySecondaries tells the zone's configured secondaries that it changed
+// (RFC 1996), so they refresh now rather than on their next SOA timer.
+func (s *Server) notifySecondaries(origin string, soa *dns.SOA) {
+	zone := s.findZoneConfig(origin)
+	if zone == nil {
+		return
+	}
+	for _, target := range zone.Notify {
+		go s.sendNotify(target, origin, soa)
+	}
+}
+
+func (s *Server) sendNotify(target, origin string, soa *dns.SOA) {
+	req := new(dns.Msg)
+	req.SetNotify(dns.Fqdn(origin))
+	req.Answer = []dns.RR{soa}
+	client := &dns.Client{Timeout: s.cfg.UpstreamTimeout}
+
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		var resp *dns.Msg
+		if resp, _, err = client.Exchange(req, target); err == nil {
+			if resp.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("answered with %s", dns.RcodeToString[resp.Rcode])
+			}
+			break
+		}
+	}
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error sending NOTIFY for %s to %s: %v", origin, target, err))
+		return
+	}
+	s.logMessage(fmt.Sprintf("Sent NOTIFY for %s (serial %d) to %s", origin, soa.Serial, target))
+}
+
+// notifyChangedZones notifies the secondaries of every zone whose serial
+// differs between two sets of zones.
+func (s *Server) notifyChangedZones(prev, next map[string]*zoneData) {
+	for origin, z := range next {
+		if old := prev[origin]; old == nil || old.soa.Serial != z.soa.Serial {
+			s.notifySecondaries(origin, z.soa)
+		}
+	}
+}
+
+// handleNotify answers a NOTIFY for a secondary zone. NOTIFYs from the
+// zone's primary, or signed with its primary key, trigger an immediate
+// refresh; anything else is refused.
+func (s *Server) handleNotify(req *dns.Msg, w dns.ResponseWriter, addr *net.UDPAddr) []byte {
+	response := new(dns.Msg)
+	response.SetReply(req)
+	response.Authoritative = true
+
+	key, err := s.requestKey(req, w)
+	switch {
+	case err != nil:
+		s.logMessage(fmt.Sprintf("Rejected NOTIFY from %s: %v", s.clientLabel(addr.IP), err))
+		response.Rcode = dns.RcodeNotAuth
+	case len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA:
+		response.Rcode = dns.RcodeFormatError
+	default:
+		origin := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+		zone := s.findZoneConfig(origin)
+		switch {
+		case zone == nil || zone.Primary == "":
+			response.Rcode = dns.RcodeNotAuth
+		case !s.fromPrimary(zone, addr.IP, key):
+			s.logMessage(fmt.Sprintf("Refused NOTIFY for %s from %s", origin, s.clientLabel(addr.IP)))
+			response.Rcode = dns.RcodeRefused
+		default:
+			s.logMessage(fmt.Sprintf("Received NOTIFY for %s from %s", origin, s.clientLabel(addr.IP)))
+			select {
+			case s.secondaryRefreshChannel(origin) <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	responseData, err := s.newResponseSigner(req, key).pack(response)
+	if err != nil {
+		s.logMessage(fmt.Sprintf("Error packing DNS response: %v", err))
+		return nil
+	}
+	return responseData
+}
+
+// fromPrimary reports whether a NOTIFY came from the zone's primary: from
+// one of its addresses, or signed with its primary key.
+func (s *Server) fromPrimary(zone *ZoneConfig, ip net.IP, key *TSIGKey) bool {
+	if key != nil && zone.PrimaryKey != "" && s.cfg.findTSIGKey(zone.PrimaryKey) == key {
+		return true
+	}
+	host, _, err := net.SplitHostPort(zone.Primary)
+	if err != nil {
+		return false
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}